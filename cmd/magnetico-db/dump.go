@@ -0,0 +1,390 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+// A dump is a gzipped stream of JSON lines: a dumpHeader followed by a dumpTorrent per torrent, in
+// the order of discovery. Every batch of torrents is written as a gzip member of its own (which
+// readers concatenate transparently), so that an interrupted export can be truncated to its last
+// complete batch and resumed.
+const (
+	dumpFormat = "magnetico-dump"
+	// dumpVersion is the version of the format written, which must be increased on any change
+	// that older versions of magnetico-db could not read correctly.
+	dumpVersion = 1
+)
+
+type dumpHeader struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	CreatedOn int64  `json:"createdOn"`
+}
+
+type dumpTorrent struct {
+	InfoHash     string                `json:"infoHash"`
+	Name         string                `json:"name"`
+	DiscoveredOn int64                 `json:"discoveredOn"`
+	Category     persistence.Category  `json:"category"`
+	Files        []persistence.File    `json:"files"`
+	Swarm        *persistence.Swarm    `json:"swarm,omitempty"`
+	Curation     *persistence.Curation `json:"curation,omitempty"`
+}
+
+// exportCheckpoint is where an interrupted export resumes from: the size of the dump up to its last
+// complete batch, and the ordering key of the last torrent of that batch.
+type exportCheckpoint struct {
+	Offset       int64  `json:"offset"`
+	DiscoveredOn int64  `json:"discoveredOn"`
+	ID           uint64 `json:"id"`
+	N            uint64 `json:"n"`
+}
+
+// importCheckpoint is where an interrupted import resumes from: the number of torrents of the dump
+// already added to the database.
+type importCheckpoint struct {
+	N uint64 `json:"n"`
+}
+
+func checkpointPath(path string) string {
+	return path + ".checkpoint"
+}
+
+// exportDump writes all the torrents of the database to the dump at path, and returns the number of
+// torrents written (by this run, if resumed).
+func exportDump(ctx context.Context, database persistence.Database, path string, resume bool, batchSize uint) (uint64, error) {
+	var checkpoint *exportCheckpoint
+	if resume {
+		checkpoint = new(exportCheckpoint)
+		if err := readCheckpoint(checkpointPath(path), checkpoint); errors.Is(err, os.ErrNotExist) {
+			log.Printf("There is no checkpoint to resume the export from, starting over")
+			checkpoint = nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	var file *os.File
+	var err error
+	if checkpoint != nil {
+		// Whatever was written after the last complete batch is discarded.
+		if file, err = os.OpenFile(path, os.O_WRONLY, 0); err != nil {
+			return 0, errors.New("os.OpenFile " + err.Error())
+		}
+		if err = file.Truncate(checkpoint.Offset); err != nil {
+			file.Close()
+			return 0, errors.New("os.File.Truncate " + err.Error())
+		}
+		if _, err = file.Seek(checkpoint.Offset, io.SeekStart); err != nil {
+			file.Close()
+			return 0, errors.New("os.File.Seek " + err.Error())
+		}
+		log.Printf("Resuming the export after %d torrents", checkpoint.N)
+	} else {
+		if file, err = os.Create(path); err != nil {
+			return 0, errors.New("os.Create " + err.Error())
+		}
+		checkpoint = new(exportCheckpoint)
+		header := dumpHeader{Format: dumpFormat, Version: dumpVersion, CreatedOn: time.Now().Unix()}
+		if err = writeMember(file, []interface{}{header}); err != nil {
+			file.Close()
+			return 0, err
+		}
+		if checkpoint.Offset, err = file.Seek(0, io.SeekCurrent); err != nil {
+			file.Close()
+			return 0, errors.New("os.File.Seek " + err.Error())
+		}
+	}
+	defer file.Close()
+
+	total, err := database.GetNumberOfTorrents(ctx)
+	if err != nil {
+		return 0, errors.New("GetNumberOfTorrents " + err.Error())
+	}
+
+	epoch := time.Now().Unix()
+	var n uint64
+	for {
+		var lastOrderedValue *float64
+		var lastID *uint64
+		if checkpoint.ID != 0 {
+			value := float64(checkpoint.DiscoveredOn)
+			lastOrderedValue, lastID = &value, &checkpoint.ID
+		}
+
+		torrents, err := database.QueryTorrents(ctx, "", epoch, persistence.ByDiscoveredOn, true, batchSize, lastOrderedValue, lastID, nil, persistence.SearchNames)
+		if err != nil {
+			return n, errors.New("QueryTorrents " + err.Error())
+		}
+		if len(torrents) == 0 {
+			break
+		}
+
+		infoHashes := make([][]byte, len(torrents))
+		for i, torrent := range torrents {
+			infoHashes[i] = torrent.InfoHash
+		}
+		files, err := database.GetFilesOfTorrents(ctx, infoHashes)
+		if err != nil {
+			return n, errors.New("GetFilesOfTorrents " + err.Error())
+		}
+		swarms, err := database.GetSwarms(ctx, infoHashes)
+		if err != nil {
+			return n, errors.New("GetSwarms " + err.Error())
+		}
+
+		lines := make([]interface{}, 0, len(torrents))
+		for _, torrent := range torrents {
+			line := dumpTorrent{
+				InfoHash:     hex.EncodeToString(torrent.InfoHash),
+				Name:         torrent.Name,
+				DiscoveredOn: torrent.DiscoveredOn,
+				Category:     torrent.Category,
+				Files:        files[string(torrent.InfoHash)],
+			}
+			if swarm, exists := swarms[string(torrent.InfoHash)]; exists && (swarm.NPeers != 0 || len(swarm.Clients) != 0) {
+				line.Swarm = &swarm
+			}
+			if line.Curation, err = database.GetCuration(ctx, torrent.InfoHash); err != nil {
+				return n, errors.New("GetCuration " + err.Error())
+			}
+			if line.Curation != nil && line.Curation.IsZero() {
+				line.Curation = nil
+			}
+			lines = append(lines, line)
+		}
+
+		if err = writeMember(file, lines); err != nil {
+			return n, err
+		}
+		// The checkpoint must not be ahead of what is safely written.
+		if err = file.Sync(); err != nil {
+			return n, errors.New("os.File.Sync " + err.Error())
+		}
+
+		last := torrents[len(torrents)-1]
+		n += uint64(len(torrents))
+		checkpoint.N += uint64(len(torrents))
+		checkpoint.DiscoveredOn, checkpoint.ID = last.DiscoveredOn, last.ID
+		if checkpoint.Offset, err = file.Seek(0, io.SeekCurrent); err != nil {
+			return n, errors.New("os.File.Seek " + err.Error())
+		}
+		if err = writeCheckpoint(checkpointPath(path), checkpoint); err != nil {
+			return n, err
+		}
+
+		log.Printf("Exported %d of about %d torrents", checkpoint.N, total)
+	}
+
+	if err = os.Remove(checkpointPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return n, errors.New("os.Remove " + err.Error())
+	}
+	return n, nil
+}
+
+// importDump adds the torrents of the dump at path to the database, skipping those that exist
+// already, and returns the number of torrents read (by this run, if resumed).
+func importDump(ctx context.Context, database persistence.Database, path string, resume bool, batchSize uint) (uint64, error) {
+	checkpoint := new(importCheckpoint)
+	if resume {
+		if err := readCheckpoint(checkpointPath(path), checkpoint); errors.Is(err, os.ErrNotExist) {
+			log.Printf("There is no checkpoint to resume the import from, starting over")
+		} else if err != nil {
+			return 0, err
+		} else {
+			log.Printf("Resuming the import after %d torrents", checkpoint.N)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, errors.New("os.Open " + err.Error())
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, errors.New("os.File.Stat " + err.Error())
+	}
+
+	counter := &countingReader{r: file}
+	gzipReader, err := gzip.NewReader(counter)
+	if err != nil {
+		return 0, errors.New("gzip.NewReader " + err.Error())
+	}
+	decoder := json.NewDecoder(gzipReader)
+
+	var header dumpHeader
+	if err = decoder.Decode(&header); err != nil {
+		return 0, errors.New("reading the header " + err.Error())
+	}
+	if header.Format != dumpFormat {
+		return 0, fmt.Errorf("%s is not a dump of magnetico", path)
+	}
+	if header.Version > dumpVersion {
+		return 0, fmt.Errorf("the dump is of version %d, whereas only up to %d can be read", header.Version, dumpVersion)
+	}
+
+	// The torrents imported before the interruption are skipped, rather than added all over again.
+	skip := checkpoint.N
+	var n uint64
+	batch := make([]persistence.Torrent, 0, batchSize)
+	curations := make(map[string]persistence.Curation)
+
+	flush := func() error {
+		// The swarms are recorded along with the torrents added, hence those of the torrents that
+		// exist already are kept as they are, rather than being merged with those of the dump.
+		if err := database.AddNewTorrents(ctx, batch); err != nil {
+			return errors.New("AddNewTorrents " + err.Error())
+		}
+		for infoHash, curation := range curations {
+			if err := curate(ctx, database, []byte(infoHash), curation); err != nil {
+				return err
+			}
+		}
+
+		n += uint64(len(batch))
+		checkpoint.N += uint64(len(batch))
+		batch = batch[:0]
+		clear(curations)
+		if err := writeCheckpoint(checkpointPath(path), checkpoint); err != nil {
+			return err
+		}
+
+		log.Printf("Imported %d torrents (%.1f%% of the dump)", checkpoint.N, 100*float64(counter.n)/float64(max(info.Size(), 1)))
+		return nil
+	}
+
+	for {
+		var line dumpTorrent
+		if err = decoder.Decode(&line); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, fmt.Errorf("reading torrent #%d %v", checkpoint.N+uint64(len(batch))+1, err)
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+
+		infoHash, err := hex.DecodeString(line.InfoHash)
+		if err != nil {
+			return n, fmt.Errorf("the info hash of torrent #%d %v", checkpoint.N+uint64(len(batch))+1, err)
+		}
+		torrent := persistence.Torrent{
+			InfoHash:     infoHash,
+			Name:         line.Name,
+			Files:        line.Files,
+			Category:     line.Category,
+			DiscoveredOn: line.DiscoveredOn,
+		}
+		if line.Swarm != nil {
+			torrent.Swarm = *line.Swarm
+		}
+		batch = append(batch, torrent)
+		if line.Curation != nil {
+			curations[string(infoHash)] = *line.Curation
+		}
+
+		if uint(len(batch)) == batchSize {
+			if err = flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if len(batch) != 0 {
+		if err = flush(); err != nil {
+			return n, err
+		}
+	}
+
+	if err = os.Remove(checkpointPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return n, errors.New("os.Remove " + err.Error())
+	}
+	return n, nil
+}
+
+// curate records the curation of a torrent of the dump, in addition to what is recorded already if
+// the torrent existed.
+func curate(ctx context.Context, database persistence.Database, infoHash []byte, curation persistence.Curation) error {
+	for _, tag := range curation.Tags {
+		if err := database.AddTag(ctx, infoHash, tag); err != nil {
+			return errors.New("AddTag " + err.Error())
+		}
+	}
+	if curation.Note != "" {
+		if err := database.SetNote(ctx, infoHash, curation.Note); err != nil {
+			return errors.New("SetNote " + err.Error())
+		}
+	}
+	if curation.Starred {
+		if err := database.SetStarred(ctx, infoHash, true); err != nil {
+			return errors.New("SetStarred " + err.Error())
+		}
+	}
+	return nil
+}
+
+// writeMember writes the values as JSON lines, in a gzip member of their own.
+func writeMember(w io.Writer, values []interface{}) error {
+	gzipWriter := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gzipWriter)
+	encoder.SetEscapeHTML(false)
+	for _, value := range values {
+		if err := encoder.Encode(value); err != nil {
+			return errors.New("json.Encoder.Encode " + err.Error())
+		}
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return errors.New("gzip.Writer.Close " + err.Error())
+	}
+	return nil
+}
+
+func readCheckpoint(path string, checkpoint interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, checkpoint); err != nil {
+		return errors.New("the checkpoint " + path + " is malformed " + err.Error())
+	}
+	return nil
+}
+
+// writeCheckpoint replaces the checkpoint atomically, so that it is never left half-written.
+func writeCheckpoint(path string, checkpoint interface{}) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return errors.New("json.Marshal " + err.Error())
+	}
+	if err = os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return errors.New("os.WriteFile " + err.Error())
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return errors.New("os.Rename " + err.Error())
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it, for reporting the progress.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+func openTestDatabase(t *testing.T, scheme string) persistence.Database {
+	t.Helper()
+
+	u := url.URL{Scheme: scheme, Path: filepath.Join(t.TempDir(), "database")}
+	database, err := persistence.MakeDatabase(u.String(), "")
+	if err != nil {
+		t.Fatalf("MakeDatabase() error = %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	return database
+}
+
+var testTorrents = []persistence.Torrent{
+	{
+		InfoHash:     []byte("aaaaaaaaaaaaaaaaaaaa"),
+		Name:         "First",
+		Files:        []persistence.File{{Size: 1, Path: "a/b.mkv"}, {Size: 2, Path: "c.srt"}},
+		Category:     persistence.Video,
+		DiscoveredOn: 1000000000,
+	},
+	{
+		InfoHash:     []byte("bbbbbbbbbbbbbbbbbbbb"),
+		Name:         "Second <&>",
+		Files:        []persistence.File{{Size: 3, Path: "d.mp3"}},
+		Category:     persistence.Audio,
+		DiscoveredOn: 1000000001,
+	},
+	{
+		InfoHash:     []byte("cccccccccccccccccccc"),
+		Name:         "Третий",
+		Files:        []persistence.File{{Size: 4, Path: "e"}},
+		DiscoveredOn: 1000000001,
+	},
+	{
+		InfoHash:     []byte("dddddddddddddddddddd"),
+		Name:         "Fourth",
+		Files:        []persistence.File{{Size: 5, Path: "f"}},
+		DiscoveredOn: 1000000002,
+	},
+}
+
+// checkDatabase checks that the database has exactly the torrents, with their files and swarms.
+func checkDatabase(t *testing.T, database persistence.Database, torrents []persistence.Torrent, swarms map[string]persistence.Swarm) {
+	t.Helper()
+	ctx := context.Background()
+
+	if n, err := database.GetNumberOfTorrents(ctx); err != nil || n != uint(len(torrents)) {
+		t.Errorf("GetNumberOfTorrents() = %d, %v, want %d", n, err, len(torrents))
+	}
+	for _, torrent := range torrents {
+		tm, err := database.GetTorrent(ctx, torrent.InfoHash)
+		if err != nil || tm == nil {
+			t.Errorf("GetTorrent(%s) = %v, %v", torrent.Name, tm, err)
+			continue
+		}
+		if tm.Name != torrent.Name || tm.DiscoveredOn != torrent.DiscoveredOn || tm.Category != torrent.Category {
+			t.Errorf("GetTorrent(%s) = %+v, want %+v", torrent.Name, tm, torrent)
+		}
+		if files, err := database.GetFiles(ctx, torrent.InfoHash); err != nil || !reflect.DeepEqual(files, torrent.Files) {
+			t.Errorf("GetFiles(%s) = %v, %v, want %v", torrent.Name, files, err, torrent.Files)
+		}
+		if want, recorded := swarms[string(torrent.InfoHash)]; recorded {
+			if swarm, err := database.GetSwarm(ctx, torrent.InfoHash); err != nil || !reflect.DeepEqual(*swarm, want) {
+				t.Errorf("GetSwarm(%s) = %v, %v, want %v", torrent.Name, swarm, err, want)
+			}
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	t.Parallel()
+
+	source := openTestDatabase(t, "bolt")
+	if err := source.AddNewTorrents(ctx, testTorrents); err != nil {
+		t.Fatalf("AddNewTorrents() error = %v", err)
+	}
+	swarms := map[string]persistence.Swarm{
+		string(testTorrents[1].InfoHash): {NPeers: 7, Clients: []string{"a", "b"}},
+	}
+	for infoHash, swarm := range swarms {
+		if err := source.RecordSwarm(ctx, []byte(infoHash), swarm); err != nil {
+			t.Fatalf("RecordSwarm() error = %v", err)
+		}
+	}
+	curated := testTorrents[2].InfoHash
+	curation := &persistence.Curation{Tags: []string{"checked", "linux"}, Note: "Works.", Starred: true}
+	for _, tag := range curation.Tags {
+		if err := source.AddTag(ctx, curated, tag); err != nil {
+			t.Fatalf("AddTag() error = %v", err)
+		}
+	}
+	if err := source.SetNote(ctx, curated, curation.Note); err != nil {
+		t.Fatalf("SetNote() error = %v", err)
+	}
+	if err := source.SetStarred(ctx, curated, true); err != nil {
+		t.Fatalf("SetStarred() error = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dump.jsonl.gz")
+	if n, err := exportDump(ctx, source, path, false, 3); err != nil || n != 4 {
+		t.Fatalf("exportDump() = %d, %v, want 4", n, err)
+	}
+	if _, err := os.Stat(checkpointPath(path)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the checkpoint of a complete export was not removed: %v", err)
+	}
+
+	destination := openTestDatabase(t, "sqlite3")
+	if n, err := importDump(ctx, destination, path, false, 3); err != nil || n != 4 {
+		t.Fatalf("importDump() = %d, %v, want 4", n, err)
+	}
+	checkDatabase(t, destination, testTorrents, swarms)
+	if got, err := destination.GetCuration(ctx, curated); err != nil || !reflect.DeepEqual(got, curation) {
+		t.Errorf("GetCuration() = %v, %v, want %v", got, err, curation)
+	}
+
+	// Importing again adds nothing, as the torrents exist already.
+	if _, err := importDump(ctx, destination, path, false, 3); err != nil {
+		t.Fatalf("importDump() error = %v", err)
+	}
+	checkDatabase(t, destination, testTorrents, swarms)
+
+	// Nor are the swarms of the torrents that exist already overwritten.
+	existing := openTestDatabase(t, "sqlite3")
+	if err := existing.AddNewTorrents(ctx, testTorrents[1:2]); err != nil {
+		t.Fatalf("AddNewTorrents() error = %v", err)
+	}
+	swarm := persistence.Swarm{NPeers: 2, Clients: []string{"c"}}
+	if err := existing.RecordSwarm(ctx, testTorrents[1].InfoHash, swarm); err != nil {
+		t.Fatalf("RecordSwarm() error = %v", err)
+	}
+	if _, err := importDump(ctx, existing, path, false, 3); err != nil {
+		t.Fatalf("importDump() error = %v", err)
+	}
+	checkDatabase(t, existing, testTorrents, map[string]persistence.Swarm{string(testTorrents[1].InfoHash): swarm})
+}
+
+func TestExportDump_Resume(t *testing.T) {
+	ctx := context.Background()
+	t.Parallel()
+
+	source := openTestDatabase(t, "bolt")
+	if err := source.AddNewTorrents(ctx, testTorrents[:2]); err != nil {
+		t.Fatalf("AddNewTorrents() error = %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "dump.jsonl.gz")
+	if _, err := exportDump(ctx, source, path, false, 2); err != nil {
+		t.Fatalf("exportDump() error = %v", err)
+	}
+
+	// As if the export had been interrupted in the middle of the batch after the first one.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat() error = %v", err)
+	}
+	last, err := source.QueryTorrents(ctx, "", time.Now().Unix(), persistence.ByDiscoveredOn, false, 1, nil, nil, nil, persistence.SearchNames)
+	if err != nil || len(last) != 1 {
+		t.Fatalf("QueryTorrents() = %v, %v", last, err)
+	}
+	checkpoint := &exportCheckpoint{Offset: info.Size(), DiscoveredOn: last[0].DiscoveredOn, ID: last[0].ID, N: 2}
+	if err = writeCheckpoint(checkpointPath(path), checkpoint); err != nil {
+		t.Fatalf("writeCheckpoint() error = %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("os.OpenFile() error = %v", err)
+	}
+	if _, err = file.Write([]byte("half a batch")); err != nil {
+		t.Fatalf("os.File.Write() error = %v", err)
+	}
+	file.Close()
+
+	if err = source.AddNewTorrents(ctx, testTorrents[2:]); err != nil {
+		t.Fatalf("AddNewTorrents() error = %v", err)
+	}
+	if n, err := exportDump(ctx, source, path, true, 2); err != nil || n != 2 {
+		t.Fatalf("exportDump() resumed = %d, %v, want 2", n, err)
+	}
+
+	destination := openTestDatabase(t, "bolt")
+	if n, err := importDump(ctx, destination, path, false, 10); err != nil || n != 4 {
+		t.Fatalf("importDump() = %d, %v, want 4", n, err)
+	}
+	checkDatabase(t, destination, testTorrents, nil)
+}
+
+func TestImportDump_Resume(t *testing.T) {
+	ctx := context.Background()
+	t.Parallel()
+
+	source := openTestDatabase(t, "bolt")
+	if err := source.AddNewTorrents(ctx, testTorrents); err != nil {
+		t.Fatalf("AddNewTorrents() error = %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "dump.jsonl.gz")
+	if _, err := exportDump(ctx, source, path, false, 10); err != nil {
+		t.Fatalf("exportDump() error = %v", err)
+	}
+
+	// As if the first two torrents had been imported before the import was interrupted.
+	if err := writeCheckpoint(checkpointPath(path), &importCheckpoint{N: 2}); err != nil {
+		t.Fatalf("writeCheckpoint() error = %v", err)
+	}
+	destination := openTestDatabase(t, "bolt")
+	if n, err := importDump(ctx, destination, path, true, 10); err != nil || n != 2 {
+		t.Fatalf("importDump() resumed = %d, %v, want 2", n, err)
+	}
+	checkDatabase(t, destination, testTorrents[2:], nil)
+	if _, err := os.Stat(checkpointPath(path)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the checkpoint of a complete import was not removed: %v", err)
+	}
+}
+
+func TestImportDump_Header(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		header dumpHeader
+	}{
+		{"Test Format", dumpHeader{Format: "something else", Version: dumpVersion}},
+		{"Test Version", dumpHeader{Format: dumpFormat, Version: dumpVersion + 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dump.jsonl.gz")
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatalf("os.Create() error = %v", err)
+			}
+			gzipWriter := gzip.NewWriter(file)
+			if err = json.NewEncoder(gzipWriter).Encode(tt.header); err != nil {
+				t.Fatalf("json.Encoder.Encode() error = %v", err)
+			}
+			gzipWriter.Close()
+			file.Close()
+
+			if _, err = importDump(context.Background(), openTestDatabase(t, "bolt"), path, false, 10); err == nil {
+				t.Error("importDump() error = nil, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+type exportCommand struct {
+	ctx context.Context
+
+	DatabaseURL string `long:"database" description:"URL of the database to export." required:"true"`
+	Output      string `long:"output" short:"o" description:"Path of the dump to write." required:"true"`
+	Resume      bool   `long:"resume" description:"Resume an interrupted export from its checkpoint, rather than starting over."`
+	BatchSize   uint   `long:"batch-size" description:"Number of torrents read from the database at once." default:"1000"`
+}
+
+type importCommand struct {
+	ctx context.Context
+
+	DatabaseURL string `long:"database" description:"URL of the database to import into." required:"true"`
+	Input       string `long:"input" short:"i" description:"Path of the dump to read." required:"true"`
+	Resume      bool   `long:"resume" description:"Resume an interrupted import from its checkpoint, rather than starting over."`
+	BatchSize   uint   `long:"batch-size" description:"Number of torrents added to the database at once." default:"1000"`
+}
+
+type deleteCommand struct {
+	ctx context.Context
+
+	DatabaseURL string   `long:"database" description:"URL of the database to delete from." required:"true"`
+	InfoHashes  []string `long:"info-hash" description:"Info hash (in hex) of a torrent to delete, can be repeated."`
+	Query       string   `long:"query" description:"Delete all the torrents that the search query matches."`
+	Category    string   `long:"category" description:"Delete all the torrents of the category (that the query matches, if any)."`
+	Scope       string   `long:"scope" description:"What the query is matched against." choice:"names" choice:"files" choice:"names-and-files" default:"names"`
+}
+
+func main() {
+	// Interrupting (or terminating) a command cancels its queries, and an interrupted export or
+	// import can be resumed from its checkpoint.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	parser := flags.NewParser(nil, flags.Default)
+	parser.ShortDescription = "magnetico-db"
+	parser.LongDescription = "Moves the torrents between the databases of magnetico, of any engine, through dumps, and manages the users of magneticow."
+
+	_, err := parser.AddCommand("export", "Export all the torrents of a database",
+		"Writes all the torrents of the database, with their files and swarms, to a dump (gzipped JSON lines).",
+		&exportCommand{ctx: ctx})
+	if err != nil {
+		log.Fatalf("Could not add the export command. %v", err)
+	}
+	_, err = parser.AddCommand("import", "Import the torrents of a dump",
+		"Adds the torrents of the dump to the database, skipping those that exist already.",
+		&importCommand{ctx: ctx})
+	if err != nil {
+		log.Fatalf("Could not add the import command. %v", err)
+	}
+
+	_, err = parser.AddCommand("delete", "Delete torrents from a database",
+		"Deletes the torrents of the given info hashes, and/or all those that the search query and the category match.",
+		&deleteCommand{ctx: ctx})
+	if err != nil {
+		log.Fatalf("Could not add the delete command. %v", err)
+	}
+
+	users, err := parser.AddCommand("users", "Manage the users of magneticow",
+		"Adds, deletes, and lists the users of magneticow, who are stored in its database.",
+		&struct{}{})
+	if err != nil {
+		log.Fatalf("Could not add the users command. %v", err)
+	}
+	for _, command := range []struct {
+		name, short, long string
+		data              interface{}
+	}{
+		{"set", "Add a user, or change its password and role",
+			"Adds the user, or replaces the password and the role of the user of the same name; the password is read from the standard input.",
+			&usersSetCommand{ctx: ctx}},
+		{"delete", "Delete a user",
+			"Deletes the user, along with its API tokens and sessions.",
+			&usersDeleteCommand{ctx: ctx}},
+		{"list", "List the users",
+			"Prints the names and the roles of the users.",
+			&usersListCommand{ctx: ctx}},
+		{"import", "Import the users of a credentials file",
+			"Adds the users of a credentials file (as magneticow used to read), with the given role.",
+			&usersImportCommand{ctx: ctx}},
+	} {
+		if _, err = users.AddCommand(command.name, command.short, command.long, command.data); err != nil {
+			log.Fatalf("Could not add the users %s command. %v", command.name, err)
+		}
+	}
+
+	if _, err = parser.Parse(); err != nil {
+		// Do not print any error messages as jessevdk/go-flags already did.
+		stop()
+		os.Exit(1)
+	}
+}
+
+func (c *exportCommand) Execute(args []string) error {
+	if c.BatchSize == 0 {
+		return fmt.Errorf("`batch-size` must be positive")
+	}
+
+	database, err := openDatabase(c.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(database)
+
+	n, err := exportDump(c.ctx, database, c.Output, c.Resume, c.BatchSize)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d torrents to %s", n, c.Output)
+	return nil
+}
+
+func (c *importCommand) Execute(args []string) error {
+	if c.BatchSize == 0 {
+		return fmt.Errorf("`batch-size` must be positive")
+	}
+
+	database, err := openDatabase(c.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(database)
+
+	n, err := importDump(c.ctx, database, c.Input, c.Resume, c.BatchSize)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d torrents from %s (those that existed already were skipped)", n, c.Input)
+	return nil
+}
+
+func (c *deleteCommand) Execute(args []string) error {
+	infoHashes := make([][]byte, 0, len(c.InfoHashes))
+	for _, s := range c.InfoHashes {
+		infoHash, err := hex.DecodeString(s)
+		if err != nil || len(infoHash) != 20 {
+			return fmt.Errorf("`%s` is not a valid info hash", s)
+		}
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	var category *persistence.Category
+	if c.Category != "" {
+		parsed, err := persistence.ParseCategory(c.Category)
+		if err != nil {
+			return err
+		}
+		category = &parsed
+	}
+
+	if len(infoHashes) == 0 && c.Query == "" && category == nil {
+		return fmt.Errorf("at least one of `info-hash`, `query`, and `category` is required")
+	}
+
+	database, err := openDatabase(c.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(database)
+
+	for _, infoHash := range infoHashes {
+		deleted, err := database.DeleteTorrent(c.ctx, infoHash)
+		if err != nil {
+			return errors.New("DeleteTorrent " + err.Error())
+		} else if !deleted {
+			log.Printf("There is no torrent %x in the database", infoHash)
+		}
+	}
+
+	if c.Query != "" || category != nil {
+		scope := map[string]persistence.SearchScope{
+			"names":           persistence.SearchNames,
+			"files":           persistence.SearchFiles,
+			"names-and-files": persistence.SearchNamesAndFiles,
+		}[c.Scope]
+		n, err := database.DeleteTorrents(c.ctx, c.Query, category, scope)
+		if err != nil {
+			return errors.New("DeleteTorrents " + err.Error())
+		}
+		log.Printf("Deleted %d torrent(s) matching the query", n)
+	}
+	return nil
+}
+
+func openDatabase(rawURL string) (persistence.Database, error) {
+	database, err := persistence.MakeDatabase(rawURL, "")
+	if err != nil {
+		return nil, errors.New("MakeDatabase " + err.Error())
+	}
+	return database, nil
+}
+
+func closeDatabase(database persistence.Database) {
+	if err := database.Close(); err != nil {
+		log.Printf("Could not close database! %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/tgragnato/magnetico/persistence"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minPasswordLength is the minimum length of the passwords of the users, in bytes, same as in
+// magneticow.
+const minPasswordLength = 8
+
+type usersSetCommand struct {
+	ctx context.Context
+
+	DatabaseURL string `long:"database" description:"URL of the database of the users." required:"true"`
+	Name        string `long:"name" description:"Name of the user." required:"true"`
+	Role        string `long:"role" description:"Role of the user." choice:"viewer" choice:"curator" choice:"admin" default:"viewer"`
+}
+
+type usersDeleteCommand struct {
+	ctx context.Context
+
+	DatabaseURL string `long:"database" description:"URL of the database of the users." required:"true"`
+	Name        string `long:"name" description:"Name of the user." required:"true"`
+}
+
+type usersListCommand struct {
+	ctx context.Context
+
+	DatabaseURL string `long:"database" description:"URL of the database of the users." required:"true"`
+}
+
+type usersImportCommand struct {
+	ctx context.Context
+
+	DatabaseURL string `long:"database" description:"URL of the database of the users." required:"true"`
+	Credentials string `long:"credentials" description:"Path to the credentials file, of <USERNAME>:<BCRYPT HASH> lines." required:"true"`
+	Role        string `long:"role" description:"Role of the imported users." choice:"viewer" choice:"curator" choice:"admin" required:"true"`
+}
+
+func (c *usersSetCommand) Execute(args []string) error {
+	role, err := persistence.ParseRole(c.Role)
+	if err != nil {
+		return err
+	}
+	if err = persistence.ValidateUserName(c.Name); err != nil {
+		return err
+	}
+
+	log.Printf("Enter the password of %s:", c.Name)
+	password, err := readPassword(os.Stdin)
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.New("bcrypt.GenerateFromPassword " + err.Error())
+	}
+
+	database, err := openDatabase(c.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(database)
+
+	if err = database.SetUser(c.ctx, persistence.User{Name: c.Name, PasswordHash: hash, Role: role}); err != nil {
+		return errors.New("SetUser " + err.Error())
+	}
+	log.Printf("Set the user %s (%s)", c.Name, role)
+	return nil
+}
+
+func (c *usersDeleteCommand) Execute(args []string) error {
+	database, err := openDatabase(c.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(database)
+
+	deleted, err := database.DeleteUser(c.ctx, c.Name)
+	if err != nil {
+		return errors.New("DeleteUser " + err.Error())
+	} else if !deleted {
+		return fmt.Errorf("there is no user %s in the database", c.Name)
+	}
+	log.Printf("Deleted the user %s, along with its tokens", c.Name)
+	return nil
+}
+
+func (c *usersListCommand) Execute(args []string) error {
+	database, err := openDatabase(c.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(database)
+
+	users, err := database.GetUsers(c.ctx)
+	if err != nil {
+		return errors.New("GetUsers " + err.Error())
+	}
+	for _, user := range users {
+		fmt.Printf("%s\t%s\n", user.Name, user.Role)
+	}
+	return nil
+}
+
+func (c *usersImportCommand) Execute(args []string) error {
+	role, err := persistence.ParseRole(c.Role)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(c.Credentials)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	users, err := persistence.ReadCredentials(file, role)
+	if err != nil {
+		return err
+	}
+
+	database, err := openDatabase(c.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(database)
+
+	for _, user := range users {
+		if err = database.SetUser(c.ctx, user); err != nil {
+			return errors.New("SetUser " + err.Error())
+		}
+	}
+	log.Printf("Imported %d user(s) as %s from %s", len(users), role, c.Credentials)
+	return nil
+}
+
+// readPassword reads a password from the first line of the reader.
+func readPassword(reader io.Reader) (string, error) {
+	line, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", errors.New("Error while reading the password " + err.Error())
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("passwords must be at least %d bytes long", minPasswordLength)
+	}
+	return password, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadPassword(t *testing.T) {
+	for input, want := range map[string]string{
+		"secret password\n":   "secret password",
+		"secret password\r\n": "secret password",
+		"secret password":     "secret password",
+		"secret\npassword\n":  "",
+		"":                    "",
+	} {
+		got, err := readPassword(strings.NewReader(input))
+		if (err != nil) != (want == "") || got != want {
+			t.Errorf("readPassword(%q) = %q, %v, want %q", input, got, err, want)
+		}
+	}
+}
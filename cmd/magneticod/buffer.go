@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/tgragnato/magnetico/metadata"
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+// writeBufferCapacity is how many times its batch size the write buffer holds at most, while the
+// database is too slow to add the torrents.
+const writeBufferCapacity = 10
+
+// writeBuffer accumulates the torrents to be persisted, and adds them to the database in batches:
+// once there are enough of them, or when flushed on a timer by the event loop so that they do not
+// wait for too long at low crawl rates.
+//
+// Once a flush has timed out, only the timer retries until one succeeds, so that the crawler is not
+// held up by every torrent added meanwhile. If the buffer is full by then, the new torrents are
+// dropped: they will be discovered again anyway.
+type writeBuffer struct {
+	database persistence.Database
+	size     int
+	// timeout bounds each flush, unless zero.
+	timeout time.Duration
+	// prefetcher is handed the torrents once added, unless nil.
+	prefetcher *readmePrefetcher
+
+	torrents []persistence.Torrent
+	// behind is whether the last flush timed out.
+	behind bool
+	// dropped is the number of torrents dropped since the last successful flush.
+	dropped int
+}
+
+func newWriteBuffer(database persistence.Database, size int, timeout time.Duration, prefetcher *readmePrefetcher) *writeBuffer {
+	return &writeBuffer{
+		database:   database,
+		size:       size,
+		timeout:    timeout,
+		prefetcher: prefetcher,
+		torrents:   make([]persistence.Torrent, 0, size),
+	}
+}
+
+func (b *writeBuffer) add(ctx context.Context, md metadata.Metadata) {
+	if len(b.torrents) >= writeBufferCapacity*b.size {
+		if b.dropped == 0 {
+			log.Printf("The write buffer is full, dropping the new torrents until the database catches up")
+		}
+		b.dropped++
+		return
+	}
+
+	b.torrents = append(b.torrents, persistence.Torrent{
+		InfoHash: md.InfoHash,
+		Name:     md.Name,
+		Files:    md.Files,
+		Category: md.Classification(),
+		Swarm:    persistence.Swarm{NPeers: uint(md.NPeers), Clients: md.Clients},
+	})
+
+	if len(b.torrents) >= b.size && !b.behind {
+		b.flush(ctx)
+	}
+}
+
+// flush adds the buffered torrents to the database, along with their swarms. If the context is done
+// (or the timeout passes) before the torrents are added, they are kept for the next flush.
+func (b *writeBuffer) flush(ctx context.Context) {
+	b.flushWithin(ctx, b.timeout)
+}
+
+// close flushes the buffer one last time at shutdown, without the timeout as there will be no next
+// flush to keep the torrents for.
+func (b *writeBuffer) close() {
+	b.flushWithin(context.Background(), 0)
+}
+
+func (b *writeBuffer) flushWithin(ctx context.Context, timeout time.Duration) {
+	if len(b.torrents) == 0 {
+		return
+	}
+
+	ctx, cancel := databaseContext(ctx, timeout)
+	defer cancel()
+
+	if err := b.database.AddNewTorrents(ctx, b.torrents); err != nil && ctx.Err() != nil {
+		log.Printf("Could not add %d new torrents to the database in time, keeping them for the next flush. %v", len(b.torrents), err)
+		b.behind = true
+		return
+	} else if err != nil {
+		log.Fatalf("Could not add new torrents to the database. %v", err)
+	}
+	if b.dropped != 0 {
+		log.Printf("Dropped %d new torrents while the write buffer was full", b.dropped)
+	}
+	b.behind, b.dropped = false, 0
+
+	if b.prefetcher != nil {
+		b.prefetcher.add(b.torrents)
+	}
+
+	b.torrents = b.torrents[:0]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// janitorQueueLength is the number of tasks that can wait for the one in progress.
+const janitorQueueLength = 2
+
+// janitor deletes torrents from the database in the background, one task at a time, so that the
+// event loop goes on adding torrents meanwhile: deleting can take minutes on large databases.
+type janitor struct {
+	tasks chan func(ctx context.Context)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newJanitor() *janitor {
+	j := &janitor{
+		tasks: make(chan func(ctx context.Context), janitorQueueLength),
+		done:  make(chan struct{}),
+	}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+
+	go j.work()
+
+	return j
+}
+
+// schedule queues the task, unless too many tasks are waiting already, in which case it is
+// skipped as the tasks waiting will clean the database up anyway.
+func (j *janitor) schedule(name string, task func(ctx context.Context)) {
+	select {
+	case j.tasks <- task:
+	default:
+		log.Printf("Skipping %s, as the database is still being cleaned up", name)
+	}
+}
+
+func (j *janitor) work() {
+	defer close(j.done)
+
+	for {
+		select {
+		case task := <-j.tasks:
+			task(j.ctx)
+		case <-j.ctx.Done():
+			return
+		}
+	}
+}
+
+// stop abandons the task in progress (whose deletions committed so far are kept) and those
+// queued, and waits for the janitor to return.
+func (j *janitor) stop() {
+	j.cancel()
+	<-j.done
+}
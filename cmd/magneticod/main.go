@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/jessevdk/go-flags"
@@ -22,6 +25,31 @@ type opFlags struct {
 	IndexerMaxNeighbors uint
 
 	LeechMaxN int
+
+	ShutdownTimeout time.Duration
+	DatabaseTimeout time.Duration
+
+	WriteBatchSize     int
+	WriteBatchInterval time.Duration
+
+	NormaliseNames bool
+	MinTotalSize   uint64
+	MaxTotalSize   uint64
+	MinNFiles      uint
+	MaxNFiles      uint
+	DropRulesPath  string
+
+	BlocklistInfoHashesPath string
+	BlocklistPatternsPath   string
+	BlocklistPurge          bool
+
+	Retention         persistence.RetentionPolicy
+	RetentionInterval time.Duration
+
+	ReadmePrefetchMaxN int
+
+	MigrateOnly   bool
+	MigrateDryRun bool
 }
 
 func main() {
@@ -32,42 +60,143 @@ func main() {
 		return
 	}
 
-	// Handle Ctrl-C gracefully.
-	interruptChan := make(chan os.Signal, 1)
-	signal.Notify(interruptChan, os.Interrupt)
+	// Handle Ctrl-C (and SIGTERM, as sent by container runtimes) gracefully.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opFlags.MigrateOnly || opFlags.MigrateDryRun {
+		migrate(opFlags.DatabaseURL, opFlags.MigrateDryRun)
+		return
+	}
 
-	database, err := persistence.MakeDatabase(opFlags.DatabaseURL)
+	// Opening the database migrates its schema, unless it is newer than this version knows of.
+	database, err := persistence.MakeDatabase(opFlags.DatabaseURL, "")
 	if err != nil {
 		log.Fatalf("Could not open the database %s. %v", opFlags.DatabaseURL, err)
 	}
 
+	// Purging the blocklist and applying the retention policy are done in the background.
+	janitor := newJanitor()
+
+	var blocklist *metadata.Blocklist
+	if opFlags.BlocklistInfoHashesPath != "" || opFlags.BlocklistPatternsPath != "" {
+		blocklist, err = metadata.NewBlocklist(opFlags.BlocklistInfoHashesPath, opFlags.BlocklistPatternsPath)
+		if err != nil {
+			log.Fatalf("Could not load the blocklist. %v", err)
+		}
+		if opFlags.BlocklistPurge {
+			janitor.schedule("purging the blocked torrents", func(ctx context.Context) { purgeBlocked(ctx, database, blocklist) })
+		}
+	}
+
+	// Reload the blocklist when you receive SIGHUP
+	sighupChan := make(chan os.Signal, 1)
+	signal.Notify(sighupChan, syscall.SIGHUP)
+
+	pipeline, err := makePipeline(opFlags, blocklist)
+	if err != nil {
+		log.Fatalf("Could not set up the metadata pipeline. %v", err)
+	}
+
 	trawlingManager := dht.NewManager(opFlags.IndexerAddrs, opFlags.IndexerInterval, opFlags.IndexerMaxNeighbors)
 	metadataSink := metadata.NewSink(5*time.Second, opFlags.LeechMaxN)
+	var prefetcher *readmePrefetcher
+	if opFlags.ReadmePrefetchMaxN != 0 {
+		if prefetcher, err = newReadmePrefetcher(database, opFlags.ReadmePrefetchMaxN); err != nil {
+			log.Fatalf("Could not set up the readme prefetcher. %v", err)
+		}
+	}
+	buffer := newWriteBuffer(database, opFlags.WriteBatchSize, opFlags.DatabaseTimeout, prefetcher)
+	flushTicker := time.NewTicker(opFlags.WriteBatchInterval)
+	defer flushTicker.Stop()
+
+	// The retention policy is applied on start-up and then periodically, if there is any, in the
+	// background.
+	retain := func(ctx context.Context) { applyRetention(ctx, database, opFlags.Retention) }
+	var retentionTick <-chan time.Time
+	if !opFlags.Retention.IsZero() {
+		janitor.schedule("applying the retention policy", retain)
+		retentionTicker := time.NewTicker(opFlags.RetentionInterval)
+		defer retentionTicker.Stop()
+		retentionTick = retentionTicker.C
+	}
 
 	// The Event Loop
 	for stopped := false; !stopped; {
 		select {
 		case result := <-trawlingManager.Output():
 			infoHash := result.InfoHash()
+			if blocklist != nil && blocklist.IsInfoHashBlocked(infoHash) {
+				// Blocked torrents are not even leeched.
+				break
+			}
 
-			exists, err := database.DoesTorrentExist(infoHash[:])
-			if err != nil {
-				log.Fatalf("Could not check whether torrent exists! %V", err)
+			dbCtx, cancel := databaseContext(ctx, opFlags.DatabaseTimeout)
+			exists, err := database.DoesTorrentExist(dbCtx, infoHash[:])
+			cancel()
+			if err != nil && dbCtx.Err() != nil {
+				// Either shutting down, or the database is too slow: the info hash is skipped, as it
+				// will be discovered again anyway.
+				if ctx.Err() == nil {
+					log.Printf("Could not check in time whether torrent exists. %v", err)
+				}
+			} else if err != nil {
+				log.Fatalf("Could not check whether torrent exists! %v", err)
 			} else if !exists {
 				metadataSink.Sink(result)
 			}
 
 		case md := <-metadataSink.Drain():
-			if err := database.AddNewTorrent(md.InfoHash, md.Name, md.Files); err != nil {
-				log.Fatalf("Could not add new torrent to the database. %v", err)
+			persist(ctx, buffer, pipeline, md)
+
+		case <-flushTicker.C:
+			buffer.flush(ctx)
+
+		case <-retentionTick:
+			janitor.schedule("applying the retention policy", retain)
+
+		case <-sighupChan:
+			if blocklist == nil {
+				log.Println("Ignoring SIGHUP since no blocklist was supplied")
+			} else if err := blocklist.Reload(); err != nil {
+				log.Printf("Could not reload the blocklist, keeping the previous one. %v", err)
+			} else {
+				log.Println("Reloaded the blocklist")
+				if opFlags.BlocklistPurge {
+					janitor.schedule("purging the blocked torrents", func(ctx context.Context) { purgeBlocked(ctx, database, blocklist) })
+				}
 			}
 
-		case <-interruptChan:
-			trawlingManager.Terminate()
+		case <-ctx.Done():
 			stopped = true
 		}
 	}
 
+	// Restore the default behaviour of the signals, so that a second Ctrl-C quits immediately.
+	stop()
+	log.Printf("Shutting down, waiting up to %v for the leeches in flight...", opFlags.ShutdownTimeout)
+	trawlingManager.Terminate()
+	janitor.stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opFlags.ShutdownTimeout)
+	defer cancel()
+	drain := metadataSink.Drain()
+	go func() {
+		if err := metadataSink.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Abandoned the leeches still in flight. %v", err)
+		}
+	}()
+	// The drain is closed by Shutdown, once the leeches in flight are done. As ctx is done by now,
+	// the remaining torrents are added with a fresh context, bounded by the database timeout only
+	// (but for the last flush, see writeBuffer.close).
+	for md := range drain {
+		persist(context.Background(), buffer, pipeline, md)
+	}
+	buffer.close()
+	if prefetcher != nil {
+		prefetcher.stop()
+	}
+
 	if err = database.Close(); err != nil {
 		log.Printf("Could not close database! %v", err)
 	}
@@ -83,6 +212,32 @@ func parseFlags() (*opFlags, error) {
 
 		LeechMaxN uint `long:"leech-max-n" description:"Maximum number of leeches." default:"50"`
 		MaxRPS    uint `long:"max-rps" description:"Maximum requests per second." default:"0"`
+
+		ShutdownTimeout uint `long:"shutdown-timeout" description:"Time to wait for the leeches in flight on shutdown, in integer seconds." default:"10"`
+		DatabaseTimeout uint `long:"database-timeout" description:"Maximum time for the database to check for or to add torrents, in integer seconds (0 for no limit)." default:"30"`
+
+		WriteBatchSize     uint `long:"write-batch-size" description:"Maximum number of torrents to be added to the database at once." default:"100"`
+		WriteBatchInterval uint `long:"write-batch-interval" description:"Maximum time for the torrents to wait before being added to the database, in integer seconds." default:"1"`
+
+		NormaliseNames bool   `long:"normalise-names" description:"Normalise the names of the torrents before persisting them."`
+		MinTotalSize   uint64 `long:"min-total-size" description:"Minimum total size of the torrents to be persisted, in bytes." default:"0"`
+		MaxTotalSize   uint64 `long:"max-total-size" description:"Maximum total size of the torrents to be persisted, in bytes (0 for no limit)." default:"0"`
+		MinNFiles      uint   `long:"min-n-files" description:"Minimum number of files of the torrents to be persisted." default:"0"`
+		MaxNFiles      uint   `long:"max-n-files" description:"Maximum number of files of the torrents to be persisted (0 for no limit)." default:"0"`
+		DropRules      string `long:"drop-rules" description:"Path to the file of keyword and regexp rules for the torrents not to be persisted."`
+
+		BlocklistInfoHashes string `long:"blocklist-infohashes" description:"Path to the file of the info hashes of the torrents never to be indexed (reloaded on SIGHUP)."`
+		BlocklistPatterns   string `long:"blocklist-patterns" description:"Path to the file of regexps on names and file paths of the torrents never to be indexed (reloaded on SIGHUP)."`
+		BlocklistPurge      bool   `long:"blocklist-purge" description:"Delete the torrents matching the blocklist from the database on start-up and on every reload."`
+
+		RetentionMaxAgeWithoutPeers uint `long:"retention-max-age-without-peers" description:"Delete the torrents that had no known peers this many integer days after their discovery (0 to keep them for ever)." default:"0"`
+		RetentionMaxTorrents        uint `long:"retention-max-torrents" description:"Keep only this many of the most recently discovered torrents (0 for no limit)." default:"0"`
+		RetentionInterval           uint `long:"retention-interval" description:"Interval of applying the retention policy, in integer hours." default:"24"`
+
+		ReadmePrefetchMaxN uint `long:"readme-prefetch-max-n" description:"Maximum number of readmes of the new torrents to be fetched at once in the background (0 not to prefetch them)." default:"0"`
+
+		MigrateOnly   bool `long:"migrate-only" description:"Migrate the schema of the database to the latest version, and exit."`
+		MigrateDryRun bool `long:"migrate-dry-run" description:"List the migrations of the schema of the database that are pending, without applying them, and exit."`
 	}
 
 	opF := new(opFlags)
@@ -118,9 +273,146 @@ func parseFlags() (*opFlags, error) {
 
 	mainline.DefaultThrottleRate = int(cmdF.MaxRPS)
 
+	opF.ShutdownTimeout = time.Duration(cmdF.ShutdownTimeout) * time.Second
+	opF.DatabaseTimeout = time.Duration(cmdF.DatabaseTimeout) * time.Second
+
+	if cmdF.WriteBatchSize == 0 {
+		log.Fatalf("`write-batch-size` must be positive")
+	}
+	if cmdF.WriteBatchInterval == 0 {
+		log.Fatalf("`write-batch-interval` must be positive")
+	}
+	opF.WriteBatchSize = int(cmdF.WriteBatchSize)
+	opF.WriteBatchInterval = time.Duration(cmdF.WriteBatchInterval) * time.Second
+
+	opF.NormaliseNames = cmdF.NormaliseNames
+	opF.MinTotalSize = cmdF.MinTotalSize
+	opF.MaxTotalSize = cmdF.MaxTotalSize
+	opF.MinNFiles = cmdF.MinNFiles
+	opF.MaxNFiles = cmdF.MaxNFiles
+	opF.DropRulesPath = cmdF.DropRules
+
+	opF.BlocklistInfoHashesPath = cmdF.BlocklistInfoHashes
+	opF.BlocklistPatternsPath = cmdF.BlocklistPatterns
+	opF.BlocklistPurge = cmdF.BlocklistPurge
+	if opF.BlocklistPurge && opF.BlocklistInfoHashesPath == "" && opF.BlocklistPatternsPath == "" {
+		log.Fatalf("`blocklist-purge` requires `blocklist-infohashes` and/or `blocklist-patterns`")
+	}
+
+	opF.Retention.MaxAgeWithoutPeers = time.Duration(cmdF.RetentionMaxAgeWithoutPeers) * 24 * time.Hour
+	opF.Retention.MaxTorrents = cmdF.RetentionMaxTorrents
+	if cmdF.RetentionInterval == 0 {
+		log.Fatalf("`retention-interval` must be positive")
+	}
+	opF.RetentionInterval = time.Duration(cmdF.RetentionInterval) * time.Hour
+
+	opF.ReadmePrefetchMaxN = int(cmdF.ReadmePrefetchMaxN)
+
+	opF.MigrateOnly = cmdF.MigrateOnly
+	opF.MigrateDryRun = cmdF.MigrateDryRun
+
 	return opF, nil
 }
 
+// makePipeline assembles the processors that the metadata goes through before being persisted,
+// in the order of increasing cost, except for the blocklist which must see the metadata as it was
+// fetched.
+func makePipeline(opF *opFlags, blocklist *metadata.Blocklist) (metadata.Pipeline, error) {
+	var pipeline metadata.Pipeline
+
+	if blocklist != nil {
+		pipeline = append(pipeline, blocklist)
+	}
+
+	if opF.NormaliseNames {
+		pipeline = append(pipeline, metadata.NameNormaliser{})
+	}
+
+	if opF.MinTotalSize != 0 || opF.MaxTotalSize != 0 {
+		pipeline = append(pipeline, metadata.SizeFilter{Min: opF.MinTotalSize, Max: opF.MaxTotalSize})
+	}
+
+	if opF.MinNFiles != 0 || opF.MaxNFiles != 0 {
+		pipeline = append(pipeline, metadata.FileCountFilter{Min: opF.MinNFiles, Max: opF.MaxNFiles})
+	}
+
+	if opF.DropRulesPath != "" {
+		dropRules, err := metadata.LoadDropRules(opF.DropRulesPath)
+		if err != nil {
+			return nil, errors.New("LoadDropRules " + err.Error())
+		}
+		pipeline = append(pipeline, dropRules)
+	}
+
+	// Classify last, so that the classifier sees the metadata as it will be persisted.
+	pipeline = append(pipeline, metadata.Classifier{})
+
+	return pipeline, nil
+}
+
+// persist runs the metadata through the pipeline and buffers the torrent to be added to the
+// database, unless it is discarded.
+func persist(ctx context.Context, buffer *writeBuffer, pipeline metadata.Pipeline, md metadata.Metadata) {
+	keep, err := pipeline.Process(&md)
+	if err != nil {
+		log.Printf("Could not process the metadata of %x. %v", md.InfoHash, err)
+		return
+	} else if !keep {
+		return
+	}
+
+	buffer.add(ctx, md)
+}
+
+// migrate applies the pending migrations of the schema of the database (which opening it does as
+// well), or only lists them if dryRun.
+func migrate(databaseURL string, dryRun bool) {
+	migrations, err := persistence.Migrate(databaseURL, dryRun)
+	if err != nil {
+		log.Fatalf("Could not migrate the database %s. %v", databaseURL, err)
+	}
+
+	switch {
+	case len(migrations) == 0:
+		log.Println("The schema of the database is up to date")
+	case dryRun:
+		for _, m := range migrations {
+			log.Printf("Pending migration to version %v", m)
+		}
+	default:
+		log.Printf("Migrated the schema of the database to version %v", migrations[len(migrations)-1])
+	}
+}
+
+// purgeBlocked deletes the torrents matching the blocklist from the database, see janitor.
+func purgeBlocked(ctx context.Context, database persistence.Database, blocklist *metadata.Blocklist) {
+	n, err := database.PurgeTorrents(ctx, blocklist.InfoHashes(), blocklist.Pattern())
+	if err != nil {
+		log.Printf("Could not purge the blocked torrents from the database. %v", err)
+		return
+	}
+	log.Printf("Purged %d blocked torrent(s) from the database", n)
+}
+
+// applyRetention deletes the torrents not retained by the policy from the database, see janitor.
+func applyRetention(ctx context.Context, database persistence.Database, policy persistence.RetentionPolicy) {
+	n, err := database.ApplyRetention(ctx, policy)
+	if err != nil {
+		log.Printf("Could not apply the retention policy to the database. %v", err)
+		return
+	}
+	log.Printf("Deleted %d torrent(s) not retained by the policy from the database", n)
+}
+
+// databaseContext returns the context of a call to the database, which is done once the parent is
+// or once the timeout has passed, unless it is zero.
+func databaseContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
 func checkAddrs(addrs []string) error {
 	for _, addr := range addrs {
 		// We are using ResolveUDPAddr but it works equally well for checking TCPAddr(esses) as
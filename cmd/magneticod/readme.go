@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/tgragnato/magnetico/metadata"
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+// readmePrefetcher fetches the readmes of the newly added torrents in the background, and stores
+// them in the database so that they are served at once. Torrents are queued only as long as there
+// is room, so that prefetching never holds up the persisting of torrents.
+type readmePrefetcher struct {
+	database persistence.Database
+	fetcher  *metadata.ReadmeFetcher
+	queue    chan []byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newReadmePrefetcher(database persistence.Database, maxN int) (*readmePrefetcher, error) {
+	fetcher, err := metadata.NewReadmeFetcher()
+	if err != nil {
+		return nil, errors.New("NewReadmeFetcher " + err.Error())
+	}
+
+	p := &readmePrefetcher{
+		database: database,
+		fetcher:  fetcher,
+		queue:    make(chan []byte, 10*maxN),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	p.wg.Add(maxN)
+	for i := 0; i < maxN; i++ {
+		go p.work()
+	}
+
+	return p, nil
+}
+
+// add queues the torrents that have readmes, once they are in the database.
+func (p *readmePrefetcher) add(torrents []persistence.Torrent) {
+	for _, torrent := range torrents {
+		if !metadata.HasReadme(torrent.Files) {
+			continue
+		}
+		select {
+		case p.queue <- torrent.InfoHash:
+		default:
+			// The queue is full: this readme will be fetched on request instead.
+		}
+	}
+}
+
+func (p *readmePrefetcher) work() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case infoHash := <-p.queue:
+			p.prefetch(infoHash)
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *readmePrefetcher) prefetch(infoHash []byte) {
+	if readme, err := p.database.GetReadme(p.ctx, infoHash); err != nil {
+		log.Printf("Could not check whether the readme of %x is stored. %v", infoHash, err)
+		return
+	} else if readme != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, metadata.ReadmeTimeout)
+	defer cancel()
+	readme, err := p.fetcher.Fetch(ctx, infoHash)
+	if err != nil {
+		// Readmes of swarms that cannot be reached are commonplace, hence not logged.
+		return
+	}
+
+	if err = p.database.SetReadme(p.ctx, infoHash, *readme); err != nil {
+		log.Printf("Could not store the readme of %x. %v", infoHash, err)
+	}
+}
+
+// stop abandons the readmes queued and being fetched, and waits for the workers to return.
+func (p *readmePrefetcher) stop() {
+	p.cancel()
+	p.wg.Wait()
+	p.fetcher.Close()
+}
@@ -1,165 +1,198 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/anacrolix/torrent"
-	"github.com/anacrolix/torrent/storage"
 	"github.com/gorilla/mux"
+	"github.com/tgragnato/magnetico/metadata"
 	"github.com/tgragnato/magnetico/persistence"
-	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	RequestLimitSize = 50 * 1024
-	MsgJsonError     = "JSON encode error"
-	MsgCantDecode    = "Couldn't decode infohash"
-	NfoSuffix        = ".nfo"
-	MagnetPrefix     = "magnet:?xt=urn:btih:"
+	MsgJsonError  = "JSON encode error"
+	MsgCantDecode = "Couldn't decode infohash"
+	// MaxNoteLength is the maximum length of the notes of the torrents, in bytes.
+	MaxNoteLength = 1 << 16
+	// MaxBodySize is the maximum size of the bodies of the requests to the API, in bytes.
+	MaxBodySize = 2 * MaxNoteLength
 )
 
-type ApiReadmeHandler struct {
-	client  *torrent.Client
-	tempDir string
+// apiHandler is an endpoint of the API, shared by its versions: it returns what is to be responded,
+// or an error (see apiError). apiV0 and apiV1 adapt it to the responses of each version.
+type apiHandler func(r *http.Request) (*apiResponse, error)
+
+// apiResponse is what an apiHandler responds.
+type apiResponse struct {
+	// Status is the status code of the response, or zero for 200 OK.
+	Status int
+	// Data is encoded as the JSON body of the response (in an envelope in API v1), unless it is nil.
+	Data interface{}
+	// Meta is about the data, and responded by API v1 only.
+	Meta *apiMeta
 }
 
-func NewApiReadmeHandler() (*ApiReadmeHandler, error) {
-	h := new(ApiReadmeHandler)
-	var err error
-
-	h.tempDir, err = os.MkdirTemp("", "magneticod_")
-	if err != nil {
-		return nil, err
+func (response *apiResponse) status() int {
+	if response.Status == 0 {
+		return http.StatusOK
 	}
-
-	config := torrent.NewDefaultClientConfig()
-	config.ListenPort = 0
-	config.DefaultStorage = storage.NewFileByInfoHash(h.tempDir)
-
-	h.client, err = torrent.NewClient(config)
-	if err != nil {
-		_ = os.RemoveAll(h.tempDir)
-		return nil, err
-	}
-
-	return h, nil
+	return response.Status
 }
 
-func (h *ApiReadmeHandler) Close() {
-	h.client.Close()
-	_ = os.RemoveAll(h.tempDir)
+// apiError is an error of the API, responded with its status code. The messages of server errors
+// (5xx) are logged rather than responded by API v1.
+type apiError struct {
+	Status  int
+	Message string
 }
 
-func (h *ApiReadmeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	infohashHex := mux.Vars(r)["infohash"]
+func (e *apiError) Error() string {
+	return e.Message
+}
 
-	infohash, err := hex.DecodeString(infohashHex)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "%s: %s", MsgCantDecode, err.Error())
-		return
-	}
+func errorf(status int, format string, a ...interface{}) error {
+	return &apiError{Status: status, Message: fmt.Sprintf(format, a...)}
+}
 
-	files, err := database.GetFiles(infohash)
-	if err != nil {
-		log.Printf("GetFiles error %v", err)
-		respondError(w, http.StatusInternalServerError, "Internal Server Error")
+// errorStatus returns the status code and the message of the error, which is an internal server
+// error unless it is an *apiError.
+func errorStatus(err error) (int, string) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status, apiErr.Message
 	}
+	return http.StatusInternalServerError, err.Error()
+}
 
-	ok := false
-	for _, file := range files {
-		if strings.HasSuffix(file.Path, NfoSuffix) {
-			ok = true
-			break
-		}
-		if strings.Contains(file.Path, "read") {
-			ok = true
-			break
+// apiV0 adapts the handler to API v0.1, which responds the bare data, and the errors as plain text.
+func apiV0(handler apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodySize)
+		response, err := handler(r)
+		if err != nil {
+			status, message := errorStatus(err)
+			respondError(w, status, "%s", message)
+			return
 		}
+		respondJSON(w, response.status(), response.Data)
 	}
+}
 
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
+// respondJSON responds the data as JSON, or nothing if it is nil.
+func respondJSON(w http.ResponseWriter, statusCode int, data interface{}) {
+	if data == nil {
+		w.WriteHeader(statusCode)
 		return
 	}
+	w.Header().Set(ContentType, ContentTypeJson)
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("%s %v", MsgJsonError, err)
+	}
+}
 
-	log.Println("README")
+// ApiReadmeHandler serves the readmes of the torrents, fetching them from their swarms on the first
+// request and from the database (where they are stored once fetched) afterwards.
+type ApiReadmeHandler struct {
+	fetcher *metadata.ReadmeFetcher
+}
 
-	t, err := h.client.AddMagnet(MagnetPrefix + infohashHex)
+func NewApiReadmeHandler() (*ApiReadmeHandler, error) {
+	fetcher, err := metadata.NewReadmeFetcher()
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, err
 	}
-	defer t.Drop()
-
-	log.Println("WAITING FOR INFO")
+	return &ApiReadmeHandler{fetcher: fetcher}, nil
+}
 
-	select {
-	case <-t.GotInfo():
+func (h *ApiReadmeHandler) Close() {
+	h.fetcher.Close()
+}
 
-	case <-time.After(30 * time.Second):
-		respondError(w, http.StatusInternalServerError, "Timeout")
+// ServeHTTP serves the readme of the torrent as plain text, for API v0.1.
+func (h *ApiReadmeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	infohash, err := requestInfohash(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "%s", err.Error())
 		return
 	}
 
-	log.Println("GOT INFO!")
-
-	t.CancelPieces(0, t.NumPieces())
-
-	var file *torrent.File
-	for _, file = range t.Files() {
-		filePath := file.Path()
-		if strings.HasSuffix(filePath, NfoSuffix) {
-			break
-		} else if strings.Contains(filePath, "read") {
-			break
+	readme, err := h.readme(r.Context(), infohash)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch apiErr.Status {
+		case http.StatusNotFound:
+			w.WriteHeader(apiErr.Status)
+		case http.StatusGatewayTimeout:
+			log.Print(apiErr.Message)
+			respondError(w, http.StatusInternalServerError, "Timeout")
+		default:
+			log.Print(apiErr.Message)
+			respondError(w, http.StatusInternalServerError, "Internal Server Error")
 		}
-	}
-
-	if file == nil {
-		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	// Cancel if the file is larger than limit
-	if file.Length() > RequestLimitSize {
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
-		return
-	}
+	w.Header().Set(ContentType, ContentTypeText)
+	_, _ = w.Write([]byte(readme.Content))
+}
 
-	file.Download()
+// Readme serves the readme of the torrent, for API v1.
+func (h *ApiReadmeHandler) Readme(r *http.Request) (*apiResponse, error) {
+	infohash, err := requestInfohash(r)
+	if err != nil {
+		return nil, err
+	}
+	readme, err := h.readme(r.Context(), infohash)
+	if err != nil {
+		return nil, err
+	}
+	return &apiResponse{Data: readme}, nil
+}
 
-	reader := file.NewReader()
-	content := make([]byte, file.Length())
-	_, err = io.ReadFull(reader, content)
+// readme returns the readme of the torrent, fetching it from the swarm if it is not in the database
+// yet; the errors are *apiError, the swarm failing to serve it being a 504 Gateway Timeout, and the
+// readmes larger than metadata.MaxReadmeSize being not found (as they are not served).
+func (h *ApiReadmeHandler) readme(ctx context.Context, infohash []byte) (*persistence.Readme, error) {
+	readme, err := database.GetReadme(ctx, infohash)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, errorf(http.StatusInternalServerError, "GetReadme error %v", err)
+	} else if readme != nil {
+		return readme, nil
 	}
-	defer reader.Close()
 
-	if strings.HasSuffix(file.Path(), NfoSuffix) {
-		content, err = charmap.CodePage437.NewDecoder().Bytes(content)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	files, err := database.GetFiles(ctx, infohash)
+	if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "GetFiles error %v", err)
+	}
+	if !metadata.HasReadme(files) {
+		return nil, errorf(http.StatusNotFound, "the torrent has no readme")
 	}
 
-	// Because .nfo files are right padded with \x00'es.
-	content = bytes.TrimRight(content, "\x00")
+	fetchCtx, cancel := context.WithTimeout(ctx, metadata.ReadmeTimeout)
+	defer cancel()
+	readme, err = h.fetcher.Fetch(fetchCtx, infohash)
+	if errors.Is(err, metadata.ErrNoReadme) {
+		return nil, errorf(http.StatusNotFound, "the torrent has no readme")
+	} else if errors.Is(err, metadata.ErrReadmeTooLarge) {
+		return nil, errorf(http.StatusNotFound, "the readme of the torrent is larger than %d bytes, hence it is not served", metadata.MaxReadmeSize)
+	} else if err != nil {
+		return nil, errorf(http.StatusGatewayTimeout, "Could not fetch the readme of %x. %v", infohash, err)
+	}
 
-	w.Header().Set(ContentType, ContentTypeText)
-	_, _ = w.Write(content)
+	if err = database.SetReadme(ctx, infohash, *readme); err != nil {
+		log.Printf("SetReadme error %v", err)
+	}
+	return readme, nil
 }
 
 func apiTorrents(w http.ResponseWriter, r *http.Request) {
@@ -179,6 +212,8 @@ func apiTorrents(w http.ResponseWriter, r *http.Request) {
 		LastOrderedValue *float64 `schema:"lastOrderedValue"`
 		LastID           *uint64  `schema:"lastID"`
 		Limit            *uint    `schema:"limit"`
+		Category         *string  `schema:"category"`
+		Scope            *string  `schema:"scope"`
 	}
 	if err := decoder.Decode(&tq, r.URL.Query()); err != nil {
 		respondError(w, http.StatusBadRequest, "error while parsing the URL: %s", err.Error())
@@ -203,9 +238,15 @@ func apiTorrents(w http.ResponseWriter, r *http.Request) {
 		*tq.Ascending = true
 	}
 
+	query, err := persistence.ParseQuery(*tq.Query)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+
 	var orderBy persistence.OrderingCriteria
 	if tq.OrderBy == nil {
-		if *tq.Query == "" {
+		if !query.HasTerms() {
 			orderBy = persistence.ByDiscoveredOn
 		} else {
 			orderBy = persistence.ByRelevance
@@ -224,9 +265,30 @@ func apiTorrents(w http.ResponseWriter, r *http.Request) {
 		*tq.Limit = 20
 	}
 
+	var category *persistence.Category
+	if tq.Category != nil {
+		c, err := persistence.ParseCategory(*tq.Category)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		category = &c
+	}
+
+	scope := persistence.SearchNames
+	if tq.Scope != nil {
+		var err error
+		scope, err = parseSearchScope(*tq.Scope)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
 	torrents, err := database.QueryTorrents(
+		r.Context(),
 		*tq.Query, *tq.Epoch, orderBy,
-		*tq.Ascending, *tq.Limit, tq.LastOrderedValue, tq.LastID)
+		*tq.Ascending, *tq.Limit, tq.LastOrderedValue, tq.LastID, category, scope)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, "query error: %s", err.Error())
 		return
@@ -238,55 +300,352 @@ func apiTorrents(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func apiTorrent(w http.ResponseWriter, r *http.Request) {
-	infohashHex := mux.Vars(r)["infohash"]
-
-	infohash, err := hex.DecodeString(infohashHex)
+func apiTorrent(r *http.Request) (*apiResponse, error) {
+	infohash, err := requestInfohash(r)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "%s: %s", MsgCantDecode, err.Error())
-		return
+		return nil, err
 	}
 
-	torrentMetadata, err := database.GetTorrent(infohash)
+	torrentMetadata, err := database.GetTorrent(r.Context(), infohash)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "couldn't get torrent: %s", err.Error())
-		return
+		return nil, errorf(http.StatusInternalServerError, "couldn't get torrent: %s", err.Error())
 	} else if torrentMetadata == nil {
-		respondError(w, http.StatusNotFound, "Not found")
-		return
+		return nil, errorf(http.StatusNotFound, "Not found")
 	}
+	return &apiResponse{Data: torrentMetadata}, nil
+}
 
-	w.Header().Set(ContentType, ContentTypeJson)
-	if err = json.NewEncoder(w).Encode(torrentMetadata); err != nil {
-		log.Printf("%s %v", MsgJsonError, err)
+func apiFileList(r *http.Request) (*apiResponse, error) {
+	infohash, err := requestInfohash(r)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := database.GetFiles(r.Context(), infohash)
+	if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "couldn't get files: %s", err.Error())
+	} else if files == nil {
+		return nil, errorf(http.StatusNotFound, "not found")
 	}
+	return &apiResponse{Data: files}, nil
 }
 
-func apiFileList(w http.ResponseWriter, r *http.Request) {
-	infohashHex := mux.Vars(r)["infohash"]
+func apiSwarm(r *http.Request) (*apiResponse, error) {
+	infohash, err := requestInfohash(r)
+	if err != nil {
+		return nil, err
+	}
 
-	infohash, err := hex.DecodeString(infohashHex)
+	swarm, err := database.GetSwarm(r.Context(), infohash)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "%s: %s", MsgCantDecode, err.Error())
-		return
+		return nil, errorf(http.StatusInternalServerError, "couldn't get swarm: %s", err.Error())
+	} else if swarm == nil {
+		return nil, errorf(http.StatusNotFound, "not found")
 	}
+	return &apiResponse{Data: swarm}, nil
+}
 
-	files, err := database.GetFiles(infohash)
+func apiTags(r *http.Request) (*apiResponse, error) {
+	tags, err := database.GetTags(r.Context())
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "couldn't get files: %s", err.Error())
-		return
-	} else if files == nil {
-		respondError(w, http.StatusNotFound, "not found")
-		return
+		return nil, errorf(http.StatusInternalServerError, "couldn't get tags: %s", err.Error())
 	}
+	return &apiResponse{Data: tags}, nil
+}
 
-	w.Header().Set(ContentType, ContentTypeJson)
-	if err = json.NewEncoder(w).Encode(files); err != nil {
-		log.Printf("%s %v", MsgJsonError, err)
+// apiCuration serves the curation of the torrent, which PATCH requests modify first: their JSON body
+// holds the note to set and/or whether the torrent is to be starred, e.g. `{"starred": true}`.
+func apiCuration(r *http.Request) (*apiResponse, error) {
+	infohash, err := requestInfohash(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Method == http.MethodPatch {
+		var patch curationPatch
+		if err = decodeJSONBody(r, &patch); err != nil {
+			return nil, err
+		}
+		if patch.Note != nil && len(*patch.Note) > MaxNoteLength {
+			return nil, errorf(http.StatusBadRequest, "notes must be at most %d bytes long", MaxNoteLength)
+		}
+
+		if err = curate(r, infohash, func() error {
+			if patch.Note != nil {
+				if err := database.SetNote(r.Context(), infohash, *patch.Note); err != nil {
+					return errors.New("SetNote " + err.Error())
+				}
+			}
+			if patch.Starred != nil {
+				if err := database.SetStarred(r.Context(), infohash, *patch.Starred); err != nil {
+					return errors.New("SetStarred " + err.Error())
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return curationResponse(r, infohash)
+}
+
+// curationPatch is the body of the PATCH requests of apiCuration, whose nil fields are left as they
+// are.
+type curationPatch struct {
+	Note    *string `json:"note,omitempty"`
+	Starred *bool   `json:"starred,omitempty"`
+}
+
+// apiTag tags the torrent (PUT) or untags it (DELETE), and serves its curation.
+func apiTag(r *http.Request) (*apiResponse, error) {
+	infohash, err := requestInfohash(r)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := persistence.NormaliseTag(mux.Vars(r)["tag"])
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	if err = curate(r, infohash, func() error {
+		if r.Method == http.MethodDelete {
+			return database.RemoveTag(r.Context(), infohash, tag)
+		}
+		return database.AddTag(r.Context(), infohash, tag)
+	}); err != nil {
+		return nil, err
+	}
+
+	return curationResponse(r, infohash)
+}
+
+// curate calls fn to modify the curation of the torrent, if it exists.
+func curate(r *http.Request, infohash []byte, fn func() error) error {
+	// The curation methods do nothing if the torrent does not exist, which must be a 404 instead.
+	exists, err := database.DoesTorrentExist(r.Context(), infohash)
+	if err != nil {
+		return errorf(http.StatusInternalServerError, "couldn't get torrent: %s", err.Error())
+	} else if !exists {
+		return errorf(http.StatusNotFound, "not found")
+	}
+
+	if err = fn(); err != nil {
+		return errorf(http.StatusInternalServerError, "couldn't curate torrent: %s", err.Error())
+	}
+	return nil
+}
+
+func curationResponse(r *http.Request, infohash []byte) (*apiResponse, error) {
+	curation, err := database.GetCuration(r.Context(), infohash)
+	if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "couldn't get curation: %s", err.Error())
+	} else if curation == nil {
+		return nil, errorf(http.StatusNotFound, "not found")
+	}
+	return &apiResponse{Data: curation}, nil
+}
+
+// apiTokens serves the tokens of the user (both API tokens and sessions), or creates an API token on
+// POST requests, whose JSON body holds its name (e.g. `{"name": "backup script"}`); the secret of the
+// token is responded only then, as only its hash is stored.
+func apiTokens(r *http.Request) (*apiResponse, error) {
+	user := requestUser(r)
+	if user == nil {
+		return nil, errorf(http.StatusBadRequest, "there are no tokens when authorisation is disabled")
+	}
+
+	if r.Method == http.MethodPost {
+		var body tokenBody
+		if err := decodeJSONBody(r, &body); err != nil {
+			return nil, err
+		}
+		if len(body.Name) > MaxTokenNameLength {
+			return nil, errorf(http.StatusBadRequest, "names must be at most %d bytes long", MaxTokenNameLength)
+		}
+
+		token, secret, err := newToken(user.Name, body.Name, false, time.Now())
+		if err != nil {
+			return nil, errorf(http.StatusInternalServerError, "couldn't create token: %s", err.Error())
+		}
+		if err = database.AddToken(r.Context(), *token); err != nil {
+			return nil, errorf(http.StatusInternalServerError, "couldn't add token: %s", err.Error())
+		}
+		return &apiResponse{Status: http.StatusCreated, Data: &newTokenResponse{token, secret}}, nil
+	}
+
+	tokens, err := database.GetTokens(r.Context(), user.Name)
+	if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "couldn't get tokens: %s", err.Error())
 	}
+	return &apiResponse{Data: tokens}, nil
 }
 
-func apiStatistics(w http.ResponseWriter, r *http.Request) {
+// tokenBody is the body of the POST requests of apiTokens.
+type tokenBody struct {
+	Name string `json:"name"`
+}
+
+// newTokenResponse is a token just created by apiTokens, along with its secret.
+type newTokenResponse struct {
+	*persistence.Token
+	Secret string `json:"secret"`
+}
+
+// apiToken revokes a token of the user.
+func apiToken(r *http.Request) (*apiResponse, error) {
+	user := requestUser(r)
+	if user == nil {
+		return nil, errorf(http.StatusBadRequest, "there are no tokens when authorisation is disabled")
+	}
+
+	// The tokens of other users are not found, rather than forbidden, so as not to tell their IDs.
+	token, err := database.GetToken(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "couldn't get token: %s", err.Error())
+	} else if token == nil || token.User != user.Name {
+		return nil, errorf(http.StatusNotFound, "not found")
+	}
+
+	if _, err = database.DeleteToken(r.Context(), token.ID); err != nil {
+		return nil, errorf(http.StatusInternalServerError, "couldn't delete token: %s", err.Error())
+	}
+	return &apiResponse{Status: http.StatusNoContent}, nil
+}
+
+func apiUsers(r *http.Request) (*apiResponse, error) {
+	users, err := database.GetUsers(r.Context())
+	if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "couldn't get users: %s", err.Error())
+	}
+	return &apiResponse{Data: users}, nil
+}
+
+// apiUser adds or modifies a user (PUT), whose JSON body holds its role and its password, either of
+// which may be left out to keep the current one (e.g. `{"role": "curator"}`, new users being viewers
+// by default), or deletes it (DELETE) along with its tokens. Changing the password of a user revokes
+// its tokens, and the last admin can be neither demoted nor deleted.
+func apiUser(r *http.Request) (*apiResponse, error) {
+	name := mux.Vars(r)["name"]
+	if err := persistence.ValidateUserName(name); err != nil {
+		return nil, errorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	if r.Method == http.MethodDelete {
+		if current := requestUser(r); current != nil && current.Name == name {
+			return nil, errorf(http.StatusBadRequest, "you cannot delete yourself")
+		}
+		if err := checkNotLastAdmin(r.Context(), name); err != nil {
+			return nil, err
+		}
+		deleted, err := database.DeleteUser(r.Context(), name)
+		if err != nil {
+			return nil, errorf(http.StatusInternalServerError, "couldn't delete user: %s", err.Error())
+		} else if !deleted {
+			return nil, errorf(http.StatusNotFound, "not found")
+		}
+		return &apiResponse{Status: http.StatusNoContent}, nil
+	}
+
+	var body userBody
+	if err := decodeJSONBody(r, &body); err != nil {
+		return nil, err
+	}
+
+	user, err := database.GetUser(r.Context(), name)
+	if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "couldn't get user: %s", err.Error())
+	}
+	existed := user != nil
+	if !existed {
+		user = &persistence.User{Name: name}
+	}
+	if body.Role != nil {
+		if user.Role == persistence.Admin && *body.Role != persistence.Admin {
+			if err = checkNotLastAdmin(r.Context(), name); err != nil {
+				return nil, err
+			}
+		}
+		user.Role = *body.Role
+	}
+	if body.Password != nil {
+		if user.PasswordHash, err = hashPassword(*body.Password); err != nil {
+			return nil, errorf(http.StatusBadRequest, "%s", err.Error())
+		}
+	} else if user.PasswordHash == nil {
+		return nil, errorf(http.StatusBadRequest, "the password of new users is required")
+	}
+
+	if err = database.SetUser(r.Context(), *user); err != nil {
+		return nil, errorf(http.StatusInternalServerError, "couldn't set user: %s", err.Error())
+	}
+	// The sessions and the API tokens of the old password are not to outlive it.
+	if existed && body.Password != nil {
+		tokens, err := database.GetTokens(r.Context(), name)
+		if err != nil {
+			return nil, errorf(http.StatusInternalServerError, "couldn't get tokens: %s", err.Error())
+		}
+		for _, token := range tokens {
+			if _, err = database.DeleteToken(r.Context(), token.ID); err != nil {
+				return nil, errorf(http.StatusInternalServerError, "couldn't delete token: %s", err.Error())
+			}
+		}
+	}
+	return &apiResponse{Data: user}, nil
+}
+
+// checkNotLastAdmin returns an error if the user of the given name is the only admin, who is then
+// not to be demoted or deleted lest nobody could manage the users through magneticow anymore.
+func checkNotLastAdmin(ctx context.Context, name string) error {
+	users, err := database.GetUsers(ctx)
+	if err != nil {
+		return errorf(http.StatusInternalServerError, "couldn't get users: %s", err.Error())
+	}
+	isAdmin, nAdmins := false, 0
+	for _, user := range users {
+		if user.Role == persistence.Admin {
+			isAdmin = isAdmin || user.Name == name
+			nAdmins++
+		}
+	}
+	if isAdmin && nAdmins == 1 {
+		return errorf(http.StatusConflict, "%s is the last admin", name)
+	}
+	return nil
+}
+
+// userBody is the body of the PUT requests of apiUser, whose nil fields are left as they are.
+type userBody struct {
+	Password *string           `json:"password,omitempty"`
+	Role     *persistence.Role `json:"role,omitempty"`
+}
+
+// decodeJSONBody decodes the JSON body of the request into v.
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	if !strings.HasPrefix(r.Header.Get(ContentType), "application/json") {
+		return errorf(http.StatusUnsupportedMediaType, "the body must be JSON")
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return errorf(http.StatusBadRequest, "couldn't decode the body: %s", err.Error())
+	}
+	return nil
+}
+
+func hashPassword(password string) ([]byte, error) {
+	if len(password) < MinPasswordLength {
+		return nil, fmt.Errorf("passwords must be at least %d bytes long", MinPasswordLength)
+	}
+	// bcrypt rejects the passwords longer than 72 bytes.
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+func apiStatistics(r *http.Request) (*apiResponse, error) {
 	from := r.URL.Query().Get("from")
 
 	var n int64
@@ -297,26 +656,32 @@ func apiStatistics(w http.ResponseWriter, r *http.Request) {
 		var err error
 		n, err = strconv.ParseInt(nStr, 10, 32)
 		if err != nil {
-			respondError(w, http.StatusBadRequest, "couldn't parse n: %s", err.Error())
-			return
+			return nil, errorf(http.StatusBadRequest, "couldn't parse n: %s", err.Error())
 		} else if n <= 0 {
-			respondError(w, http.StatusBadRequest, "n must be a positive number")
-			return
+			return nil, errorf(http.StatusBadRequest, "n must be a positive number")
 		}
 	}
 
-	stats, err := database.GetStatistics(from, uint(n))
+	stats, err := database.GetStatistics(r.Context(), from, uint(n))
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "error while getting statistics: %s", err.Error())
-		return
+		return nil, errorf(http.StatusBadRequest, "error while getting statistics: %s", err.Error())
 	}
+	return &apiResponse{Data: stats}, nil
+}
 
-	w.Header().Set(ContentType, ContentTypeJson)
-	if err = json.NewEncoder(w).Encode(stats); err != nil {
-		log.Printf("%s %v", MsgJsonError, err)
+// requestInfohash returns the infohash of the torrent that the request is about.
+func requestInfohash(r *http.Request) ([]byte, error) {
+	infohash, err := hex.DecodeString(mux.Vars(r)["infohash"])
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "%s: %s", MsgCantDecode, err.Error())
 	}
+	return infohash, nil
 }
 
+// orderByNames are the names of the orderings that the databases support, among those that
+// parseOrderBy parses: the others are not recorded, hence QueryTorrents rejects them.
+var orderByNames = []string{"RELEVANCE", "TOTAL_SIZE", "DISCOVERED_ON", "N_FILES"}
+
 func parseOrderBy(s string) (persistence.OrderingCriteria, error) {
 	switch s {
 	case "RELEVANCE":
@@ -344,3 +709,22 @@ func parseOrderBy(s string) (persistence.OrderingCriteria, error) {
 		return persistence.ByDiscoveredOn, fmt.Errorf("unknown orderBy string: %s", s)
 	}
 }
+
+// searchScopeNames are the names of the scopes that parseSearchScope parses.
+var searchScopeNames = []string{"NAMES", "FILES", "NAMES_AND_FILES"}
+
+func parseSearchScope(s string) (persistence.SearchScope, error) {
+	switch s {
+	case "NAMES":
+		return persistence.SearchNames, nil
+
+	case "FILES":
+		return persistence.SearchFiles, nil
+
+	case "NAMES_AND_FILES":
+		return persistence.SearchNamesAndFiles, nil
+
+	default:
+		return persistence.SearchNames, fmt.Errorf("unknown scope string: %s", s)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tgragnato/magnetico/metadata"
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+const (
+	// APIV1Prefix is the prefix of the paths of API v1.
+	APIV1Prefix = "/api/v1"
+	// DefaultPageSize is the number of torrents in a page of API v1, unless the limit is supplied.
+	DefaultPageSize = 20
+	// MaxPageSize is the maximum number of torrents in a page of API v1.
+	MaxPageSize = 100
+)
+
+// apiMeta is about the data of a response of API v1, such as which page of a list it is.
+type apiMeta struct {
+	// NextCursor is the cursor of the next page, or empty if this page is the last one.
+	NextCursor string `json:"nextCursor,omitempty"`
+	// EstimatedTotal is an estimate of the number of items across all the pages, as of the first one.
+	EstimatedTotal uint `json:"estimatedTotal"`
+	// ExactTotal is whether EstimatedTotal is exact rather than an estimate.
+	ExactTotal bool `json:"exactTotal"`
+}
+
+// v1Envelope is the body of the successful responses of API v1.
+type v1Envelope struct {
+	Data interface{} `json:"data"`
+	Meta *apiMeta    `json:"meta,omitempty"`
+}
+
+// v1ErrorBody is the body of the error responses of API v1, e.g.
+//
+//	{"error": {"status": 404, "code": "not_found", "message": "not found"}}
+type v1ErrorBody struct {
+	Error v1Error `json:"error"`
+}
+
+type v1Error struct {
+	// Status is the status code of the response.
+	Status int `json:"status"`
+	// Code is the status text in snake case (e.g. "bad_request"), for the clients to switch on.
+	Code string `json:"code"`
+	// Message is meant for the users.
+	Message string `json:"message"`
+}
+
+// apiV1 adapts the handler to API v1, which responds the data in an envelope (see v1Envelope), and
+// the errors as JSON objects (see v1ErrorBody).
+func apiV1(handler apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodySize)
+		response, err := handler(r)
+		if err != nil {
+			status, message := errorStatus(err)
+			if status >= http.StatusInternalServerError {
+				log.Printf("API error %d %s", status, message)
+			}
+			respondV1Error(w, status, message)
+			return
+		}
+		if response.Data == nil {
+			w.WriteHeader(response.status())
+			return
+		}
+
+		// Empty lists are responded as such, rather than as null.
+		data := response.Data
+		if value := reflect.ValueOf(data); value.Kind() == reflect.Slice && value.IsNil() {
+			data = reflect.MakeSlice(value.Type(), 0, 0).Interface()
+		}
+		respondJSON(w, response.status(), &v1Envelope{Data: data, Meta: response.Meta})
+	}
+}
+
+// respondV1Error responds the error object, whose message is the status text for server errors
+// (5xx) so as not to disclose their details.
+func respondV1Error(w http.ResponseWriter, statusCode int, message string) {
+	if statusCode >= http.StatusInternalServerError {
+		message = http.StatusText(statusCode)
+	}
+	respondJSON(w, statusCode, &v1ErrorBody{Error: v1Error{
+		Status:  statusCode,
+		Code:    strings.ToLower(strings.ReplaceAll(http.StatusText(statusCode), " ", "_")),
+		Message: message,
+	}})
+}
+
+// respondAPIError responds an error of the request outside of its handler (e.g. of authorisation),
+// as an error object for API v1 and as plain text otherwise.
+func respondAPIError(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
+	if strings.HasPrefix(r.URL.Path, APIV1Prefix+"/") {
+		respondV1Error(w, statusCode, strings.TrimSpace(message))
+		return
+	}
+	respondError(w, statusCode, "%s", message)
+}
+
+// notFoundHandler and methodNotAllowedHandler respond the requests that are not routed, as error
+// objects for API v1 and as the router does otherwise.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, APIV1Prefix+"/") {
+		respondV1Error(w, http.StatusNotFound, "not found")
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, APIV1Prefix+"/") {
+		respondV1Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// apiEndpoint is an endpoint of API v1, which is both routed and documented (see openAPIDocument)
+// from the table of apiV1Endpoints.
+type apiEndpoint struct {
+	Method string
+	// Path is the path template of the route, relative to APIV1Prefix.
+	Path string
+	// Role is the role that the user must have at least.
+	Role    persistence.Role
+	Handler apiHandler
+	Summary string
+	// Parameters are the parameters of the query string; those of the path are its variables.
+	Parameters []apiParameter
+	// Body is a value of the type of the JSON body of the requests, or nil if there is none.
+	Body interface{}
+	// Status is the status code of the successful responses, or zero for 200 OK.
+	Status int
+	// Data is a value of the type of the data of the successful responses, or nil if they have no
+	// body.
+	Data interface{}
+	// Paged is whether the data is a page of a list, along with meta (see apiMeta).
+	Paged bool
+	// Errors describe the error responses particular to the endpoint, by their status codes.
+	Errors map[int]string
+}
+
+type apiParameter struct {
+	Name        string
+	Description string
+	// Value is a value of the type of the parameter, from which its schema is derived.
+	Value interface{}
+	// Enum are the values the parameter can take, if it is a string.
+	Enum []string
+}
+
+// apiV1Endpoints returns the endpoints of API v1, the readmes being served by the readmeHandler.
+func apiV1Endpoints(readmeHandler *ApiReadmeHandler) []apiEndpoint {
+	const torrent = "/torrents/{infohash:[a-f0-9]{40}}"
+	return []apiEndpoint{
+		{
+			Method: http.MethodGet, Path: "/torrents", Handler: apiV1Torrents,
+			Summary: "Search the torrents",
+			Parameters: []apiParameter{
+				{Name: "query", Value: "", Description: "The search query; all the torrents match the empty query."},
+				{Name: "orderBy", Value: "", Enum: orderByNames, Description: "What the torrents are ordered by; RELEVANCE if there is a query, DISCOVERED_ON otherwise."},
+				{Name: "ascending", Value: false, Description: "Whether the torrents are in ascending order; true by default."},
+				{Name: "limit", Value: uint(0), Description: fmt.Sprintf("The number of torrents in the page, from 1 to %d; %d by default.", MaxPageSize, DefaultPageSize)},
+				{Name: "category", Value: persistence.Category(0), Description: "The category of the torrents."},
+				{Name: "scope", Value: "", Enum: searchScopeNames, Description: "What the query searches; NAMES by default."},
+				{Name: "cursor", Value: "", Description: "The nextCursor of the previous page, whose search parameters must be supplied unchanged."},
+			},
+			Data: []persistence.TorrentMetadata{}, Paged: true,
+		},
+		{
+			Method: http.MethodGet, Path: torrent, Handler: apiTorrent,
+			Summary: "Get a torrent", Data: persistence.TorrentMetadata{},
+		},
+		{
+			Method: http.MethodGet, Path: torrent + "/files", Handler: apiFileList,
+			Summary: "Get the files of a torrent", Data: []persistence.File{},
+		},
+		{
+			Method: http.MethodGet, Path: torrent + "/swarm", Handler: apiSwarm,
+			Summary: "Get the swarm of a torrent", Data: persistence.Swarm{},
+		},
+		{
+			Method: http.MethodGet, Path: torrent + "/readme", Handler: readmeHandler.Readme,
+			Summary: "Get the readme of a torrent, fetching it from its swarm if need be", Data: persistence.Readme{},
+			Errors: map[int]string{
+				http.StatusNotFound:       fmt.Sprintf("The torrent does not exist, it has no readme, or its readme is larger than %d bytes.", metadata.MaxReadmeSize),
+				http.StatusGatewayTimeout: "The swarm of the torrent did not serve its readme in time.",
+			},
+		},
+		{
+			Method: http.MethodGet, Path: torrent + "/curation", Handler: apiCuration,
+			Summary: "Get the curation of a torrent", Data: persistence.Curation{},
+		},
+		{
+			Method: http.MethodPatch, Path: torrent + "/curation", Role: persistence.Curator, Handler: apiCuration,
+			Summary: "Set the note of a torrent and/or whether it is starred", Body: curationPatch{}, Data: persistence.Curation{},
+		},
+		{
+			Method: http.MethodPut, Path: torrent + "/tags/{tag}", Role: persistence.Curator, Handler: apiTag,
+			Summary: "Tag a torrent", Data: persistence.Curation{},
+		},
+		{
+			Method: http.MethodDelete, Path: torrent + "/tags/{tag}", Role: persistence.Curator, Handler: apiTag,
+			Summary: "Untag a torrent", Data: persistence.Curation{},
+		},
+		{
+			Method: http.MethodGet, Path: "/tags", Handler: apiTags,
+			Summary: "List the tags", Data: []persistence.Tag{},
+		},
+		{
+			Method: http.MethodGet, Path: "/statistics", Handler: apiStatistics,
+			Summary: "Get the statistics of the torrents discovered",
+			Parameters: []apiParameter{
+				{Name: "from", Value: "", Description: "The first year (e.g. 2024), month (2024-06), week (2024-W22), day (2024-06-01) or hour (2024-06-01T12) of the statistics, whose format sets their period."},
+				{Name: "n", Value: uint(0), Description: "The number of periods."},
+			},
+			Data: persistence.Statistics{},
+		},
+		{
+			Method: http.MethodGet, Path: "/tokens", Handler: apiTokens,
+			Summary: "List the tokens of the user, including their sessions", Data: []persistence.Token{},
+		},
+		{
+			Method: http.MethodPost, Path: "/tokens", Handler: apiTokens,
+			Summary: "Create an API token, whose secret is responded only once", Body: tokenBody{},
+			Status: http.StatusCreated, Data: newTokenResponse{},
+		},
+		{
+			Method: http.MethodDelete, Path: "/tokens/{id:[a-f0-9]+}", Handler: apiToken,
+			Summary: "Revoke a token of the user", Status: http.StatusNoContent,
+		},
+		{
+			Method: http.MethodGet, Path: "/users", Role: persistence.Admin, Handler: apiUsers,
+			Summary: "List the users", Data: []persistence.User{},
+		},
+		{
+			Method: http.MethodPut, Path: "/users/{name}", Role: persistence.Admin, Handler: apiUser,
+			Summary: "Add or modify a user, the password of new users being required", Body: userBody{}, Data: persistence.User{},
+		},
+		{
+			Method: http.MethodDelete, Path: "/users/{name}", Role: persistence.Admin, Handler: apiUser,
+			Summary: "Delete a user along with their tokens", Status: http.StatusNoContent,
+		},
+	}
+}
+
+// routeAPIV1 adds the routes of the endpoints of API v1 to the router, along with that of their
+// OpenAPI document (which is public).
+func routeAPIV1(router *mux.Router, endpoints []apiEndpoint) {
+	document, err := json.Marshal(openAPIDocument(endpoints))
+	if err != nil {
+		log.Panicf("Could NOT encode the OpenAPI document! THIS IS A BUG, PLEASE REPORT. %v", err)
+	}
+	router.HandleFunc(APIV1Prefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ContentType, ContentTypeJson)
+		_, _ = w.Write(document)
+	}).Methods(http.MethodGet).Name("openapi")
+
+	for _, endpoint := range endpoints {
+		router.HandleFunc(APIV1Prefix+endpoint.Path,
+			authorise(endpoint.Role, apiV1(endpoint.Handler))).Methods(endpoint.Method)
+	}
+}
+
+// torrentsCursor is where a page of apiV1Torrents ends and the next one starts. It is handed to the
+// clients as an opaque string (see String), so that they need not know how the torrents are ordered.
+type torrentsCursor struct {
+	// Epoch is that of the first page, so that the pages are of the same torrents.
+	Epoch int64 `json:"e"`
+	// Search is the hash of the search parameters, which must be the same for all the pages.
+	Search           uint64  `json:"s"`
+	LastOrderedValue float64 `json:"v"`
+	LastID           uint64  `json:"i"`
+	// EstimatedTotal and ExactTotal are those of the first page (see apiMeta), which the next pages
+	// respond as well rather than estimating the number of torrents again.
+	EstimatedTotal uint `json:"t"`
+	ExactTotal     bool `json:"x"`
+}
+
+func (c *torrentsCursor) String() string {
+	data, _ := json.Marshal(c) // cannot fail
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseTorrentsCursor(s string) (*torrentsCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	cursor := new(torrentsCursor)
+	if err = json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// apiV1Torrents serves a page of the torrents that match the search, along with an estimate of how
+// many do, made for the first page only. Unlike API v0.1, the next page is requested with the cursor
+// of the previous one.
+func apiV1Torrents(r *http.Request) (*apiResponse, error) {
+	var tq struct {
+		Query     string  `schema:"query"`
+		OrderBy   *string `schema:"orderBy"`
+		Ascending *bool   `schema:"ascending"`
+		Limit     *uint   `schema:"limit"`
+		Category  *string `schema:"category"`
+		Scope     *string `schema:"scope"`
+		Cursor    string  `schema:"cursor"`
+	}
+	if err := decoder.Decode(&tq, r.URL.Query()); err != nil {
+		return nil, errorf(http.StatusBadRequest, "error while parsing the URL: %s", err.Error())
+	}
+
+	query, err := persistence.ParseQuery(tq.Query)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	orderBy := persistence.ByDiscoveredOn
+	if tq.OrderBy != nil {
+		if orderBy, err = parseOrderBy(*tq.OrderBy); err != nil {
+			return nil, errorf(http.StatusBadRequest, "%s", err.Error())
+		}
+	} else if query.HasTerms() {
+		orderBy = persistence.ByRelevance
+	}
+
+	ascending := true
+	if tq.Ascending != nil {
+		ascending = *tq.Ascending
+	}
+
+	limit := uint(DefaultPageSize)
+	if tq.Limit != nil {
+		if *tq.Limit == 0 || *tq.Limit > MaxPageSize {
+			return nil, errorf(http.StatusBadRequest, "limit must be from 1 to %d", MaxPageSize)
+		}
+		limit = *tq.Limit
+	}
+
+	var category *persistence.Category
+	if tq.Category != nil {
+		c, err := persistence.ParseCategory(*tq.Category)
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "%s", err.Error())
+		}
+		category = &c
+	}
+
+	scope := persistence.SearchNames
+	if tq.Scope != nil {
+		if scope, err = parseSearchScope(*tq.Scope); err != nil {
+			return nil, errorf(http.StatusBadRequest, "%s", err.Error())
+		}
+	}
+
+	search := fnv.New64a()
+	_, _ = fmt.Fprintf(search, "%s\x00%d\x00%t\x00%d", tq.Query, orderBy, ascending, scope)
+	if category != nil {
+		_, _ = fmt.Fprintf(search, "\x00%s", category)
+	}
+
+	cursor := &torrentsCursor{Epoch: time.Now().Unix(), Search: search.Sum64()}
+	var lastOrderedValue *float64
+	var lastID *uint64
+	if tq.Cursor != "" {
+		if cursor, err = parseTorrentsCursor(tq.Cursor); err != nil {
+			return nil, errorf(http.StatusBadRequest, "invalid cursor")
+		} else if cursor.Search != search.Sum64() {
+			return nil, errorf(http.StatusBadRequest, "the cursor is of another search; its parameters must not change across its pages")
+		}
+		lastOrderedValue, lastID = &cursor.LastOrderedValue, &cursor.LastID
+	}
+
+	torrents, err := database.QueryTorrents(
+		r.Context(),
+		tq.Query, cursor.Epoch, orderBy,
+		ascending, limit, lastOrderedValue, lastID, category, scope)
+	var queryError *persistence.QueryError
+	var searchError *persistence.SearchError
+	if errors.As(err, &queryError) || errors.As(err, &searchError) {
+		return nil, errorf(http.StatusBadRequest, "%s", err.Error())
+	} else if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "query error: %s", err.Error())
+	}
+
+	if tq.Cursor == "" {
+		cursor.EstimatedTotal, cursor.ExactTotal, err = persistence.EstimateNumberOfTorrents(
+			r.Context(), database, tq.Query, cursor.Epoch, category, scope)
+		if err != nil {
+			return nil, errorf(http.StatusInternalServerError, "couldn't estimate the number of torrents: %s", err.Error())
+		}
+	}
+
+	meta := &apiMeta{EstimatedTotal: cursor.EstimatedTotal, ExactTotal: cursor.ExactTotal}
+	if uint(len(torrents)) == limit {
+		last := &torrents[len(torrents)-1]
+		cursor.LastOrderedValue, cursor.LastID = last.OrderedValue(orderBy), last.ID
+		meta.NextCursor = cursor.String()
+	}
+
+	return &apiResponse{Data: torrents, Meta: meta}, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+// serveV1 serves the request to API v1 as the user, and decodes the body of the response into v
+// unless it is nil.
+func serveV1(t *testing.T, router http.Handler, method string, path string, user string, v interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, APIV1Prefix+path, nil)
+	if user != "" {
+		r.SetBasicAuth(user, user+"-password")
+	}
+	w := serve(router, r)
+	if v != nil {
+		if got := w.Header().Get(ContentType); got != ContentTypeJson {
+			t.Fatalf("%s %s: Content-Type = %q, want %q", method, path, got, ContentTypeJson)
+		}
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: Decode() error = %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAPIV1Envelope(t *testing.T) {
+	router := setUpAuth(t)
+
+	var torrent struct {
+		Data persistence.TorrentMetadata `json:"data"`
+		Meta *apiMeta                    `json:"meta"`
+	}
+	if code := serveV1(t, router, http.MethodGet, "/torrents/"+testInfoHash, "vera", &torrent); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if torrent.Data.Name != "ubuntu" || torrent.Meta != nil {
+		t.Errorf("torrent = %+v, want the data of ubuntu without meta", torrent)
+	}
+
+	// Empty lists are not null.
+	var tags map[string]json.RawMessage
+	if code := serveV1(t, router, http.MethodGet, "/tags", "vera", &tags); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if got := string(tags["data"]); got != "[]" {
+		t.Errorf("data = %s, want []", got)
+	}
+
+	// API v0.1 responds the bare data still.
+	r := httptest.NewRequest(http.MethodGet, "/api/v0.1/torrents/"+testInfoHash, nil)
+	r.SetBasicAuth("vera", "vera-password")
+	var bare persistence.TorrentMetadata
+	if err := json.NewDecoder(serve(router, r).Body).Decode(&bare); err != nil || bare.Name != "ubuntu" {
+		t.Errorf("v0.1 torrent = %+v, %v, want ubuntu", bare, err)
+	}
+}
+
+func TestAPIV1Errors(t *testing.T) {
+	router := setUpAuth(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		user   string
+		want   int
+		code   string
+	}{
+		{"Unauthenticated", http.MethodGet, "/tags", "", http.StatusUnauthorized, "unauthorized"},
+		{"Forbidden", http.MethodPut, "/torrents/" + testInfoHash + "/tags/linux", "vera", http.StatusForbidden, "forbidden"},
+		{"Not Found", http.MethodGet, "/torrents/" + strings.Repeat("0", 40), "vera", http.StatusNotFound, "not_found"},
+		{"Unknown Path", http.MethodGet, "/nothing", "vera", http.StatusNotFound, "not_found"},
+		{"Method Not Allowed", http.MethodPost, "/tags", "vera", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"Bad Limit", http.MethodGet, "/torrents?limit=1000", "vera", http.StatusBadRequest, "bad_request"},
+		{"Bad Query", http.MethodGet, "/torrents?query=" + url.QueryEscape(`"ubuntu`), "vera", http.StatusBadRequest, "bad_request"},
+		{"Bad Cursor", http.MethodGet, "/torrents?cursor=nonsense", "vera", http.StatusBadRequest, "bad_request"},
+		{"Unrecorded Order", http.MethodGet, "/torrents?orderBy=N_SEEDERS", "vera", http.StatusBadRequest, "bad_request"},
+		{"Relevance Without Terms", http.MethodGet, "/torrents?orderBy=RELEVANCE", "vera", http.StatusBadRequest, "bad_request"},
+		{"Files Not Indexed", http.MethodGet, "/torrents?query=ubuntu&scope=FILES", "vera", http.StatusBadRequest, "bad_request"},
+		{"No Body", http.MethodPost, "/tokens", "vera", http.StatusUnsupportedMediaType, "unsupported_media_type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body v1ErrorBody
+			if code := serveV1(t, router, tt.method, tt.path, tt.user, &body); code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+			if body.Error.Status != tt.want || body.Error.Code != tt.code || body.Error.Message == "" {
+				t.Errorf("error = %+v, want status %d and code %s", body.Error, tt.want, tt.code)
+			}
+		})
+	}
+
+	// API v0.1 responds its errors as plain text still.
+	w := serve(router, httptest.NewRequest(http.MethodGet, "/api/v0.1/tags", nil))
+	if w.Code != http.StatusUnauthorized || w.Body.String() != "Unauthorised.\n" {
+		t.Errorf("v0.1 error = %d %q, want %d %q", w.Code, w.Body.String(), http.StatusUnauthorized, "Unauthorised.\n")
+	}
+}
+
+func TestAPIV1Torrents(t *testing.T) {
+	router := setUpAuth(t)
+	for i := 0; i < 5; i++ {
+		infoHash := []byte(fmt.Sprintf("linux-%014d", i))
+		if err := database.AddNewTorrent(context.Background(), infoHash, fmt.Sprintf("linux %d", i), []persistence.File{{Size: 1, Path: "linux.iso"}}, persistence.Software); err != nil {
+			t.Fatalf("AddNewTorrent() error = %v", err)
+		}
+	}
+
+	type page struct {
+		Data []persistence.TorrentMetadata `json:"data"`
+		Meta apiMeta                       `json:"meta"`
+	}
+	seen := make(map[uint64]bool)
+	cursor, pages := "", 0
+	for {
+		path := "/torrents?query=linux&limit=2"
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		var p page
+		if code := serveV1(t, router, http.MethodGet, path, "vera", &p); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if p.Meta.EstimatedTotal != 5 || !p.Meta.ExactTotal {
+			t.Errorf("meta = %+v, want an exact total of 5", p.Meta)
+		}
+		for _, torrent := range p.Data {
+			if seen[torrent.ID] {
+				t.Errorf("torrent %d is on several pages", torrent.ID)
+			}
+			seen[torrent.ID] = true
+		}
+
+		if pages++; p.Meta.NextCursor == "" || pages > 5 {
+			break
+		}
+		cursor = p.Meta.NextCursor
+	}
+	if len(seen) != 5 || pages != 3 {
+		t.Errorf("got %d torrents in %d pages, want 5 in 3", len(seen), pages)
+	}
+
+	// The next pages respond the estimate of the first one rather than estimating again.
+	first, err := parseTorrentsCursor(cursor)
+	if err != nil {
+		t.Fatalf("parseTorrentsCursor() error = %v", err)
+	}
+	first.EstimatedTotal, first.ExactTotal = 42, false
+	var p page
+	if code := serveV1(t, router, http.MethodGet, "/torrents?query=linux&limit=2&cursor="+url.QueryEscape(first.String()), "vera", &p); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	} else if p.Meta.EstimatedTotal != 42 || p.Meta.ExactTotal {
+		t.Errorf("meta of the next page = %+v, want the estimate of the cursor", p.Meta)
+	}
+
+	// The cursors are of their search only.
+	var body v1ErrorBody
+	path := "/torrents?query=ubuntu&limit=2&cursor=" + url.QueryEscape(cursor)
+	if code := serveV1(t, router, http.MethodGet, path, "vera", &body); code != http.StatusBadRequest {
+		t.Errorf("status with the cursor of another search = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	router := setUpAuth(t)
+
+	// The document is public.
+	var document map[string]interface{}
+	if code := serveV1(t, router, http.MethodGet, "/openapi.json", "", &document); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if version, _ := document["openapi"].(string); !strings.HasPrefix(version, "3.") {
+		t.Errorf("openapi = %q, want 3.x", version)
+	}
+
+	paths, _ := document["paths"].(map[string]interface{})
+	for _, endpoint := range apiV1Endpoints(&ApiReadmeHandler{}) {
+		path, _ := openAPIPath(endpoint.Path)
+		operations, _ := paths[path].(map[string]interface{})
+		if _, found := operations[strings.ToLower(endpoint.Method)]; !found {
+			t.Errorf("%s %s is not documented", endpoint.Method, path)
+		}
+	}
+	if _, found := paths["/torrents/{infohash}/tags/{tag}"]; !found {
+		t.Errorf("paths = %v, want /torrents/{infohash}/tags/{tag}", paths)
+	}
+	readme, _ := paths["/torrents/{infohash}/readme"].(map[string]interface{})
+	get, _ := readme["get"].(map[string]interface{})
+	if responses, _ := get["responses"].(map[string]interface{}); responses["404"] == nil {
+		t.Errorf("responses of the readme = %v, want 404 documented", responses)
+	}
+
+	// All the references resolve.
+	components, _ := document["components"].(map[string]interface{})
+	var check func(v interface{})
+	check = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, found := v["$ref"].(string); found {
+				parts := strings.Split(strings.TrimPrefix(ref, "#/components/"), "/")
+				if kind, _ := components[parts[0]].(map[string]interface{}); len(parts) != 2 || kind[parts[1]] == nil {
+					t.Errorf("$ref %s does not resolve", ref)
+				}
+			}
+			for _, value := range v {
+				check(value)
+			}
+		case []interface{}:
+			for _, value := range v {
+				check(value)
+			}
+		}
+	}
+	check(document)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/tgragnato/magnetico/persistence"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// SessionCookie is the name of the cookie holding the session of the web interface.
+	SessionCookie = "magneticow_session"
+	// SessionLifetime is how long the sessions of the web interface last after logging in.
+	SessionLifetime = 30 * 24 * time.Hour
+	// MinPasswordLength is the minimum length of the passwords of the users, in bytes.
+	MinPasswordLength = 8
+	// MaxTokenNameLength is the maximum length of the names of the API tokens, in bytes.
+	MaxTokenNameLength = 100
+)
+
+// publicRoutes are the names of the routes that are served without authenticating the requests.
+var publicRoutes = map[string]bool{
+	"login":   true,
+	"openapi": true,
+	"static":  true,
+}
+
+// dummyPasswordHash is the password hash checked against when logging in as a missing user.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("magneticow"), bcrypt.DefaultCost)
+
+type userKey struct{}
+
+// authenticate is the middleware of all the routes, which authenticates the requests by
+//
+//   - a bearer API token (e.g. `Authorization: Bearer <token>`), or the `apikey` parameter of the
+//     Torznab API, which Torznab clients supply instead (see torznabHandler),
+//   - HTTP basic auth, with the name and the password of the user,
+//   - or the session cookie of the web interface, see loginHandler;
+//
+// and lets only those of known users through, except for the public routes. The user is stored in
+// the context of the request, see requestUser. Whether the user is allowed to do what is requested
+// is up to the handlers, see authorise.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.NoAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := authenticateRequest(r)
+		if err != nil {
+			log.Printf("Could not authenticate the request. %v", err)
+			respondAPIError(w, r, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		if user != nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+			return
+		}
+
+		if route := mux.CurrentRoute(r); route != nil && publicRoutes[route.GetName()] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		unauthenticated(w, r)
+	})
+}
+
+// authenticateRequest returns the user whose credentials the request holds, or nil if there are
+// none or they are not valid.
+func authenticateRequest(r *http.Request) (*persistence.User, error) {
+	if apiKey := r.URL.Query().Get("apikey"); apiKey != "" && strings.HasPrefix(r.URL.Path, "/torznab/") {
+		return tokenUser(r.Context(), apiKey, false)
+	}
+
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		if secret, found := strings.CutPrefix(authorization, "Bearer "); found {
+			return tokenUser(r.Context(), secret, false)
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return nil, nil
+		}
+		user, err := database.GetUser(r.Context(), username)
+		if err != nil {
+			return nil, errors.New("GetUser " + err.Error())
+		} else if user == nil {
+			return nil, nil
+		}
+		if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) != nil {
+			return nil, nil
+		}
+		return user, nil
+	}
+
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		return tokenUser(r.Context(), cookie.Value, true)
+	}
+	return nil, nil
+}
+
+// importCredentials adds the users of the credentials file that magneticow used to read before it
+// had users of its own as curators, who could tag and annotate the torrents, but not those who
+// exist already lest their passwords or roles changed since be reverted on every start.
+func importCredentials(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	users, err := persistence.ReadCredentials(file, persistence.Curator)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, user := range users {
+		if existing, err := database.GetUser(ctx, user.Name); err != nil {
+			return errors.New("GetUser " + err.Error())
+		} else if existing != nil {
+			continue
+		}
+		if err = database.SetUser(ctx, user); err != nil {
+			return errors.New("SetUser " + err.Error())
+		}
+		n++
+	}
+	log.Printf("Imported %d new user(s) as %s from %s", n, persistence.Curator, path)
+	return nil
+}
+
+// tokenUser returns the user of the token, or nil if the token is not valid: tokens consist of
+// their ID and their secret, separated by a dot, and sessions are not API tokens (nor vice versa).
+func tokenUser(ctx context.Context, secret string, session bool) (*persistence.User, error) {
+	id, secret, found := strings.Cut(secret, ".")
+	if !found {
+		return nil, nil
+	}
+
+	token, err := database.GetToken(ctx, id)
+	if err != nil {
+		return nil, errors.New("GetToken " + err.Error())
+	} else if token == nil || token.Session != session || token.Expired(time.Now().Unix()) {
+		return nil, nil
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], token.Hash) != 1 {
+		return nil, nil
+	}
+
+	user, err := database.GetUser(ctx, token.User)
+	if err != nil {
+		return nil, errors.New("GetUser " + err.Error())
+	}
+	return user, nil
+}
+
+// unauthenticated responds the requests that are not authenticated: the pages of the web interface
+// redirect to the login page, whereas the APIs and the feed challenge their clients.
+func unauthenticated(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="magneticow"`)
+		respondAPIError(w, r, http.StatusUnauthorized, "Unauthorised.\n")
+
+	case strings.HasPrefix(r.URL.Path, "/torznab/"):
+		torznabError(w, http.StatusUnauthorized, torznabIncorrectCredentials, "Incorrect user credentials")
+
+	case r.URL.Path == "/feed":
+		// Feed readers support HTTP basic auth far better than anything else.
+		w.Header().Set("WWW-Authenticate", `Basic realm="magneticow"`)
+		respondError(w, http.StatusUnauthorized, "Unauthorised.\n")
+
+	default:
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	}
+}
+
+// authorise wraps a handler requiring the user to have the given role at least. Every user is a
+// viewer at least, hence the handlers that do not modify anything need not be wrapped.
+func authorise(role persistence.Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user := requestUser(r); user != nil && user.Role < role {
+			respondAPIError(w, r, http.StatusForbidden, fmt.Sprintf("Forbidden: you must be %s at least.\n", role))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// requestUser returns the user that the request is authenticated as, or nil if authorisation is
+// disabled.
+func requestUser(r *http.Request) *persistence.User {
+	user, _ := r.Context().Value(userKey{}).(*persistence.User)
+	return user
+}
+
+// newToken returns a new token of the user, and its secret (to be given to the user once, as only
+// its hash is stored).
+func newToken(user string, name string, session bool, now time.Time) (*persistence.Token, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", errors.New("rand.Read " + err.Error())
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", errors.New("rand.Read " + err.Error())
+	}
+
+	token := &persistence.Token{
+		ID:        hex.EncodeToString(id),
+		User:      user,
+		Name:      name,
+		Session:   session,
+		CreatedOn: now.Unix(),
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(encodedSecret))
+	token.Hash = hash[:]
+	if session {
+		token.ExpiresOn = now.Add(SessionLifetime).Unix()
+	}
+	return token, token.ID + "." + encodedSecret, nil
+}
+
+// loginHandler serves the login page, and logs the users in on POST by setting a session cookie
+// before redirecting them to the `next` page.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !isLocalPath(next) {
+		next = "/"
+	}
+
+	if r.Method == http.MethodGet {
+		renderLogin(w, http.StatusOK, next, "")
+		return
+	}
+	if opts.NoAuth {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	user, err := database.GetUser(r.Context(), r.PostFormValue("username"))
+	if err != nil {
+		handlerError(errors.New("GetUser "+err.Error()), w)
+		return
+	}
+	// The password is checked even if there is no such user, so as not to tell whether there is.
+	hash := dummyPasswordHash
+	if user != nil {
+		hash = user.PasswordHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(r.PostFormValue("password"))) != nil || user == nil {
+		renderLogin(w, http.StatusUnauthorized, next, "Wrong username or password.")
+		return
+	}
+
+	now := time.Now()
+	if _, err = database.DeleteExpiredTokens(r.Context(), now.Unix()); err != nil {
+		log.Printf("DeleteExpiredTokens error %v", err)
+	}
+	token, secret, err := newToken(user.Name, "", true, now)
+	if err != nil {
+		handlerError(errors.New("newToken "+err.Error()), w)
+		return
+	}
+	if err = database.AddToken(r.Context(), *token); err != nil {
+		handlerError(errors.New("AddToken "+err.Error()), w)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    secret,
+		Path:     "/",
+		Expires:  time.Unix(token.ExpiresOn, 0),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// isLocalPath reports whether @next is a page of magneticow, to which the users may be redirected
+// after logging in, rather than one of other sites: browsers take `//other.example` for one, and so
+// `/\other.example` or `/\t/other.example` too, since they turn backslashes into slashes and skip
+// tabs and newlines.
+func isLocalPath(next string) bool {
+	if strings.ContainsFunc(next, func(r rune) bool { return r == '\\' || unicode.IsControl(r) }) {
+		return false
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return false
+	}
+	return strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(u.Path, "//")
+}
+
+// logoutHandler ends the session of the request, if any, and redirects to the login page.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		// Only the session whose secret the cookie holds is deleted, lest anyone could log the others
+		// out by their IDs.
+		user, err := tokenUser(r.Context(), cookie.Value, true)
+		if err != nil {
+			handlerError(errors.New("tokenUser "+err.Error()), w)
+			return
+		} else if user != nil {
+			id, _, _ := strings.Cut(cookie.Value, ".")
+			if _, err = database.DeleteToken(r.Context(), id); err != nil {
+				handlerError(errors.New("DeleteToken "+err.Error()), w)
+				return
+			}
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func renderLogin(w http.ResponseWriter, statusCode int, next string, message string) {
+	w.Header().Set(ContentType, ContentTypeHtml)
+	w.WriteHeader(statusCode)
+	_ = templates["login"].Execute(w, struct {
+		Next    string
+		Message string
+	}{
+		Next:    next,
+		Message: message,
+	})
+}
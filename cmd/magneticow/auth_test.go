@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/tgragnato/magnetico/persistence"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testInfoHash = "0123456789abcdef0123456789abcdef01234567"
+
+// setUpAuth opens a database of three users, vera the viewer, carl the curator, and ada the admin,
+// whose passwords are their names followed by "-password", and returns the router of magneticow.
+func setUpAuth(t *testing.T) *mux.Router {
+	db, err := persistence.MakeDatabase("bolt://"+filepath.Join(t.TempDir(), "magneticow.bolt"), "")
+	if err != nil {
+		t.Fatalf("MakeDatabase() error = %v", err)
+	}
+	database, templates, opts.NoAuth = db, makeTemplates(), false
+	t.Cleanup(func() {
+		_ = db.Close()
+		database = nil
+	})
+
+	ctx := context.Background()
+	for name, role := range map[string]persistence.Role{"vera": persistence.Viewer, "carl": persistence.Curator, "ada": persistence.Admin} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(name+"-password"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("GenerateFromPassword() error = %v", err)
+		}
+		if err = database.SetUser(ctx, persistence.User{Name: name, PasswordHash: hash, Role: role}); err != nil {
+			t.Fatalf("SetUser() error = %v", err)
+		}
+	}
+	infoHash := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67}
+	if err = database.AddNewTorrent(ctx, infoHash, "ubuntu", []persistence.File{{Size: 1, Path: "ubuntu.iso"}}, persistence.Software); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+
+	return makeRouter(&ApiReadmeHandler{})
+}
+
+func serve(router http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestAuthenticate(t *testing.T) {
+	router := setUpAuth(t)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		user      string
+		password  string
+		want      int
+		challenge string
+	}{
+		{"Anonymous Page", http.MethodGet, "/torrents", "", "", http.StatusSeeOther, ""},
+		{"Anonymous API", http.MethodGet, "/api/v0.1/tags", "", "", http.StatusUnauthorized, "Bearer"},
+		{"Anonymous Feed", http.MethodGet, "/feed", "", "", http.StatusUnauthorized, "Basic"},
+		{"Anonymous Readme", http.MethodGet, "/api/v0.1/torrents/" + testInfoHash + "/readme", "", "", http.StatusUnauthorized, "Bearer"},
+		{"Anonymous Static", http.MethodGet, "/static/styles/login.css", "", "", http.StatusOK, ""},
+		{"Anonymous Login", http.MethodGet, "/login", "", "", http.StatusOK, ""},
+		{"Wrong Password", http.MethodGet, "/api/v0.1/tags", "vera", "carl-password", http.StatusUnauthorized, "Bearer"},
+		{"Unknown User", http.MethodGet, "/api/v0.1/tags", "bob", "bob-password", http.StatusUnauthorized, "Bearer"},
+		{"Viewer Feed", http.MethodGet, "/feed", "vera", "vera-password", http.StatusOK, ""},
+		{"Viewer Curation", http.MethodGet, "/api/v0.1/torrents/" + testInfoHash + "/curation", "vera", "vera-password", http.StatusOK, ""},
+		{"Viewer Tag", http.MethodPut, "/api/v0.1/torrents/" + testInfoHash + "/tags/linux", "vera", "vera-password", http.StatusForbidden, ""},
+		{"Curator Tag", http.MethodPut, "/api/v0.1/torrents/" + testInfoHash + "/tags/linux", "carl", "carl-password", http.StatusOK, ""},
+		{"Curator Users", http.MethodGet, "/api/v0.1/users", "carl", "carl-password", http.StatusForbidden, ""},
+		{"Admin Users", http.MethodGet, "/api/v0.1/users", "ada", "ada-password", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			w := serve(router, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(got, tt.challenge) || (tt.challenge == "") != (got == "") {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.challenge)
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	router := setUpAuth(t)
+
+	login := func(password string, next string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"vera"}, "password": {password}, "next": {next}}
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set(ContentType, "application/x-www-form-urlencoded")
+		return serve(router, r)
+	}
+
+	if w := login("carl-password", "/"); w.Code != http.StatusUnauthorized || len(w.Result().Cookies()) != 0 {
+		t.Errorf("login with a wrong password = %d, %v, want %d and no cookies", w.Code, w.Result().Cookies(), http.StatusUnauthorized)
+	}
+	// Other sites are not redirected to.
+	for _, next := range []string{"//example.com", "/\t/example.com", "/\\example.com", "/%2F/example.com", "https://example.com/", "example.com"} {
+		if w := login("vera-password", next); w.Header().Get("Location") != "/" {
+			t.Errorf("Location after login with next %q = %q, want /", next, w.Header().Get("Location"))
+		}
+	}
+
+	w := login("vera-password", "/torrents?query=ubuntu")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/torrents?query=ubuntu" {
+		t.Errorf("login = %d, %q, want %d, /torrents?query=ubuntu", w.Code, w.Header().Get("Location"), http.StatusSeeOther)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %v, want a session cookie", cookies)
+	}
+	session := cookies[0]
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v0.1/tags", nil)
+	r.AddCookie(session)
+	if w := serve(router, r); w.Code != http.StatusOK {
+		t.Errorf("status with the session = %d, want %d", w.Code, http.StatusOK)
+	}
+	// Sessions are not API tokens.
+	r = httptest.NewRequest(http.MethodGet, "/api/v0.1/tags", nil)
+	r.Header.Set("Authorization", "Bearer "+session.Value)
+	if w := serve(router, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("status with the session as a bearer token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Sessions are not deleted by their IDs alone, even by the users who are authenticated otherwise.
+	id, _, _ := strings.Cut(session.Value, ".")
+	r = httptest.NewRequest(http.MethodPost, "/logout", nil)
+	r.SetBasicAuth("carl", "carl-password")
+	r.AddCookie(&http.Cookie{Name: SessionCookie, Value: id + ".forged"})
+	serve(router, r)
+	r = httptest.NewRequest(http.MethodGet, "/api/v0.1/tags", nil)
+	r.AddCookie(session)
+	if w := serve(router, r); w.Code != http.StatusOK {
+		t.Errorf("status with the session after a forged logout = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/logout", nil)
+	r.AddCookie(session)
+	if w := serve(router, r); w.Code != http.StatusSeeOther {
+		t.Errorf("logout = %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/v0.1/tags", nil)
+	r.AddCookie(session)
+	if w := serve(router, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("status with the session after logging out = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	router := setUpAuth(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v0.1/tokens", strings.NewReader(`{"name": "backup script"}`))
+	r.Header.Set(ContentType, ContentTypeJson)
+	r.SetBasicAuth("carl", "carl-password")
+	w := serve(router, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating a token = %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	var token struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil || token.Name != "backup script" || token.Secret == "" {
+		t.Fatalf("token = %+v, %v", token, err)
+	}
+
+	r = httptest.NewRequest(http.MethodPut, "/api/v0.1/torrents/"+testInfoHash+"/tags/linux", nil)
+	r.Header.Set("Authorization", "Bearer "+token.Secret)
+	if w := serve(router, r); w.Code != http.StatusOK {
+		t.Errorf("tagging with the token = %d, want %d", w.Code, http.StatusOK)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/v0.1/tags", nil)
+	r.Header.Set("Authorization", "Bearer "+token.Secret+"x")
+	if w := serve(router, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("status with a wrong secret = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Only the tokens of the user can be revoked.
+	r = httptest.NewRequest(http.MethodDelete, "/api/v0.1/tokens/"+token.ID, nil)
+	r.SetBasicAuth("ada", "ada-password")
+	if w := serve(router, r); w.Code != http.StatusNotFound {
+		t.Errorf("revoking the token of another user = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	r = httptest.NewRequest(http.MethodDelete, "/api/v0.1/tokens/"+token.ID, nil)
+	r.Header.Set("Authorization", "Bearer "+token.Secret)
+	if w := serve(router, r); w.Code != http.StatusNoContent {
+		t.Errorf("revoking the token = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/v0.1/tags", nil)
+	r.Header.Set("Authorization", "Bearer "+token.Secret)
+	if w := serve(router, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("status with a revoked token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	router := setUpAuth(t)
+
+	put := func(name string, body string) int {
+		r := httptest.NewRequest(http.MethodPut, "/api/v0.1/users/"+name, strings.NewReader(body))
+		r.Header.Set(ContentType, ContentTypeJson)
+		r.SetBasicAuth("ada", "ada-password")
+		return serve(router, r).Code
+	}
+	// The password of new users is required.
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`{"role": "curator"}`, http.StatusBadRequest},
+		{`{"password": "short"}`, http.StatusBadRequest},
+		{`{"password": "bob-password", "role": "ox"}`, http.StatusBadRequest},
+		{`{"password": "bob-password"}`, http.StatusOK},
+	} {
+		if got := put("bob", tt.body); got != tt.want {
+			t.Errorf("PUT %s = %d, want %d", tt.body, got, tt.want)
+		}
+	}
+	if got := put("Bob", `{"password": "bob-password"}`); got != http.StatusBadRequest {
+		t.Errorf("PUT of an invalid name = %d, want %d", got, http.StatusBadRequest)
+	}
+
+	// The password is kept if it is left out.
+	if got := put("bob", `{"role": "curator"}`); got != http.StatusOK {
+		t.Errorf("PUT of the role = %d, want %d", got, http.StatusOK)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/v0.1/users", nil)
+	r.SetBasicAuth("bob", "bob-password")
+	if w := serve(router, r); w.Code != http.StatusForbidden {
+		t.Errorf("status of the curator bob = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// Changing the password revokes the tokens.
+	r = httptest.NewRequest(http.MethodPost, "/api/v0.1/tokens", strings.NewReader(`{"name": "script"}`))
+	r.Header.Set(ContentType, ContentTypeJson)
+	r.SetBasicAuth("bob", "bob-password")
+	w := serve(router, r)
+	var token struct {
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("creating a token = %d, %v", w.Code, err)
+	}
+	if got := put("bob", `{"password": "new-bob-password"}`); got != http.StatusOK {
+		t.Errorf("PUT of the password = %d, want %d", got, http.StatusOK)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/v0.1/tags", nil)
+	r.Header.Set("Authorization", "Bearer "+token.Secret)
+	if w := serve(router, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("status with a token of the old password = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/v0.1/users/ada", nil)
+	r.SetBasicAuth("ada", "ada-password")
+	if w := serve(router, r); w.Code != http.StatusBadRequest {
+		t.Errorf("deleting oneself = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// The last admin is neither demoted nor deleted, even with authorisation disabled.
+	if got := put("ada", `{"role": "curator"}`); got != http.StatusConflict {
+		t.Errorf("demoting the last admin = %d, want %d", got, http.StatusConflict)
+	}
+	opts.NoAuth = true
+	r = httptest.NewRequest(http.MethodDelete, "/api/v0.1/users/ada", nil)
+	if w := serve(router, r); w.Code != http.StatusConflict {
+		t.Errorf("deleting the last admin = %d, want %d", w.Code, http.StatusConflict)
+	}
+	opts.NoAuth = false
+	if got := put("bob", `{"role": "admin"}`); got != http.StatusOK {
+		t.Errorf("promoting bob = %d, want %d", got, http.StatusOK)
+	}
+	if got := put("ada", `{"role": "admin"}`); got != http.StatusOK {
+		t.Errorf("keeping ada an admin = %d, want %d", got, http.StatusOK)
+	}
+	r = httptest.NewRequest(http.MethodDelete, "/api/v0.1/users/bob", nil)
+	r.SetBasicAuth("ada", "ada-password")
+	if w := serve(router, r); w.Code != http.StatusNoContent {
+		t.Errorf("deleting bob = %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestImportCredentials(t *testing.T) {
+	setUpAuth(t)
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("bob-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword() error = %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "credentials")
+	if err = os.WriteFile(path, []byte("bob:"+string(hash)+"\nvera:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	if err = importCredentials(ctx, path); err != nil {
+		t.Fatalf("importCredentials() error = %v", err)
+	}
+
+	if bob, err := database.GetUser(ctx, "bob"); err != nil || bob == nil || bob.Role != persistence.Curator {
+		t.Errorf("GetUser(bob) = %v, %v, want a curator", bob, err)
+	}
+	// The users who exist already are left alone.
+	vera, err := database.GetUser(ctx, "vera")
+	if err != nil || vera == nil || vera.Role != persistence.Viewer || bcrypt.CompareHashAndPassword(vera.PasswordHash, []byte("vera-password")) != nil {
+		t.Errorf("GetUser(vera) = %v, %v, want the viewer unchanged", vera, err)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+const (
+	ContentTypeRss  = "application/rss+xml; charset=utf-8"
+	ContentTypeAtom = "application/atom+xml; charset=utf-8"
+	// FeedLength is the number of torrents in the feeds.
+	FeedLength = 20
+	// torrentNamespace is that of the elements about torrents in the feeds (e.g. torrent:infoHash),
+	// as read by torrent clients.
+	torrentNamespace = "http://xmlns.ezrss.it/0.1/"
+)
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Torrent string     `xml:"xmlns:torrent,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	Description string       `xml:"description"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+	Category    string       `xml:"category"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+	feedTorrent
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length uint64 `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Torrent string      `xml:"xmlns:torrent,attr"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length uint64 `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title    string       `xml:"title"`
+	ID       string       `xml:"id"`
+	Updated  string       `xml:"updated"`
+	Links    []atomLink   `xml:"link"`
+	Category atomCategory `xml:"category"`
+	Summary  string       `xml:"summary"`
+	feedTorrent
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// feedTorrent are the elements about the torrent of an item of the feeds.
+type feedTorrent struct {
+	InfoHash      string `xml:"torrent:infoHash"`
+	ContentLength uint64 `xml:"torrent:contentLength"`
+	MagnetURI     string `xml:"torrent:magnetURI"`
+}
+
+// feedHandler serves the feed of the most recent torrents, or of those matching the `query`, in RSS
+// or in Atom (`format=atom`). The torrents can also be filtered by their `minSize` (e.g. 700MiB) and
+// their `category`, and ordered otherwise (`orderBy` and `ascending`, as in the API). The feeds are
+// served conditionally, see http.ServeContent, as feed readers poll them.
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	for name, values := range params {
+		if len(values) > 1 {
+			respondError(w, http.StatusBadRequest, "%s supplied multiple times!", name)
+			return
+		}
+	}
+
+	query := params.Get("query")
+	var title string
+	if query == "" {
+		title = "Most recent torrents - magneticow"
+	} else {
+		title = "`" + query + "` - magneticow"
+	}
+
+	// The minimum size is parsed on its own, and added to the query as a filter of its number of
+	// bytes only, so that it cannot add anything else to the query.
+	if value := params.Get("minSize"); value != "" {
+		minSize, err := persistence.ParseSize(value)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "couldn't parse minSize: %s", err.Error())
+			return
+		}
+		query += " size:>=" + strconv.FormatUint(minSize, 10)
+	}
+
+	var category *persistence.Category
+	if name := params.Get("category"); name != "" {
+		c, err := persistence.ParseCategory(name)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "%s", err.Error())
+			return
+		}
+		category = &c
+	}
+
+	orderBy := persistence.ByDiscoveredOn
+	if name := params.Get("orderBy"); name != "" {
+		var err error
+		if orderBy, err = parseOrderBy(name); err != nil {
+			respondError(w, http.StatusBadRequest, "%s", err.Error())
+			return
+		}
+	}
+
+	ascending := false
+	if value := params.Get("ascending"); value != "" {
+		var err error
+		if ascending, err = strconv.ParseBool(value); err != nil {
+			respondError(w, http.StatusBadRequest, "couldn't parse ascending: %s", err.Error())
+			return
+		}
+	}
+
+	torrents, err := database.QueryTorrents(
+		r.Context(),
+		query,
+		time.Now().Unix(),
+		orderBy,
+		ascending,
+		FeedLength,
+		nil,
+		nil,
+		category,
+		persistence.SearchNames,
+	)
+	var queryError *persistence.QueryError
+	var searchError *persistence.SearchError
+	if errors.As(err, &queryError) || errors.As(err, &searchError) {
+		respondError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	} else if err != nil {
+		handlerError(errors.New("query torrent "+err.Error()), w)
+		return
+	}
+
+	// The feeds change when their torrents do, so they are last modified when the most recent one
+	// was discovered, and their dates are those of the torrents rather than that of the request.
+	var lastModified time.Time
+	for _, torrent := range torrents {
+		if discoveredOn := time.Unix(torrent.DiscoveredOn, 0); discoveredOn.After(lastModified) {
+			lastModified = discoveredOn
+		}
+	}
+
+	var feed interface{}
+	var contentType string
+	switch params.Get("format") {
+	case "", "rss":
+		feed, contentType = makeRSSFeed(r, title, torrents, lastModified), ContentTypeRss
+	case "atom":
+		feed, contentType = makeAtomFeed(r, title, torrents, lastModified), ContentTypeAtom
+	default:
+		respondError(w, http.StatusBadRequest, "unknown format: %s", params.Get("format"))
+		return
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	if err = xml.NewEncoder(&buffer).Encode(feed); err != nil {
+		handlerError(errors.New("xml.Encode "+err.Error()), w)
+		return
+	}
+
+	hash := sha256.Sum256(buffer.Bytes())
+	w.Header().Set("ETag", `"`+hex.EncodeToString(hash[:16])+`"`)
+	w.Header().Set(ContentType, contentType)
+	http.ServeContent(w, r, "", lastModified, bytes.NewReader(buffer.Bytes()))
+}
+
+func makeRSSFeed(r *http.Request, title string, torrents []persistence.TorrentMetadata, lastModified time.Time) *rssFeed {
+	base := baseURL(r)
+	feed := &rssFeed{
+		Version: "2.0",
+		Torrent: torrentNamespace,
+		Channel: rssChannel{
+			Title:       title,
+			Link:        base + "/",
+			Description: "Torrents discovered by magneticod",
+		},
+	}
+	if !lastModified.IsZero() {
+		feed.Channel.LastBuildDate = lastModified.UTC().Format(time.RFC1123Z)
+	}
+
+	for _, torrent := range torrents {
+		item := makeFeedTorrent(&torrent)
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       torrent.Name,
+			Link:        base + "/torrents/" + item.InfoHash,
+			Description: describeTorrent(&torrent),
+			GUID:        rssGUID{Value: item.InfoHash},
+			PubDate:     time.Unix(torrent.DiscoveredOn, 0).UTC().Format(time.RFC1123Z),
+			Category:    torrent.Category.String(),
+			Enclosure:   rssEnclosure{URL: item.MagnetURI, Length: torrent.Size, Type: "application/x-bittorrent"},
+			feedTorrent: item,
+		})
+	}
+	return feed
+}
+
+func makeAtomFeed(r *http.Request, title string, torrents []persistence.TorrentMetadata, lastModified time.Time) *atomFeed {
+	base := baseURL(r)
+	self := base + r.URL.RequestURI()
+	// Atom feeds must have been updated at some point, even if they are empty.
+	if lastModified.IsZero() {
+		lastModified = time.Unix(0, 0)
+	}
+	feed := &atomFeed{
+		Torrent: torrentNamespace,
+		Title:   title,
+		ID:      self,
+		Updated: lastModified.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "self", Href: self, Type: "application/atom+xml"}},
+		Author:  atomAuthor{Name: "magneticow"},
+	}
+
+	for _, torrent := range torrents {
+		item := makeFeedTorrent(&torrent)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   torrent.Name,
+			ID:      "urn:btih:" + item.InfoHash,
+			Updated: time.Unix(torrent.DiscoveredOn, 0).UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Href: base + "/torrents/" + item.InfoHash},
+				{Rel: "enclosure", Href: item.MagnetURI, Type: "application/x-bittorrent", Length: torrent.Size},
+			},
+			Category:    atomCategory{Term: torrent.Category.String()},
+			Summary:     describeTorrent(&torrent),
+			feedTorrent: item,
+		})
+	}
+	return feed
+}
+
+func makeFeedTorrent(torrent *persistence.TorrentMetadata) feedTorrent {
+	return feedTorrent{
+		InfoHash:      hex.EncodeToString(torrent.InfoHash),
+		ContentLength: torrent.Size,
+		MagnetURI:     magnetLink(torrent.InfoHash, torrent.Name),
+	}
+}
+
+// describeTorrent returns the size and the number of files of the torrent, e.g. "1.2 GiB in 3 files".
+func describeTorrent(torrent *persistence.TorrentMetadata) string {
+	if torrent.NFiles == 1 {
+		return humanize.IBytes(torrent.Size) + " in 1 file"
+	}
+	return fmt.Sprintf("%s in %d files", humanize.IBytes(torrent.Size), torrent.NFiles)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveFeed(router http.Handler, query string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/feed?"+query, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	r.SetBasicAuth("vera", "vera-password")
+	return serve(router, r)
+}
+
+func TestFeedFormats(t *testing.T) {
+	router := setUpAuth(t)
+	magnet := "magnet:?xt=urn:btih:" + testInfoHash + "&dn=ubuntu"
+
+	w := serveFeed(router, "query=ubuntu", nil)
+	if w.Code != http.StatusOK || w.Header().Get(ContentType) != ContentTypeRss {
+		t.Fatalf("RSS = %d %q, want %d %q", w.Code, w.Header().Get(ContentType), http.StatusOK, ContentTypeRss)
+	}
+	var rss rssFeed
+	if err := xml.NewDecoder(w.Body).Decode(&rss); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(rss.Channel.Items) != 1 {
+		t.Fatalf("items = %+v, want ubuntu", rss.Channel.Items)
+	}
+	if item := rss.Channel.Items[0]; item.Title != "ubuntu" || item.PubDate == "" || item.Category != "software" || item.Enclosure.URL != magnet || item.Enclosure.Length != 1 {
+		t.Errorf("item = %+v, want ubuntu", item)
+	}
+
+	w = serveFeed(router, "query=ubuntu&format=atom", nil)
+	if w.Code != http.StatusOK || w.Header().Get(ContentType) != ContentTypeAtom {
+		t.Fatalf("Atom = %d %q, want %d %q", w.Code, w.Header().Get(ContentType), http.StatusOK, ContentTypeAtom)
+	}
+	var atom struct {
+		Entries []struct {
+			ID       string `xml:"id"`
+			Updated  string `xml:"updated"`
+			InfoHash string `xml:"http://xmlns.ezrss.it/0.1/ infoHash"`
+			Size     uint64 `xml:"http://xmlns.ezrss.it/0.1/ contentLength"`
+		} `xml:"http://www.w3.org/2005/Atom entry"`
+	}
+	if err := xml.NewDecoder(w.Body).Decode(&atom); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(atom.Entries) != 1 {
+		t.Fatalf("entries = %+v, want ubuntu", atom.Entries)
+	}
+	if entry := atom.Entries[0]; entry.ID != "urn:btih:"+testInfoHash || entry.Updated == "" || entry.InfoHash != testInfoHash || entry.Size != 1 {
+		t.Errorf("entry = %+v, want ubuntu", entry)
+	}
+}
+
+func TestFeedFilters(t *testing.T) {
+	router := setUpAuth(t)
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+		items int
+	}{
+		{"Category", "category=software", http.StatusOK, 1},
+		{"Other Category", "category=video", http.StatusOK, 0},
+		{"Min Size", "minSize=1B", http.StatusOK, 1},
+		{"Larger Min Size", "minSize=1KiB", http.StatusOK, 0},
+		{"Order", "orderBy=TOTAL_SIZE&ascending=true", http.StatusOK, 1},
+		{"Unrecorded Order", "orderBy=UPDATED_ON", http.StatusBadRequest, 0},
+		{"Relevance Without Query", "orderBy=RELEVANCE", http.StatusBadRequest, 0},
+		{"Min Size With Query", "query=ubuntu&minSize=0.5B", http.StatusOK, 1},
+		{"Bad Min Size", "minSize=1GiB%20ubuntu", http.StatusBadRequest, 0},
+		{"Min Size Filter", "minSize=1B%20size:<1B", http.StatusBadRequest, 0},
+		{"Unknown Min Size Unit", "minSize=1XB", http.StatusBadRequest, 0},
+		{"Bad Category", "category=films", http.StatusBadRequest, 0},
+		{"Bad Format", "format=json", http.StatusBadRequest, 0},
+		{"Repeated Query", "query=a&query=b", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveFeed(router, tt.query, nil)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var rss rssFeed
+			if err := xml.NewDecoder(w.Body).Decode(&rss); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if len(rss.Channel.Items) != tt.items {
+				t.Errorf("items = %d, want %d", len(rss.Channel.Items), tt.items)
+			}
+		})
+	}
+}
+
+func TestFeedConditionalGet(t *testing.T) {
+	router := setUpAuth(t)
+
+	w := serveFeed(router, "", nil)
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("feed = %d, ETag %q, Last-Modified %q, want %d with both", w.Code, etag, lastModified, http.StatusOK)
+	}
+
+	if w := serveFeed(router, "", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("status with If-None-Match = %d, want %d", w.Code, http.StatusNotModified)
+	}
+	if w := serveFeed(router, "", http.Header{"If-Modified-Since": {lastModified}}); w.Code != http.StatusNotModified {
+		t.Errorf("status with If-Modified-Since = %d, want %d", w.Code, http.StatusNotModified)
+	}
+	// The feeds of other formats are other representations.
+	if w := serveFeed(router, "format=atom", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusOK {
+		t.Errorf("status of Atom with the ETag of RSS = %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -1,22 +1,13 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"embed"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
-	"regexp"
-	"strconv"
-	"sync"
-	"syscall"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -24,7 +15,6 @@ import (
 	"github.com/gorilla/schema"
 	"github.com/jessevdk/go-flags"
 	"github.com/tgragnato/magnetico/persistence"
-	"golang.org/x/crypto/bcrypt"
 )
 
 //go:embed static/** templates/*
@@ -41,10 +31,13 @@ var (
 var opts struct {
 	Addr     string
 	Database string
-	// Credentials are nil when no-auth cmd-line flag is supplied.
-	Credentials        map[string][]byte // TODO: encapsulate credentials and mutex for safety
-	CredentialsRWMutex sync.RWMutex
-	// CredentialsPath is nil when no-auth is supplied.
+	// DatabaseReplica is the DSN of a read-only replica of the database serving the searches, or
+	// empty if there is none.
+	DatabaseReplica string
+	// NoAuth is whether authorisation is disabled, in which case everyone can do everything.
+	NoAuth bool
+	// CredentialsPath is the credentials file of the deprecated `credentials` flag, whose users are
+	// imported on start, or empty if it is not supplied.
 	CredentialsPath string
 }
 
@@ -54,57 +47,108 @@ func main() {
 		return
 	}
 
-	// Reload credentials when you receive SIGHUP
-	sighupChan := make(chan os.Signal, 1)
-	signal.Notify(sighupChan, syscall.SIGHUP)
-	go func() {
-		for range sighupChan {
-			opts.CredentialsRWMutex.Lock()
-			if opts.Credentials == nil {
-				log.Println("Ignoring SIGHUP since `no-auth` was supplied")
-				continue
-			}
-
-			opts.Credentials = make(map[string][]byte) // Clear opts.Credentials
-			opts.CredentialsRWMutex.Unlock()
-			if err := loadCred(opts.CredentialsPath); err != nil { // Reload credentials
-				log.Printf("couldn't load credentials %v", err)
-			}
-		}
-	}()
-
 	apiReadmeHandler, err := NewApiReadmeHandler()
 	if err != nil {
 		log.Fatalf("Could not initialise readme handler %v", err)
 	}
 	defer apiReadmeHandler.Close()
 
+	router := makeRouter(apiReadmeHandler)
+	templates = makeTemplates()
+
+	database, err = persistence.MakeDatabase(opts.Database, opts.DatabaseReplica)
+	if err != nil {
+		log.Panicf("could not access to database %v", err)
+	}
+	if opts.CredentialsPath != "" {
+		log.Println("`credentials` is deprecated, import the credentials file with `magnetico-db users import` instead")
+		if err = importCredentials(context.Background(), opts.CredentialsPath); err != nil {
+			log.Panicf("could not import the credentials %v", err)
+		}
+	}
+	if !opts.NoAuth {
+		if users, err := database.GetUsers(context.Background()); err != nil {
+			log.Panicf("could not get the users %v", err)
+		} else if len(users) == 0 {
+			log.Println("There are no users yet, add one with `magnetico-db users set` (or supply `no-auth`)")
+		}
+	}
+
+	decoder.IgnoreUnknownKeys(false)
+	decoder.ZeroEmpty(true)
+
+	log.Printf("magneticow is ready to serve on %s!", opts.Addr)
+	err = http.ListenAndServe(opts.Addr, router)
+	if err != nil {
+		log.Printf("ListenAndServe error %v", err)
+	}
+}
+
+// makeRouter returns the router of all the routes of magneticow, the readmes being served by the
+// readmeHandler.
+func makeRouter(readmeHandler *ApiReadmeHandler) *mux.Router {
+	// Every route is authenticated, see authenticate; those that modify anything also require the
+	// role to do so, see authorise.
 	router := mux.NewRouter()
+	router.Use(authenticate)
+	router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
 	router.HandleFunc("/",
-		BasicAuth(rootHandler))
+		rootHandler)
+	router.HandleFunc("/login",
+		loginHandler).Methods(http.MethodGet, http.MethodPost).Name("login")
+	router.HandleFunc("/logout",
+		logoutHandler).Methods(http.MethodPost)
 
+	// API v0.1 is kept as it was for the clients of old, see routeAPIV1 for API v1.
 	router.HandleFunc("/api/v0.1/statistics",
-		BasicAuth(apiStatistics))
+		apiV0(apiStatistics))
 	router.HandleFunc("/api/v0.1/torrents",
-		BasicAuth(apiTorrents))
+		apiTorrents)
 	router.HandleFunc("/api/v0.1/torrents/{infohash:[a-f0-9]{40}}",
-		BasicAuth(apiTorrent))
+		apiV0(apiTorrent))
 	router.HandleFunc("/api/v0.1/torrents/{infohash:[a-f0-9]{40}}/filelist",
-		BasicAuth(apiFileList))
+		apiV0(apiFileList))
+	router.HandleFunc("/api/v0.1/torrents/{infohash:[a-f0-9]{40}}/swarm",
+		apiV0(apiSwarm))
 	router.Handle("/api/v0.1/torrents/{infohash:[a-f0-9]{40}}/readme",
-		apiReadmeHandler)
+		readmeHandler)
+	router.HandleFunc("/api/v0.1/torrents/{infohash:[a-f0-9]{40}}/curation",
+		apiV0(apiCuration)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v0.1/torrents/{infohash:[a-f0-9]{40}}/curation",
+		authorise(persistence.Curator, apiV0(apiCuration))).Methods(http.MethodPatch)
+	router.HandleFunc("/api/v0.1/torrents/{infohash:[a-f0-9]{40}}/tags/{tag}",
+		authorise(persistence.Curator, apiV0(apiTag))).Methods(http.MethodPut, http.MethodDelete)
+	router.HandleFunc("/api/v0.1/tags",
+		apiV0(apiTags))
+	router.HandleFunc("/api/v0.1/tokens",
+		apiV0(apiTokens)).Methods(http.MethodGet, http.MethodPost)
+	router.HandleFunc("/api/v0.1/tokens/{id:[a-f0-9]+}",
+		apiV0(apiToken)).Methods(http.MethodDelete)
+	router.HandleFunc("/api/v0.1/users",
+		authorise(persistence.Admin, apiV0(apiUsers))).Methods(http.MethodGet)
+	router.HandleFunc("/api/v0.1/users/{name}",
+		authorise(persistence.Admin, apiV0(apiUser))).Methods(http.MethodPut, http.MethodDelete)
+
+	routeAPIV1(router, apiV1Endpoints(readmeHandler))
 
 	router.HandleFunc("/feed",
-		BasicAuth(feedHandler))
+		feedHandler)
+	router.HandleFunc("/torznab/api",
+		torznabHandler).Methods(http.MethodGet)
 	router.PathPrefix("/static").HandlerFunc(
-		BasicAuth(staticHandler))
+		staticHandler).Name("static")
 	router.HandleFunc("/statistics",
-		BasicAuth(statisticsHandler))
+		statisticsHandler)
 	router.HandleFunc("/torrents",
-		BasicAuth(torrentsHandler))
+		torrentsHandler)
 	router.HandleFunc("/torrents/{infohash:[a-f0-9]{40}}",
-		BasicAuth(torrentsInfohashHandler))
+		torrentsInfohashHandler)
 
+	return router
+}
+
+func makeTemplates() map[string]*template.Template {
 	templateFunctions := template.FuncMap{
 		"add": func(augend int, addends int) int {
 			return augend + addends
@@ -142,29 +186,17 @@ func main() {
 		},
 	}
 
-	templates = make(map[string]*template.Template)
-	templates["feed"] = template.
-		Must(template.New("feed").
-			Funcs(templateFunctions).
-			Parse(string(mustAsset("templates/feed.xml"))))
+	templates := make(map[string]*template.Template)
 	templates["homepage"] = template.
 		Must(template.New("homepage").
 			Funcs(templateFunctions).
 			Parse(string(mustAsset("templates/homepage.html"))))
+	templates["login"] = template.
+		Must(template.New("login").
+			Funcs(templateFunctions).
+			Parse(string(mustAsset("templates/login.html"))))
 
-	database, err = persistence.MakeDatabase(opts.Database)
-	if err != nil {
-		log.Panicf("could not access to database %v", err)
-	}
-
-	decoder.IgnoreUnknownKeys(false)
-	decoder.ZeroEmpty(true)
-
-	log.Printf("magneticow is ready to serve on %s!", opts.Addr)
-	err = http.ListenAndServe(opts.Addr, router)
-	if err != nil {
-		log.Printf("ListenAndServe error %v", err)
-	}
+	return templates
 }
 
 // TODO: I think there is a standard lib. function for this
@@ -183,10 +215,11 @@ func mustAsset(name string) []byte {
 
 func parseFlags() error {
 	var cmdFlags struct {
-		Addr     string `short:"a" long:"addr"        description:"Address (host:port) to serve on"  default:":8080"`
-		Database string `short:"d" long:"database"    description:"DSN of the database"`
-		Cred     string `short:"c" long:"credentials" description:"Path to the credentials file"`
-		NoAuth   bool   `          long:"no-auth"     description:"Disables authorisation"`
+		Addr            string `short:"a" long:"addr"             description:"Address (host:port) to serve on"  default:":8080"`
+		Database        string `short:"d" long:"database"         description:"DSN of the database"`
+		DatabaseReplica string `          long:"database-replica" description:"DSN of a read-only replica of the database, to serve the searches from"`
+		Cred            string `short:"c" long:"credentials"      description:"Deprecated: path to a credentials file, whose new users are imported as curators"`
+		NoAuth          bool   `          long:"no-auth"          description:"Disables authorisation"`
 	}
 
 	if _, err := flags.Parse(&cmdFlags); err != nil {
@@ -197,10 +230,6 @@ func parseFlags() error {
 		return fmt.Errorf("`credentials` and `no-auth` cannot be supplied together")
 	}
 
-	if cmdFlags.Cred == "" && !cmdFlags.NoAuth {
-		return fmt.Errorf("you should supply either `credentials` or `no-auth`")
-	}
-
 	opts.Addr = cmdFlags.Addr
 
 	if cmdFlags.Database == "" {
@@ -209,107 +238,9 @@ func parseFlags() error {
 	} else {
 		opts.Database = cmdFlags.Database
 	}
-
-	if !cmdFlags.NoAuth {
-		if cmdFlags.Cred != "" {
-			opts.CredentialsPath = cmdFlags.Cred
-		}
-
-		opts.Credentials = make(map[string][]byte)
-		if err := loadCred(opts.CredentialsPath); err != nil {
-			return err
-		}
-	}
+	opts.DatabaseReplica = cmdFlags.DatabaseReplica
+	opts.NoAuth = cmdFlags.NoAuth
+	opts.CredentialsPath = cmdFlags.Cred
 
 	return nil
 }
-
-func loadCred(cred string) error {
-	file, err := os.Open(cred)
-	if err != nil {
-		return err
-	}
-
-	opts.CredentialsRWMutex.Lock()
-	defer opts.CredentialsRWMutex.Unlock()
-
-	reader := bufio.NewReader(file)
-	for lineno := 1; true; lineno++ {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return errors.New("Error while reading line " + strconv.Itoa(lineno) + " " + err.Error())
-		}
-
-		line = line[:len(line)-1] // strip '\n'
-
-		/* The following regex checks if the line satisfies the following conditions:
-		 *
-		 * <USERNAME>:<BCRYPT HASH>
-		 *
-		 * where
-		 *     <USERNAME> must start with a small-case a-z character, might contain non-consecutive
-		 *   underscores in-between, and consists of small-case a-z characters and digits 0-9.
-		 *
-		 *     <BCRYPT HASH> is the output of the well-known bcrypt function.
-		 */
-		re := regexp.MustCompile(`^[a-z](?:_?[a-z0-9])*:\$2[aby]?\$\d{1,2}\$[./A-Za-z0-9]{53}$`)
-		if !re.Match(line) {
-			return fmt.Errorf("on line %d: format should be: <USERNAME>:<BCRYPT HASH>, instead got: %s", lineno, line)
-		}
-
-		tokens := bytes.Split(line, []byte(":"))
-		opts.Credentials[string(tokens[0])] = tokens[1]
-	}
-
-	return nil
-}
-
-// BasicAuth wraps a handler requiring HTTP basic auth for it using the given
-// username and password and the specified realm, which shouldn't contain quotes.
-//
-// Most web browser display a dialog with something like:
-//
-//	The website says: "<realm>"
-//
-// Which is really stupid, so you may want to set the realm to a message rather than
-// an actual realm.
-//
-// Source: https://stackoverflow.com/a/39591234/4466589
-func BasicAuth(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if opts.Credentials == nil { // --no-auth is supplied by the user.
-			handler(w, r)
-			return
-		}
-
-		username, password, ok := r.BasicAuth()
-		if !ok { // No credentials provided
-			authenticate(w)
-			return
-		}
-
-		opts.CredentialsRWMutex.RLock()
-		hashedPassword, ok := opts.Credentials[username]
-		opts.CredentialsRWMutex.RUnlock()
-		if !ok { // User not found
-			authenticate(w)
-			return
-		}
-
-		if err := bcrypt.CompareHashAndPassword(hashedPassword, []byte(password)); err != nil { // Wrong password
-			authenticate(w)
-			return
-		}
-
-		handler(w, r)
-	}
-}
-
-func authenticate(w http.ResponseWriter) {
-	w.Header().Set("WWW-Authenticate", `Basic realm="magneticow"`)
-	w.WriteHeader(http.StatusUnauthorized)
-	_, _ = w.Write([]byte("Unauthorised.\n"))
-}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification that the document of API v1 follows.
+const OpenAPIVersion = "3.0.3"
+
+// openAPISchema is a schema object of OpenAPI, a subset of JSON Schema.
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Pattern              string                    `json:"pattern,omitempty"`
+	Minimum              *int                      `json:"minimum,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Ref         string                      `json:"$ref,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Description string                     `json:"description,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPISecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+	In     string `json:"in,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema        `json:"schemas"`
+	Responses       map[string]openAPIResponse       `json:"responses"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Version     string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+// openAPI is an OpenAPI document.
+type openAPI struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Servers    []openAPIServer                         `json:"servers"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+	Security   []map[string][]string                   `json:"security"`
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// openAPIDocument returns the OpenAPI document of the endpoints of API v1, whose schemas are derived
+// from the Go types of their bodies, data and parameters.
+func openAPIDocument(endpoints []apiEndpoint) *openAPI {
+	schemas := make(map[string]*openAPISchema)
+	document := &openAPI{
+		OpenAPI: OpenAPIVersion,
+		Info: openAPIInfo{
+			Title: "magneticow",
+			Description: "The successful responses hold their data in an envelope, " +
+				"`{\"data\": ..., \"meta\": ...}`, meta being responded by the paged endpoints only.",
+			Version: "1",
+		},
+		Servers: []openAPIServer{{URL: APIV1Prefix}},
+		Paths:   make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{
+			Schemas: schemas,
+			Responses: map[string]openAPIResponse{
+				"Error": {
+					Description: "An error.",
+					Content:     jsonContent(schemaOf(reflect.TypeOf(v1ErrorBody{}), schemas)),
+				},
+			},
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				"token":   {Type: "http", Scheme: "bearer"},
+				"basic":   {Type: "http", Scheme: "basic"},
+				"session": {Type: "apiKey", In: "cookie", Name: SessionCookie},
+			},
+		},
+		Security: []map[string][]string{{"token": {}}, {"basic": {}}, {"session": {}}},
+	}
+
+	for _, endpoint := range endpoints {
+		path, parameters := openAPIPath(endpoint.Path)
+		operation := &openAPIOperation{
+			Summary:    endpoint.Summary,
+			Parameters: parameters,
+			Responses: map[string]openAPIResponse{
+				"default": {Ref: "#/components/responses/Error"},
+			},
+		}
+		if endpoint.Role > persistence.Viewer {
+			operation.Description = fmt.Sprintf("Requires the %s role at least.", endpoint.Role)
+		}
+
+		for _, parameter := range endpoint.Parameters {
+			schema := schemaOf(reflect.TypeOf(parameter.Value), schemas)
+			if parameter.Enum != nil {
+				schema = &openAPISchema{Type: "string", Enum: parameter.Enum}
+			}
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:        parameter.Name,
+				In:          "query",
+				Description: parameter.Description,
+				Schema:      schema,
+			})
+		}
+
+		if endpoint.Body != nil {
+			operation.RequestBody = &openAPIRequestBody{
+				Required: true,
+				Content:  jsonContent(schemaOf(reflect.TypeOf(endpoint.Body), schemas)),
+			}
+		}
+
+		status := endpoint.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response := openAPIResponse{Description: http.StatusText(status) + "."}
+		if endpoint.Data != nil {
+			envelope := &openAPISchema{
+				Type: "object",
+				Properties: map[string]*openAPISchema{
+					"data": schemaOf(reflect.TypeOf(endpoint.Data), schemas),
+				},
+				Required: []string{"data"},
+			}
+			if endpoint.Paged {
+				envelope.Properties["meta"] = schemaOf(reflect.TypeOf(apiMeta{}), schemas)
+				envelope.Required = append(envelope.Required, "meta")
+			}
+			response.Content = jsonContent(envelope)
+		}
+		operation.Responses[strconv.Itoa(status)] = response
+		for status, description := range endpoint.Errors {
+			operation.Responses[strconv.Itoa(status)] = openAPIResponse{
+				Description: description,
+				Content:     jsonContent(schemaOf(reflect.TypeOf(v1ErrorBody{}), schemas)),
+			}
+		}
+
+		if document.Paths[path] == nil {
+			document.Paths[path] = make(map[string]*openAPIOperation)
+		}
+		document.Paths[path][strings.ToLower(endpoint.Method)] = operation
+	}
+
+	return document
+}
+
+func jsonContent(schema *openAPISchema) map[string]openAPIMediaType {
+	return map[string]openAPIMediaType{ContentTypeJson: {Schema: schema}}
+}
+
+// openAPIPath returns the OpenAPI path of the path template of a route, and its parameters: the
+// patterns of the variables (e.g. `{infohash:[a-f0-9]{40}}`) are moved to their schemas.
+func openAPIPath(template string) (string, []openAPIParameter) {
+	var path strings.Builder
+	var parameters []openAPIParameter
+	for {
+		start := strings.IndexByte(template, '{')
+		if start == -1 {
+			path.WriteString(template)
+			return path.String(), parameters
+		}
+		path.WriteString(template[:start])
+
+		// The patterns may hold braces of their own, which are balanced.
+		end, depth := start, 0
+		for ; end < len(template); end++ {
+			if template[end] == '{' {
+				depth++
+			} else if template[end] == '}' {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+
+		name, pattern, _ := strings.Cut(template[start+1:end], ":")
+		schema := &openAPISchema{Type: "string"}
+		if pattern != "" {
+			schema.Pattern = "^" + pattern + "$"
+		}
+		path.WriteString("{" + name + "}")
+		parameters = append(parameters, openAPIParameter{Name: name, In: "path", Required: true, Schema: schema})
+		template = template[end+1:]
+	}
+}
+
+// schemaOf returns the schema of the values of the type when encoded as JSON. The schemas of the
+// named structs and enums are added to the schemas, and referred to.
+func schemaOf(t reflect.Type, schemas map[string]*openAPISchema) *openAPISchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Implements(textMarshalerType):
+		schema := &openAPISchema{Type: "string", Enum: enumOf(t)}
+		if schema.Enum == nil || t.Name() == "" {
+			return schema
+		}
+		return refer(t, schema, schemas)
+
+	case t.Kind() == reflect.Struct:
+		name := schemaName(t)
+		if name != "" {
+			if _, found := schemas[name]; found {
+				return &openAPISchema{Ref: "#/components/schemas/" + name}
+			}
+			// Added beforehand in case the struct is recursive.
+			schemas[name] = nil
+		}
+		schema := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+		addProperties(schema, t, schemas)
+		if name == "" {
+			return schema
+		}
+		return refer(t, schema, schemas)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		minimum := 0
+		return &openAPISchema{Type: "integer", Format: "int64", Minimum: &minimum}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Byte slices are encoded as strings (e.g. infohashes in hex).
+			return &openAPISchema{Type: "string"}
+		}
+		return &openAPISchema{Type: "array", Items: schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: schemaOf(t.Elem(), schemas)}
+	default:
+		return &openAPISchema{}
+	}
+}
+
+// addProperties adds the fields of the struct to the properties of the schema, along with those of
+// its embedded structs, as encoding/json encodes them.
+func addProperties(schema *openAPISchema, t reflect.Type, schemas map[string]*openAPISchema) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addProperties(schema, embedded, schemas)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = schemaOf(field.Type, schemas)
+		if !strings.Contains(","+options+",", ",omitempty,") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+func refer(t reflect.Type, schema *openAPISchema, schemas map[string]*openAPISchema) *openAPISchema {
+	name := schemaName(t)
+	schemas[name] = schema
+	return &openAPISchema{Ref: "#/components/schemas/" + name}
+}
+
+// schemaName returns the name of the schema of the type, which is its name capitalised and without
+// the prefix of the API (e.g. apiMeta is Meta, and v1Error is Error), or empty for anonymous types.
+func schemaName(t reflect.Type) string {
+	name := strings.TrimPrefix(strings.TrimPrefix(t.Name(), "api"), "v1")
+	r, size := utf8.DecodeRuneInString(name)
+	if size == 0 {
+		return ""
+	}
+	return string(unicode.ToUpper(r)) + name[size:]
+}
+
+// enumOf returns the names of the values of the enum type (e.g. persistence.Role), which are both
+// marshalled and unmarshalled as text from zero up, or nil if the type is not such an enum.
+func enumOf(t reflect.Type) []string {
+	if !reflect.PointerTo(t).Implements(reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return nil
+	}
+
+	var names []string
+	for i := uint64(0); !reflect.Zero(t).OverflowUint(i); i++ {
+		value := reflect.New(t)
+		value.Elem().SetUint(i)
+		text, err := value.Elem().Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return names
+		}
+		// The values past the last one are marshalled as something that is not unmarshalled.
+		if value.Interface().(encoding.TextUnmarshaler).UnmarshalText(text) != nil {
+			return names
+		}
+		names = append(names, string(text))
+	}
+	return names
+}
@@ -42,6 +42,8 @@ window.onload = function () {
             }
         });
 
+        setUpCuration(infoHash);
+
         myFetch("/api/v0.1/torrents/" + infoHash + "/readme")
             .then(response => {
                 return response.text();
@@ -56,3 +58,45 @@ window.onload = function () {
             });
     });
 };
+
+
+// Renders the curation of the torrent, and sends its changes.
+function setUpCuration(infoHash) {
+    const url = "/api/v0.1/torrents/" + infoHash;
+    const status = document.getElementById("curationStatus");
+
+    const render = curation => {
+        document.getElementById("starred").checked = curation.starred;
+        document.getElementById("note").value = curation.note;
+        const template = document.getElementById("tags-template").innerHTML;
+        document.getElementById("tags").innerHTML = Mustache.render(template, {tags: curation.tags});
+        for (let button of document.querySelectorAll(".removeTag")) {
+            button.onclick = () => curate(url + "/tags/" + encodeURIComponent(button.dataset.tag), {method: "DELETE"});
+        }
+        status.innerText = "";
+    };
+    const curate = (url, options) => myFetch(url, options)
+        .then(response => response.json())
+        .then(render)
+        .catch(err => {
+            status.innerText = err;
+        });
+    const patch = body => curate(url + "/curation", {
+        method: "PATCH",
+        headers: {"Content-Type": "application/json"},
+        body: JSON.stringify(body),
+    });
+
+    document.getElementById("starred").onchange = event => patch({starred: event.target.checked});
+    document.getElementById("saveNote").onclick = () => patch({note: document.getElementById("note").value});
+    document.getElementById("tagForm").onsubmit = event => {
+        event.preventDefault();
+        const tag = document.getElementById("tag");
+        if (tag.value.trim() !== "") {
+            curate(url + "/tags/" + encodeURIComponent(tag.value.trim()), {method: "PUT"});
+            tag.value = "";
+        }
+    };
+
+    curate(url + "/curation");
+}
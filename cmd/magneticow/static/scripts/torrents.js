@@ -1,6 +1,8 @@
 "use strict";
 
 const query = (new URL(location)).searchParams.get("query")
+    , category = (new URL(location)).searchParams.get("category") || null
+    , scope = (new URL(location)).searchParams.get("scope") || null
     , epoch = Math.floor(Date.now() / 1000)
 ;
 let orderBy, ascending;  // use `setOrderBy()` to modify orderBy
@@ -8,17 +10,19 @@ let lastOrderedValue, lastID;
 
 
 window.onload = function() {
-    if (query !== null && query !== "") {
-        orderBy = "RELEVANCE";
-    }
-
     const title = document.getElementsByTagName("title")[0];
     if (query) {
         title.textContent = query + " - magneticow";
         const input = document.getElementsByTagName("input")[0];
         input.setAttribute("value", query);
+    }
 
+    if (hasSearchTerms(query)) {
         setOrderBy("RELEVANCE");
+    } else if (query) {
+        // Only filters (such as size:>1GiB), which cannot be ordered by relevance.
+        ascending = false;
+        setOrderBy("DISCOVERED_ON");
     } else {
         title.textContent = "Most recent torrents - magneticow";
 
@@ -26,6 +30,13 @@ window.onload = function() {
         setOrderBy("DISCOVERED_ON");
     }
 
+    if (scope) {
+        document.querySelector("select[name=scope]").value = scope;
+    }
+    if (category) {
+        document.querySelector("select[name=category]").value = category;
+    }
+
     if (query) {
         const feedAnchor = document.getElementById("feed-anchor");
         feedAnchor.setAttribute("href", "/feed?query=" + encodeURIComponent(query));
@@ -35,6 +46,17 @@ window.onload = function() {
 };
 
 
+// hasSearchTerms mirrors persistence.ParseQuery, loosely: filters (those of Query.parseFilter) and
+// exclusions are not terms.
+function hasSearchTerms(query) {
+    if (!query)
+        return false;
+    return query.split(/\s+/).some(token =>
+        /[\p{L}\p{N}]/u.test(token) && !token.startsWith("-") && !/^(size|files|ext|after|before|tag|is):/i.test(token)
+    );
+}
+
+
 function setOrderBy(x) {
     const validValues = [
         "TOTAL_SIZE",
@@ -71,6 +93,8 @@ function load() {
     const template = document.getElementById("item-template").innerHTML;
     const reqURL   = "/api/v0.1/torrents?" + encodeQueryData({
         query           : query,
+        category        : category,
+        scope           : scope,
         epoch           : epoch,
         lastID          : lastID,
         lastOrderedValue: lastOrderedValue,
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+const (
+	// TorznabDefaultLimit and TorznabMaxLimit are the default and the maximum numbers of the
+	// results of a Torznab search.
+	TorznabDefaultLimit = 100
+	TorznabMaxLimit     = 100
+	// TorznabMaxResults is the number of the results of a search past which Torznab clients cannot
+	// page (i.e. the maximum of offset + limit), as QueryTorrents does not skip torrents.
+	TorznabMaxResults = 1000
+)
+
+// Torznab error codes, see torznabError.
+const (
+	torznabIncorrectCredentials = 100
+	torznabMissingParameter     = 200
+	torznabIncorrectParameter   = 201
+	torznabNoSuchFunction       = 202
+	torznabUnknownError         = 900
+)
+
+// torznabCategory is a category of Newznab, and the categories of the torrents that it consists of.
+type torznabCategory struct {
+	ID         int
+	Name       string
+	Categories []persistence.Category
+}
+
+// torznabCategories are the (top-level) Newznab categories that the torrents are in. Videos are both
+// movies and TV, as the classifier does not tell them apart.
+var torznabCategories = []torznabCategory{
+	{2000, "Movies", []persistence.Category{persistence.Video}},
+	{3000, "Audio", []persistence.Category{persistence.Audio}},
+	{4000, "PC", []persistence.Category{persistence.Software}},
+	{5000, "TV", []persistence.Category{persistence.Video}},
+	{7000, "Books", []persistence.Category{persistence.Ebook}},
+	{8000, "Other", []persistence.Category{persistence.Uncategorised, persistence.Archive, persistence.Images}},
+}
+
+// torznabSearchFunctions are the values of the `t` parameter that search, all of them by the `q`
+// parameter only.
+var torznabSearchFunctions = map[string]bool{
+	"search":   true,
+	"tvsearch": true,
+	"movie":    true,
+	"music":    true,
+	"book":     true,
+}
+
+type torznabCaps struct {
+	XMLName xml.Name `xml:"caps"`
+	Server  struct {
+		Title string `xml:"title,attr"`
+	} `xml:"server"`
+	Limits struct {
+		Max     uint `xml:"max,attr"`
+		Default uint `xml:"default,attr"`
+	} `xml:"limits"`
+	Searching struct {
+		Search      torznabSearchCaps `xml:"search"`
+		TVSearch    torznabSearchCaps `xml:"tv-search"`
+		MovieSearch torznabSearchCaps `xml:"movie-search"`
+		MusicSearch torznabSearchCaps `xml:"music-search"`
+		BookSearch  torznabSearchCaps `xml:"book-search"`
+	} `xml:"searching"`
+	Categories []torznabCapsCategory `xml:"categories>category"`
+}
+
+type torznabSearchCaps struct {
+	Available       string `xml:"available,attr"`
+	SupportedParams string `xml:"supportedParams,attr"`
+}
+
+type torznabCapsCategory struct {
+	ID   int    `xml:"id,attr"`
+	Name string `xml:"name,attr"`
+}
+
+type torznabRSS struct {
+	XMLName xml.Name       `xml:"rss"`
+	Version string         `xml:"version,attr"`
+	Torznab string         `xml:"xmlns:torznab,attr"`
+	Channel torznabChannel `xml:"channel"`
+}
+
+type torznabChannel struct {
+	Title       string          `xml:"title"`
+	Description string          `xml:"description"`
+	Link        string          `xml:"link"`
+	Response    torznabResponse `xml:"torznab:response"`
+	Items       []torznabItem   `xml:"item"`
+}
+
+type torznabResponse struct {
+	Offset uint `xml:"offset,attr"`
+	Total  uint `xml:"total,attr"`
+}
+
+type torznabItem struct {
+	Title      string        `xml:"title"`
+	GUID       rssGUID       `xml:"guid"`
+	Link       string        `xml:"link"`
+	Comments   string        `xml:"comments"`
+	PubDate    string        `xml:"pubDate"`
+	Size       uint64        `xml:"size"`
+	Categories []int         `xml:"category"`
+	Enclosure  rssEnclosure  `xml:"enclosure"`
+	Attrs      []torznabAttr `xml:"torznab:attr"`
+}
+
+type torznabAttr struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type torznabErrorBody struct {
+	XMLName     xml.Name `xml:"error"`
+	Code        int      `xml:"code,attr"`
+	Description string   `xml:"description,attr"`
+}
+
+// torznabHandler is the Torznab (and Newznab) API of magneticow, for media automation tools: it
+// serves its capabilities (`t=caps`), and searches (`t=search` and the like) by query (`q`), Newznab
+// categories (`cat`, comma-separated), `limit` and `offset`. The clients authenticate with an API
+// token as their `apikey`, see authenticateRequest.
+func torznabHandler(w http.ResponseWriter, r *http.Request) {
+	function := r.URL.Query().Get("t")
+	switch {
+	case function == "":
+		torznabError(w, http.StatusBadRequest, torznabMissingParameter, "Missing parameter (t)")
+	case function == "caps":
+		respondXML(w, http.StatusOK, makeTorznabCaps())
+	case torznabSearchFunctions[function]:
+		torznabSearch(w, r)
+	default:
+		torznabError(w, http.StatusBadRequest, torznabNoSuchFunction, "No such function ("+function+")")
+	}
+}
+
+func makeTorznabCaps() *torznabCaps {
+	caps := new(torznabCaps)
+	caps.Server.Title = "magneticow"
+	caps.Limits.Max, caps.Limits.Default = TorznabMaxLimit, TorznabDefaultLimit
+	search := torznabSearchCaps{Available: "yes", SupportedParams: "q"}
+	caps.Searching.Search, caps.Searching.TVSearch, caps.Searching.MovieSearch = search, search, search
+	caps.Searching.MusicSearch, caps.Searching.BookSearch = search, search
+	for _, category := range torznabCategories {
+		caps.Categories = append(caps.Categories, torznabCapsCategory{ID: category.ID, Name: category.Name})
+	}
+	return caps
+}
+
+func torznabSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit, err := parseTorznabUint(q.Get("limit"), TorznabDefaultLimit)
+	if err != nil || limit > TorznabMaxLimit {
+		torznabError(w, http.StatusBadRequest, torznabIncorrectParameter, fmt.Sprintf("Incorrect parameter (limit must be at most %d)", TorznabMaxLimit))
+		return
+	}
+	offset, err := parseTorznabUint(q.Get("offset"), 0)
+	if err != nil {
+		torznabError(w, http.StatusBadRequest, torznabIncorrectParameter, "Incorrect parameter (offset)")
+		return
+	}
+	if offset+limit > TorznabMaxResults {
+		torznabError(w, http.StatusBadRequest, torznabIncorrectParameter, fmt.Sprintf("Incorrect parameter (offset + limit must be at most %d)", TorznabMaxResults))
+		return
+	}
+	categories, err := parseTorznabCategories(q.Get("cat"))
+	if err != nil {
+		torznabError(w, http.StatusBadRequest, torznabIncorrectParameter, "Incorrect parameter (cat)")
+		return
+	}
+
+	torrents, total, err := queryTorznab(r.Context(), q.Get("q"), categories, offset, limit)
+	var queryError *persistence.QueryError
+	if errors.As(err, &queryError) {
+		torznabError(w, http.StatusBadRequest, torznabIncorrectParameter, "Incorrect parameter (q): "+queryError.Error())
+		return
+	} else if err != nil {
+		log.Printf("Torznab search error %v", err)
+		torznabError(w, http.StatusInternalServerError, torznabUnknownError, "Unknown error")
+		return
+	}
+
+	base := baseURL(r)
+
+	rss := &torznabRSS{
+		Version: "2.0",
+		Torznab: "http://torznab.com/schemas/2015/feed",
+		Channel: torznabChannel{
+			Title:       "magneticow",
+			Description: "Torrents discovered by magneticod",
+			Link:        base + "/",
+			Response:    torznabResponse{Offset: offset, Total: total},
+		},
+	}
+	infoHashes := make([][]byte, len(torrents))
+	for i := range torrents {
+		infoHashes[i] = torrents[i].InfoHash
+	}
+	swarms, err := database.GetSwarms(r.Context(), infoHashes)
+	if err != nil {
+		log.Printf("Torznab search error GetSwarms %v", err)
+		torznabError(w, http.StatusInternalServerError, torznabUnknownError, "Unknown error")
+		return
+	}
+	for _, torrent := range torrents {
+		swarm := swarms[string(torrent.InfoHash)]
+		rss.Channel.Items = append(rss.Channel.Items, *makeTorznabItem(base, &torrent, &swarm))
+	}
+	respondXML(w, http.StatusOK, rss)
+}
+
+// queryTorznab returns the page of the torrents that match the query and are in any of the
+// categories (or in all of them if nil), most recently discovered first, and an estimate of how
+// many match. Since QueryTorrents takes one category at most and skips no torrents, the torrents of
+// each category are queried up to the end of the page, and merged; offset + limit must be at most
+// TorznabMaxResults.
+//
+// The number of the torrents that match is exact if none of the categories has more torrents than
+// were queried, and estimated once otherwise (across all the categories if there are several, see
+// EstimateNumberOfTorrents).
+func queryTorznab(ctx context.Context, query string, categories []persistence.Category, offset uint, limit uint) ([]persistence.TorrentMetadata, uint, error) {
+	epoch := time.Now().Unix()
+
+	var torrents []persistence.TorrentMetadata
+	more := false
+	queryCategory := func(category *persistence.Category) error {
+		page, err := database.QueryTorrents(ctx, query, epoch, persistence.ByDiscoveredOn, false, offset+limit, nil, nil, category, persistence.SearchNames)
+		if err != nil {
+			return err
+		}
+		torrents = append(torrents, page...)
+		more = more || uint(len(page)) == offset+limit
+		return nil
+	}
+
+	if categories == nil {
+		if err := queryCategory(nil); err != nil {
+			return nil, 0, err
+		}
+	}
+	for i := range categories {
+		if err := queryCategory(&categories[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	total := uint(len(torrents))
+	if more {
+		var category *persistence.Category
+		if len(categories) == 1 {
+			category = &categories[0]
+		}
+		n, _, err := persistence.EstimateNumberOfTorrents(ctx, database, query, epoch, category, persistence.SearchNames)
+		if err != nil {
+			return nil, 0, err
+		}
+		total = max(n, total)
+	}
+
+	sort.SliceStable(torrents, func(i, j int) bool {
+		if torrents[i].DiscoveredOn != torrents[j].DiscoveredOn {
+			return torrents[i].DiscoveredOn > torrents[j].DiscoveredOn
+		}
+		return torrents[i].ID > torrents[j].ID
+	})
+	if uint(len(torrents)) <= offset {
+		return nil, total, nil
+	}
+	torrents = torrents[offset:]
+	if uint(len(torrents)) > limit {
+		torrents = torrents[:limit]
+	}
+	return torrents, total, nil
+}
+
+// makeTorznabItem returns the item of the torrent, whose swarm is that of GetSwarms (hence zero if
+// it has not been recorded).
+func makeTorznabItem(base string, torrent *persistence.TorrentMetadata, swarm *persistence.Swarm) *torznabItem {
+	infoHash := hex.EncodeToString(torrent.InfoHash)
+	magnet := magnetLink(torrent.InfoHash, torrent.Name)
+	item := &torznabItem{
+		Title:     torrent.Name,
+		GUID:      rssGUID{Value: infoHash},
+		Link:      magnet,
+		Comments:  base + "/torrents/" + infoHash,
+		PubDate:   time.Unix(torrent.DiscoveredOn, 0).UTC().Format(time.RFC1123Z),
+		Size:      torrent.Size,
+		Enclosure: rssEnclosure{URL: magnet, Length: torrent.Size, Type: "application/x-bittorrent"},
+	}
+
+	for _, category := range torznabCategories {
+		for _, c := range category.Categories {
+			if c == torrent.Category {
+				item.Categories = append(item.Categories, category.ID)
+				item.Attrs = append(item.Attrs, torznabAttr{"category", strconv.Itoa(category.ID)})
+			}
+		}
+	}
+	item.Attrs = append(item.Attrs,
+		torznabAttr{"size", strconv.FormatUint(torrent.Size, 10)},
+		torznabAttr{"files", strconv.FormatUint(uint64(torrent.NFiles), 10)},
+		torznabAttr{"infohash", infoHash},
+		torznabAttr{"magneturl", magnet},
+	)
+
+	// Seeders and leechers are not tracked, but the peers known when the torrent was discovered are.
+	if swarm.NPeers != 0 {
+		item.Attrs = append(item.Attrs, torznabAttr{"peers", strconv.FormatUint(uint64(swarm.NPeers), 10)})
+	}
+	return item
+}
+
+// parseTorznabCategories returns the categories of the torrents that the comma-separated Newznab
+// categories consist of (the subcategories being those of their parents), or nil for all of them if
+// none are given.
+func parseTorznabCategories(s string) ([]persistence.Category, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	found := make(map[persistence.Category]bool)
+	categories := []persistence.Category{}
+	for _, field := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		for _, category := range torznabCategories {
+			if category.ID != id/1000*1000 {
+				continue
+			}
+			for _, c := range category.Categories {
+				if !found[c] {
+					found[c] = true
+					categories = append(categories, c)
+				}
+			}
+		}
+	}
+	return categories, nil
+}
+
+func parseTorznabUint(s string, defaultValue uint) (uint, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint(n), err
+}
+
+// torznabError responds the error as Torznab clients expect it.
+func torznabError(w http.ResponseWriter, statusCode int, code int, description string) {
+	respondXML(w, statusCode, &torznabErrorBody{Code: code, Description: description})
+}
+
+func respondXML(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set(ContentType, ContentTypeXml)
+	w.WriteHeader(statusCode)
+	_, _ = w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("XML encode error %v", err)
+	}
+}
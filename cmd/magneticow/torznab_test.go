@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+// serveTorznab serves the Torznab request, authenticated with the API key unless it is empty, and
+// decodes the body of the response into v.
+func serveTorznab(t *testing.T, router http.Handler, query string, apiKey string, v interface{}) int {
+	t.Helper()
+	if apiKey != "" {
+		query += "&apikey=" + apiKey
+	}
+	w := serve(router, httptest.NewRequest(http.MethodGet, "/torznab/api?"+query, nil))
+	if got := w.Header().Get(ContentType); got != ContentTypeXml {
+		t.Fatalf("%s: Content-Type = %q, want %q", query, got, ContentTypeXml)
+	}
+	if err := xml.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("%s: Decode() error = %v", query, err)
+	}
+	return w.Code
+}
+
+func setUpTorznab(t *testing.T) (http.Handler, string) {
+	router := setUpAuth(t)
+	token, secret, err := newToken("vera", "sonarr", false, time.Now())
+	if err != nil {
+		t.Fatalf("newToken() error = %v", err)
+	}
+	if err = database.AddToken(context.Background(), *token); err != nil {
+		t.Fatalf("AddToken() error = %v", err)
+	}
+	return router, secret
+}
+
+func TestTorznabCaps(t *testing.T) {
+	router, apiKey := setUpTorznab(t)
+
+	var caps torznabCaps
+	if code := serveTorznab(t, router, "t=caps", apiKey, &caps); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if caps.Searching.Search.Available != "yes" || len(caps.Categories) != len(torznabCategories) {
+		t.Errorf("caps = %+v, want search and %d categories", caps, len(torznabCategories))
+	}
+}
+
+func TestTorznabSearch(t *testing.T) {
+	router, apiKey := setUpTorznab(t)
+
+	infoHash, _ := hex.DecodeString(testInfoHash)
+	if err := database.RecordSwarm(context.Background(), infoHash, persistence.Swarm{NPeers: 3}); err != nil {
+		t.Fatalf("RecordSwarm() error = %v", err)
+	}
+
+	var rss struct {
+		Channel struct {
+			Response struct {
+				Total uint `xml:"total,attr"`
+			} `xml:"http://torznab.com/schemas/2015/feed response"`
+			Items []struct {
+				Title     string `xml:"title"`
+				Link      string `xml:"link"`
+				Size      uint64 `xml:"size"`
+				Enclosure struct {
+					URL string `xml:"url,attr"`
+				} `xml:"enclosure"`
+				Attrs []torznabAttr `xml:"http://torznab.com/schemas/2015/feed attr"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if code := serveTorznab(t, router, "t=search&q=ubuntu&cat=4000", apiKey, &rss); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if len(rss.Channel.Items) != 1 || rss.Channel.Response.Total != 1 {
+		t.Fatalf("items = %+v of %d, want ubuntu of 1", rss.Channel.Items, rss.Channel.Response.Total)
+	}
+	item := rss.Channel.Items[0]
+	magnet := "magnet:?xt=urn:btih:" + testInfoHash + "&dn=ubuntu"
+	if item.Title != "ubuntu" || item.Link != magnet || item.Enclosure.URL != magnet || item.Size != 1 {
+		t.Errorf("item = %+v, want ubuntu and its magnet link", item)
+	}
+	attrs := make(map[string]string)
+	for _, attr := range item.Attrs {
+		attrs[attr.Name] = attr.Value
+	}
+	if attrs["category"] != "4000" || attrs["files"] != "1" || attrs["infohash"] != testInfoHash || attrs["magneturl"] != magnet || attrs["peers"] != "3" {
+		t.Errorf("attrs = %v, want those of ubuntu", attrs)
+	}
+
+	// Ubuntu is not a movie, nor a TV show.
+	rss.Channel.Items = nil
+	if code := serveTorznab(t, router, "t=tvsearch&q=ubuntu&cat=2000,5030", apiKey, &rss); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if len(rss.Channel.Items) != 0 {
+		t.Errorf("items = %+v, want none", rss.Channel.Items)
+	}
+}
+
+func TestTorznabErrors(t *testing.T) {
+	router, apiKey := setUpTorznab(t)
+
+	tests := []struct {
+		name   string
+		query  string
+		apiKey string
+		want   int
+		code   int
+	}{
+		{"No API Key", "t=caps", "", http.StatusUnauthorized, torznabIncorrectCredentials},
+		{"Wrong API Key", "t=caps", strings.Repeat("0", 16) + ".secret", http.StatusUnauthorized, torznabIncorrectCredentials},
+		{"No Function", "q=ubuntu", apiKey, http.StatusBadRequest, torznabMissingParameter},
+		{"Unknown Function", "t=register", apiKey, http.StatusBadRequest, torznabNoSuchFunction},
+		{"Bad Limit", "t=search&limit=1000", apiKey, http.StatusBadRequest, torznabIncorrectParameter},
+		{"Bad Offset", "t=search&offset=950&limit=100", apiKey, http.StatusBadRequest, torznabIncorrectParameter},
+		{"Bad Category", "t=search&cat=movies", apiKey, http.StatusBadRequest, torznabIncorrectParameter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body torznabErrorBody
+			if code := serveTorznab(t, router, tt.query, tt.apiKey, &body); code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+			if body.Code != tt.code {
+				t.Errorf("code = %d, want %d", body.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestQueryTorznab(t *testing.T) {
+	setUpAuth(t)
+	ctx := context.Background()
+	for i, category := range []persistence.Category{persistence.Software, persistence.Audio, persistence.Software, persistence.Audio, persistence.Software} {
+		infoHash := []byte(fmt.Sprintf("linux-%014d", i))
+		if err := database.AddNewTorrent(ctx, infoHash, fmt.Sprintf("linux %d", i), []persistence.File{{Size: 1, Path: "linux"}}, category); err != nil {
+			t.Fatalf("AddNewTorrent() error = %v", err)
+		}
+	}
+	categories := []persistence.Category{persistence.Software, persistence.Audio}
+
+	tests := []struct {
+		name   string
+		offset uint
+		limit  uint
+		want   int
+	}{
+		// There may be more torrents than queried, hence they are counted.
+		{"First Page", 0, 2, 2},
+		// There are not, hence those queried are all of them.
+		{"Last Page", 4, 2, 1},
+		{"Past The End", 6, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrents, total, err := queryTorznab(ctx, "linux", categories, tt.offset, tt.limit)
+			if err != nil || len(torrents) != tt.want || total != 5 {
+				t.Errorf("queryTorznab() = %d torrents of %d, %v, want %d of 5", len(torrents), total, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTorznabCategories(t *testing.T) {
+	got, err := parseTorznabCategories("2000,5040,8010")
+	want := []persistence.Category{persistence.Video, persistence.Uncategorised, persistence.Archive, persistence.Images}
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("parseTorznabCategories() = %v, %v, want %v", got, err, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("parseTorznabCategories()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
@@ -1,8 +1,25 @@
 package main
 
-import "net/http"
+import (
+	"encoding/hex"
+	"net/http"
+	"net/url"
+)
 
 func handlerError(err error, w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	_, _ = w.Write([]byte(err.Error()))
 }
+
+// baseURL returns the URL of magneticow as requested, e.g. `https://magneticow.example`.
+func baseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// magnetLink returns the magnet link of the torrent.
+func magnetLink(infoHash []byte, name string) string {
+	return "magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash) + "&dn=" + url.QueryEscape(name)
+}
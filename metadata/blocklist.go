@@ -0,0 +1,140 @@
+package metadata
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Blocklist refuses the torrents of the info hashes it lists, and those whose names or file paths
+// match any of its regular expressions.
+//
+// Blocklist is safe for concurrent use, and can be reloaded from its files at any time (e.g. on
+// SIGHUP).
+type Blocklist struct {
+	infoHashesPath string
+	patternsPath   string
+
+	mx         sync.RWMutex
+	infoHashes map[[20]byte]struct{}
+	// pattern is the alternation of all patterns, nil if there are none.
+	pattern *regexp.Regexp
+}
+
+// NewBlocklist loads a Blocklist from the given files, either of which might be empty to skip it.
+//
+// The info hashes file must consist of one hex-encoded info hash per line, and the patterns file of
+// one regular expression per line following the syntax of the regexp package, which is matched
+// against the name and against each file path of the torrents (use the (?i) flag for
+// case-insensitive matching). Empty lines and lines starting with # are ignored in both.
+func NewBlocklist(infoHashesPath, patternsPath string) (*Blocklist, error) {
+	b := new(Blocklist)
+	b.infoHashesPath = infoHashesPath
+	b.patternsPath = patternsPath
+
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Reload reads the files of the blocklist again. On error, the blocklist is left unchanged.
+func (b *Blocklist) Reload() error {
+	infoHashes := make(map[[20]byte]struct{})
+	if b.infoHashesPath != "" {
+		err := readRuleLines(b.infoHashesPath, func(line string) error {
+			var infoHash [20]byte
+			if n, err := hex.Decode(infoHash[:], []byte(line)); err != nil || n != 20 || len(line) != 40 {
+				return fmt.Errorf("%q is not a hex-encoded info hash", line)
+			}
+			infoHashes[infoHash] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return errors.New("info hashes " + err.Error())
+		}
+	}
+
+	var patterns []string
+	if b.patternsPath != "" {
+		err := readRuleLines(b.patternsPath, func(line string) error {
+			if _, err := regexp.Compile(line); err != nil {
+				return err
+			}
+			patterns = append(patterns, "(?:"+line+")")
+			return nil
+		})
+		if err != nil {
+			return errors.New("patterns " + err.Error())
+		}
+	}
+
+	var pattern *regexp.Regexp
+	if len(patterns) != 0 {
+		pattern = regexp.MustCompile(strings.Join(patterns, "|"))
+	}
+
+	b.mx.Lock()
+	b.infoHashes = infoHashes
+	b.pattern = pattern
+	b.mx.Unlock()
+
+	return nil
+}
+
+// IsInfoHashBlocked reports whether the torrent of the given info hash must not be leeched at all.
+func (b *Blocklist) IsInfoHashBlocked(infoHash [20]byte) bool {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+
+	_, blocked := b.infoHashes[infoHash]
+	return blocked
+}
+
+// InfoHashes returns the info hashes of the blocklist, in no particular order.
+func (b *Blocklist) InfoHashes() [][]byte {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+
+	infoHashes := make([][]byte, 0, len(b.infoHashes))
+	for infoHash := range b.infoHashes {
+		infoHashes = append(infoHashes, append([]byte(nil), infoHash[:]...))
+	}
+	return infoHashes
+}
+
+// Pattern returns the alternation of all the patterns of the blocklist, or nil if there are none.
+func (b *Blocklist) Pattern() *regexp.Regexp {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+
+	return b.pattern
+}
+
+func (b *Blocklist) Process(md *Metadata) (bool, error) {
+	var infoHash [20]byte
+	copy(infoHash[:], md.InfoHash)
+	if b.IsInfoHashBlocked(infoHash) {
+		return false, nil
+	}
+
+	pattern := b.Pattern()
+	if pattern == nil {
+		return true, nil
+	}
+
+	if pattern.MatchString(md.Name) {
+		return false, nil
+	}
+	for _, file := range md.Files {
+		if pattern.MatchString(file.Path) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
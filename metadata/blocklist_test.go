@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+func TestBlocklist(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	infoHashesPath := filepath.Join(dir, "infohashes")
+	patternsPath := filepath.Join(dir, "patterns")
+
+	blockedInfoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+	if err := os.WriteFile(infoHashesPath, []byte("# comment\ndeadbeef00000000000000000000000000000000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(patternsPath, []byte("(?i)forbidden\n\\.exe$\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	blocklist, err := NewBlocklist(infoHashesPath, patternsPath)
+	if err != nil {
+		t.Fatalf("NewBlocklist() error = %v", err)
+	}
+
+	if !blocklist.IsInfoHashBlocked(blockedInfoHash) {
+		t.Error("IsInfoHashBlocked() of a blocked info hash = false")
+	}
+	if blocklist.IsInfoHashBlocked([20]byte{1}) {
+		t.Error("IsInfoHashBlocked() of an allowed info hash = true")
+	}
+	if n := len(blocklist.InfoHashes()); n != 1 {
+		t.Errorf("len(InfoHashes()) = %d, want 1", n)
+	}
+
+	tests := []struct {
+		md   Metadata
+		keep bool
+	}{
+		{Metadata{InfoHash: blockedInfoHash[:], Name: "allowed"}, false},
+		{Metadata{InfoHash: []byte{1}, Name: "allowed", Files: []persistence.File{{Path: "allowed.txt"}}}, true},
+		{Metadata{InfoHash: []byte{1}, Name: "FORBIDDEN", Files: []persistence.File{{Path: "allowed.txt"}}}, false},
+		{Metadata{InfoHash: []byte{1}, Name: "allowed", Files: []persistence.File{{Path: "allowed.txt"}, {Path: "setup.exe"}}}, false},
+	}
+	for _, tt := range tests {
+		keep, err := blocklist.Process(&tt.md)
+		if err != nil || keep != tt.keep {
+			t.Errorf("Blocklist.Process(%+v) = %v, %v, want %v, nil", tt.md, keep, err, tt.keep)
+		}
+	}
+
+	// A failed reload must leave the blocklist unchanged.
+	if err = os.WriteFile(patternsPath, []byte("(\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = blocklist.Reload(); err == nil {
+		t.Error("Reload() of an invalid regexp did not err")
+	}
+	if blocklist.Pattern() == nil || !blocklist.Pattern().MatchString("forbidden") {
+		t.Error("Pattern() changed after a failed reload")
+	}
+
+	if err = os.WriteFile(infoHashesPath, []byte(""), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(patternsPath, []byte(""), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = blocklist.Reload(); err != nil {
+		t.Errorf("Reload() error = %v", err)
+	}
+	if blocklist.IsInfoHashBlocked(blockedInfoHash) || blocklist.Pattern() != nil {
+		t.Error("Reload() did not clear the blocklist")
+	}
+}
+
+func TestNewBlocklist_InvalidInfoHash(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "infohashes")
+	if err := os.WriteFile(path, []byte("deadbeef\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBlocklist(path, ""); err == nil {
+		t.Error("NewBlocklist() of an invalid info hash did not err")
+	}
+}
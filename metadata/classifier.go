@@ -0,0 +1,129 @@
+package metadata
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+// dominantShare is the minimum share of the total size that the files of a category must add up to
+// for the torrent to be classified as such.
+const dominantShare = 0.5
+
+var extensionCategories = map[string]persistence.Category{
+	".3gp": persistence.Video, ".avi": persistence.Video, ".flv": persistence.Video,
+	".m2ts": persistence.Video, ".m4v": persistence.Video, ".mkv": persistence.Video,
+	".mov": persistence.Video, ".mp4": persistence.Video, ".mpeg": persistence.Video,
+	".mpg": persistence.Video, ".ogv": persistence.Video, ".ts": persistence.Video,
+	".vob": persistence.Video, ".webm": persistence.Video, ".wmv": persistence.Video,
+
+	".aac": persistence.Audio, ".aiff": persistence.Audio, ".alac": persistence.Audio,
+	".ape": persistence.Audio, ".dsf": persistence.Audio, ".flac": persistence.Audio,
+	".m4a": persistence.Audio, ".m4b": persistence.Audio, ".mp3": persistence.Audio,
+	".ogg": persistence.Audio, ".opus": persistence.Audio, ".wav": persistence.Audio,
+	".wma": persistence.Audio, ".wv": persistence.Audio,
+
+	".apk": persistence.Software, ".appimage": persistence.Software, ".bin": persistence.Software,
+	".deb": persistence.Software, ".dmg": persistence.Software, ".exe": persistence.Software,
+	".img": persistence.Software, ".iso": persistence.Software, ".jar": persistence.Software,
+	".msi": persistence.Software, ".pkg": persistence.Software, ".rpm": persistence.Software,
+
+	".azw": persistence.Ebook, ".azw3": persistence.Ebook, ".cbr": persistence.Ebook,
+	".cbz": persistence.Ebook, ".djvu": persistence.Ebook, ".epub": persistence.Ebook,
+	".fb2": persistence.Ebook, ".mobi": persistence.Ebook, ".pdf": persistence.Ebook,
+
+	".7z": persistence.Archive, ".bz2": persistence.Archive, ".gz": persistence.Archive,
+	".rar": persistence.Archive, ".tar": persistence.Archive, ".tgz": persistence.Archive,
+	".xz": persistence.Archive, ".zip": persistence.Archive, ".zst": persistence.Archive,
+
+	".bmp": persistence.Images, ".cr2": persistence.Images, ".gif": persistence.Images,
+	".heic": persistence.Images, ".jpeg": persistence.Images, ".jpg": persistence.Images,
+	".nef": persistence.Images, ".png": persistence.Images, ".psd": persistence.Images,
+	".tif": persistence.Images, ".tiff": persistence.Images, ".webp": persistence.Images,
+}
+
+// splitArchiveRE matches the extensions of the volumes of split archives (e.g. `.r00`, `.001`).
+var splitArchiveRE = regexp.MustCompile(`^\.(?:r\d{2}|\d{3})$`)
+
+// namePatterns are tried in order when the files of a torrent are not conclusive.
+var namePatterns = []struct {
+	category persistence.Category
+	re       *regexp.Regexp
+}{
+	{persistence.Video, regexp.MustCompile(`(?i)\b(?:s\d{1,2}e\d{1,3}|(?:480|576|720|1080|2160)[pi]|[xh]\.?26[45]|hevc|xvid|divx|blu-?ray|[bh]drip|brrip|web-?(?:dl|rip)|hdtv|dvdrip|remux)\b`)},
+	{persistence.Audio, regexp.MustCompile(`(?i)\b(?:flac|mp3|aac|\d{3}\s?kbps|lossless|discography|vinyl)\b`)},
+	{persistence.Ebook, regexp.MustCompile(`(?i)\b(?:e-?books?|epub|mobi|azw3)\b`)},
+	{persistence.Software, regexp.MustCompile(`(?i)\b(?:x86|x64|amd64|arm64|macos|setup|installer|portable)\b`)},
+	{persistence.Images, regexp.MustCompile(`(?i)\b(?:wallpapers?|photos|pictures|imageset)\b`)},
+}
+
+// classifiedCategories is the order in which categories are considered, so that ties are broken
+// deterministically.
+var classifiedCategories = []persistence.Category{
+	persistence.Video,
+	persistence.Audio,
+	persistence.Software,
+	persistence.Ebook,
+	persistence.Archive,
+	persistence.Images,
+}
+
+// Classifier is a Processor that assigns a category to the torrents by the extensions of their
+// files, weighted by size. The names of the torrents are used when the files alone are not
+// conclusive, or when they are archives (as are scene releases, split into RAR volumes).
+//
+// Classifier never discards any torrents.
+type Classifier struct{}
+
+func (Classifier) Process(md *Metadata) (bool, error) {
+	md.classification = classify(md.Name, md.Files)
+	return true, nil
+}
+
+func classify(name string, files []persistence.File) persistence.Category {
+	var totalSize uint64
+	sizes := make(map[persistence.Category]uint64)
+	for _, file := range files {
+		if file.Size <= 0 {
+			continue
+		}
+		totalSize += uint64(file.Size)
+		sizes[fileCategory(file.Path)] += uint64(file.Size)
+	}
+
+	dominant := persistence.Uncategorised
+	var dominantSize uint64
+	for _, category := range classifiedCategories {
+		if sizes[category] > dominantSize {
+			dominant, dominantSize = category, sizes[category]
+		}
+	}
+	if float64(dominantSize) < dominantShare*float64(totalSize) {
+		dominant = persistence.Uncategorised
+	}
+
+	if dominant != persistence.Uncategorised && dominant != persistence.Archive {
+		return dominant
+	}
+
+	for _, pattern := range namePatterns {
+		if pattern.re.MatchString(name) {
+			return pattern.category
+		}
+	}
+
+	return dominant
+}
+
+func fileCategory(filePath string) persistence.Category {
+	ext := strings.ToLower(path.Ext(filePath))
+	if category, ok := extensionCategories[ext]; ok {
+		return category
+	}
+	if splitArchiveRE.MatchString(ext) {
+		return persistence.Archive
+	}
+	return persistence.Uncategorised
+}
@@ -0,0 +1,90 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+func TestClassify(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		files []persistence.File
+		want  persistence.Category
+	}{
+		{
+			name:  "Big Buck Bunny",
+			files: []persistence.File{{Size: 1 << 30, Path: "Big Buck Bunny/bbb.MKV"}, {Size: 1 << 10, Path: "Big Buck Bunny/bbb.nfo"}},
+			want:  persistence.Video,
+		},
+		{
+			name:  "Some Album",
+			files: []persistence.File{{Size: 30 << 20, Path: "01.flac"}, {Size: 30 << 20, Path: "02.flac"}, {Size: 1 << 20, Path: "cover.jpg"}},
+			want:  persistence.Audio,
+		},
+		{
+			name:  "ubuntu-22.04-desktop-amd64.iso",
+			files: []persistence.File{{Size: 4 << 30, Path: "ubuntu-22.04-desktop-amd64.iso"}},
+			want:  persistence.Software,
+		},
+		{
+			name:  "A Book",
+			files: []persistence.File{{Size: 1 << 20, Path: "A Book.epub"}},
+			want:  persistence.Ebook,
+		},
+		{
+			name:  "Some.Show.S01E02.1080p.WEB-DL",
+			files: []persistence.File{{Size: 100 << 20, Path: "show.rar"}, {Size: 100 << 20, Path: "show.r00"}},
+			want:  persistence.Video,
+		},
+		{
+			name:  "backup",
+			files: []persistence.File{{Size: 100 << 20, Path: "backup.7z.001"}, {Size: 100 << 20, Path: "backup.7z.002"}},
+			want:  persistence.Archive,
+		},
+		{
+			name:  "Holiday",
+			files: []persistence.File{{Size: 5 << 20, Path: "a.JPG"}, {Size: 5 << 20, Path: "b.png"}},
+			want:  persistence.Images,
+		},
+		{
+			name:  "Something 1080p",
+			files: []persistence.File{{Size: 1 << 20, Path: "a.dat"}},
+			want:  persistence.Video,
+		},
+		{
+			name:  "Something",
+			files: []persistence.File{{Size: 1 << 20, Path: "a.dat"}, {Size: 1 << 19, Path: "a.mp3"}},
+			want:  persistence.Uncategorised,
+		},
+		{
+			name:  "Nothing",
+			files: nil,
+			want:  persistence.Uncategorised,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := classify(tt.name, tt.files); got != tt.want {
+			t.Errorf("classify(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClassifier_Process(t *testing.T) {
+	t.Parallel()
+
+	md := &Metadata{
+		Name:  "A Book",
+		Files: []persistence.File{{Size: 1 << 20, Path: "A Book.pdf"}},
+	}
+	keep, err := Classifier{}.Process(md)
+	if !keep || err != nil {
+		t.Errorf("Classifier.Process() = %v, %v, want true, nil", keep, err)
+	}
+	if md.Classification() != persistence.Ebook {
+		t.Errorf("Classification() = %v, want %v", md.Classification(), persistence.Ebook)
+	}
+}
@@ -20,8 +20,11 @@ import (
 const MAX_METADATA_SIZE = 10 * 1024 * 1024
 
 type rootDict struct {
-	M            mDict `bencode:"m"`
-	MetadataSize int   `bencode:"metadata_size"`
+	M            mDict  `bencode:"m"`
+	MetadataSize int    `bencode:"metadata_size"`
+	V            string `bencode:"v"`
+	YourIP       string `bencode:"yourip"`
+	Reqq         int    `bencode:"reqq"`
 }
 
 type mDict struct {
@@ -45,12 +48,18 @@ type Leech struct {
 	metadataReceived, metadataSize uint
 	metadata                       []byte
 
+	// Fields of the extension handshake of the remote peer, see BEP 10.
+	client string
+	yourIP net.IP
+	reqq   int
+
 	connClosed bool
 }
 
 type LeechEventHandlers struct {
-	OnSuccess func(Metadata)        // must be supplied. args: metadata
-	OnError   func([20]byte, error) // must be supplied. args: infohash, error
+	OnSuccess     func(Metadata)         // must be supplied. args: metadata
+	OnError       func([20]byte, error)  // must be supplied. args: infohash, error
+	OnExHandshake func([20]byte, string) // optional. args: infohash, client name
 }
 
 func NewLeech(infoHash [20]byte, peerAddr *net.TCPAddr, clientID []byte, ev LeechEventHandlers) *Leech {
@@ -142,6 +151,17 @@ func (l *Leech) doExHandshake() error {
 	l.metadataSize = uint(rRootDict.MetadataSize)
 	l.metadata = make([]byte, l.metadataSize)
 
+	// The rest is informational only, hence peers that omit (or garble) it are not rejected.
+	l.client = rRootDict.V
+	if len(rRootDict.YourIP) == net.IPv4len || len(rRootDict.YourIP) == net.IPv6len {
+		l.yourIP = net.IP(rRootDict.YourIP)
+	}
+	l.reqq = rRootDict.Reqq
+
+	if l.ev.OnExHandshake != nil {
+		l.ev.OnExHandshake(l.infoHash, l.client)
+	}
+
 	return nil
 }
 
@@ -421,6 +441,10 @@ func (l *Leech) Do(deadline time.Time) {
 		TotalSize:    totalSize,
 		DiscoveredOn: time.Now().Unix(),
 		Files:        files,
+		Client:       l.client,
+		YourIP:       l.yourIP,
+		Reqq:         l.reqq,
+		MetadataSize: l.metadataSize,
 	})
 }
 
@@ -44,3 +44,27 @@ func TestDecoder(t *testing.T) {
 		}
 	}
 }
+
+func TestRootDict(t *testing.T) {
+	t.Parallel()
+
+	dump := []byte("d1:md11:ut_metadatai3ee13:metadata_sizei31235e4:reqqi250e1:v15:qBittorrent 4.66:yourip4:\x7f\x00\x00\x01e")
+
+	rRootDict := new(rootDict)
+	if err := bencode.Unmarshal(dump, rRootDict); err != nil {
+		t.Fatalf("Couldn't unmarshal the extension handshake! %s", err.Error())
+	}
+
+	if rRootDict.M.UTMetadata != 3 || rRootDict.MetadataSize != 31235 {
+		t.Errorf("ut_metadata or metadata_size were not decoded correctly: %+v", rRootDict)
+	}
+	if rRootDict.V != "qBittorrent 4.6" {
+		t.Errorf("Expected v to be %q, but got %q", "qBittorrent 4.6", rRootDict.V)
+	}
+	if rRootDict.YourIP != "\x7f\x00\x00\x01" {
+		t.Errorf("Expected yourip to be 127.0.0.1, but got %q", rRootDict.YourIP)
+	}
+	if rRootDict.Reqq != 250 {
+		t.Errorf("Expected reqq to be 250, but got %d", rRootDict.Reqq)
+	}
+}
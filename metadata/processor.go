@@ -0,0 +1,138 @@
+package metadata
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Processor is a stage that the metadata goes through after it has been fetched and before it is
+// persisted. Process may modify the metadata in place, and returns keep as false if the metadata
+// must be discarded.
+type Processor interface {
+	Process(md *Metadata) (keep bool, err error)
+}
+
+// Pipeline is a Processor that runs its processors in order, stopping at the first one that either
+// discards the metadata or errs.
+type Pipeline []Processor
+
+func (p Pipeline) Process(md *Metadata) (bool, error) {
+	for _, processor := range p {
+		keep, err := processor.Process(md)
+		if err != nil {
+			return false, err
+		}
+		if !keep {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// NameNormaliser normalises the name of the torrent to the Unicode NFC form, replaces control
+// characters with spaces, collapses consecutive spaces and trims them. Torrents whose names are
+// left empty are discarded.
+type NameNormaliser struct{}
+
+func (NameNormaliser) Process(md *Metadata) (bool, error) {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.IsSpace(r) {
+			return ' '
+		}
+		return r
+	}, norm.NFC.String(md.Name))
+
+	md.Name = strings.Join(strings.Fields(name), " ")
+	return md.Name != "", nil
+}
+
+// SizeFilter discards the torrents whose total size is less than Min, or greater than Max if Max is
+// not zero.
+type SizeFilter struct {
+	Min uint64
+	Max uint64
+}
+
+func (f SizeFilter) Process(md *Metadata) (bool, error) {
+	if md.TotalSize < f.Min {
+		return false, nil
+	}
+	if f.Max != 0 && md.TotalSize > f.Max {
+		return false, nil
+	}
+	return true, nil
+}
+
+// FileCountFilter discards the torrents that consist of less than Min files, or more than Max
+// files if Max is not zero.
+type FileCountFilter struct {
+	Min uint
+	Max uint
+}
+
+func (f FileCountFilter) Process(md *Metadata) (bool, error) {
+	nFiles := uint(len(md.Files))
+	if nFiles < f.Min {
+		return false, nil
+	}
+	if f.Max != 0 && nFiles > f.Max {
+		return false, nil
+	}
+	return true, nil
+}
+
+// DropRules discards the torrents whose names contain any of its keywords (case-insensitively), or
+// match any of its regular expressions.
+type DropRules struct {
+	keywords []string
+	patterns []*regexp.Regexp
+}
+
+// LoadDropRules reads the drop rules from the file at path, which must consist of one rule per
+// line:
+//
+//	re:<REGEXP>
+//	<KEYWORD>
+//
+// where <REGEXP> follows the syntax of the regexp package (use the (?i) flag for case-insensitive
+// matching). Empty lines and lines starting with # are ignored.
+func LoadDropRules(path string) (*DropRules, error) {
+	rules := new(DropRules)
+	err := readRuleLines(path, func(line string) error {
+		if pattern, isRegexp := strings.CutPrefix(line, "re:"); isRegexp {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return err
+			}
+			rules.patterns = append(rules.patterns, re)
+		} else {
+			rules.keywords = append(rules.keywords, strings.ToLower(line))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (r *DropRules) Process(md *Metadata) (bool, error) {
+	name := strings.ToLower(md.Name)
+	for _, keyword := range r.keywords {
+		if strings.Contains(name, keyword) {
+			return false, nil
+		}
+	}
+
+	for _, pattern := range r.patterns {
+		if pattern.MatchString(md.Name) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
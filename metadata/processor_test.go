@@ -0,0 +1,157 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+type processorFunc func(md *Metadata) (bool, error)
+
+func (f processorFunc) Process(md *Metadata) (bool, error) {
+	return f(md)
+}
+
+func TestPipeline_Process(t *testing.T) {
+	t.Parallel()
+
+	var calls int
+	count := processorFunc(func(md *Metadata) (bool, error) {
+		calls++
+		return true, nil
+	})
+	drop := processorFunc(func(md *Metadata) (bool, error) {
+		return false, nil
+	})
+
+	keep, err := Pipeline{count, count}.Process(&Metadata{})
+	if !keep || err != nil || calls != 2 {
+		t.Errorf("Pipeline.Process() = %v, %v after %d calls, want true, nil after 2 calls", keep, err, calls)
+	}
+
+	calls = 0
+	keep, err = Pipeline{count, drop, count}.Process(&Metadata{})
+	if keep || err != nil || calls != 1 {
+		t.Errorf("Pipeline.Process() = %v, %v after %d calls, want false, nil after 1 call", keep, err, calls)
+	}
+
+	keep, err = Pipeline{}.Process(&Metadata{})
+	if !keep || err != nil {
+		t.Errorf("Pipeline{}.Process() = %v, %v, want true, nil", keep, err)
+	}
+}
+
+func TestNameNormaliser_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		want string
+		keep bool
+	}{
+		{"Ubuntu 22.04", "Ubuntu 22.04", true},
+		{"  Ubuntu \t 22.04\n", "Ubuntu 22.04", true},
+		{"Ubuntu\x0022.04", "Ubuntu 22.04", true},
+		{"Café", "Café", true},
+		{" \t\r\n", "", false},
+	}
+
+	for _, tt := range tests {
+		md := &Metadata{Name: tt.name}
+		keep, err := NameNormaliser{}.Process(md)
+		if err != nil {
+			t.Errorf("NameNormaliser.Process(%q) error = %v", tt.name, err)
+		}
+		if keep != tt.keep || md.Name != tt.want {
+			t.Errorf("NameNormaliser.Process(%q) = %q, %v, want %q, %v", tt.name, md.Name, keep, tt.want, tt.keep)
+		}
+	}
+}
+
+func TestSizeFilter_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		filter    SizeFilter
+		totalSize uint64
+		keep      bool
+	}{
+		{SizeFilter{}, 0, true},
+		{SizeFilter{Min: 10}, 9, false},
+		{SizeFilter{Min: 10}, 10, true},
+		{SizeFilter{Max: 10}, 10, true},
+		{SizeFilter{Max: 10}, 11, false},
+		{SizeFilter{Min: 10, Max: 20}, 15, true},
+	}
+
+	for _, tt := range tests {
+		keep, _ := tt.filter.Process(&Metadata{TotalSize: tt.totalSize})
+		if keep != tt.keep {
+			t.Errorf("%+v.Process() of total size %d = %v, want %v", tt.filter, tt.totalSize, keep, tt.keep)
+		}
+	}
+}
+
+func TestFileCountFilter_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		filter FileCountFilter
+		nFiles int
+		keep   bool
+	}{
+		{FileCountFilter{}, 1, true},
+		{FileCountFilter{Min: 2}, 1, false},
+		{FileCountFilter{Min: 2}, 2, true},
+		{FileCountFilter{Max: 2}, 3, false},
+	}
+
+	for _, tt := range tests {
+		keep, _ := tt.filter.Process(&Metadata{Files: make([]persistence.File, tt.nFiles)})
+		if keep != tt.keep {
+			t.Errorf("%+v.Process() of %d files = %v, want %v", tt.filter, tt.nFiles, keep, tt.keep)
+		}
+	}
+}
+
+func TestDropRules(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "drop-rules")
+	rules := "# comment\n\nSample\nre:(?i)\\bcam(rip)?\\b\n"
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dropRules, err := LoadDropRules(path)
+	if err != nil {
+		t.Fatalf("LoadDropRules() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		keep bool
+	}{
+		{"Ubuntu 22.04", true},
+		{"A Movie SAMPLE", false},
+		{"A Movie CAMRip", false},
+		{"A Movie Cam", false},
+		{"Camera Manual", true},
+	}
+
+	for _, tt := range tests {
+		keep, err := dropRules.Process(&Metadata{Name: tt.name})
+		if err != nil || keep != tt.keep {
+			t.Errorf("DropRules.Process(%q) = %v, %v, want %v, nil", tt.name, keep, err, tt.keep)
+		}
+	}
+
+	if err = os.WriteFile(path, []byte("re:(\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadDropRules(path); err == nil {
+		t.Error("LoadDropRules() of an invalid regexp did not err")
+	}
+}
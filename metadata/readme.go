@@ -0,0 +1,145 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/tgragnato/magnetico/persistence"
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	// MaxReadmeSize is the size of the largest readme fetched, in bytes.
+	MaxReadmeSize = 50 * 1024
+	// ReadmeTimeout is how long fetching a readme from the swarm of its torrent may take.
+	ReadmeTimeout = 30 * time.Second
+	nfoSuffix     = ".nfo"
+	readmePrefix  = "readme"
+)
+
+var (
+	ErrNoReadme       = errors.New("the torrent has no readme")
+	ErrReadmeTooLarge = errors.New("the readme of the torrent is too large")
+)
+
+// IsReadme reports whether the file of the given path is the readme of its torrent: an NFO file, or
+// a file whose name starts with "readme" (as in README, or ReadMe.txt), regardless of the case.
+func IsReadme(filePath string) bool {
+	name := strings.ToLower(path.Base(filePath))
+	return strings.HasSuffix(name, nfoSuffix) || strings.HasPrefix(name, readmePrefix)
+}
+
+// HasReadme reports whether any of the files is a readme, see IsReadme.
+func HasReadme(files []persistence.File) bool {
+	for _, file := range files {
+		if IsReadme(file.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadmeFetcher downloads the readmes of torrents from their swarms, without downloading any other
+// file.
+type ReadmeFetcher struct {
+	client  *torrent.Client
+	tempDir string
+}
+
+func NewReadmeFetcher() (*ReadmeFetcher, error) {
+	f := new(ReadmeFetcher)
+	var err error
+
+	f.tempDir, err = os.MkdirTemp("", "magnetico_")
+	if err != nil {
+		return nil, err
+	}
+
+	config := torrent.NewDefaultClientConfig()
+	config.ListenPort = 0
+	config.DefaultStorage = storage.NewFileByInfoHash(f.tempDir)
+
+	f.client, err = torrent.NewClient(config)
+	if err != nil {
+		_ = os.RemoveAll(f.tempDir)
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *ReadmeFetcher) Close() {
+	f.client.Close()
+	_ = os.RemoveAll(f.tempDir)
+}
+
+// Fetch downloads the readme of the torrent of the given info hash, giving up once the context is
+// done. Returns ErrNoReadme if the torrent has no readme, and ErrReadmeTooLarge if it is larger than
+// MaxReadmeSize.
+func (f *ReadmeFetcher) Fetch(ctx context.Context, infoHash []byte) (*persistence.Readme, error) {
+	t, err := f.client.AddMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash))
+	if err != nil {
+		return nil, errors.New("AddMagnet " + err.Error())
+	}
+	defer t.Drop()
+
+	select {
+	case <-t.GotInfo():
+	case <-ctx.Done():
+		return nil, errors.New("waiting for the info " + ctx.Err().Error())
+	}
+
+	t.CancelPieces(0, t.NumPieces())
+
+	// The display paths are the paths of the files as stored in the database (see Leech), without
+	// the name of the torrent which Path() is prefixed with.
+	var file *torrent.File
+	for _, candidate := range t.Files() {
+		if IsReadme(candidate.DisplayPath()) {
+			file = candidate
+			break
+		}
+	}
+	if file == nil {
+		return nil, ErrNoReadme
+	}
+	if file.Length() > MaxReadmeSize {
+		return nil, ErrReadmeTooLarge
+	}
+
+	file.Download()
+	reader := file.NewReader()
+	defer reader.Close()
+
+	content := make([]byte, file.Length())
+	for n := 0; n < len(content); {
+		m, err := reader.ReadContext(ctx, content[n:])
+		n += m
+		if err == io.EOF && n == len(content) {
+			break
+		} else if err != nil {
+			return nil, errors.New("reading the readme " + err.Error())
+		}
+	}
+
+	if strings.HasSuffix(strings.ToLower(file.DisplayPath()), nfoSuffix) {
+		content, err = charmap.CodePage437.NewDecoder().Bytes(content)
+		if err != nil {
+			return nil, errors.New("decoding the readme " + err.Error())
+		}
+	}
+
+	// Because .nfo files are right padded with \x00'es.
+	content = bytes.TrimRight(content, "\x00")
+
+	return &persistence.Readme{Path: file.DisplayPath(), Content: string(content)}, nil
+}
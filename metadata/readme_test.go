@@ -0,0 +1,45 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/tgragnato/magnetico/persistence"
+)
+
+func TestIsReadme(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"README", true},
+		{"dir/ReadMe.txt", true},
+		{"Some.Release.NFO", true},
+		{"info.nfo", true},
+		{"movie.mkv", false},
+		{"nfo/movie.mkv", false},
+		{"Thread.mkv", false},
+		{"Already.mp3", false},
+		{"readme/movie.mkv", false},
+	}
+	for _, tt := range tests {
+		if got := IsReadme(tt.path); got != tt.want {
+			t.Errorf("IsReadme(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestHasReadme(t *testing.T) {
+	t.Parallel()
+
+	if HasReadme(nil) {
+		t.Error("HasReadme() of no files = true, want false")
+	}
+	if HasReadme([]persistence.File{{Size: 1, Path: "movie.mkv"}}) {
+		t.Error("HasReadme() of no readme = true, want false")
+	}
+	if !HasReadme([]persistence.File{{Size: 1, Path: "movie.mkv"}, {Size: 1, Path: "movie.nfo"}}) {
+		t.Error("HasReadme() of an NFO file = false, want true")
+	}
+}
@@ -1,9 +1,11 @@
 package metadata
 
 import (
+	"context"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgragnato/magnetico/dht"
@@ -27,8 +29,36 @@ type Metadata struct {
 	DiscoveredOn int64
 	// Files must be populated for both single-file and multi-file torrents!
 	Files []persistence.File
-	// Content classification
-	classification int
+	// Content classification, see Classifier.
+	classification persistence.Category
+
+	// Client is the name (and the version) of the client of the peer that sent the metadata, as
+	// advertised in its extension handshake; might be empty.
+	Client string
+	// YourIP is our address as seen by the peer that sent the metadata; might be nil.
+	YourIP net.IP
+	// Reqq is the number of outstanding requests the peer that sent the metadata supports.
+	Reqq int
+	// MetadataSize is the size of the info dictionary in bytes.
+	MetadataSize uint
+
+	// NPeers is the number of peers that were known for the torrent when it was first seen.
+	NPeers int
+	// Clients are the distinct client names advertised by all the peers that were tried while
+	// fetching the metadata.
+	Clients []string
+}
+
+// Classification returns the category assigned to the torrent by the Classifier, if any.
+func (md *Metadata) Classification() persistence.Category {
+	return md.classification
+}
+
+type incomingInfoHash struct {
+	// peers are the peers yet to be tried, in order.
+	peers   []net.TCPAddr
+	nPeers  int
+	clients []string
 }
 
 type Sink struct {
@@ -37,9 +67,16 @@ type Sink struct {
 	maxNLeeches int
 	drain       chan Metadata
 
-	incomingInfoHashes   map[[20]byte][]net.TCPAddr
+	incomingInfoHashes   map[[20]byte]*incomingInfoHash
 	incomingInfoHashesMx sync.RWMutex
 
+	// leeches are the leeches in flight, which are waited for by Shutdown.
+	leeches sync.WaitGroup
+	// stopping is set once Shutdown is called, after which no more leeches are started.
+	stopping atomic.Bool
+
+	// drainMx guards terminated, so that drain is never closed while a flush is sending on it.
+	drainMx     sync.RWMutex
 	terminated  bool
 	termination chan interface{}
 }
@@ -51,16 +88,19 @@ func NewSink(deadline time.Duration, maxNLeeches int) *Sink {
 	ms.deadline = deadline
 	ms.maxNLeeches = maxNLeeches
 	ms.drain = make(chan Metadata, 10)
-	ms.incomingInfoHashes = make(map[[20]byte][]net.TCPAddr)
+	ms.incomingInfoHashes = make(map[[20]byte]*incomingInfoHash)
 	ms.termination = make(chan interface{})
 
 	return ms
 }
 
 func (ms *Sink) Sink(res dht.Result) {
-	if ms.terminated {
+	if ms.isTerminated() {
 		log.Panicln("Trying to Sink() an already closed Sink!")
 	}
+	if ms.stopping.Load() {
+		return
+	}
 
 	// cap the max # of leeches
 	ms.incomingInfoHashesMx.RLock()
@@ -82,60 +122,142 @@ func (ms *Sink) Sink(res dht.Result) {
 
 	peer := peerAddrs[0]
 	ms.incomingInfoHashesMx.Lock()
-	ms.incomingInfoHashes[infoHash] = peerAddrs[1:]
+	ms.incomingInfoHashes[infoHash] = &incomingInfoHash{
+		peers:  peerAddrs[1:],
+		nPeers: len(peerAddrs),
+	}
 	ms.incomingInfoHashesMx.Unlock()
 
-	go NewLeech(infoHash, &peer, ms.PeerID, LeechEventHandlers{
-		OnSuccess: ms.flush,
-		OnError:   ms.onLeechError,
-	}).Do(time.Now().Add(ms.deadline))
+	ms.leech(infoHash, &peer)
 }
 
 func (ms *Sink) Drain() <-chan Metadata {
-	if ms.terminated {
+	if ms.isTerminated() {
 		log.Panicln("Trying to Drain() an already closed Sink!")
 	}
 	return ms.drain
 }
 
+// Shutdown stops the Sink from starting any more leeches, waits for the ones in flight until they
+// are done or ctx is, and then terminates the Sink. The metadata fetched in the meantime is sent to
+// the drain as usual, hence the caller must keep draining until the drain is closed.
+func (ms *Sink) Shutdown(ctx context.Context) error {
+	ms.stopping.Store(true)
+
+	done := make(chan struct{})
+	go func() {
+		ms.leeches.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	ms.Terminate()
+	return err
+}
+
+// Terminate closes the drain immediately, abandoning the leeches in flight.
 func (ms *Sink) Terminate() {
-	ms.terminated = true
+	ms.stopping.Store(true)
+	// Unblock the flushes waiting on the drain first, so that the lock below can be acquired.
 	close(ms.termination)
+
+	ms.drainMx.Lock()
+	defer ms.drainMx.Unlock()
+	ms.terminated = true
 	close(ms.drain)
 }
 
+func (ms *Sink) isTerminated() bool {
+	ms.drainMx.RLock()
+	defer ms.drainMx.RUnlock()
+	return ms.terminated
+}
+
+func (ms *Sink) leech(infoHash [20]byte, peer *net.TCPAddr) {
+	ms.leeches.Add(1)
+	go func() {
+		defer ms.leeches.Done()
+		NewLeech(infoHash, peer, ms.PeerID, ms.leechEventHandlers()).Do(time.Now().Add(ms.deadline))
+	}()
+}
+
+func (ms *Sink) leechEventHandlers() LeechEventHandlers {
+	return LeechEventHandlers{
+		OnSuccess:     ms.flush,
+		OnError:       ms.onLeechError,
+		OnExHandshake: ms.onLeechExHandshake,
+	}
+}
+
 func (ms *Sink) flush(result Metadata) {
+	ms.drainMx.RLock()
+	defer ms.drainMx.RUnlock()
 	if ms.terminated {
 		return
 	}
 
-	ms.drain <- result
-
 	var infoHash [20]byte
 	copy(infoHash[:], result.InfoHash)
+
+	ms.incomingInfoHashesMx.RLock()
+	if incoming, exists := ms.incomingInfoHashes[infoHash]; exists {
+		result.NPeers = incoming.nPeers
+		result.Clients = append([]string(nil), incoming.clients...)
+	}
+	ms.incomingInfoHashesMx.RUnlock()
+
+	select {
+	case ms.drain <- result:
+	case <-ms.termination:
+		// The Sink has been terminated while waiting for the drain, the metadata is abandoned.
+	}
+
 	ms.delete(infoHash)
 }
 
 func (ms *Sink) onLeechError(infoHash [20]byte, err error) {
-	ms.incomingInfoHashesMx.RLock()
-	peers, exists := ms.incomingInfoHashes[infoHash]
-	ms.incomingInfoHashesMx.RUnlock()
-	if !exists || len(peers) == 0 {
+	ms.incomingInfoHashesMx.Lock()
+	incoming, exists := ms.incomingInfoHashes[infoHash]
+	if !exists {
+		ms.incomingInfoHashesMx.Unlock()
 		return
 	}
-
-	if len(peers) == 1 {
-		ms.delete(infoHash)
-	} else {
-		ms.incomingInfoHashesMx.Lock()
-		ms.incomingInfoHashes[infoHash] = peers[1:]
+	if len(incoming.peers) == 0 || ms.stopping.Load() {
+		delete(ms.incomingInfoHashes, infoHash)
 		ms.incomingInfoHashesMx.Unlock()
+		return
+	}
+	peer := incoming.peers[0]
+	incoming.peers = incoming.peers[1:]
+	ms.incomingInfoHashesMx.Unlock()
+
+	ms.leech(infoHash, &peer)
+}
+
+func (ms *Sink) onLeechExHandshake(infoHash [20]byte, client string) {
+	if client == "" {
+		return
 	}
 
-	go NewLeech(infoHash, &peers[0], ms.PeerID, LeechEventHandlers{
-		OnSuccess: ms.flush,
-		OnError:   ms.onLeechError,
-	}).Do(time.Now().Add(ms.deadline))
+	ms.incomingInfoHashesMx.Lock()
+	defer ms.incomingInfoHashesMx.Unlock()
+
+	incoming, exists := ms.incomingInfoHashes[infoHash]
+	if !exists {
+		return
+	}
+	for _, c := range incoming.clients {
+		if c == client {
+			return
+		}
+	}
+	incoming.clients = append(incoming.clients, client)
 }
 
 func (ms *Sink) delete(infoHash [20]byte) {
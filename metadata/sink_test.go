@@ -1,6 +1,8 @@
 package metadata
 
 import (
+	"context"
+	"errors"
 	"net"
 	"reflect"
 	"testing"
@@ -36,25 +38,50 @@ func (tr *TestResult) PeerAddrs() []net.TCPAddr {
 	return tr.peerAddrs
 }
 
+// nIncoming returns the number of the info hashes that the sink is leeching, under its lock.
+func nIncoming(sink *Sink) int {
+	sink.incomingInfoHashesMx.RLock()
+	defer sink.incomingInfoHashesMx.RUnlock()
+	return len(sink.incomingInfoHashes)
+}
+
 func TestSink_Sink(t *testing.T) {
 	t.Parallel()
 
+	// The peer accepts the connections but never answers, so that the info hash is still being
+	// leeched (rather than given up on) when it is checked.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
 	sink := NewSink(time.Minute, 2)
-	if len(sink.incomingInfoHashes) != 0 {
+	defer sink.Terminate()
+	if nIncoming(sink) != 0 {
 		t.Error("incomingInfoHashes field of Sink has not been initialized correctly")
 	}
 	testResult := &TestResult{
 		infoHash:  [20]byte{255},
-		peerAddrs: []net.TCPAddr{{IP: net.ParseIP("127.0.0.1"), Port: 443, Zone: ""}},
+		peerAddrs: []net.TCPAddr{*listener.Addr().(*net.TCPAddr)},
 	}
 
 	sink.Sink(testResult)
-	if len(sink.incomingInfoHashes) != 1 {
+	if nIncoming(sink) != 1 {
 		t.Error("incomingInfoHashes field of Sink has not been filled in correctly")
 	}
 
 	sink.Sink(testResult)
-	if len(sink.incomingInfoHashes) != 1 {
+	if nIncoming(sink) != 1 {
 		t.Error("the same InfoHash should not be processed multiple times")
 	}
 }
@@ -117,3 +144,83 @@ func TestFlush(t *testing.T) {
 		t.Error("InfoHash was not deleted after flush")
 	}
 }
+
+func TestSink_Swarm(t *testing.T) {
+	t.Parallel()
+
+	sink := NewSink(time.Minute, 1)
+	infoHash := [20]byte{1, 2, 3}
+	sink.incomingInfoHashes[infoHash] = &incomingInfoHash{nPeers: 3}
+
+	sink.onLeechExHandshake(infoHash, "Transmission 4.0")
+	sink.onLeechExHandshake(infoHash, "")
+	sink.onLeechExHandshake(infoHash, "qBittorrent 4.6")
+	sink.onLeechExHandshake(infoHash, "Transmission 4.0")
+
+	go sink.flush(Metadata{InfoHash: infoHash[:]})
+
+	select {
+	case result := <-sink.drain:
+		if result.NPeers != 3 {
+			t.Errorf("Expected NPeers to be 3, but got %d", result.NPeers)
+		}
+		expected := []string{"Transmission 4.0", "qBittorrent 4.6"}
+		if !reflect.DeepEqual(result.Clients, expected) {
+			t.Errorf("Expected Clients to be %v, but got %v", expected, result.Clients)
+		}
+
+	case <-time.After(1 * time.Second):
+		t.Error("Timeout waiting for flush result")
+	}
+}
+
+func TestSink_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	sink := NewSink(time.Minute, 1)
+	infoHash := [20]byte{4, 5, 6}
+	sink.incomingInfoHashes[infoHash] = &incomingInfoHash{nPeers: 1}
+
+	// Pretend a leech is in flight, which succeeds after a while.
+	sink.leeches.Add(1)
+	go func() {
+		defer sink.leeches.Done()
+		time.Sleep(100 * time.Millisecond)
+		sink.flush(Metadata{InfoHash: infoHash[:]})
+	}()
+
+	drain := sink.Drain()
+	errChan := make(chan error, 1)
+	go func() { errChan <- sink.Shutdown(context.Background()) }()
+
+	var drained int
+	for range drain {
+		drained++
+	}
+	if drained != 1 {
+		t.Errorf("Expected 1 metadata to be drained, but got %d", drained)
+	}
+	if err := <-errChan; err != nil {
+		t.Errorf("Expected Shutdown to succeed, but got %v", err)
+	}
+}
+
+func TestSink_Shutdown_Timeout(t *testing.T) {
+	t.Parallel()
+
+	sink := NewSink(time.Minute, 1)
+	sink.leeches.Add(1)
+	defer sink.leeches.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sink.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Shutdown to time out, but got %v", err)
+	}
+	if !sink.terminated {
+		t.Error("terminated field of Sink has not been set to true")
+	}
+
+	// A leech that succeeds after the Sink has been terminated must not panic.
+	sink.flush(Metadata{InfoHash: []byte{1}})
+}
@@ -1,11 +1,14 @@
 package metadata
 
 import (
+	"bufio"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/tgragnato/magnetico/persistence"
@@ -84,3 +87,28 @@ func toBigEndian(i uint, n int) []byte {
 
 	return b
 }
+
+// readRuleLines calls fn for each line of the file at path, skipping empty lines and comments.
+func readRuleLines(path string, fn func(line string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = fn(line); err != nil {
+			return fmt.Errorf("on line %d: %v", lineno, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return errors.New("scanner.Scan " + err.Error())
+	}
+
+	return nil
+}
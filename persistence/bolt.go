@@ -0,0 +1,1582 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.etcd.io/bbolt"
+)
+
+// boltDatabase is an embedded backend built on bbolt, for the builds without cgo.
+//
+// Torrents are stored as JSON records keyed by their IDs, with their files kept apart so that they
+// are decoded only when needed. Ordering is served by buckets whose keys are the big-endian
+// encoding of the ordered value followed by the ID, and full-text search by inverted indices whose
+// keys are the tokens followed by a NUL byte and the ID.
+type boltDatabase struct {
+	db *bbolt.DB
+	// filesIndex is whether the files_idx bucket exists, see setupFilesIndex.
+	filesIndex bool
+}
+
+var (
+	boltTorrents     = []byte("torrents")
+	boltFiles        = []byte("files")
+	boltInfoHashes   = []byte("info_hashes")
+	boltDiscoveredOn = []byte("discovered_on_idx")
+	boltTotalSize    = []byte("total_size_idx")
+	boltNFiles       = []byte("n_files_idx")
+	boltNames        = []byte("names_idx")
+	boltPaths        = []byte("files_idx")
+	boltStatistics   = []byte("statistics_hourly")
+	boltReadmes      = []byte("readmes")
+	boltCurations    = []byte("curations")
+	boltTags         = []byte("tags_idx")
+	boltUsers        = []byte("users")
+	boltTokens       = []byte("tokens")
+)
+
+// boltTorrent is the record of a torrent, as stored in the torrents bucket.
+type boltTorrent struct {
+	InfoHash      []byte   `json:"h"`
+	Name          string   `json:"n"`
+	TotalSize     uint64   `json:"s"`
+	DiscoveredOn  int64    `json:"d"`
+	NFiles        uint     `json:"f"`
+	Category      uint8    `json:"c,omitempty"`
+	NInitialPeers uint     `json:"p,omitempty"`
+	Clients       []string `json:"l,omitempty"`
+}
+
+// boltCuration is the record of what the users recorded about a torrent, as stored in the curations
+// bucket. The torrents tagged with each tag are indexed by the tags_idx bucket, whose keys are the
+// tag followed by a NUL byte and the ID of the torrent.
+type boltCuration struct {
+	Tags    []string `json:"t,omitempty"`
+	Note    string   `json:"n,omitempty"`
+	Starred bool     `json:"s,omitempty"`
+}
+
+// boltUser is the record of a user, as stored in the users bucket keyed by its name.
+type boltUser struct {
+	PasswordHash []byte `json:"p"`
+	Role         Role   `json:"r"`
+}
+
+// boltToken is the record of a token, as stored in the tokens bucket keyed by its ID. Users have
+// few tokens, hence the tokens of a user are found by walking the bucket rather than by an index.
+type boltToken struct {
+	Hash      []byte `json:"h"`
+	User      string `json:"u"`
+	Name      string `json:"n,omitempty"`
+	Session   bool   `json:"s,omitempty"`
+	CreatedOn int64  `json:"c"`
+	ExpiresOn int64  `json:"e,omitempty"`
+}
+
+// boltAggregate is the record of the torrents discovered in an hour, as stored in the
+// statistics_hourly bucket keyed by the big-endian encoding of the Unix time of its start.
+type boltAggregate struct {
+	NDiscovered int64 `json:"d"`
+	NFiles      int64 `json:"f"`
+	TotalSize   int64 `json:"s"`
+}
+
+func makeBoltDatabase(url_ *url.URL) (Database, error) {
+	db := new(boltDatabase)
+
+	filesIndex, err := popFilesIndexOption(url_)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both bolt:///absolute/path and bolt://relative/path are accepted.
+	path := url_.Host + url_.Path
+	if path == "" {
+		return nil, fmt.Errorf("the path of the database is missing")
+	}
+
+	db.db, err = bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.New("bbolt.Open " + err.Error())
+	}
+
+	err = db.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{boltTorrents, boltFiles, boltInfoHashes, boltDiscoveredOn, boltTotalSize, boltNFiles, boltNames, boltReadmes, boltCurations, boltTags, boltUsers, boltTokens} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return errors.New("CreateBucketIfNotExists " + err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.db.Close()
+		return nil, errors.New("setupDatabase " + err.Error())
+	}
+
+	if err := db.setupStatistics(); err != nil {
+		_ = db.db.Close()
+		return nil, errors.New("setupStatistics " + err.Error())
+	}
+
+	if err := db.setupFilesIndex(filesIndex); err != nil {
+		_ = db.db.Close()
+		return nil, errors.New("setupFilesIndex " + err.Error())
+	}
+
+	return db, nil
+}
+
+func (db *boltDatabase) Engine() databaseEngine {
+	return Bolt
+}
+
+func (db *boltDatabase) DoesTorrentExist(ctx context.Context, infoHash []byte) (bool, error) {
+	var exists bool
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		exists = tx.Bucket(boltInfoHashes).Get(infoHash) != nil
+		return nil
+	})
+	return exists, err
+}
+
+func (db *boltDatabase) AddNewTorrent(ctx context.Context, infoHash []byte, name string, files []File, category Category) error {
+	return db.AddNewTorrents(ctx, []Torrent{{InfoHash: infoHash, Name: name, Files: files, Category: category}})
+}
+
+func (db *boltDatabase) AddNewTorrents(ctx context.Context, torrents []Torrent) error {
+	torrents = acceptableTorrents(torrents)
+	if len(torrents) == 0 {
+		return nil
+	}
+
+	return db.update(ctx, func(tx *bbolt.Tx) error {
+		for _, torrent := range torrents {
+			if err := db.addTorrent(tx, &torrent); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// addTorrent adds the torrent to every bucket, unless it exists already. Unlike the other backends,
+// the existence check is race-free as bbolt allows only one read-write transaction at a time.
+func (db *boltDatabase) addTorrent(tx *bbolt.Tx, torrent *Torrent) error {
+	if tx.Bucket(boltInfoHashes).Get(torrent.InfoHash) != nil {
+		return nil
+	}
+
+	id, err := tx.Bucket(boltTorrents).NextSequence()
+	if err != nil {
+		return errors.New("NextSequence " + err.Error())
+	}
+
+	record := &boltTorrent{
+		InfoHash:     torrent.InfoHash,
+		Name:         torrent.Name,
+		TotalSize:    torrent.totalSize(),
+		DiscoveredOn: torrent.DiscoveredOn,
+		NFiles:       uint(len(torrent.Files)),
+		Category:     uint8(torrent.Category),
+	}
+	recordSwarm(record, torrent.Swarm)
+	if err = db.putTorrent(tx, id, record); err != nil {
+		return err
+	}
+	if err = aggregateTorrent(tx, record, 1); err != nil {
+		return err
+	}
+
+	encodedFiles, err := json.Marshal(torrent.Files)
+	if err != nil {
+		return errors.New("json.Marshal (files) " + err.Error())
+	}
+	key := boltID(id)
+	if err = tx.Bucket(boltFiles).Put(key, encodedFiles); err != nil {
+		return errors.New("Put (files) " + err.Error())
+	}
+	if err = tx.Bucket(boltInfoHashes).Put(torrent.InfoHash, key); err != nil {
+		return errors.New("Put (info_hashes) " + err.Error())
+	}
+
+	orderings := map[string]uint64{
+		string(boltDiscoveredOn): uint64(record.DiscoveredOn),
+		string(boltTotalSize):    record.TotalSize,
+		string(boltNFiles):       uint64(record.NFiles),
+	}
+	for bucket, value := range orderings {
+		if err = tx.Bucket([]byte(bucket)).Put(boltOrderKey(value, id), nil); err != nil {
+			return errors.New("Put (" + bucket + ") " + err.Error())
+		}
+	}
+
+	if err = boltIndex(tx.Bucket(boltNames), id, []string{torrent.Name}); err != nil {
+		return errors.New("boltIndex (names) " + err.Error())
+	}
+	if paths := tx.Bucket(boltPaths); paths != nil {
+		if err = boltIndex(paths, id, filePaths(torrent.Files)); err != nil {
+			return errors.New("boltIndex (paths) " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (db *boltDatabase) Close() error {
+	return db.db.Close()
+}
+
+func (db *boltDatabase) GetNumberOfTorrents(ctx context.Context) (uint, error) {
+	var n uint
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		n = uint(tx.Bucket(boltInfoHashes).Stats().KeyN)
+		return nil
+	})
+	return n, err
+}
+
+func (db *boltDatabase) QueryTorrents(
+	ctx context.Context,
+	query string,
+	epoch int64,
+	orderBy OrderingCriteria,
+	ascending bool,
+	limit uint,
+	lastOrderedValue *float64,
+	lastID *uint64,
+	category *Category,
+	scope SearchScope,
+) ([]TorrentMetadata, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkOrdering(q, orderBy); err != nil {
+		return nil, err
+	}
+	if (lastOrderedValue == nil) != (lastID == nil) {
+		return nil, fmt.Errorf("lastOrderedValue and lastID should be supplied together, if supplied")
+	}
+	if (q.HasTerms() || len(q.Excluded) != 0) && scope.files() && !db.filesIndex {
+		return nil, &SearchError{Reason: "file paths cannot be searched since they are not indexed"}
+	}
+
+	var orderBucket []byte
+	switch orderBy {
+	case ByRelevance:
+	case ByTotalSize:
+		orderBucket = boltTotalSize
+	case ByDiscoveredOn:
+		orderBucket = boltDiscoveredOn
+	case ByNFiles:
+		orderBucket = boltNFiles
+	}
+
+	m := &boltMatcher{
+		query:    q,
+		phrases:  tokenizePhrases(q.Terms),
+		excluded: tokenizePhrases(q.Excluded),
+		epoch:    epoch,
+		category: category,
+		scope:    scope,
+	}
+	// after reports whether the (value, id) pair comes after the last one of the previous page.
+	after := func(value float64, id uint64) bool {
+		if lastID == nil {
+			return true
+		}
+		if ascending {
+			return value > *lastOrderedValue || (value == *lastOrderedValue && id > *lastID)
+		}
+		return value < *lastOrderedValue || (value == *lastOrderedValue && id < *lastID)
+	}
+
+	torrents := make([]TorrentMetadata, 0)
+	err = db.view(ctx, func(tx *bbolt.Tx) error {
+		m.tx = tx
+
+		if q.HasTerms() {
+			// Search terms narrow the torrents down to (usually) few, which are ordered in memory.
+			matches, err := m.search(ctx)
+			if err != nil {
+				return err
+			}
+			sort.Slice(matches, func(i, j int) bool {
+				vi, vj := matches[i].OrderedValue(orderBy), matches[j].OrderedValue(orderBy)
+				if vi != vj {
+					return (vi < vj) == ascending
+				}
+				return (matches[i].ID < matches[j].ID) == ascending
+			})
+			for _, torrent := range matches {
+				if uint(len(torrents)) == limit {
+					break
+				}
+				if after(torrent.OrderedValue(orderBy), torrent.ID) {
+					torrents = append(torrents, torrent)
+				}
+			}
+			return nil
+		}
+
+		// Otherwise the ordering bucket is walked from the last torrent of the previous page.
+		c := tx.Bucket(orderBucket).Cursor()
+		var k []byte
+		switch {
+		case lastID == nil && ascending:
+			k, _ = c.First()
+		case lastID == nil:
+			k, _ = c.Last()
+		case ascending:
+			k, _ = c.Seek(boltOrderKey(uint64(*lastOrderedValue), 0))
+		default:
+			if k, _ = c.Seek(boltOrderKey(uint64(*lastOrderedValue)+1, 0)); k == nil {
+				k, _ = c.Last()
+			} else {
+				k, _ = c.Prev()
+			}
+		}
+		for ; k != nil && uint(len(torrents)) < limit; k = boltStep(c, ascending) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			value, id := binary.BigEndian.Uint64(k[:8]), binary.BigEndian.Uint64(k[8:])
+			if !after(float64(value), id) {
+				continue
+			}
+			torrent, ok, err := m.match(id)
+			if err != nil {
+				return err
+			} else if ok {
+				torrents = append(torrents, *torrent)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return torrents, nil
+}
+
+func (db *boltDatabase) GetTorrent(ctx context.Context, infoHash []byte) (*TorrentMetadata, error) {
+	var tm *TorrentMetadata
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		key := tx.Bucket(boltInfoHashes).Get(infoHash)
+		if key == nil {
+			return nil
+		}
+		record, err := getBoltTorrent(tx, key)
+		if err != nil {
+			return err
+		}
+		tm = &TorrentMetadata{
+			InfoHash:     record.InfoHash,
+			Name:         record.Name,
+			Size:         record.TotalSize,
+			DiscoveredOn: record.DiscoveredOn,
+			NFiles:       record.NFiles,
+			Category:     Category(record.Category),
+		}
+		return nil
+	})
+	return tm, err
+}
+
+func (db *boltDatabase) GetFiles(ctx context.Context, infoHash []byte) ([]File, error) {
+	var files []File
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		key := tx.Bucket(boltInfoHashes).Get(infoHash)
+		if key == nil {
+			return nil
+		}
+		var err error
+		files, err = getBoltFiles(tx, key)
+		return err
+	})
+	return files, err
+}
+
+func (db *boltDatabase) GetFilesOfTorrents(ctx context.Context, infoHashes [][]byte) (map[string][]File, error) {
+	files := make(map[string][]File, len(infoHashes))
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		for _, infoHash := range infoHashes {
+			key := tx.Bucket(boltInfoHashes).Get(infoHash)
+			if key == nil {
+				continue
+			}
+			torrentFiles, err := getBoltFiles(tx, key)
+			if err != nil {
+				return err
+			}
+			files[string(infoHash)] = torrentFiles
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (db *boltDatabase) GetStatistics(ctx context.Context, from string, n uint) (*Statistics, error) {
+	fromTime, gran, err := ParseISO8601(from)
+	if err != nil {
+		return nil, errors.New("parsing ISO8601 error " + err.Error())
+	}
+	toTime := statisticsEnd(*fromTime, gran, n)
+	format := statisticsKey(gran)
+
+	// As the periods end on the last second of an hour, the hours within them start after the
+	// beginning and not after the end.
+	stats := NewStatistics()
+	err = db.view(ctx, func(tx *bbolt.Tx) error {
+		c := tx.Bucket(boltStatistics).Cursor()
+		for k, v := c.Seek(boltID(uint64(fromTime.Unix() + 1))); k != nil; k, v = c.Next() {
+			hour := int64(binary.BigEndian.Uint64(k))
+			if hour > toTime.Unix() {
+				break
+			}
+			var record boltAggregate
+			if err := json.Unmarshal(v, &record); err != nil {
+				return errors.New("json.Unmarshal (statistics) " + err.Error())
+			}
+
+			dT := format(time.Unix(hour, 0))
+			stats.NDiscovered[dT] += uint64(record.NDiscovered)
+			stats.TotalSize[dT] += uint64(record.TotalSize)
+			stats.NFiles[dT] += uint64(record.NFiles)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (db *boltDatabase) RecordSwarm(ctx context.Context, infoHash []byte, swarm Swarm) error {
+	return db.update(ctx, func(tx *bbolt.Tx) error {
+		key := tx.Bucket(boltInfoHashes).Get(infoHash)
+		if key == nil {
+			return nil
+		}
+		record, err := getBoltTorrent(tx, key)
+		if err != nil {
+			return err
+		}
+
+		recordSwarm(record, swarm)
+		return db.putTorrent(tx, binary.BigEndian.Uint64(key), record)
+	})
+}
+
+// recordSwarm records the swarm in the torrent, unless it has a number of peers already, and adds
+// the clients that it does not have yet.
+func recordSwarm(record *boltTorrent, swarm Swarm) {
+	if record.NInitialPeers == 0 {
+		record.NInitialPeers = swarm.NPeers
+	}
+	for _, client := range swarm.Clients {
+		known := false
+		for _, c := range record.Clients {
+			known = known || c == client
+		}
+		if !known {
+			record.Clients = append(record.Clients, client)
+		}
+	}
+}
+
+func (db *boltDatabase) GetSwarm(ctx context.Context, infoHash []byte) (*Swarm, error) {
+	var swarm *Swarm
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		key := tx.Bucket(boltInfoHashes).Get(infoHash)
+		if key == nil {
+			return nil
+		}
+		record, err := getBoltTorrent(tx, key)
+		if err != nil {
+			return err
+		}
+
+		swarm = &Swarm{NPeers: record.NInitialPeers, Clients: append([]string{}, record.Clients...)}
+		sort.Strings(swarm.Clients)
+		return nil
+	})
+	return swarm, err
+}
+
+func (db *boltDatabase) GetSwarms(ctx context.Context, infoHashes [][]byte) (map[string]Swarm, error) {
+	swarms := make(map[string]Swarm, len(infoHashes))
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		for _, infoHash := range infoHashes {
+			key := tx.Bucket(boltInfoHashes).Get(infoHash)
+			if key == nil {
+				continue
+			}
+			record, err := getBoltTorrent(tx, key)
+			if err != nil {
+				return err
+			}
+			swarm := Swarm{NPeers: record.NInitialPeers, Clients: append([]string{}, record.Clients...)}
+			sort.Strings(swarm.Clients)
+			swarms[string(infoHash)] = swarm
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return swarms, nil
+}
+
+func (db *boltDatabase) SetReadme(ctx context.Context, infoHash []byte, readme Readme) error {
+	return db.update(ctx, func(tx *bbolt.Tx) error {
+		key := tx.Bucket(boltInfoHashes).Get(infoHash)
+		if key == nil {
+			return nil
+		}
+		files, err := getBoltFiles(tx, key)
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(files, func(file File) bool { return file.Path == readme.Path }) {
+			return nil
+		}
+
+		encoded, err := json.Marshal(&readme)
+		if err != nil {
+			return errors.New("json.Marshal (readme) " + err.Error())
+		}
+		if err = tx.Bucket(boltReadmes).Put(key, encoded); err != nil {
+			return errors.New("Put (readmes) " + err.Error())
+		}
+		return nil
+	})
+}
+
+func (db *boltDatabase) GetReadme(ctx context.Context, infoHash []byte) (*Readme, error) {
+	var readme *Readme
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		key := tx.Bucket(boltInfoHashes).Get(infoHash)
+		if key == nil {
+			return nil
+		}
+		v := tx.Bucket(boltReadmes).Get(key)
+		if v == nil {
+			return nil
+		}
+
+		readme = new(Readme)
+		if err := json.Unmarshal(v, readme); err != nil {
+			return errors.New("json.Unmarshal (readme) " + err.Error())
+		}
+		return nil
+	})
+	return readme, err
+}
+
+func (db *boltDatabase) AddTag(ctx context.Context, infoHash []byte, tag string) error {
+	tag, err := NormaliseTag(tag)
+	if err != nil {
+		return err
+	}
+
+	return db.updateCuration(ctx, infoHash, func(tx *bbolt.Tx, id uint64, curation *boltCuration) error {
+		if slices.Contains(curation.Tags, tag) {
+			return nil
+		}
+		curation.Tags = append(curation.Tags, tag)
+		sort.Strings(curation.Tags)
+		if err := tx.Bucket(boltTags).Put(boltIndexKey(tag, id), nil); err != nil {
+			return errors.New("Put (tags_idx) " + err.Error())
+		}
+		return nil
+	})
+}
+
+func (db *boltDatabase) RemoveTag(ctx context.Context, infoHash []byte, tag string) error {
+	tag, err := NormaliseTag(tag)
+	if err != nil {
+		return err
+	}
+
+	return db.updateCuration(ctx, infoHash, func(tx *bbolt.Tx, id uint64, curation *boltCuration) error {
+		curation.Tags = slices.DeleteFunc(curation.Tags, func(t string) bool { return t == tag })
+		if err := tx.Bucket(boltTags).Delete(boltIndexKey(tag, id)); err != nil {
+			return errors.New("Delete (tags_idx) " + err.Error())
+		}
+		return nil
+	})
+}
+
+func (db *boltDatabase) SetNote(ctx context.Context, infoHash []byte, note string) error {
+	return db.updateCuration(ctx, infoHash, func(tx *bbolt.Tx, id uint64, curation *boltCuration) error {
+		curation.Note = note
+		return nil
+	})
+}
+
+func (db *boltDatabase) SetStarred(ctx context.Context, infoHash []byte, starred bool) error {
+	return db.updateCuration(ctx, infoHash, func(tx *bbolt.Tx, id uint64, curation *boltCuration) error {
+		curation.Starred = starred
+		return nil
+	})
+}
+
+func (db *boltDatabase) GetCuration(ctx context.Context, infoHash []byte) (*Curation, error) {
+	var curation *Curation
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		key := tx.Bucket(boltInfoHashes).Get(infoHash)
+		if key == nil {
+			return nil
+		}
+		record, err := getBoltCuration(tx, key)
+		if err != nil {
+			return err
+		}
+
+		curation = &Curation{Tags: append([]string{}, record.Tags...), Note: record.Note, Starred: record.Starred}
+		return nil
+	})
+	return curation, err
+}
+
+func (db *boltDatabase) GetTags(ctx context.Context) ([]Tag, error) {
+	tags := make([]Tag, 0)
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		// The keys are ordered by tag, hence the torrents of each tag are consecutive.
+		return tx.Bucket(boltTags).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			name := string(k[:len(k)-9])
+			if len(tags) == 0 || tags[len(tags)-1].Name != name {
+				tags = append(tags, Tag{Name: name})
+			}
+			tags[len(tags)-1].NTorrents++
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (db *boltDatabase) SetUser(ctx context.Context, user User) error {
+	if err := ValidateUserName(user.Name); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(boltUser{PasswordHash: user.PasswordHash, Role: user.Role})
+	if err != nil {
+		return errors.New("json.Marshal (user) " + err.Error())
+	}
+	return db.update(ctx, func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(boltUsers).Put([]byte(user.Name), encoded); err != nil {
+			return errors.New("Put (users) " + err.Error())
+		}
+		return nil
+	})
+}
+
+func (db *boltDatabase) GetUser(ctx context.Context, name string) (*User, error) {
+	var user *User
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		value := tx.Bucket(boltUsers).Get([]byte(name))
+		if value == nil {
+			return nil
+		}
+		var record boltUser
+		if err := json.Unmarshal(value, &record); err != nil {
+			return errors.New("json.Unmarshal (user) " + err.Error())
+		}
+		user = &User{Name: name, PasswordHash: record.PasswordHash, Role: record.Role}
+		return nil
+	})
+	return user, err
+}
+
+func (db *boltDatabase) GetUsers(ctx context.Context) ([]User, error) {
+	users := make([]User, 0)
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltUsers).ForEach(func(k, v []byte) error {
+			var record boltUser
+			if err := json.Unmarshal(v, &record); err != nil {
+				return errors.New("json.Unmarshal (user) " + err.Error())
+			}
+			users = append(users, User{Name: string(k), PasswordHash: record.PasswordHash, Role: record.Role})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (db *boltDatabase) DeleteUser(ctx context.Context, name string) (bool, error) {
+	var deleted bool
+	err := db.update(ctx, func(tx *bbolt.Tx) error {
+		if tx.Bucket(boltUsers).Get([]byte(name)) == nil {
+			return nil
+		}
+		if err := tx.Bucket(boltUsers).Delete([]byte(name)); err != nil {
+			return errors.New("Delete (users) " + err.Error())
+		}
+		deleted = true
+
+		return deleteBoltTokens(tx, func(token *boltToken) bool { return token.User == name })
+	})
+	return deleted, err
+}
+
+func (db *boltDatabase) AddToken(ctx context.Context, token Token) error {
+	encoded, err := json.Marshal(boltToken{
+		Hash:      token.Hash,
+		User:      token.User,
+		Name:      token.Name,
+		Session:   token.Session,
+		CreatedOn: token.CreatedOn,
+		ExpiresOn: token.ExpiresOn,
+	})
+	if err != nil {
+		return errors.New("json.Marshal (token) " + err.Error())
+	}
+
+	return db.update(ctx, func(tx *bbolt.Tx) error {
+		if tx.Bucket(boltUsers).Get([]byte(token.User)) == nil {
+			return fmt.Errorf("unknown user: %s", token.User)
+		}
+		if tx.Bucket(boltTokens).Get([]byte(token.ID)) != nil {
+			return fmt.Errorf("the token %s exists already", token.ID)
+		}
+		if err := tx.Bucket(boltTokens).Put([]byte(token.ID), encoded); err != nil {
+			return errors.New("Put (tokens) " + err.Error())
+		}
+		return nil
+	})
+}
+
+func (db *boltDatabase) GetToken(ctx context.Context, id string) (*Token, error) {
+	var token *Token
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		value := tx.Bucket(boltTokens).Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+		var err error
+		token, err = decodeBoltToken([]byte(id), value)
+		return err
+	})
+	return token, err
+}
+
+func (db *boltDatabase) GetTokens(ctx context.Context, user string) ([]Token, error) {
+	tokens := make([]Token, 0)
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltTokens).ForEach(func(k, v []byte) error {
+			token, err := decodeBoltToken(k, v)
+			if err != nil {
+				return err
+			}
+			if token.User == user {
+				tokens = append(tokens, *token)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The tokens were walked in the order of their IDs.
+	sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].CreatedOn < tokens[j].CreatedOn })
+	return tokens, nil
+}
+
+func (db *boltDatabase) DeleteToken(ctx context.Context, id string) (bool, error) {
+	var deleted bool
+	err := db.update(ctx, func(tx *bbolt.Tx) error {
+		if tx.Bucket(boltTokens).Get([]byte(id)) == nil {
+			return nil
+		}
+		if err := tx.Bucket(boltTokens).Delete([]byte(id)); err != nil {
+			return errors.New("Delete (tokens) " + err.Error())
+		}
+		deleted = true
+		return nil
+	})
+	return deleted, err
+}
+
+func (db *boltDatabase) DeleteExpiredTokens(ctx context.Context, now int64) (uint, error) {
+	var nDeleted uint
+	err := db.update(ctx, func(tx *bbolt.Tx) error {
+		nDeleted = 0
+		return deleteBoltTokens(tx, func(token *boltToken) bool {
+			expired := token.ExpiresOn != 0 && token.ExpiresOn <= now
+			if expired {
+				nDeleted++
+			}
+			return expired
+		})
+	})
+	return nDeleted, err
+}
+
+// updateCuration calls fn with the curation of the torrent of the given InfoHash, and stores it as
+// modified by fn. Does nothing if the torrent does not exist.
+func (db *boltDatabase) updateCuration(ctx context.Context, infoHash []byte, fn func(tx *bbolt.Tx, id uint64, curation *boltCuration) error) error {
+	return db.update(ctx, func(tx *bbolt.Tx) error {
+		key := tx.Bucket(boltInfoHashes).Get(infoHash)
+		if key == nil {
+			return nil
+		}
+		curation, err := getBoltCuration(tx, key)
+		if err != nil {
+			return err
+		}
+		if err = fn(tx, binary.BigEndian.Uint64(key), curation); err != nil {
+			return err
+		}
+
+		if len(curation.Tags) == 0 && curation.Note == "" && !curation.Starred {
+			if err = tx.Bucket(boltCurations).Delete(key); err != nil {
+				return errors.New("Delete (curations) " + err.Error())
+			}
+			return nil
+		}
+		encoded, err := json.Marshal(curation)
+		if err != nil {
+			return errors.New("json.Marshal (curation) " + err.Error())
+		}
+		if err = tx.Bucket(boltCurations).Put(key, encoded); err != nil {
+			return errors.New("Put (curations) " + err.Error())
+		}
+		return nil
+	})
+}
+
+func (db *boltDatabase) PurgeTorrents(ctx context.Context, infoHashes [][]byte, pattern *regexp.Regexp) (uint, error) {
+	// The torrents to be deleted are found in a read-only transaction, which does not block the
+	// writers, and then deleted in batches.
+	var ids []uint64
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		for _, infoHash := range infoHashes {
+			if key := tx.Bucket(boltInfoHashes).Get(infoHash); key != nil {
+				ids = append(ids, binary.BigEndian.Uint64(key))
+			}
+		}
+
+		if pattern == nil {
+			return nil
+		}
+		return tx.Bucket(boltTorrents).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var record boltTorrent
+			if err := json.Unmarshal(v, &record); err != nil {
+				return errors.New("json.Unmarshal (torrent) " + err.Error())
+			}
+			matches := pattern.MatchString(record.Name)
+			if !matches {
+				files, err := getBoltFiles(tx, k)
+				if err != nil {
+					return err
+				}
+				for _, file := range files {
+					if matches = pattern.MatchString(file.Path); matches {
+						break
+					}
+				}
+			}
+			if matches {
+				ids = append(ids, binary.BigEndian.Uint64(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return db.deleteTorrents(ctx, ids)
+}
+
+func (db *boltDatabase) DeleteTorrent(ctx context.Context, infoHash []byte) (bool, error) {
+	n, err := db.PurgeTorrents(ctx, [][]byte{infoHash}, nil)
+	return n != 0, err
+}
+
+func (db *boltDatabase) DeleteTorrents(ctx context.Context, query string, category *Category, scope SearchScope) (uint, error) {
+	infoHashes, err := queriedInfoHashes(ctx, db, query, category, scope)
+	if err != nil {
+		return 0, err
+	}
+	return db.PurgeTorrents(ctx, infoHashes, nil)
+}
+
+func (db *boltDatabase) ApplyRetention(ctx context.Context, policy RetentionPolicy) (uint, error) {
+	// The torrents not retained are found in a read-only transaction, which does not block the
+	// writers, and then deleted in batches.
+	var ids []uint64
+	err := db.view(ctx, func(tx *bbolt.Tx) error {
+		deleted := make(map[uint64]struct{})
+
+		if policy.MaxAgeWithoutPeers != 0 {
+			cutoff := uint64(time.Now().Add(-policy.MaxAgeWithoutPeers).Unix())
+			c := tx.Bucket(boltDiscoveredOn).Cursor()
+			for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k[:8]) < cutoff; k, _ = c.Next() {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				record, err := getBoltTorrent(tx, k[8:])
+				if err != nil {
+					return err
+				}
+				if record.NInitialPeers == 0 {
+					id := binary.BigEndian.Uint64(k[8:])
+					ids = append(ids, id)
+					deleted[id] = struct{}{}
+				}
+			}
+		}
+
+		if policy.MaxTorrents != 0 {
+			// The torrents deleted for their age are not retained either.
+			var n uint
+			c := tx.Bucket(boltDiscoveredOn).Cursor()
+			for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				id := binary.BigEndian.Uint64(k[8:])
+				if _, isDeleted := deleted[id]; isDeleted {
+					continue
+				}
+				if n++; n > policy.MaxTorrents {
+					ids = append(ids, id)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return db.deleteTorrents(ctx, ids)
+}
+
+// view runs fn in a read-only transaction, unless the context is done already. As bbolt cannot
+// interrupt a transaction, the walks of whole buckets check the context themselves.
+func (db *boltDatabase) view(ctx context.Context, fn func(*bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.db.View(fn)
+}
+
+// update runs fn in a read-write transaction, unless the context is done already; the transaction
+// is rolled back rather than committed if the context is done by the time fn returns.
+func (db *boltDatabase) update(ctx context.Context, fn func(*bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+// setupStatistics creates the statistics_hourly bucket (the hourly aggregates served by
+// GetStatistics) if it does not exist yet, populated from the existing torrents.
+func (db *boltDatabase) setupStatistics() error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(boltStatistics) != nil {
+			return nil
+		}
+
+		if _, err := tx.CreateBucket(boltStatistics); err != nil {
+			return errors.New("CreateBucket " + err.Error())
+		}
+		return tx.Bucket(boltTorrents).ForEach(func(k, v []byte) error {
+			var record boltTorrent
+			if err := json.Unmarshal(v, &record); err != nil {
+				return errors.New("json.Unmarshal (torrent) " + err.Error())
+			}
+			return aggregateTorrent(tx, &record, 1)
+		})
+	})
+}
+
+// setupFilesIndex creates the files_idx bucket (the inverted index of the paths of the files) if
+// asked so and if it does not exist yet. Once created, it is kept up to date even if it is not asked
+// for anymore.
+func (db *boltDatabase) setupFilesIndex(create bool) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		db.filesIndex = tx.Bucket(boltPaths) != nil
+		if db.filesIndex || !create {
+			return nil
+		}
+
+		log.Println("Indexing the paths of the files... (this might take a while)")
+		paths, err := tx.CreateBucket(boltPaths)
+		if err != nil {
+			return errors.New("CreateBucket " + err.Error())
+		}
+		err = tx.Bucket(boltFiles).ForEach(func(k, v []byte) error {
+			var files []File
+			if err := json.Unmarshal(v, &files); err != nil {
+				return errors.New("json.Unmarshal (files) " + err.Error())
+			}
+			return boltIndex(paths, binary.BigEndian.Uint64(k), filePaths(files))
+		})
+		if err != nil {
+			return err
+		}
+
+		db.filesIndex = true
+		return nil
+	})
+}
+
+func (db *boltDatabase) putTorrent(tx *bbolt.Tx, id uint64, record *boltTorrent) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return errors.New("json.Marshal (torrent) " + err.Error())
+	}
+	if err = tx.Bucket(boltTorrents).Put(boltID(id), encoded); err != nil {
+		return errors.New("Put (torrents) " + err.Error())
+	}
+	return nil
+}
+
+// deleteTorrents deletes the torrents of the given IDs (those that still exist), in transactions of
+// up to deleteBatchSize of them that are committed one after the other. Returns the number of
+// torrents deleted, including those of the batches committed before an error.
+func (db *boltDatabase) deleteTorrents(ctx context.Context, ids []uint64) (uint, error) {
+	var nDeleted uint
+	for start := 0; start < len(ids); start += deleteBatchSize {
+		var n uint
+		err := db.update(ctx, func(tx *bbolt.Tx) error {
+			n = 0
+			for _, id := range ids[start:min(start+deleteBatchSize, len(ids))] {
+				deleted, err := db.deleteTorrent(tx, id)
+				if err != nil {
+					return err
+				} else if deleted {
+					n++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nDeleted, err
+		}
+		nDeleted += n
+	}
+	return nDeleted, nil
+}
+
+// deleteTorrent deletes the torrent of the given ID from every bucket, and reports whether it
+// existed.
+func (db *boltDatabase) deleteTorrent(tx *bbolt.Tx, id uint64) (bool, error) {
+	key := boltID(id)
+	if tx.Bucket(boltTorrents).Get(key) == nil {
+		return false, nil
+	}
+	record, err := getBoltTorrent(tx, key)
+	if err != nil {
+		return false, err
+	}
+	files, err := getBoltFiles(tx, key)
+	if err != nil {
+		return false, err
+	}
+
+	deletions := []struct {
+		bucket []byte
+		key    []byte
+	}{
+		{boltTorrents, key},
+		{boltFiles, key},
+		{boltReadmes, key},
+		{boltCurations, key},
+		{boltInfoHashes, record.InfoHash},
+		{boltDiscoveredOn, boltOrderKey(uint64(record.DiscoveredOn), id)},
+		{boltTotalSize, boltOrderKey(record.TotalSize, id)},
+		{boltNFiles, boltOrderKey(uint64(record.NFiles), id)},
+	}
+	for _, token := range tokenize(record.Name) {
+		deletions = append(deletions, struct {
+			bucket []byte
+			key    []byte
+		}{boltNames, boltIndexKey(token, id)})
+	}
+	curation, err := getBoltCuration(tx, key)
+	if err != nil {
+		return false, err
+	}
+	for _, tag := range curation.Tags {
+		deletions = append(deletions, struct {
+			bucket []byte
+			key    []byte
+		}{boltTags, boltIndexKey(tag, id)})
+	}
+	if tx.Bucket(boltPaths) != nil {
+		for _, path := range filePaths(files) {
+			for _, token := range tokenize(path) {
+				deletions = append(deletions, struct {
+					bucket []byte
+					key    []byte
+				}{boltPaths, boltIndexKey(token, id)})
+			}
+		}
+	}
+
+	for _, deletion := range deletions {
+		if err = tx.Bucket(deletion.bucket).Delete(deletion.key); err != nil {
+			return false, errors.New("Delete (" + string(deletion.bucket) + ") " + err.Error())
+		}
+	}
+	if err = aggregateTorrent(tx, record, -1); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// aggregateTorrent adds the torrent to the aggregate of the hour of its discovery if sign is 1, or
+// removes it if sign is -1.
+func aggregateTorrent(tx *bbolt.Tx, record *boltTorrent, sign int64) error {
+	bucket := tx.Bucket(boltStatistics)
+	key := boltID(uint64(record.DiscoveredOn - record.DiscoveredOn%3600))
+
+	var aggregate boltAggregate
+	if v := bucket.Get(key); v != nil {
+		if err := json.Unmarshal(v, &aggregate); err != nil {
+			return errors.New("json.Unmarshal (statistics) " + err.Error())
+		}
+	}
+	aggregate.NDiscovered += sign
+	aggregate.NFiles += sign * int64(record.NFiles)
+	aggregate.TotalSize += sign * int64(record.TotalSize)
+
+	if aggregate.NDiscovered <= 0 {
+		if err := bucket.Delete(key); err != nil {
+			return errors.New("Delete (statistics_hourly) " + err.Error())
+		}
+		return nil
+	}
+	encoded, err := json.Marshal(&aggregate)
+	if err != nil {
+		return errors.New("json.Marshal (statistics) " + err.Error())
+	}
+	if err = bucket.Put(key, encoded); err != nil {
+		return errors.New("Put (statistics_hourly) " + err.Error())
+	}
+	return nil
+}
+
+// boltMatcher matches the torrents against the criteria of QueryTorrents, within a transaction.
+type boltMatcher struct {
+	tx       *bbolt.Tx
+	query    *Query
+	phrases  [][]string
+	excluded [][]string
+	epoch    int64
+	category *Category
+	scope    SearchScope
+}
+
+// search returns the torrents that match the terms of the query (and all the other criteria), with
+// their relevance. The context is checked for each candidate, since the terms can be common.
+func (m *boltMatcher) search(ctx context.Context) ([]TorrentMetadata, error) {
+	var tokens []string
+	for _, phrase := range m.phrases {
+		tokens = append(tokens, phrase...)
+	}
+
+	candidates := make(map[uint64]struct{})
+	if m.scope.names() {
+		for id := range boltLookup(m.tx.Bucket(boltNames), tokens) {
+			candidates[id] = struct{}{}
+		}
+	}
+	if m.scope.files() {
+		for id := range boltLookup(m.tx.Bucket(boltPaths), tokens) {
+			candidates[id] = struct{}{}
+		}
+	}
+
+	matches := make([]TorrentMetadata, 0, len(candidates))
+	for id := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		torrent, ok, err := m.match(id)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			matches = append(matches, *torrent)
+		}
+	}
+	return matches, nil
+}
+
+// match returns the torrent of the given ID if it matches all the criteria.
+func (m *boltMatcher) match(id uint64) (*TorrentMetadata, bool, error) {
+	key := boltID(id)
+	record, err := getBoltTorrent(m.tx, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if record.DiscoveredOn > m.epoch {
+		return nil, false, nil
+	}
+	if m.category != nil && Category(record.Category) != *m.category {
+		return nil, false, nil
+	}
+	for _, c := range m.query.Size {
+		if !c.holds(record.TotalSize) {
+			return nil, false, nil
+		}
+	}
+	for _, c := range m.query.NFiles {
+		if !c.holds(uint64(record.NFiles)) {
+			return nil, false, nil
+		}
+	}
+	if m.query.After != nil && record.DiscoveredOn < m.query.After.Unix() {
+		return nil, false, nil
+	}
+	if m.query.Before != nil && record.DiscoveredOn >= m.query.Before.Unix() {
+		return nil, false, nil
+	}
+	if len(m.query.Tags) != 0 || m.query.Starred {
+		curation, err := getBoltCuration(m.tx, key)
+		if err != nil {
+			return nil, false, err
+		}
+		if m.query.Starred && !curation.Starred {
+			return nil, false, nil
+		}
+		for _, tag := range m.query.Tags {
+			if !slices.Contains(curation.Tags, tag) {
+				return nil, false, nil
+			}
+		}
+	}
+
+	torrent := &TorrentMetadata{
+		ID:           id,
+		InfoHash:     record.InfoHash,
+		Name:         record.Name,
+		Size:         record.TotalSize,
+		DiscoveredOn: record.DiscoveredOn,
+		NFiles:       record.NFiles,
+		Category:     Category(record.Category),
+	}
+
+	nameTokens := tokenize(record.Name)
+	if m.scope.names() && matchesAny(nameTokens, m.excluded) {
+		return nil, false, nil
+	}
+	// Relevance is like bm25 on SQLite: the lower, the more relevant.
+	relevance, matched := 0.0, false
+	if len(m.phrases) != 0 && m.scope.names() && matchesAll(nameTokens, m.phrases) {
+		relevance, matched = -score(nameTokens, m.phrases), true
+	}
+
+	if len(m.query.Extensions) == 0 && len(m.phrases) == 0 && (len(m.excluded) == 0 || !m.scope.files()) {
+		return torrent, true, nil
+	}
+
+	files, err := getBoltFiles(m.tx, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(m.query.Extensions) != 0 {
+		hasExtension := false
+		for _, file := range files {
+			ext := strings.ToLower(file.Path[strings.LastIndex(file.Path, ".")+1:])
+			for _, e := range m.query.Extensions {
+				hasExtension = hasExtension || (strings.Contains(file.Path, ".") && ext == e)
+			}
+		}
+		if !hasExtension {
+			return nil, false, nil
+		}
+	}
+
+	if m.scope.files() {
+		for _, file := range files {
+			pathTokens := tokenize(file.Path)
+			if matchesAny(pathTokens, m.excluded) {
+				return nil, false, nil
+			}
+			if len(m.phrases) != 0 && matchesAll(pathTokens, m.phrases) {
+				torrent.MatchedFiles = append(torrent.MatchedFiles, file.Path)
+				if r := -score(pathTokens, m.phrases); !matched || r < relevance {
+					relevance = r
+				}
+				matched = true
+			}
+		}
+		sort.Strings(torrent.MatchedFiles)
+	}
+
+	if len(m.phrases) != 0 && !matched {
+		return nil, false, nil
+	}
+	torrent.Relevance = relevance
+	return torrent, true, nil
+}
+
+func (c Comparison) holds(value uint64) bool {
+	switch c.Operator {
+	case "<":
+		return value < c.Value
+	case "<=":
+		return value <= c.Value
+	case ">=":
+		return value >= c.Value
+	case ">":
+		return value > c.Value
+	default:
+		return value == c.Value
+	}
+}
+
+// tokenize splits s into lowercase words, where anything but letters and digits separates words
+// (as the tokenizer of the FTS5 index of SQLite does, without stemming).
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func tokenizePhrases(terms []string) [][]string {
+	phrases := make([][]string, 0, len(terms))
+	for _, term := range terms {
+		if tokens := tokenize(term); len(tokens) != 0 {
+			phrases = append(phrases, tokens)
+		}
+	}
+	return phrases
+}
+
+// matchesAll reports whether all of the phrases occur in tokens.
+func matchesAll(tokens []string, phrases [][]string) bool {
+	for _, phrase := range phrases {
+		if !containsPhrase(tokens, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny reports whether any of the phrases occurs in tokens.
+func matchesAny(tokens []string, phrases [][]string) bool {
+	for _, phrase := range phrases {
+		if containsPhrase(tokens, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPhrase(tokens []string, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		match := true
+		for j := range phrase {
+			if tokens[i+j] != phrase[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// score is the share of the tokens that are matched by the phrases, so that shorter documents
+// that match rank higher.
+func score(tokens []string, phrases [][]string) float64 {
+	n := 0
+	for _, phrase := range phrases {
+		n += len(phrase)
+	}
+	return float64(n) / float64(len(tokens))
+}
+
+func filePaths(files []File) []string {
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.Path
+	}
+	return paths
+}
+
+// boltIndex adds the distinct tokens of the texts to the inverted index for the torrent of the
+// given ID.
+func boltIndex(bucket *bbolt.Bucket, id uint64, texts []string) error {
+	seen := make(map[string]struct{})
+	for _, text := range texts {
+		for _, token := range tokenize(text) {
+			if _, exists := seen[token]; exists {
+				continue
+			}
+			seen[token] = struct{}{}
+			if err := bucket.Put(boltIndexKey(token, id), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// boltLookup returns the IDs of the torrents that have all the tokens in the inverted index.
+func boltLookup(bucket *bbolt.Bucket, tokens []string) map[uint64]struct{} {
+	var ids map[uint64]struct{}
+	for _, token := range tokens {
+		found := make(map[uint64]struct{})
+		prefix := append([]byte(token), 0)
+		c := bucket.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			id := binary.BigEndian.Uint64(k[len(prefix):])
+			if _, ok := ids[id]; ids == nil || ok {
+				found[id] = struct{}{}
+			}
+		}
+		ids = found
+		if len(ids) == 0 {
+			break
+		}
+	}
+	return ids
+}
+
+func boltStep(c *bbolt.Cursor, ascending bool) []byte {
+	var k []byte
+	if ascending {
+		k, _ = c.Next()
+	} else {
+		k, _ = c.Prev()
+	}
+	return k
+}
+
+func getBoltTorrent(tx *bbolt.Tx, key []byte) (*boltTorrent, error) {
+	v := tx.Bucket(boltTorrents).Get(key)
+	if v == nil {
+		return nil, fmt.Errorf("torrent %d does not exist", binary.BigEndian.Uint64(key))
+	}
+	record := new(boltTorrent)
+	if err := json.Unmarshal(v, record); err != nil {
+		return nil, errors.New("json.Unmarshal (torrent) " + err.Error())
+	}
+	return record, nil
+}
+
+// getBoltCuration returns the curation of the torrent of the given key, which is empty if nothing is
+// recorded about it.
+func getBoltCuration(tx *bbolt.Tx, key []byte) (*boltCuration, error) {
+	curation := new(boltCuration)
+	if v := tx.Bucket(boltCurations).Get(key); v != nil {
+		if err := json.Unmarshal(v, curation); err != nil {
+			return nil, errors.New("json.Unmarshal (curation) " + err.Error())
+		}
+	}
+	return curation, nil
+}
+
+func decodeBoltToken(key []byte, value []byte) (*Token, error) {
+	var record boltToken
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, errors.New("json.Unmarshal (token) " + err.Error())
+	}
+	return &Token{
+		ID:        string(key),
+		Hash:      record.Hash,
+		User:      record.User,
+		Name:      record.Name,
+		Session:   record.Session,
+		CreatedOn: record.CreatedOn,
+		ExpiresOn: record.ExpiresOn,
+	}, nil
+}
+
+// deleteBoltTokens deletes the tokens for which the predicate holds.
+func deleteBoltTokens(tx *bbolt.Tx, predicate func(*boltToken) bool) error {
+	// Keys cannot be deleted while iterating with ForEach, hence they are collected first.
+	var keys [][]byte
+	err := tx.Bucket(boltTokens).ForEach(func(k, v []byte) error {
+		var record boltToken
+		if err := json.Unmarshal(v, &record); err != nil {
+			return errors.New("json.Unmarshal (token) " + err.Error())
+		}
+		if predicate(&record) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err = tx.Bucket(boltTokens).Delete(key); err != nil {
+			return errors.New("Delete (tokens) " + err.Error())
+		}
+	}
+	return nil
+}
+
+func getBoltFiles(tx *bbolt.Tx, key []byte) ([]File, error) {
+	var files []File
+	if err := json.Unmarshal(tx.Bucket(boltFiles).Get(key), &files); err != nil {
+		return nil, errors.New("json.Unmarshal (files) " + err.Error())
+	}
+	return files, nil
+}
+
+func boltID(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+func boltOrderKey(value uint64, id uint64) []byte {
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, value), id)
+}
+
+func boltIndexKey(token string, id uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(token), 0), id)
+}
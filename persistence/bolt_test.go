@@ -0,0 +1,106 @@
+package persistence
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// openBoltDatabase opens a database in a temporary directory, which is closed at the end of the
+// test.
+func openBoltDatabase(t *testing.T, filesIndex bool) Database {
+	t.Helper()
+
+	url_ := &url.URL{Scheme: "bolt", Path: filepath.Join(t.TempDir(), "database.bolt")}
+	if filesIndex {
+		url_.RawQuery = "files_index=true"
+	}
+	db, err := makeBoltDatabase(url_)
+	if err != nil {
+		t.Fatalf("makeBoltDatabase() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func Test_boltDatabase_Conformance(t *testing.T) {
+	t.Parallel()
+
+	testConformance(t, openBoltDatabase)
+}
+
+func Test_boltDatabase_PurgeTorrents(t *testing.T) {
+	ctx := context.Background()
+	t.Parallel()
+
+	db := openBoltDatabase(t, true)
+
+	if err := db.AddNewTorrent(ctx, []byte("purged"), "purged torrent", []File{{Size: 1, Path: "a"}, {Size: 1, Path: "b"}}, Uncategorised); err != nil {
+		t.Fatalf("boltDatabase.AddNewTorrent() error = %v", err)
+	}
+	if err := db.AddNewTorrent(ctx, []byte("kept"), "kept torrent", []File{{Size: 1, Path: "c"}}, Uncategorised); err != nil {
+		t.Fatalf("boltDatabase.AddNewTorrent() error = %v", err)
+	}
+	if _, err := db.PurgeTorrents(ctx, [][]byte{[]byte("purged")}, nil); err != nil {
+		t.Fatalf("boltDatabase.PurgeTorrents() error = %v", err)
+	}
+
+	// Nothing of the purged torrents must be left behind in any bucket.
+	want := map[string]int{
+		string(boltTorrents):     1,
+		string(boltFiles):        1,
+		string(boltInfoHashes):   1,
+		string(boltDiscoveredOn): 1,
+		string(boltTotalSize):    1,
+		string(boltNFiles):       1,
+		string(boltNames):        2,
+		string(boltPaths):        1,
+	}
+	got := make(map[string]int)
+	err := db.(*boltDatabase).db.View(func(tx *bbolt.Tx) error {
+		for bucket := range want {
+			got[bucket] = tx.Bucket([]byte(bucket)).Stats().KeyN
+		}
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("keys left after purging = %v (err %v), want %v", got, err, want)
+	}
+}
+
+func Test_boltDatabase_QueryTorrents_Files(t *testing.T) {
+	ctx := context.Background()
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "database.bolt")
+
+	db, err := makeBoltDatabase(&url.URL{Scheme: "bolt", Path: path})
+	if err != nil {
+		t.Fatalf("makeBoltDatabase() error = %v", err)
+	}
+	if err = db.AddNewTorrent(ctx, []byte("before"), "xyz-123", []File{{Size: 1, Path: "ubuntu-22.04.iso"}}, Uncategorised); err != nil {
+		t.Fatalf("boltDatabase.AddNewTorrent() error = %v", err)
+	}
+	db.Close()
+
+	// Reopening with the index populates it with the existing files.
+	db, err = makeBoltDatabase(&url.URL{Scheme: "bolt", Path: path, RawQuery: "files_index=true"})
+	if err != nil {
+		t.Fatalf("makeBoltDatabase() error = %v", err)
+	}
+	defer db.Close()
+
+	got, err := db.QueryTorrents(ctx, "ubuntu", time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchFiles)
+	if err != nil {
+		t.Fatalf("boltDatabase.QueryTorrents() error = %v", err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].MatchedFiles, []string{"ubuntu-22.04.iso"}) {
+		t.Errorf("boltDatabase.QueryTorrents() = %v, want the torrent added before the index", got)
+	}
+}
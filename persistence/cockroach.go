@@ -0,0 +1,399 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// cockroachDatabase stores the torrents in CockroachDB, whose dialect is mostly that of PostgreSQL
+// hence the queries of postgresDatabase are reused, but whose schema differs:
+//   - IDs are generated by unique_rowid() rather than by sequences, which would be a bottleneck
+//     for a distributed database.
+//   - Trigram and inverted (GIN) indexes are built in, rather than provided by pg_trgm; the
+//     fuzzy matching uses similarity() and % instead of word_similarity() and <%, which are not.
+//   - There are no triggers, hence neither the `statistics_hourly` table that they maintain on
+//     PostgreSQL: statistics are aggregated from the torrents, by the index on discovered_on.
+//
+// CockroachDB runs transactions at the SERIALIZABLE isolation level, and aborts those conflicting
+// with others for the client to retry them, which every writing method does, see retry; deletions
+// retry each of their batches (see retryBatch) so that those already committed are not re-run.
+type cockroachDatabase struct {
+	*postgresDatabase
+}
+
+// cockroachMaxAttempts is how many times a transaction is attempted, if it keeps being aborted.
+const cockroachMaxAttempts = 5
+
+func makeCockroachDatabase(url_ *url.URL) (Database, error) {
+	db, filesIndex, err := openCockroach(url_)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.setupDatabase(false); err != nil {
+		_ = db.conn.Close()
+		return nil, fmt.Errorf("setupDatabase %w", err)
+	}
+
+	if err := db.setupFilesIndex(filesIndex); err != nil {
+		_ = db.conn.Close()
+		return nil, fmt.Errorf("setupFilesIndex %w", err)
+	}
+
+	return db, nil
+}
+
+// openCockroach connects to the database of the given URL, without setting it up, and returns
+// whether its files are to be indexed.
+func openCockroach(url_ *url.URL) (*cockroachDatabase, bool, error) {
+	// CockroachDB speaks the wire protocol of PostgreSQL.
+	url_.Scheme = "postgres"
+	db, filesIndex, err := openPostgres(url_)
+	if err != nil {
+		return nil, false, err
+	}
+
+	db.trgm = true
+	db.wholeNames = true
+	cdb := &cockroachDatabase{postgresDatabase: db}
+	db.retryBatch = cdb.retry
+	return cdb, filesIndex, nil
+}
+
+func (db *cockroachDatabase) openReplica(url_ *url.URL) (Database, error) {
+	replica, _, err := openCockroach(url_)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkReplicaSchema(replica.conn, cockroachMigrations, postgresVersioner); err != nil {
+		_ = replica.conn.Close()
+		return nil, err
+	}
+	if err = replica.setupFilesIndex(false); err != nil {
+		_ = replica.conn.Close()
+		return nil, fmt.Errorf("setupFilesIndex %w", err)
+	}
+
+	return replica, nil
+}
+
+func (db *cockroachDatabase) Engine() databaseEngine {
+	return Cockroach
+}
+
+func (db *cockroachDatabase) AddNewTorrent(ctx context.Context, infoHash []byte, name string, files []File, category Category) error {
+	return db.AddNewTorrents(ctx, []Torrent{{InfoHash: infoHash, Name: name, Files: files, Category: category}})
+}
+
+func (db *cockroachDatabase) AddNewTorrents(ctx context.Context, torrents []Torrent) error {
+	return db.retry(ctx, func() error {
+		return db.postgresDatabase.AddNewTorrents(ctx, torrents)
+	})
+}
+
+func (db *cockroachDatabase) GetStatistics(ctx context.Context, from string, n uint) (*Statistics, error) {
+	fromTime, gran, err := ParseISO8601(from)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ISO8601 error %w", err)
+	}
+	toTime := statisticsEnd(*fromTime, gran, n)
+
+	// As the periods end on the last second of an hour, the torrents within them are discovered
+	// after the beginning and not after the end, same as the hours of the aggregates elsewhere.
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT
+			discovered_on - discovered_on % 3600 AS hour,
+			count(*)::INT8,
+			sum(n_files)::INT8,
+			sum(total_size)::INT8
+		FROM torrents
+		WHERE discovered_on > $1 AND discovered_on <= $2
+		GROUP BY hour;`,
+		fromTime.Unix(),
+		toTime.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer db.closeRows(rows)
+
+	return scanStatistics(rows, gran)
+}
+
+func (db *cockroachDatabase) RecordSwarm(ctx context.Context, infoHash []byte, swarm Swarm) error {
+	return db.retry(ctx, func() error {
+		return db.postgresDatabase.RecordSwarm(ctx, infoHash, swarm)
+	})
+}
+
+func (db *cockroachDatabase) SetReadme(ctx context.Context, infoHash []byte, readme Readme) error {
+	return db.retry(ctx, func() error {
+		return db.postgresDatabase.SetReadme(ctx, infoHash, readme)
+	})
+}
+
+func (db *cockroachDatabase) AddTag(ctx context.Context, infoHash []byte, tag string) error {
+	return db.retry(ctx, func() error {
+		return db.postgresDatabase.AddTag(ctx, infoHash, tag)
+	})
+}
+
+func (db *cockroachDatabase) RemoveTag(ctx context.Context, infoHash []byte, tag string) error {
+	return db.retry(ctx, func() error {
+		return db.postgresDatabase.RemoveTag(ctx, infoHash, tag)
+	})
+}
+
+func (db *cockroachDatabase) SetNote(ctx context.Context, infoHash []byte, note string) error {
+	return db.retry(ctx, func() error {
+		return db.postgresDatabase.SetNote(ctx, infoHash, note)
+	})
+}
+
+func (db *cockroachDatabase) SetStarred(ctx context.Context, infoHash []byte, starred bool) error {
+	return db.retry(ctx, func() error {
+		return db.postgresDatabase.SetStarred(ctx, infoHash, starred)
+	})
+}
+
+func (db *cockroachDatabase) SetUser(ctx context.Context, user User) error {
+	return db.retry(ctx, func() error {
+		return db.postgresDatabase.SetUser(ctx, user)
+	})
+}
+
+func (db *cockroachDatabase) DeleteUser(ctx context.Context, name string) (bool, error) {
+	var deleted bool
+	err := db.retry(ctx, func() error {
+		var err error
+		deleted, err = db.postgresDatabase.DeleteUser(ctx, name)
+		return err
+	})
+	return deleted, err
+}
+
+func (db *cockroachDatabase) AddToken(ctx context.Context, token Token) error {
+	return db.retry(ctx, func() error {
+		return db.postgresDatabase.AddToken(ctx, token)
+	})
+}
+
+func (db *cockroachDatabase) DeleteToken(ctx context.Context, id string) (bool, error) {
+	var deleted bool
+	err := db.retry(ctx, func() error {
+		var err error
+		deleted, err = db.postgresDatabase.DeleteToken(ctx, id)
+		return err
+	})
+	return deleted, err
+}
+
+func (db *cockroachDatabase) DeleteExpiredTokens(ctx context.Context, now int64) (uint, error) {
+	var n uint
+	err := db.retry(ctx, func() error {
+		var err error
+		n, err = db.postgresDatabase.DeleteExpiredTokens(ctx, now)
+		return err
+	})
+	return n, err
+}
+
+func (db *cockroachDatabase) DeleteTorrent(ctx context.Context, infoHash []byte) (bool, error) {
+	n, err := db.PurgeTorrents(ctx, [][]byte{infoHash}, nil)
+	return n != 0, err
+}
+
+func (db *cockroachDatabase) DeleteTorrents(ctx context.Context, query string, category *Category, scope SearchScope) (uint, error) {
+	infoHashes, err := queriedInfoHashes(ctx, db, query, category, scope)
+	if err != nil {
+		return 0, err
+	}
+	return db.PurgeTorrents(ctx, infoHashes, nil)
+}
+
+// retry calls fn, which runs a transaction of its own, until it is not aborted by CockroachDB to be
+// retried (or it has been attempted cockroachMaxAttempts times), backing off exponentially.
+func (db *cockroachDatabase) retry(ctx context.Context, fn func() error) error {
+	backoff := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) {
+			return err
+		} else if attempt == cockroachMaxAttempts {
+			return fmt.Errorf("giving up after %d attempts %w", attempt, err)
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return fmt.Errorf("retrying %w", ctx.Err())
+		}
+	}
+}
+
+// cockroachRetryCode is the SQLSTATE of serialisation failures.
+const cockroachRetryCode = "40001"
+
+// isRetryable reports whether the error is a serialisation failure, that is a transaction aborted
+// for the client to retry it.
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == cockroachRetryCode
+}
+
+// setupDatabase creates the `migrations` table if it does not exist, and migrates the schema to the
+// latest version, see migrate.
+func (db *cockroachDatabase) setupDatabase(dryRun bool) ([]Migration, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("sql.DB.Begin %w", err)
+	}
+	defer db.rollback(tx)
+
+	// cockroach:// URLs used to be handled as postgres:// ones, whose schema cannot be migrated
+	// (neither its sequences nor its triggers would work), whereas its torrents can be moved.
+	var postgresSchema bool
+	err = tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM information_schema.sequences WHERE sequence_schema = $1 AND sequence_name = 'seq_torrents_id');",
+		db.schema,
+	).Scan(&postgresSchema)
+	if err != nil {
+		return nil, fmt.Errorf("sql.Tx.QueryRow (information_schema.sequences) %w", err)
+	} else if postgresSchema {
+		return nil, fmt.Errorf("the schema %s was set up for PostgreSQL rather than CockroachDB, move its torrents to a new schema with magnetico-db", db.schema)
+	}
+
+	// Initial Setup for schema version 0:
+	// FROZEN.
+	_, err = tx.Exec(`
+		CREATE SCHEMA IF NOT EXISTS ` + db.schema + `;
+
+		CREATE TABLE IF NOT EXISTS migrations (
+			schema_version  SMALLINT NOT NULL UNIQUE
+		);
+
+		INSERT INTO migrations (schema_version) VALUES (0) ON CONFLICT DO NOTHING;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("sql.Tx.Exec (v0) %w", err)
+	}
+
+	migrations, err := migrate(tx, cockroachMigrations, postgresVersioner, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return migrations, nil
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("sql.Tx.Commit %w", err)
+	}
+
+	return migrations, nil
+}
+
+// cockroachMigrations are the migrations of the schema of CockroachDB databases, see migration.
+// The version of the schema is kept as on PostgreSQL, see postgresVersioner.
+var cockroachMigrations = []migration{
+	// 0 -> 1: FROZEN.
+	// Changes:
+	//   * Created the `torrents`, `files`, and `peer_clients` tables, as they were on PostgreSQL at
+	//     schema version 6 except for the IDs, generated by unique_rowid(), and the statistics.
+	{
+		name: "initial schema",
+		sql: `
+		CREATE TABLE torrents (
+			id               BIGINT PRIMARY KEY DEFAULT unique_rowid(),
+			info_hash        BYTEA NOT NULL UNIQUE,
+			name             TEXT NOT NULL,
+			total_size       BIGINT NOT NULL CHECK (total_size > 0),
+			discovered_on    BIGINT NOT NULL CHECK (discovered_on > 0),
+			n_initial_peers  BIGINT CHECK (n_initial_peers IS NULL OR n_initial_peers >= 0) DEFAULT NULL,
+			category         SMALLINT NOT NULL CHECK (category >= 0) DEFAULT 0,
+			n_files          BIGINT NOT NULL CHECK (n_files >= 0) DEFAULT 0,
+			name_tsv         TSVECTOR AS (to_tsvector('simple', regexp_replace(name, '[^[:alnum:]]+', ' ', 'g'))) STORED
+		);
+		CREATE INDEX idx_torrents_total_size ON torrents (total_size);
+		CREATE INDEX idx_torrents_discovered_on ON torrents (discovered_on);
+		CREATE INDEX idx_torrents_category ON torrents (category);
+		CREATE INDEX idx_torrents_n_files ON torrents (n_files);
+		CREATE INDEX idx_torrents_name_gin_trgm ON torrents USING GIN (name gin_trgm_ops);
+		CREATE INDEX idx_torrents_name_tsv ON torrents USING GIN (name_tsv);
+
+		CREATE TABLE files (
+			id          BIGINT PRIMARY KEY DEFAULT unique_rowid(),
+			torrent_id  BIGINT REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			size        BIGINT NOT NULL,
+			path        TEXT NOT NULL,
+			is_readme   BOOLEAN CHECK (is_readme IS NULL OR is_readme) DEFAULT NULL,
+			content     TEXT    CHECK ((content IS NULL AND is_readme IS NULL) OR (content IS NOT NULL AND is_readme)) DEFAULT NULL
+		);
+		CREATE INDEX idx_files_torrent_id ON files (torrent_id);
+		CREATE UNIQUE INDEX readme_index ON files (torrent_id, is_readme);
+
+		CREATE TABLE peer_clients (
+			torrent_id  BIGINT NOT NULL REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			client      TEXT NOT NULL,
+			UNIQUE (torrent_id, client)
+		);
+	`,
+	},
+	// 1 -> 2: FROZEN.
+	// Changes:
+	//   * Created the `tags` and `torrent_tags` tables, and added `note` and `starred` columns
+	//     to the `torrents` table, as on PostgreSQL at schema version 7.
+	{
+		name: "tags, notes, and stars",
+		sql: `
+		CREATE TABLE tags (
+			id    BIGINT PRIMARY KEY DEFAULT unique_rowid(),
+			name  TEXT NOT NULL UNIQUE
+		);
+
+		CREATE TABLE torrent_tags (
+			torrent_id  BIGINT NOT NULL REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			tag_id      BIGINT NOT NULL REFERENCES tags ON DELETE CASCADE ON UPDATE RESTRICT,
+			PRIMARY KEY (torrent_id, tag_id)
+		);
+		CREATE INDEX idx_torrent_tags_tag_id ON torrent_tags (tag_id);
+
+		ALTER TABLE torrents ADD COLUMN note TEXT DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN starred BOOLEAN NOT NULL DEFAULT FALSE;
+		CREATE INDEX idx_torrents_starred ON torrents (id) WHERE starred;
+	`,
+	},
+	// 2 -> 3: NOT FROZEN! (subject to change or complete removal)
+	// Changes:
+	//   * Created the `users` and `tokens` tables, as on PostgreSQL at schema version 8.
+	{
+		name: "users and tokens",
+		sql: `
+		CREATE TABLE users (
+			id             BIGINT PRIMARY KEY DEFAULT unique_rowid(),
+			name           TEXT NOT NULL UNIQUE,
+			password_hash  BYTEA NOT NULL,
+			role           SMALLINT NOT NULL CHECK (role >= 0)
+		);
+
+		CREATE TABLE tokens (
+			id          TEXT PRIMARY KEY,
+			hash        BYTEA NOT NULL,
+			user_id     BIGINT NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE RESTRICT,
+			name        TEXT NOT NULL,
+			session     BOOLEAN NOT NULL,
+			created_on  BIGINT NOT NULL CHECK (created_on >= 0),
+			expires_on  BIGINT NOT NULL CHECK (expires_on >= 0)
+		);
+		CREATE INDEX idx_tokens_user_id ON tokens (user_id);
+		CREATE INDEX idx_tokens_expires_on ON tokens (expires_on) WHERE expires_on != 0;
+	`,
+	},
+}
@@ -0,0 +1,157 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// openCockroachDatabase opens the database of MAGNETICO_TEST_COCKROACH_URL (which must be a server
+// started for the tests, such as a throwaway container) in a schema of its own for each test, which
+// is dropped at its end.
+func openCockroachDatabase(t *testing.T, filesIndex bool) Database {
+	t.Helper()
+
+	url_, err := url.Parse(os.Getenv("MAGNETICO_TEST_COCKROACH_URL"))
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+	suffix := make([]byte, 8)
+	if _, err = rand.Read(suffix); err != nil {
+		t.Fatalf("rand.Read() error = %v", err)
+	}
+	schema := "test_" + hex.EncodeToString(suffix)
+
+	query := url_.Query()
+	query.Set("schema", schema)
+	if filesIndex {
+		query.Set("files_index", "true")
+	}
+	url_.RawQuery = query.Encode()
+
+	db, err := makeCockroachDatabase(url_)
+	if err != nil {
+		t.Fatalf("makeCockroachDatabase() error = %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.(*cockroachDatabase).conn.Exec("DROP SCHEMA " + schema + " CASCADE;"); err != nil {
+			t.Errorf("could not drop the schema %s: %v", schema, err)
+		}
+		db.Close()
+	})
+
+	return db
+}
+
+func TestCockroachDatabase_Conformance(t *testing.T) {
+	if os.Getenv("MAGNETICO_TEST_COCKROACH_URL") == "" {
+		t.Skip("MAGNETICO_TEST_COCKROACH_URL is not set")
+	}
+	t.Parallel()
+
+	testConformance(t, openCockroachDatabase)
+}
+
+func TestCockroachDatabase_Retry(t *testing.T) {
+	t.Parallel()
+
+	db := &cockroachDatabase{}
+	aborted := fmt.Errorf("tx.Commit %w", &pgconn.PgError{Code: "40001", Message: "restart transaction"})
+
+	attempts := 0
+	err := db.retry(context.Background(), func() error {
+		if attempts++; attempts < 3 {
+			return aborted
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("retry() of a transaction aborted twice = %v after %d attempts, want nil after 3", err, attempts)
+	}
+
+	attempts = 0
+	err = db.retry(context.Background(), func() error { attempts++; return aborted })
+	if err == nil || attempts != cockroachMaxAttempts {
+		t.Errorf("retry() of a transaction always aborted = %v after %d attempts, want an error after %d", err, attempts, cockroachMaxAttempts)
+	}
+
+	attempts = 0
+	err = db.retry(context.Background(), func() error { attempts++; return &pgconn.PgError{Code: "23505", Message: "duplicate key value"} })
+	if err == nil || attempts != 1 {
+		t.Errorf("retry() of a failed transaction = %v after %d attempts, want an error after 1", err, attempts)
+	}
+
+	// Not even if its message looks like that of a serialisation failure.
+	attempts = 0
+	err = db.retry(context.Background(), func() error { attempts++; return errors.New("ERROR: restart transaction (SQLSTATE 40001)") })
+	if err == nil || attempts != 1 {
+		t.Errorf("retry() of an error that is not a PgError = %v after %d attempts, want an error after 1", err, attempts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	err = db.retry(ctx, func() error { attempts++; return aborted })
+	if err == nil || attempts != 1 {
+		t.Errorf("retry() with a cancelled context = %v after %d attempts, want an error after 1", err, attempts)
+	}
+}
+
+func TestCockroachDatabase_RetryBatch(t *testing.T) {
+	ctx := context.Background()
+	t.Parallel()
+
+	// The batches are run on SQLite, whose statements are the same, by the runner of CockroachDB.
+	conn := openSqlite3Database(t, false).(*sqlite3Database).conn
+	args := make([]interface{}, 2*deleteBatchSize+1)
+	for i := range args {
+		args[i] = []byte(fmt.Sprintf("%020d", i))
+		if _, err := conn.Exec("INSERT INTO torrents (info_hash, name, total_size, discovered_on) VALUES (?, 'name', 1, 1);", args[i]); err != nil {
+			t.Fatalf("conn.Exec() error = %v", err)
+		}
+	}
+
+	// Each batch is aborted once, and must be retried on its own: the batches committed before it
+	// must be neither re-run nor left out of the count.
+	db := &cockroachDatabase{}
+	attempts := 0
+	run := func(ctx context.Context, fn func() error) error {
+		aborted := false
+		return db.retry(ctx, func() error {
+			attempts++
+			if !aborted {
+				aborted = true
+				return fmt.Errorf("tx.Commit %w", &pgconn.PgError{Code: "40001", Message: "restart transaction"})
+			}
+			return fn()
+		})
+	}
+
+	n, err := deleteInBatches(ctx, conn, run, "DELETE FROM torrents WHERE info_hash = ?;", args)
+	if err != nil || n != uint(len(args)) || attempts != 6 {
+		t.Errorf("deleteInBatches() = %d, %v after %d attempts, want %d, nil after 6", n, err, attempts, len(args))
+	}
+}
+
+func TestCockroachDatabase_BuildQueryTorrents(t *testing.T) {
+	db := &cockroachDatabase{&postgresDatabase{trgm: true, wholeNames: true}}
+
+	q, _ := ParseQuery("ubuntu")
+	sqlQuery, _ := db.buildQueryTorrents(q, 1000, ByRelevance, true, 20, nil, nil, nil, SearchNames)
+	for _, fragment := range []string{"similarity($2::TEXT, name)", "$2::TEXT % name"} {
+		if !strings.Contains(sqlQuery, fragment) {
+			t.Errorf("Expected the query to contain %q, but got %s", fragment, sqlQuery)
+		}
+	}
+	if strings.Contains(sqlQuery, "word_similarity") || strings.Contains(sqlQuery, "<%") {
+		t.Errorf("Expected the query not to use word similarity, but got %s", sqlQuery)
+	}
+}
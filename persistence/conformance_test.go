@@ -0,0 +1,1298 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+)
+
+// openDatabase opens an empty database for the test, which is closed (and deleted) at its end.
+type openDatabase func(t *testing.T, filesIndex bool) Database
+
+// testConformance runs the tests that every Database implementation must pass, so that the
+// backends are interchangeable. Each test opens its own database.
+func testConformance(t *testing.T, open openDatabase) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, open openDatabase)
+	}{
+		{"DoesTorrentExist", testDoesTorrentExist},
+		{"AddNewTorrent", testAddNewTorrent},
+		{"AddNewTorrents", testAddNewTorrents},
+		{"Duplicates", testDuplicates},
+		{"GetNumberOfTorrents", testGetNumberOfTorrents},
+		{"GetTorrent", testGetTorrent},
+		{"GetFiles", testGetFiles},
+		{"UnicodeNames", testUnicodeNames},
+		{"QueryTorrents", testQueryTorrents},
+		{"Ordering", testOrdering},
+		{"Pagination", testPagination},
+		{"EstimateNumberOfTorrents", testEstimateNumberOfTorrents},
+		{"Category", testCategory},
+		{"Structured", testStructured},
+		{"Files", testFiles},
+		{"RecordSwarm", testRecordSwarm},
+		{"Readme", testReadme},
+		{"Curation", testCuration},
+		{"Tags", testTags},
+		{"Users", testUsers},
+		{"Tokens", testTokens},
+		{"PurgeTorrents", testPurgeTorrents},
+		{"DeleteTorrent", testDeleteTorrent},
+		{"DeleteTorrents", testDeleteTorrents},
+		{"ApplyRetention", testApplyRetention},
+		{"GetStatistics", testGetStatistics},
+		{"CancelledContext", testCancelledContext},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tt.test(t, open)
+		})
+	}
+}
+
+// addTorrents adds the torrents named after their info hashes, in the given order.
+func addTorrents(t *testing.T, db Database, torrents map[string][]File, order ...string) {
+	t.Helper()
+	ctx := context.Background()
+
+	for _, name := range order {
+		if err := db.AddNewTorrent(ctx, []byte(name), name, torrents[name], Uncategorised); err != nil {
+			t.Fatalf("AddNewTorrent(%q) error = %v", name, err)
+		}
+	}
+}
+
+func names(torrents []TorrentMetadata) []string {
+	names := make([]string, 0, len(torrents))
+	for _, torrent := range torrents {
+		names = append(names, torrent.Name)
+	}
+	return names
+}
+
+func testDoesTorrentExist(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	tests := []struct {
+		name     string
+		infoHash []byte
+		want     bool
+	}{
+		{"Test Empty", []byte{}, false},
+		{"Test Zeroes", make([]byte, 20), false},
+		{"Test Existing", []byte("existing"), true},
+		{"Test Prefix", []byte("exist"), false},
+	}
+	addTorrents(t, db, map[string][]File{"existing": {{Size: 1, Path: "a"}}}, "existing")
+
+	for _, tt := range tests {
+		got, err := db.DoesTorrentExist(ctx, tt.infoHash)
+		if err != nil {
+			t.Errorf("DoesTorrentExist(%s) error = %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("DoesTorrentExist(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func testAddNewTorrent(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	tests := []struct {
+		name     string
+		infoHash []byte
+		files    []File
+		want     bool
+	}{
+		{"Test Nil", []byte("nil"), nil, false},
+		{"Test Empty", []byte("empty"), []File{}, false},
+		{"Test Zeroes", make([]byte, 20), []File{{Size: 0, Path: "test"}}, false},
+		{"Test NonZeroes", []byte("non-zeroes"), []File{{Size: 1, Path: "test"}}, true},
+	}
+	for _, tt := range tests {
+		if err := db.AddNewTorrent(ctx, tt.infoHash, tt.name, tt.files, Uncategorised); err != nil {
+			t.Errorf("AddNewTorrent(%s) error = %v", tt.name, err)
+		}
+		// Torrents whose total size is zero are not stored at all.
+		if exists, err := db.DoesTorrentExist(ctx, tt.infoHash); err != nil || exists != tt.want {
+			t.Errorf("DoesTorrentExist(%s) = %v, %v, want %v", tt.name, exists, err, tt.want)
+		}
+	}
+}
+
+func testAddNewTorrents(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	if err := db.AddNewTorrents(ctx, nil); err != nil {
+		t.Errorf("AddNewTorrents() of nothing error = %v", err)
+	}
+	if err := db.AddNewTorrent(ctx, []byte("existing"), "existing", []File{{Size: 1, Path: "a"}}, Uncategorised); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+
+	// Enough files for more than one statement, where the backends batch them.
+	many := make([]File, 1000)
+	for i := range many {
+		many[i] = File{Size: int64(i + 1), Path: fmt.Sprintf("file %03d", i)}
+	}
+	batch := []Torrent{
+		{InfoHash: []byte("first"), Name: "first", Files: []File{{Size: 1, Path: "first"}}, Category: Video, Swarm: Swarm{NPeers: 4, Clients: []string{"b", "a"}}},
+		{InfoHash: []byte("existing"), Name: "existing again", Files: []File{{Size: 2, Path: "b"}}, Swarm: Swarm{NPeers: 7, Clients: []string{"c"}}},
+		{InfoHash: []byte("empty"), Name: "empty", Files: []File{{Size: 0, Path: "empty"}}},
+		{InfoHash: []byte("invalid"), Name: "invalid", Files: []File{{Size: 1, Path: "\xff"}}},
+		{InfoHash: []byte("many"), Name: "many", Files: many, Category: Software},
+		{InfoHash: []byte("first"), Name: "first again", Files: []File{{Size: 3, Path: "c"}}, Swarm: Swarm{NPeers: 9, Clients: []string{"d"}}},
+	}
+	if err := db.AddNewTorrents(ctx, batch); err != nil {
+		t.Fatalf("AddNewTorrents() error = %v", err)
+	}
+
+	if n, err := db.GetNumberOfTorrents(ctx); err != nil || n != 3 {
+		t.Errorf("GetNumberOfTorrents() = %d, %v, want 3", n, err)
+	}
+	for name, want := range map[string]string{"existing": "existing", "first": "first", "many": "many"} {
+		tm, err := db.GetTorrent(ctx, []byte(name))
+		if err != nil || tm == nil || tm.Name != want {
+			t.Errorf("GetTorrent(%q) = %v, %v, want %q", name, tm, err, want)
+		}
+	}
+	for _, name := range []string{"empty", "invalid"} {
+		if exists, err := db.DoesTorrentExist(ctx, []byte(name)); err != nil || exists {
+			t.Errorf("DoesTorrentExist(%q) = %v, %v, want false", name, exists, err)
+		}
+	}
+	// The swarms are recorded along with the torrents added only.
+	wantSwarms := map[string]Swarm{
+		"first":    {NPeers: 4, Clients: []string{"a", "b"}},
+		"existing": {Clients: []string{}},
+		"many":     {Clients: []string{}},
+	}
+	if got, err := db.GetSwarms(ctx, [][]byte{[]byte("first"), []byte("existing"), []byte("many")}); err != nil || !reflect.DeepEqual(got, wantSwarms) {
+		t.Errorf("GetSwarms() = %v, %v, want %v", got, err, wantSwarms)
+	}
+
+	// The time of discovery of imported torrents is kept.
+	imported := Torrent{InfoHash: []byte("imported"), Name: "imported", Files: []File{{Size: 1, Path: "a"}}, DiscoveredOn: 1234567890}
+	if err := db.AddNewTorrents(ctx, []Torrent{imported}); err != nil {
+		t.Fatalf("AddNewTorrents() error = %v", err)
+	}
+	if tm, err := db.GetTorrent(ctx, []byte("imported")); err != nil || tm == nil || tm.DiscoveredOn != 1234567890 {
+		t.Errorf("GetTorrent() = %+v, %v, want it discovered on 1234567890", tm, err)
+	}
+
+	tm, err := db.GetTorrent(ctx, []byte("many"))
+	if err != nil || tm == nil || tm.NFiles != 1000 || tm.Size != 1000*1001/2 || tm.Category != Software {
+		t.Errorf("GetTorrent() = %+v, %v, want 1000 files", tm, err)
+	}
+	if files, err := db.GetFiles(ctx, []byte("many")); err != nil || !reflect.DeepEqual(files, many) {
+		t.Errorf("GetFiles() = %d files, %v, want the 1000 files in order", len(files), err)
+	}
+}
+
+func testDuplicates(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	if err := db.AddNewTorrent(ctx, []byte("duplicate"), "first", []File{{Size: 1, Path: "first"}}, Video); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+	// Adding a torrent again is not an error, and leaves the existing one as it is.
+	if err := db.AddNewTorrent(ctx, []byte("duplicate"), "second", []File{{Size: 2, Path: "second"}}, Audio); err != nil {
+		t.Fatalf("AddNewTorrent() of a duplicate error = %v", err)
+	}
+
+	tm, err := db.GetTorrent(ctx, []byte("duplicate"))
+	if err != nil || tm == nil {
+		t.Fatalf("GetTorrent() = %v, %v", tm, err)
+	}
+	if tm.Name != "first" || tm.Size != 1 || tm.NFiles != 1 || tm.Category != Video {
+		t.Errorf("GetTorrent() = %+v, want the first torrent", tm)
+	}
+	files, err := db.GetFiles(ctx, []byte("duplicate"))
+	if err != nil || !reflect.DeepEqual(files, []File{{Size: 1, Path: "first"}}) {
+		t.Errorf("GetFiles() = %v, %v, want the files of the first torrent", files, err)
+	}
+	if n, err := db.GetNumberOfTorrents(ctx); err != nil || n != 1 {
+		t.Errorf("GetNumberOfTorrents() = %d, %v, want 1", n, err)
+	}
+	got, err := db.QueryTorrents(ctx, "", time.Now().Unix(), ByDiscoveredOn, true, 10, nil, nil, nil, SearchNames)
+	if err != nil || len(got) != 1 {
+		t.Errorf("QueryTorrents() = %v, %v, want a single torrent", got, err)
+	}
+}
+
+func testGetNumberOfTorrents(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	if n, err := db.GetNumberOfTorrents(ctx); err != nil || n != 0 {
+		t.Errorf("GetNumberOfTorrents() of an empty database = %d, %v, want 0", n, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("torrent %d", i)
+		if err := db.AddNewTorrent(ctx, []byte(name), name, []File{{Size: 1, Path: name}}, Uncategorised); err != nil {
+			t.Fatalf("AddNewTorrent() error = %v", err)
+		}
+	}
+	if n, err := db.GetNumberOfTorrents(ctx); err != nil || n != 3 {
+		t.Errorf("GetNumberOfTorrents() = %d, %v, want 3", n, err)
+	}
+}
+
+func testGetTorrent(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	for _, infoHash := range [][]byte{{}, make([]byte, 20)} {
+		if tm, err := db.GetTorrent(ctx, infoHash); err != nil || tm != nil {
+			t.Errorf("GetTorrent(%v) of a missing torrent = %v, %v, want nil, nil", infoHash, tm, err)
+		}
+	}
+
+	before := time.Now().Unix()
+	files := []File{{Size: 3, Path: "a.mkv"}, {Size: 4, Path: "b.srt"}}
+	if err := db.AddNewTorrent(ctx, []byte("torrent"), "Torrent", files, Video); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+	after := time.Now().Unix()
+
+	tm, err := db.GetTorrent(ctx, []byte("torrent"))
+	if err != nil || tm == nil {
+		t.Fatalf("GetTorrent() = %v, %v", tm, err)
+	}
+	if string(tm.InfoHash) != "torrent" || tm.Name != "Torrent" || tm.Size != 7 || tm.NFiles != 2 || tm.Category != Video {
+		t.Errorf("GetTorrent() = %+v", tm)
+	}
+	if tm.DiscoveredOn < before || tm.DiscoveredOn > after {
+		t.Errorf("GetTorrent().DiscoveredOn = %d, want within [%d, %d]", tm.DiscoveredOn, before, after)
+	}
+}
+
+func testGetFiles(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	for _, infoHash := range [][]byte{{}, make([]byte, 20)} {
+		if files, err := db.GetFiles(ctx, infoHash); err != nil || files != nil {
+			t.Errorf("GetFiles(%v) of a missing torrent = %v, %v, want nil, nil", infoHash, files, err)
+		}
+	}
+
+	// Files are returned in the order of the torrent.
+	files := []File{{Size: 3, Path: "z/last"}, {Size: 1, Path: "a/first"}, {Size: 2, Path: "m/middle"}}
+	if err := db.AddNewTorrent(ctx, []byte("torrent"), "torrent", files, Uncategorised); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+	if got, err := db.GetFiles(ctx, []byte("torrent")); err != nil || !reflect.DeepEqual(got, files) {
+		t.Errorf("GetFiles() = %v, %v, want %v", got, err, files)
+	}
+
+	other := []File{{Size: 4, Path: "other"}}
+	if err := db.AddNewTorrent(ctx, []byte("other"), "other", other, Uncategorised); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+	want := map[string][]File{"torrent": files, "other": other}
+	if got, err := db.GetFilesOfTorrents(ctx, [][]byte{[]byte("torrent"), []byte("missing"), []byte("other")}); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetFilesOfTorrents() = %v, %v, want %v", got, err, want)
+	}
+	if got, err := db.GetFilesOfTorrents(ctx, nil); err != nil || len(got) != 0 {
+		t.Errorf("GetFilesOfTorrents() of no torrents = %v, %v, want none", got, err)
+	}
+}
+
+func testUnicodeNames(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, true)
+
+	name := "Ñandú – 日本語 ☃ Ελληνικά"
+	files := []File{{Size: 1, Path: "音楽/曲.flac"}, {Size: 2, Path: "Ψ/emoji 🎵.txt"}}
+	if err := db.AddNewTorrent(ctx, []byte("unicode"), name, files, Uncategorised); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+	// Names and paths that are not valid UTF-8 are ignored rather than stored mangled.
+	if err := db.AddNewTorrent(ctx, []byte("invalid"), "\xff\xfe", []File{{Size: 1, Path: "a"}}, Uncategorised); err != nil {
+		t.Fatalf("AddNewTorrent() of an invalid name error = %v", err)
+	}
+	if exists, err := db.DoesTorrentExist(ctx, []byte("invalid")); err != nil || exists {
+		t.Errorf("DoesTorrentExist() of an invalid name = %v, %v, want false", exists, err)
+	}
+
+	tm, err := db.GetTorrent(ctx, []byte("unicode"))
+	if err != nil || tm == nil || tm.Name != name {
+		t.Errorf("GetTorrent() = %v, %v, want the name %q", tm, err, name)
+	}
+	if got, err := db.GetFiles(ctx, []byte("unicode")); err != nil || !reflect.DeepEqual(got, files) {
+		t.Errorf("GetFiles() = %v, %v, want %v", got, err, files)
+	}
+
+	for _, query := range []string{"Ñandú", "日本語", "Ελληνικά", `"日本語 ☃ Ελληνικά"`} {
+		got, err := db.QueryTorrents(ctx, query, time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchNames)
+		if err != nil || !reflect.DeepEqual(names(got), []string{name}) {
+			t.Errorf("QueryTorrents(%q) = %v, %v, want the torrent", query, got, err)
+		}
+	}
+	got, err := db.QueryTorrents(ctx, "音楽", time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchFiles)
+	if err != nil || len(got) != 1 || !reflect.DeepEqual(got[0].MatchedFiles, []string{"音楽/曲.flac"}) {
+		t.Errorf("QueryTorrents() of the files = %v, %v, want the torrent", got, err)
+	}
+}
+
+func testQueryTorrents(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	tests := []struct {
+		name    string
+		query   string
+		orderBy OrderingCriteria
+		want    []TorrentMetadata
+		wantErr bool
+	}{
+		{"Test Relevance", "", ByRelevance, nil, true},
+		{"Test DiscoveredOn", "", ByDiscoveredOn, []TorrentMetadata{}, false},
+		{"Test NFiles", "", ByNFiles, []TorrentMetadata{}, false},
+		{"Test TotalSize", "", ByTotalSize, []TorrentMetadata{}, false},
+		{"Test Terms", "ubuntu", ByRelevance, []TorrentMetadata{}, false},
+	}
+	for _, tt := range tests {
+		got, err := db.QueryTorrents(ctx, tt.query, 0, tt.orderBy, true, 10, nil, nil, nil, SearchNames)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("QueryTorrents(%s) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("QueryTorrents(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	addTorrents(t, db, map[string][]File{"torrent": {{Size: 1, Path: "a"}}}, "torrent")
+	// Torrents discovered after the epoch are not returned.
+	got, err := db.QueryTorrents(ctx, "", time.Now().Unix()-3600, ByDiscoveredOn, true, 10, nil, nil, nil, SearchNames)
+	if err != nil || len(got) != 0 {
+		t.Errorf("QueryTorrents() before the epoch = %v, %v, want none", got, err)
+	}
+	lastOrderedValue := 1.0
+	if _, err = db.QueryTorrents(ctx, "", time.Now().Unix(), ByDiscoveredOn, true, 10, &lastOrderedValue, nil, nil, SearchNames); err == nil {
+		t.Error("QueryTorrents() error = nil, want an error since lastID is missing")
+	}
+}
+
+func testOrdering(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	torrents := map[string][]File{
+		"big ubuntu":           {{Size: 100, Path: "a"}},
+		"small ubuntu":         {{Size: 1, Path: "a"}, {Size: 1, Path: "b"}, {Size: 1, Path: "c"}},
+		"ubuntu":               {{Size: 50, Path: "a"}, {Size: 50, Path: "b"}},
+		"some other distro":    {{Size: 10, Path: "a"}},
+		"ubuntu ubuntu ubuntu": {{Size: 10, Path: "a"}},
+	}
+	addTorrents(t, db, torrents, "big ubuntu", "small ubuntu", "ubuntu", "some other distro", "ubuntu ubuntu ubuntu")
+
+	for orderBy := ByRelevance; orderBy <= ByUpdatedOn; orderBy++ {
+		for _, ascending := range []bool{true, false} {
+			got, err := db.QueryTorrents(ctx, "ubuntu", time.Now().Unix(), orderBy, ascending, 10, nil, nil, nil, SearchNames)
+			if checkOrdering(&Query{Terms: []string{"ubuntu"}}, orderBy) != nil {
+				if err == nil {
+					t.Errorf("QueryTorrents() by %s error = nil, want an error", orderBy)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("QueryTorrents() by %s error = %v", orderBy, err)
+				continue
+			}
+
+			if len(got) != 4 {
+				t.Errorf("QueryTorrents() by %s = %v, want the 4 torrents matching ubuntu", orderBy, names(got))
+			}
+			// Ties are broken on the IDs, which increase in the order of insertion.
+			if !sort.SliceIsSorted(got, func(i, j int) bool {
+				vi, vj := got[i].OrderedValue(orderBy), got[j].OrderedValue(orderBy)
+				if vi != vj {
+					return (vi < vj) == ascending
+				}
+				return (got[i].ID < got[j].ID) == ascending
+			}) {
+				t.Errorf("QueryTorrents() by %s (ascending %v) is not sorted: %+v", orderBy, ascending, got)
+			}
+		}
+	}
+
+	got, err := db.QueryTorrents(ctx, "", time.Now().Unix(), ByTotalSize, true, 10, nil, nil, nil, SearchNames)
+	want := []string{"small ubuntu", "some other distro", "ubuntu ubuntu ubuntu", "big ubuntu", "ubuntu"}
+	if err != nil || !reflect.DeepEqual(names(got), want) {
+		t.Errorf("QueryTorrents() by total size = %v, %v, want %v", names(got), err, want)
+	}
+	got, err = db.QueryTorrents(ctx, "", time.Now().Unix(), ByNFiles, false, 10, nil, nil, nil, SearchNames)
+	want = []string{"small ubuntu", "ubuntu", "ubuntu ubuntu ubuntu", "some other distro", "big ubuntu"}
+	if err != nil || !reflect.DeepEqual(names(got), want) {
+		t.Errorf("QueryTorrents() by number of files = %v, %v, want %v", names(got), err, want)
+	}
+}
+
+func testPagination(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	// Values repeat, so that the pages must break ties on the IDs.
+	sizes := []int64{3, 1, 2, 3, 1, 2, 2}
+	for i, size := range sizes {
+		name := fmt.Sprintf("torrent %c", 'a'+i)
+		files := make([]File, 1+i%3)
+		for j := range files {
+			files[j] = File{Size: size, Path: fmt.Sprintf("%d", j)}
+		}
+		if err := db.AddNewTorrent(ctx, []byte(name), name, files, Uncategorised); err != nil {
+			t.Fatalf("AddNewTorrent() error = %v", err)
+		}
+	}
+
+	for _, orderBy := range []OrderingCriteria{ByRelevance, ByTotalSize, ByDiscoveredOn, ByNFiles} {
+		for _, ascending := range []bool{true, false} {
+			for _, query := range []string{"", "torrent"} {
+				if orderBy == ByRelevance && query == "" {
+					continue
+				}
+
+				all, err := db.QueryTorrents(ctx, query, time.Now().Unix(), orderBy, ascending, 100, nil, nil, nil, SearchNames)
+				if err != nil || len(all) != len(sizes) {
+					t.Fatalf("QueryTorrents() = %v, %v, want all the torrents", all, err)
+				}
+
+				var pages []TorrentMetadata
+				var lastOrderedValue *float64
+				var lastID *uint64
+				for page := 0; page <= len(sizes); page++ {
+					got, err := db.QueryTorrents(ctx, query, time.Now().Unix(), orderBy, ascending, 2, lastOrderedValue, lastID, nil, SearchNames)
+					if err != nil {
+						t.Fatalf("QueryTorrents() error = %v", err)
+					}
+					if len(got) == 0 {
+						break
+					}
+					pages = append(pages, got...)
+					last := got[len(got)-1]
+					value := last.OrderedValue(orderBy)
+					lastOrderedValue, lastID = &value, &last.ID
+				}
+
+				if !reflect.DeepEqual(names(pages), names(all)) {
+					t.Errorf("QueryTorrents(%q) by %s (ascending %v) pages = %v, want %v", query, orderBy, ascending, names(pages), names(all))
+				}
+			}
+		}
+	}
+}
+
+func testEstimateNumberOfTorrents(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	addTorrents(t, db, map[string][]File{
+		"ubuntu desktop": {{Size: 1, Path: "a"}},
+		"ubuntu server":  {{Size: 1, Path: "a"}},
+		"debian":         {{Size: 1, Path: "a"}},
+	}, "ubuntu desktop", "ubuntu server", "debian")
+
+	for _, tt := range []struct {
+		query string
+		want  uint
+		exact bool
+	}{
+		{"", 3, false},
+		{"ubuntu", 2, true},
+		{"ubuntu -server", 1, true},
+		{"arch", 0, true},
+	} {
+		got, exact, err := EstimateNumberOfTorrents(ctx, db, tt.query, time.Now().Unix(), nil, SearchNames)
+		if err != nil || got != tt.want || exact != tt.exact {
+			t.Errorf("EstimateNumberOfTorrents(%q) = %d, %v, %v, want %d, %v", tt.query, got, exact, err, tt.want, tt.exact)
+		}
+	}
+}
+
+func testCategory(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	if err := db.AddNewTorrent(ctx, []byte("video"), "video", []File{{Size: 1, Path: "a.mkv"}}, Video); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+	if err := db.AddNewTorrent(ctx, []byte("audio"), "audio", []File{{Size: 1, Path: "a.mp3"}}, Audio); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+
+	category := Audio
+	got, err := db.QueryTorrents(ctx, "", time.Now().Unix(), ByDiscoveredOn, true, 10, nil, nil, &category, SearchNames)
+	if err != nil || len(got) != 1 || got[0].Name != "audio" || got[0].Category != Audio {
+		t.Errorf("QueryTorrents() = %v, %v, want only the audio torrent", got, err)
+	}
+
+	got, err = db.QueryTorrents(ctx, "", time.Now().Unix(), ByDiscoveredOn, true, 10, nil, nil, nil, SearchNames)
+	if err != nil || len(got) != 2 {
+		t.Errorf("QueryTorrents() = %v, %v, want both torrents", got, err)
+	}
+
+	tm, err := db.GetTorrent(ctx, []byte("video"))
+	if err != nil || tm == nil || tm.Category != Video {
+		t.Errorf("GetTorrent() = %v, %v, want a video torrent", tm, err)
+	}
+}
+
+func testStructured(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	torrents := map[string][]File{
+		"Ubuntu Server 24.04":   {{Size: 2 << 30, Path: "ubuntu.iso"}},
+		"Ubuntu Desktop 24.04":  {{Size: 5 << 30, Path: "ubuntu.iso"}, {Size: 1, Path: "SHA256SUMS"}},
+		"Some \"Quoted\" Movie": {{Size: 1 << 30, Path: "movie.MKV"}},
+	}
+	addTorrents(t, db, torrents, "Ubuntu Server 24.04", "Ubuntu Desktop 24.04", "Some \"Quoted\" Movie")
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"ubuntu -desktop", []string{"Ubuntu Server 24.04"}},
+		{`"server 24"`, []string{"Ubuntu Server 24.04"}},
+		{`"desktop server"`, []string{}},
+		{`"quoted" AND OR NEAR(`, []string{}},
+		{`quoted"`, []string{"Some \"Quoted\" Movie"}},
+		{"size:>3GiB", []string{"Ubuntu Desktop 24.04"}},
+		{"files:>=2", []string{"Ubuntu Desktop 24.04"}},
+		{"ext:mkv", []string{"Some \"Quoted\" Movie"}},
+		{"-ubuntu", []string{"Some \"Quoted\" Movie"}},
+		{"before:2000-01-01", []string{}},
+	}
+	for _, tt := range tests {
+		got, err := db.QueryTorrents(ctx, tt.query, time.Now().Unix(), ByDiscoveredOn, true, 10, nil, nil, nil, SearchNames)
+		if err != nil {
+			t.Errorf("QueryTorrents(%q) error = %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(names(got), tt.want) {
+			t.Errorf("QueryTorrents(%q) = %v, want %v", tt.query, names(got), tt.want)
+		}
+	}
+
+	_, err := db.QueryTorrents(ctx, "size:>1XB", time.Now().Unix(), ByDiscoveredOn, true, 10, nil, nil, nil, SearchNames)
+	var queryError *QueryError
+	if !errors.As(err, &queryError) {
+		t.Errorf("QueryTorrents() error = %v, want a QueryError", err)
+	}
+	_, err = db.QueryTorrents(ctx, "size:>1GiB", time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchNames)
+	if err == nil {
+		t.Error("QueryTorrents() error = nil, want an error since there are no search terms")
+	}
+}
+
+func testFiles(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+	if _, err := db.QueryTorrents(ctx, "ubuntu", time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchFiles); err == nil {
+		t.Error("QueryTorrents() error = nil, want an error since file paths are not indexed")
+	}
+
+	db = open(t, true)
+	torrents := map[string][]File{
+		"xyz-123": {{Size: 1, Path: "ubuntu-22.04.iso"}},
+		"abc-456": {{Size: 1, Path: "docs/ubuntu.txt"}, {Size: 2, Path: "debian.iso"}, {Size: 3, Path: "ubuntu/server.iso"}},
+		"ubuntu":  {{Size: 1, Path: "a.iso"}},
+	}
+	addTorrents(t, db, torrents, "xyz-123", "abc-456", "ubuntu")
+
+	got, err := db.QueryTorrents(ctx, "ubuntu", time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchFiles)
+	if err != nil {
+		t.Fatalf("QueryTorrents() error = %v", err)
+	}
+	matchedFiles := make(map[string][]string)
+	for _, torrent := range got {
+		matchedFiles[torrent.Name] = torrent.MatchedFiles
+	}
+	want := map[string][]string{
+		"xyz-123": {"ubuntu-22.04.iso"},
+		"abc-456": {"docs/ubuntu.txt", "ubuntu/server.iso"},
+	}
+	if !reflect.DeepEqual(matchedFiles, want) {
+		t.Errorf("QueryTorrents() matched files = %v, want %v", matchedFiles, want)
+	}
+
+	got, err = db.QueryTorrents(ctx, "ubuntu", time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchNamesAndFiles)
+	if err != nil || len(got) != 3 {
+		t.Errorf("QueryTorrents() = %v, %v, want all the torrents", got, err)
+	}
+
+	got, err = db.QueryTorrents(ctx, "ubuntu", time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchNames)
+	if err != nil || len(got) != 1 || got[0].Name != "ubuntu" || got[0].MatchedFiles != nil {
+		t.Errorf("QueryTorrents() = %v, %v, want only the torrent named ubuntu", got, err)
+	}
+
+	got, err = db.QueryTorrents(ctx, "iso -server", time.Now().Unix(), ByDiscoveredOn, true, 10, nil, nil, nil, SearchFiles)
+	if err != nil || !reflect.DeepEqual(names(got), []string{"xyz-123", "ubuntu"}) {
+		t.Errorf("QueryTorrents() = %v, %v, want the torrents without server files", names(got), err)
+	}
+
+	// Files are removed from the index along with their torrents.
+	if _, err = db.PurgeTorrents(ctx, [][]byte{[]byte("abc-456")}, nil); err != nil {
+		t.Fatalf("PurgeTorrents() error = %v", err)
+	}
+	got, err = db.QueryTorrents(ctx, "server", time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchFiles)
+	if err != nil || len(got) != 0 {
+		t.Errorf("QueryTorrents() = %v, %v, want no torrents", got, err)
+	}
+}
+
+func testRecordSwarm(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	infoHash := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	if err := db.RecordSwarm(ctx, infoHash, Swarm{NPeers: 5, Clients: []string{"a"}}); err != nil {
+		t.Errorf("RecordSwarm() of a missing torrent error = %v", err)
+	}
+	if swarm, err := db.GetSwarm(ctx, infoHash); err != nil || swarm != nil {
+		t.Errorf("GetSwarm() of a missing torrent = %v, %v, want nil, nil", swarm, err)
+	}
+
+	if err := db.AddNewTorrent(ctx, infoHash, "swarm", []File{{Size: 1, Path: "swarm"}}, Uncategorised); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+	if swarm, err := db.GetSwarm(ctx, infoHash); err != nil || !reflect.DeepEqual(swarm, &Swarm{Clients: []string{}}) {
+		t.Errorf("GetSwarm() of an unrecorded torrent = %v, %v", swarm, err)
+	}
+
+	if err := db.RecordSwarm(ctx, infoHash, Swarm{NPeers: 5, Clients: []string{"b", "a"}}); err != nil {
+		t.Errorf("RecordSwarm() error = %v", err)
+	}
+	// Only the number of peers first recorded is kept, whereas clients accumulate.
+	if err := db.RecordSwarm(ctx, infoHash, Swarm{NPeers: 9, Clients: []string{"c", "a"}}); err != nil {
+		t.Errorf("RecordSwarm() error = %v", err)
+	}
+
+	want := &Swarm{NPeers: 5, Clients: []string{"a", "b", "c"}}
+	if got, err := db.GetSwarm(ctx, infoHash); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetSwarm() = %v, %v, want %v", got, err, want)
+	}
+
+	if err := db.AddNewTorrent(ctx, []byte("unrecorded"), "unrecorded", []File{{Size: 1, Path: "a"}}, Uncategorised); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+	wantSwarms := map[string]Swarm{string(infoHash): *want, "unrecorded": {Clients: []string{}}}
+	if got, err := db.GetSwarms(ctx, [][]byte{infoHash, []byte("missing"), []byte("unrecorded")}); err != nil || !reflect.DeepEqual(got, wantSwarms) {
+		t.Errorf("GetSwarms() = %v, %v, want %v", got, err, wantSwarms)
+	}
+}
+
+func testReadme(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	infoHash := []byte("readme")
+	readme := Readme{Path: "dir/README.txt", Content: "Hello, wörld!"}
+
+	if err := db.SetReadme(ctx, infoHash, readme); err != nil {
+		t.Errorf("SetReadme() of a missing torrent error = %v", err)
+	}
+	if got, err := db.GetReadme(ctx, infoHash); err != nil || got != nil {
+		t.Errorf("GetReadme() of a missing torrent = %v, %v, want nil, nil", got, err)
+	}
+
+	files := []File{{Size: 1, Path: "dir/README.txt"}, {Size: 2, Path: "dir/info.nfo"}}
+	if err := db.AddNewTorrent(ctx, infoHash, "readme", files, Uncategorised); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+	if got, err := db.GetReadme(ctx, infoHash); err != nil || got != nil {
+		t.Errorf("GetReadme() of an unfetched readme = %v, %v, want nil, nil", got, err)
+	}
+
+	if err := db.SetReadme(ctx, infoHash, Readme{Path: "missing.txt", Content: "x"}); err != nil {
+		t.Errorf("SetReadme() of a missing file error = %v", err)
+	}
+	if got, err := db.GetReadme(ctx, infoHash); err != nil || got != nil {
+		t.Errorf("GetReadme() after a readme of a missing file = %v, %v, want nil, nil", got, err)
+	}
+
+	if err := db.SetReadme(ctx, infoHash, readme); err != nil {
+		t.Fatalf("SetReadme() error = %v", err)
+	}
+	if got, err := db.GetReadme(ctx, infoHash); err != nil || !reflect.DeepEqual(got, &readme) {
+		t.Errorf("GetReadme() = %v, %v, want %v", got, err, readme)
+	}
+
+	// A readme replaces the one stored before.
+	readme = Readme{Path: "dir/info.nfo", Content: "NFO"}
+	if err := db.SetReadme(ctx, infoHash, readme); err != nil {
+		t.Fatalf("SetReadme() error = %v", err)
+	}
+	if got, err := db.GetReadme(ctx, infoHash); err != nil || !reflect.DeepEqual(got, &readme) {
+		t.Errorf("GetReadme() = %v, %v, want %v", got, err, readme)
+	}
+
+	if got, err := db.GetFiles(ctx, infoHash); err != nil || !reflect.DeepEqual(got, files) {
+		t.Errorf("GetFiles() = %v, %v, want %v", got, err, files)
+	}
+	if _, err := db.DeleteTorrent(ctx, infoHash); err != nil {
+		t.Fatalf("DeleteTorrent() error = %v", err)
+	}
+	if got, err := db.GetReadme(ctx, infoHash); err != nil || got != nil {
+		t.Errorf("GetReadme() of a deleted torrent = %v, %v, want nil, nil", got, err)
+	}
+}
+
+func testCuration(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	infoHash := []byte("curated")
+
+	if err := db.AddTag(ctx, infoHash, "linux"); err != nil {
+		t.Errorf("AddTag() of a missing torrent error = %v", err)
+	}
+	if err := db.SetStarred(ctx, infoHash, true); err != nil {
+		t.Errorf("SetStarred() of a missing torrent error = %v", err)
+	}
+	if got, err := db.GetCuration(ctx, infoHash); err != nil || got != nil {
+		t.Errorf("GetCuration() of a missing torrent = %v, %v, want nil, nil", got, err)
+	}
+
+	addTorrents(t, db, map[string][]File{"curated": {{Size: 1, Path: "a"}}}, "curated")
+	want := &Curation{Tags: []string{}}
+	if got, err := db.GetCuration(ctx, infoHash); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetCuration() of an uncurated torrent = %v, %v, want %v", got, err, want)
+	}
+
+	for _, tag := range []string{"Linux", "iso", "linux"} {
+		if err := db.AddTag(ctx, infoHash, tag); err != nil {
+			t.Fatalf("AddTag(%q) error = %v", tag, err)
+		}
+	}
+	if err := db.AddTag(ctx, infoHash, "not a tag"); err == nil {
+		t.Error("AddTag() of an invalid tag error = nil")
+	}
+	if err := db.SetNote(ctx, infoHash, "Checked, wörks."); err != nil {
+		t.Fatalf("SetNote() error = %v", err)
+	}
+	if err := db.SetStarred(ctx, infoHash, true); err != nil {
+		t.Fatalf("SetStarred() error = %v", err)
+	}
+	want = &Curation{Tags: []string{"iso", "linux"}, Note: "Checked, wörks.", Starred: true}
+	if got, err := db.GetCuration(ctx, infoHash); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetCuration() = %v, %v, want %v", got, err, want)
+	}
+
+	if err := db.RemoveTag(ctx, infoHash, "ISO"); err != nil {
+		t.Fatalf("RemoveTag() error = %v", err)
+	}
+	if err := db.RemoveTag(ctx, infoHash, "missing"); err != nil {
+		t.Errorf("RemoveTag() of a missing tag error = %v", err)
+	}
+	if err := db.SetNote(ctx, infoHash, ""); err != nil {
+		t.Fatalf("SetNote() error = %v", err)
+	}
+	if err := db.SetStarred(ctx, infoHash, false); err != nil {
+		t.Fatalf("SetStarred() error = %v", err)
+	}
+	want = &Curation{Tags: []string{"linux"}}
+	if got, err := db.GetCuration(ctx, infoHash); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetCuration() after undoing = %v, %v, want %v", got, err, want)
+	}
+
+	if _, err := db.DeleteTorrent(ctx, infoHash); err != nil {
+		t.Fatalf("DeleteTorrent() error = %v", err)
+	}
+	if got, err := db.GetCuration(ctx, infoHash); err != nil || got != nil {
+		t.Errorf("GetCuration() of a deleted torrent = %v, %v, want nil, nil", got, err)
+	}
+	if got, err := db.GetTags(ctx); err != nil || len(got) != 0 {
+		t.Errorf("GetTags() after deleting the only tagged torrent = %v, %v, want none", got, err)
+	}
+}
+
+func testTags(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	addTorrents(t, db, map[string][]File{
+		"ubuntu":  {{Size: 1, Path: "ubuntu.iso"}},
+		"debian":  {{Size: 1, Path: "debian.iso"}},
+		"windows": {{Size: 1, Path: "windows.iso"}},
+	}, "ubuntu", "debian", "windows")
+	for infoHash, tags := range map[string][]string{"ubuntu": {"linux", "seed"}, "debian": {"linux"}, "windows": {"seed"}} {
+		for _, tag := range tags {
+			if err := db.AddTag(ctx, []byte(infoHash), tag); err != nil {
+				t.Fatalf("AddTag() error = %v", err)
+			}
+		}
+	}
+	if err := db.SetStarred(ctx, []byte("debian"), true); err != nil {
+		t.Fatalf("SetStarred() error = %v", err)
+	}
+
+	want := []Tag{{Name: "linux", NTorrents: 2}, {Name: "seed", NTorrents: 2}}
+	if got, err := db.GetTags(ctx); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTags() = %v, %v, want %v", got, err, want)
+	}
+
+	for query, want := range map[string][]string{
+		"tag:linux":           {"debian", "ubuntu"},
+		"tag:linux tag:seed":  {"ubuntu"},
+		"tag:seed windows":    {"windows"},
+		"is:starred":          {"debian"},
+		"is:starred tag:seed": {},
+		"tag:missing":         {},
+		"tag:linux -debian":   {"ubuntu"},
+	} {
+		got, err := db.QueryTorrents(ctx, query, time.Now().Unix(), ByDiscoveredOn, false, 10, nil, nil, nil, SearchNames)
+		if err != nil {
+			t.Errorf("QueryTorrents(%q) error = %v", query, err)
+			continue
+		}
+		gotNames := names(got)
+		sort.Strings(gotNames)
+		if !reflect.DeepEqual(gotNames, want) {
+			t.Errorf("QueryTorrents(%q) = %v, want %v", query, gotNames, want)
+		}
+	}
+
+	// Tags left without torrents are deleted.
+	if err := db.RemoveTag(ctx, []byte("windows"), "seed"); err != nil {
+		t.Fatalf("RemoveTag() error = %v", err)
+	}
+	if err := db.RemoveTag(ctx, []byte("ubuntu"), "seed"); err != nil {
+		t.Fatalf("RemoveTag() error = %v", err)
+	}
+	want = []Tag{{Name: "linux", NTorrents: 2}}
+	if got, err := db.GetTags(ctx); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTags() after removing a tag = %v, %v, want %v", got, err, want)
+	}
+}
+
+func testUsers(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	if got, err := db.GetUser(ctx, "alice"); err != nil || got != nil {
+		t.Errorf("GetUser() of a missing user = %v, %v, want nil, nil", got, err)
+	}
+	for _, name := range []string{"", "Alice", "al__ice", "alice_", "1alice"} {
+		if err := db.SetUser(ctx, User{Name: name, PasswordHash: []byte("hash")}); err == nil {
+			t.Errorf("SetUser(%q) error = nil, want an error", name)
+		}
+	}
+
+	for _, user := range []User{
+		{Name: "bob", PasswordHash: []byte("bob's hash"), Role: Viewer},
+		{Name: "alice", PasswordHash: []byte("alice's hash"), Role: Curator},
+		{Name: "alice", PasswordHash: []byte("alice's new hash"), Role: Admin},
+	} {
+		if err := db.SetUser(ctx, user); err != nil {
+			t.Fatalf("SetUser(%q) error = %v", user.Name, err)
+		}
+	}
+
+	alice := User{Name: "alice", PasswordHash: []byte("alice's new hash"), Role: Admin}
+	if got, err := db.GetUser(ctx, "alice"); err != nil || got == nil || !reflect.DeepEqual(*got, alice) {
+		t.Errorf("GetUser() = %v, %v, want %v", got, err, alice)
+	}
+	want := []User{alice, {Name: "bob", PasswordHash: []byte("bob's hash"), Role: Viewer}}
+	if got, err := db.GetUsers(ctx); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetUsers() = %v, %v, want %v", got, err, want)
+	}
+
+	if deleted, err := db.DeleteUser(ctx, "bob"); err != nil || !deleted {
+		t.Errorf("DeleteUser() = %v, %v, want true, nil", deleted, err)
+	}
+	if deleted, err := db.DeleteUser(ctx, "bob"); err != nil || deleted {
+		t.Errorf("DeleteUser() of a missing user = %v, %v, want false, nil", deleted, err)
+	}
+	if got, err := db.GetUsers(ctx); err != nil || !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("GetUsers() after deleting = %v, %v, want %v", got, err, want[:1])
+	}
+}
+
+func testTokens(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	for _, name := range []string{"alice", "bob"} {
+		if err := db.SetUser(ctx, User{Name: name, PasswordHash: []byte("hash")}); err != nil {
+			t.Fatalf("SetUser() error = %v", err)
+		}
+	}
+	tokens := []Token{
+		{ID: "b", Hash: []byte("b's hash"), User: "alice", Name: "backup script", CreatedOn: 100},
+		{ID: "a", Hash: []byte("a's hash"), User: "alice", Session: true, CreatedOn: 200, ExpiresOn: 300},
+		{ID: "c", Hash: []byte("c's hash"), User: "bob", Session: true, CreatedOn: 100, ExpiresOn: 500},
+	}
+	for _, token := range tokens {
+		if err := db.AddToken(ctx, token); err != nil {
+			t.Fatalf("AddToken(%q) error = %v", token.ID, err)
+		}
+	}
+	if err := db.AddToken(ctx, Token{ID: "d", Hash: []byte("d's hash"), User: "carol", CreatedOn: 100}); err == nil {
+		t.Errorf("AddToken() of a missing user error = nil, want an error")
+	}
+
+	if got, err := db.GetToken(ctx, "a"); err != nil || got == nil || !reflect.DeepEqual(*got, tokens[1]) {
+		t.Errorf("GetToken() = %v, %v, want %v", got, err, tokens[1])
+	}
+	if got, err := db.GetToken(ctx, "d"); err != nil || got != nil {
+		t.Errorf("GetToken() of a missing token = %v, %v, want nil, nil", got, err)
+	}
+	if got, err := db.GetTokens(ctx, "alice"); err != nil || !reflect.DeepEqual(got, tokens[:2]) {
+		t.Errorf("GetTokens() = %v, %v, want %v", got, err, tokens[:2])
+	}
+
+	// Tokens that never expire are kept.
+	if n, err := db.DeleteExpiredTokens(ctx, 300); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredTokens() = %d, %v, want 1, nil", n, err)
+	}
+	if got, err := db.GetTokens(ctx, "alice"); err != nil || !reflect.DeepEqual(got, tokens[:1]) {
+		t.Errorf("GetTokens() after deleting the expired ones = %v, %v, want %v", got, err, tokens[:1])
+	}
+
+	if deleted, err := db.DeleteToken(ctx, "b"); err != nil || !deleted {
+		t.Errorf("DeleteToken() = %v, %v, want true, nil", deleted, err)
+	}
+	if deleted, err := db.DeleteToken(ctx, "b"); err != nil || deleted {
+		t.Errorf("DeleteToken() of a missing token = %v, %v, want false, nil", deleted, err)
+	}
+
+	// The tokens of the users are deleted along with them.
+	if _, err := db.DeleteUser(ctx, "bob"); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if got, err := db.GetToken(ctx, "c"); err != nil || got != nil {
+		t.Errorf("GetToken() of a deleted user = %v, %v, want nil, nil", got, err)
+	}
+}
+
+func testPurgeTorrents(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, true)
+
+	torrents := []struct {
+		infoHash []byte
+		name     string
+		path     string
+	}{
+		{[]byte("blocked by info hash"), "one", "one.txt"},
+		{[]byte("blocked by name"), "forbidden", "two.txt"},
+		{[]byte("blocked by file path"), "three", "dir/forbidden.txt"},
+		{[]byte("allowed"), "four", "four.txt"},
+	}
+	for _, torrent := range torrents {
+		if err := db.AddNewTorrent(ctx, torrent.infoHash, torrent.name, []File{{Size: 1, Path: torrent.path}}, Uncategorised); err != nil {
+			t.Fatalf("AddNewTorrent() error = %v", err)
+		}
+	}
+
+	n, err := db.PurgeTorrents(ctx, [][]byte{[]byte("blocked by info hash"), []byte("missing")}, regexp.MustCompile("forbidden"))
+	if err != nil {
+		t.Fatalf("PurgeTorrents() error = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("PurgeTorrents() = %d, want 3", n)
+	}
+
+	for _, torrent := range torrents {
+		exists, err := db.DoesTorrentExist(ctx, torrent.infoHash)
+		if err != nil {
+			t.Errorf("DoesTorrentExist() error = %v", err)
+		}
+		if want := torrent.name == "four"; exists != want {
+			t.Errorf("DoesTorrentExist(%q) = %v, want %v", torrent.infoHash, exists, want)
+		}
+	}
+
+	if files, err := db.GetFiles(ctx, []byte("blocked by file path")); err != nil || files != nil {
+		t.Errorf("GetFiles() of a purged torrent = %v, %v, want nil, nil", files, err)
+	}
+	for _, query := range []string{"forbidden", "one"} {
+		got, err := db.QueryTorrents(ctx, query, time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchNamesAndFiles)
+		if err != nil || len(got) != 0 {
+			t.Errorf("QueryTorrents(%q) = %v, %v, want no purged torrents", query, got, err)
+		}
+	}
+
+	if n, err = db.PurgeTorrents(ctx, nil, nil); err != nil || n != 0 {
+		t.Errorf("PurgeTorrents() of nothing = %d, %v, want 0", n, err)
+	}
+
+	// More torrents than are deleted at once, matched by info hash and by pattern alike.
+	var many []Torrent
+	var infoHashes [][]byte
+	for i := 0; i < 2*deleteBatchSize+1; i++ {
+		infoHash := []byte(fmt.Sprintf("many %03d", i))
+		many = append(many, Torrent{InfoHash: infoHash, Name: "many", Files: []File{{Size: 1, Path: "a"}}})
+		infoHashes = append(infoHashes, infoHash)
+	}
+	for _, purge := range []func() (uint, error){
+		func() (uint, error) { return db.PurgeTorrents(ctx, infoHashes, nil) },
+		func() (uint, error) { return db.PurgeTorrents(ctx, nil, regexp.MustCompile("^many$")) },
+	} {
+		if err = db.AddNewTorrents(ctx, many); err != nil {
+			t.Fatalf("AddNewTorrents() error = %v", err)
+		}
+		if n, err = purge(); err != nil || n != uint(len(many)) {
+			t.Errorf("PurgeTorrents() of many = %d, %v, want %d", n, err, len(many))
+		}
+	}
+	if exists, err := db.DoesTorrentExist(ctx, []byte("allowed")); err != nil || !exists {
+		t.Errorf("DoesTorrentExist() of the allowed torrent = %v, %v, want true", exists, err)
+	}
+}
+
+func testDeleteTorrent(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	addTorrents(t, db, map[string][]File{"deleted": {{Size: 1, Path: "a"}}, "kept": {{Size: 1, Path: "b"}}}, "deleted", "kept")
+
+	if deleted, err := db.DeleteTorrent(ctx, []byte("deleted")); err != nil || !deleted {
+		t.Errorf("DeleteTorrent() = %v, %v, want true", deleted, err)
+	}
+	if deleted, err := db.DeleteTorrent(ctx, []byte("deleted")); err != nil || deleted {
+		t.Errorf("DeleteTorrent() of a missing torrent = %v, %v, want false", deleted, err)
+	}
+
+	if exists, err := db.DoesTorrentExist(ctx, []byte("deleted")); err != nil || exists {
+		t.Errorf("DoesTorrentExist() of the deleted torrent = %v, %v", exists, err)
+	}
+	if files, err := db.GetFiles(ctx, []byte("deleted")); err != nil || files != nil {
+		t.Errorf("GetFiles() of the deleted torrent = %v, %v, want nil, nil", files, err)
+	}
+	if exists, err := db.DoesTorrentExist(ctx, []byte("kept")); err != nil || !exists {
+		t.Errorf("DoesTorrentExist() of the kept torrent = %v, %v", exists, err)
+	}
+}
+
+func testDeleteTorrents(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, true)
+
+	torrents := []Torrent{
+		{InfoHash: []byte("spam name"), Name: "spam spam", Files: []File{{Size: 1, Path: "a"}}},
+		{InfoHash: []byte("spam path"), Name: "innocent", Files: []File{{Size: 1, Path: "spam.exe"}}, Category: Software},
+		{InfoHash: []byte("video"), Name: "holiday", Files: []File{{Size: 1, Path: "b.mkv"}}, Category: Video},
+		{InfoHash: []byte("kept"), Name: "something else", Files: []File{{Size: 1, Path: "c"}}},
+	}
+	// Discovered long ago, and in the future, as the epoch must not restrict the deletion.
+	for i := range torrents {
+		torrents[i].DiscoveredOn = []int64{1, time.Now().Unix() + 3600}[i%2]
+	}
+	if err := db.AddNewTorrents(ctx, torrents); err != nil {
+		t.Fatalf("AddNewTorrents() error = %v", err)
+	}
+
+	if _, err := db.DeleteTorrents(ctx, "", nil, SearchNames); err == nil {
+		t.Error("DeleteTorrents() of all the torrents error = nil, want an error")
+	}
+	if n, err := db.DeleteTorrents(ctx, "spam", nil, SearchNamesAndFiles); err != nil || n != 2 {
+		t.Errorf("DeleteTorrents(\"spam\") = %d, %v, want 2", n, err)
+	}
+	video := Video
+	if n, err := db.DeleteTorrents(ctx, "", &video, SearchNames); err != nil || n != 1 {
+		t.Errorf("DeleteTorrents() of videos = %d, %v, want 1", n, err)
+	}
+
+	for _, torrent := range torrents {
+		exists, err := db.DoesTorrentExist(ctx, torrent.InfoHash)
+		if want := string(torrent.InfoHash) == "kept"; err != nil || exists != want {
+			t.Errorf("DoesTorrentExist(%q) = %v, %v, want %v", torrent.InfoHash, exists, err, want)
+		}
+	}
+}
+
+func testApplyRetention(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	day := int64(24 * 60 * 60)
+	now := time.Now().Unix()
+	torrents := []Torrent{
+		{InfoHash: []byte("old without peers"), DiscoveredOn: now - 10*day},
+		{InfoHash: []byte("old with peers"), DiscoveredOn: now - 9*day},
+		{InfoHash: []byte("recent without peers"), DiscoveredOn: now - day},
+		{InfoHash: []byte("newer"), DiscoveredOn: now - 60},
+		{InfoHash: []byte("newest"), DiscoveredOn: now},
+	}
+	for i := range torrents {
+		torrents[i].Name = string(torrents[i].InfoHash)
+		torrents[i].Files = []File{{Size: 1, Path: "a"}}
+	}
+	if err := db.AddNewTorrents(ctx, torrents); err != nil {
+		t.Fatalf("AddNewTorrents() error = %v", err)
+	}
+	if err := db.RecordSwarm(ctx, []byte("old with peers"), Swarm{NPeers: 3}); err != nil {
+		t.Fatalf("RecordSwarm() error = %v", err)
+	}
+
+	exist := func() (infoHashes []string) {
+		for _, torrent := range torrents {
+			if exists, err := db.DoesTorrentExist(ctx, torrent.InfoHash); err != nil {
+				t.Fatalf("DoesTorrentExist() error = %v", err)
+			} else if exists {
+				infoHashes = append(infoHashes, string(torrent.InfoHash))
+			}
+		}
+		return
+	}
+
+	if n, err := db.ApplyRetention(ctx, RetentionPolicy{}); err != nil || n != 0 {
+		t.Errorf("ApplyRetention() of the zero policy = %d, %v, want 0", n, err)
+	}
+
+	if n, err := db.ApplyRetention(ctx, RetentionPolicy{MaxAgeWithoutPeers: 7 * 24 * time.Hour}); err != nil || n != 1 {
+		t.Errorf("ApplyRetention(MaxAgeWithoutPeers) = %d, %v, want 1", n, err)
+	}
+	want := []string{"old with peers", "recent without peers", "newer", "newest"}
+	if got := exist(); !reflect.DeepEqual(got, want) {
+		t.Errorf("torrents retained = %v, want %v", got, want)
+	}
+
+	if n, err := db.ApplyRetention(ctx, RetentionPolicy{MaxTorrents: 2}); err != nil || n != 2 {
+		t.Errorf("ApplyRetention(MaxTorrents) = %d, %v, want 2", n, err)
+	}
+	want = []string{"newer", "newest"}
+	if got := exist(); !reflect.DeepEqual(got, want) {
+		t.Errorf("torrents retained = %v, want %v", got, want)
+	}
+
+	// More torrents than are deleted at once, all of them older than those retained.
+	var many []Torrent
+	for i := 0; i < 2*deleteBatchSize+1; i++ {
+		infoHash := []byte(fmt.Sprintf("many %03d", i))
+		many = append(many, Torrent{InfoHash: infoHash, Name: "many", Files: []File{{Size: 1, Path: "a"}}, DiscoveredOn: now - 10*day + int64(i%3)})
+	}
+	for _, policy := range []RetentionPolicy{{MaxAgeWithoutPeers: 7 * 24 * time.Hour}, {MaxTorrents: 2}} {
+		if err := db.AddNewTorrents(ctx, many); err != nil {
+			t.Fatalf("AddNewTorrents() error = %v", err)
+		}
+		if n, err := db.ApplyRetention(ctx, policy); err != nil || n != uint(len(many)) {
+			t.Errorf("ApplyRetention(%+v) of many = %d, %v, want %d", policy, n, err, len(many))
+		}
+		if got := exist(); !reflect.DeepEqual(got, want) {
+			t.Errorf("torrents retained = %v, want %v", got, want)
+		}
+	}
+}
+
+func testGetStatistics(t *testing.T, open openDatabase) {
+	ctx := context.Background()
+	db := open(t, false)
+
+	empty := &Statistics{
+		NDiscovered: map[string]uint64{},
+		NFiles:      map[string]uint64{},
+		TotalSize:   map[string]uint64{},
+	}
+	for _, from := range []string{"2018", "2018-04", "2018-W16", "2018-04-20", "2018-04-20T15"} {
+		got, err := db.GetStatistics(ctx, from, 1)
+		if err != nil || !reflect.DeepEqual(got, empty) {
+			t.Errorf("GetStatistics(%q) of an empty database = %v, %v, want %v", from, got, err, empty)
+		}
+	}
+	if _, err := db.GetStatistics(ctx, "yesterday", 1); err == nil {
+		t.Error("GetStatistics() error = nil, want an error")
+	}
+
+	torrents := map[string][]File{
+		"one": {{Size: 1, Path: "a"}},
+		"two": {{Size: 2, Path: "a"}, {Size: 3, Path: "b"}},
+	}
+	addTorrents(t, db, torrents, "one", "two")
+
+	// The times of ParseISO8601 are the ends of the periods, hence the previous ones.
+	now := time.Now().UTC()
+	_, week := now.ISOWeek()
+	froms := map[Granularity]string{
+		Year: now.AddDate(-1, 0, 0).Format("2006"),
+		// Before the previous month, as ParseISO8601 takes the 31st of every month.
+		Month: now.AddDate(0, 0, -now.Day()-31).Format("2006-01"),
+		Day:   now.AddDate(0, 0, -1).Format("2006-01-02"),
+		Hour:  now.Add(-time.Hour).Format("2006-01-02T15"),
+	}
+	if week > 2 {
+		froms[Week] = fmt.Sprintf("%d-W%02d", now.Year(), week-2)
+	}
+
+	for gran, from := range froms {
+		want := NewStatistics()
+		for name, files := range torrents {
+			tm, err := db.GetTorrent(ctx, []byte(name))
+			if err != nil || tm == nil {
+				t.Fatalf("GetTorrent() = %v, %v", tm, err)
+			}
+			key := statisticsKey(gran)(time.Unix(tm.DiscoveredOn, 0))
+			want.NDiscovered[key] += 1
+			want.NFiles[key] += uint64(len(files))
+			want.TotalSize[key] += tm.Size
+		}
+
+		got, err := db.GetStatistics(ctx, from, 3)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("GetStatistics(%q, 3) = %v, %v, want %v", from, got, err, want)
+		}
+	}
+
+	// Deleted torrents are not counted anymore.
+	two, err := db.GetTorrent(ctx, []byte("two"))
+	if err != nil || two == nil {
+		t.Fatalf("GetTorrent() = %v, %v", two, err)
+	}
+	if _, err = db.DeleteTorrent(ctx, []byte("one")); err != nil {
+		t.Fatalf("DeleteTorrent() error = %v", err)
+	}
+	key := statisticsKey(Hour)(time.Unix(two.DiscoveredOn, 0))
+	want := &Statistics{
+		NDiscovered: map[string]uint64{key: 1},
+		NFiles:      map[string]uint64{key: 2},
+		TotalSize:   map[string]uint64{key: 5},
+	}
+	if got, err := db.GetStatistics(ctx, froms[Hour], 3); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetStatistics(%q, 3) after a deletion = %v, %v, want %v", froms[Hour], got, err, want)
+	}
+}
+
+func testCancelledContext(t *testing.T, open openDatabase) {
+	db := open(t, false)
+	addTorrents(t, db, map[string][]File{"existing": {{Size: 1, Path: "a"}}}, "existing")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := db.AddNewTorrent(ctx, []byte("new"), "new", []File{{Size: 1, Path: "b"}}, Uncategorised); err == nil {
+		t.Error("AddNewTorrent() with a cancelled context error = nil")
+	}
+	if _, err := db.QueryTorrents(ctx, "", math.MaxInt64, ByDiscoveredOn, true, 10, nil, nil, nil, SearchNames); err == nil {
+		t.Error("QueryTorrents() with a cancelled context error = nil")
+	}
+	if _, err := db.DeleteTorrent(ctx, []byte("existing")); err == nil {
+		t.Error("DeleteTorrent() with a cancelled context error = nil")
+	}
+
+	// Nothing has been added or deleted.
+	for infoHash, want := range map[string]bool{"new": false, "existing": true} {
+		if exists, err := db.DoesTorrentExist(context.Background(), []byte(infoHash)); err != nil || exists != want {
+			t.Errorf("DoesTorrentExist(%q) = %v, %v, want %v", infoHash, exists, err, want)
+		}
+	}
+}
@@ -1,30 +1,50 @@
 package persistence
 
 import (
+	"bufio"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
+	"regexp"
+	"time"
 )
 
+// Database is implemented by every supported database engine. Methods that access the database take
+// a context, and fail as soon as it is done: the query being run is abandoned, and the transaction
+// if any is rolled back.
 type Database interface {
 	Engine() databaseEngine
-	DoesTorrentExist(infoHash []byte) (bool, error)
-	AddNewTorrent(infoHash []byte, name string, files []File) error
+	DoesTorrentExist(ctx context.Context, infoHash []byte) (bool, error)
+	AddNewTorrent(ctx context.Context, infoHash []byte, name string, files []File, category Category) error
+	// AddNewTorrents adds the torrents in a single transaction, which is much cheaper than adding
+	// them one by one. Torrents that exist already (or earlier in the batch) are skipped, and so
+	// are those whose total size is zero or whose name or file paths are not valid UTF-8, same as
+	// AddNewTorrent. The swarms of the torrents added are recorded along with them, whereas those
+	// of the torrents skipped are not.
+	AddNewTorrents(ctx context.Context, torrents []Torrent) error
 	Close() error
 
 	// GetNumberOfTorrents returns the number of torrents saved in the database. Might be an
 	// approximation.
-	GetNumberOfTorrents() (uint, error)
+	GetNumberOfTorrents(ctx context.Context) (uint, error)
 	// QueryTorrents returns @pageSize amount of torrents,
 	// * that are discovered before @discoveredOnBefore
 	// * that match the @query if it's not empty, else all torrents
+	// * that are of the @category if it's not nil, else of any category
+	// where the @query is matched against the names and/or the file paths of the torrents as per
+	// the @scope (file paths can be searched only if they are indexed, see MakeDatabase)
 	// * ordered by the @orderBy in ascending order if @ascending is true, else in descending order
 	// after skipping (@page * @pageSize) torrents that also fits the criteria above.
 	//
-	// On error, returns (nil, error), otherwise a non-nil slice of TorrentMetadata and nil.
+	// On error, returns (nil, error), otherwise a non-nil slice of TorrentMetadata and nil. The
+	// error is a QueryError if the @query is malformed, and a SearchError if it cannot be run (e.g.
+	// it is ordered by relevance without search terms).
 	QueryTorrents(
+		ctx context.Context,
 		query string,
 		epoch int64,
 		orderBy OrderingCriteria,
@@ -32,12 +52,98 @@ type Database interface {
 		limit uint,
 		lastOrderedValue *float64,
 		lastID *uint64,
+		category *Category,
+		scope SearchScope,
 	) ([]TorrentMetadata, error)
 	// GetTorrents returns the TorrentExtMetadata for the torrent of the given InfoHash. Will return
 	// nil, nil if the torrent does not exist in the database.
-	GetTorrent(infoHash []byte) (*TorrentMetadata, error)
-	GetFiles(infoHash []byte) ([]File, error)
-	GetStatistics(from string, n uint) (*Statistics, error)
+	GetTorrent(ctx context.Context, infoHash []byte) (*TorrentMetadata, error)
+	GetFiles(ctx context.Context, infoHash []byte) ([]File, error)
+	// GetFilesOfTorrents returns the files of the torrents of the given InfoHashes by their info
+	// hashes (as strings), which is much cheaper than getting them one by one. The torrents that do
+	// not exist in the database are left out.
+	GetFilesOfTorrents(ctx context.Context, infoHashes [][]byte) (map[string][]File, error)
+	GetStatistics(ctx context.Context, from string, n uint) (*Statistics, error)
+
+	// RecordSwarm aggregates what has been observed about the swarm of an already stored torrent:
+	// the number of peers is kept from the first observation only, whereas clients are added to
+	// the ones observed before. Does nothing if the torrent does not exist in the database.
+	RecordSwarm(ctx context.Context, infoHash []byte, swarm Swarm) error
+	// GetSwarm returns the Swarm of the torrent of the given InfoHash. Will return nil, nil if the
+	// torrent does not exist in the database.
+	GetSwarm(ctx context.Context, infoHash []byte) (*Swarm, error)
+	// GetSwarms returns the Swarms of the torrents of the given InfoHashes by their info hashes (as
+	// strings), which is much cheaper than getting them one by one. The torrents that do not exist
+	// in the database are left out.
+	GetSwarms(ctx context.Context, infoHashes [][]byte) (map[string]Swarm, error)
+
+	// SetReadme stores the readme of an already stored torrent, which is one of its files,
+	// replacing the readme stored before if any. Does nothing if the torrent does not exist in the
+	// database, or does not have a file of the path of the readme.
+	SetReadme(ctx context.Context, infoHash []byte, readme Readme) error
+	// GetReadme returns the Readme stored for the torrent of the given InfoHash. Will return nil,
+	// nil if the torrent does not exist in the database or no readme is stored for it.
+	GetReadme(ctx context.Context, infoHash []byte) (*Readme, error)
+
+	// AddTag tags the torrent of the given InfoHash, creating the tag if it does not exist yet.
+	// Returns an error if the tag is not valid (see NormaliseTag), and does nothing if the torrent
+	// does not exist in the database or is tagged so already.
+	AddTag(ctx context.Context, infoHash []byte, tag string) error
+	// RemoveTag untags the torrent of the given InfoHash, deleting the tag if no torrents are
+	// tagged so anymore. Does nothing if the torrent does not exist in the database or is not
+	// tagged so.
+	RemoveTag(ctx context.Context, infoHash []byte, tag string) error
+	// SetNote sets the free-text note of the torrent of the given InfoHash, replacing the note set
+	// before if any, or removes it if the @note is empty. Does nothing if the torrent does not exist
+	// in the database.
+	SetNote(ctx context.Context, infoHash []byte, note string) error
+	// SetStarred stars or unstars the torrent of the given InfoHash. Does nothing if the torrent
+	// does not exist in the database.
+	SetStarred(ctx context.Context, infoHash []byte, starred bool) error
+	// GetCuration returns the Curation of the torrent of the given InfoHash. Will return nil, nil
+	// if the torrent does not exist in the database.
+	GetCuration(ctx context.Context, infoHash []byte) (*Curation, error)
+	// GetTags returns the tags of at least one torrent, ordered by name.
+	GetTags(ctx context.Context) ([]Tag, error)
+
+	// SetUser adds the user, or replaces the password hash and the role of the user of the same
+	// name if it exists already. Returns an error if the name is not valid (see ValidateUserName).
+	SetUser(ctx context.Context, user User) error
+	// GetUser returns the User of the given name. Will return nil, nil if there is no such user.
+	GetUser(ctx context.Context, name string) (*User, error)
+	// GetUsers returns all the users, ordered by name.
+	GetUsers(ctx context.Context) ([]User, error)
+	// DeleteUser deletes the user of the given name, along with its tokens. Returns whether the
+	// user existed.
+	DeleteUser(ctx context.Context, name string) (bool, error)
+	// AddToken adds the token (of a user that must exist), whose ID must be unique.
+	AddToken(ctx context.Context, token Token) error
+	// GetToken returns the Token of the given ID, even if it has expired. Will return nil, nil if
+	// there is no such token.
+	GetToken(ctx context.Context, id string) (*Token, error)
+	// GetTokens returns the tokens of the user of the given name, ordered by the time of their
+	// creation.
+	GetTokens(ctx context.Context, user string) ([]Token, error)
+	// DeleteToken deletes the token of the given ID. Returns whether the token existed.
+	DeleteToken(ctx context.Context, id string) (bool, error)
+	// DeleteExpiredTokens deletes the tokens that have expired by @now (a Unix time, see
+	// Token.Expired), and returns the number of tokens deleted.
+	DeleteExpiredTokens(ctx context.Context, now int64) (uint, error)
+
+	// PurgeTorrents deletes the torrents of the given info hashes, and the torrents whose names or
+	// file paths match the @pattern if it's not nil. Returns the number of torrents deleted. The
+	// torrents are deleted in batches, each committed on its own, so as not to block the writers.
+	PurgeTorrents(ctx context.Context, infoHashes [][]byte, pattern *regexp.Regexp) (uint, error)
+	// DeleteTorrent deletes the torrent of the given InfoHash, along with its files. Returns
+	// whether the torrent existed in the database.
+	DeleteTorrent(ctx context.Context, infoHash []byte) (bool, error)
+	// DeleteTorrents deletes all the torrents that QueryTorrents would return for the @query, the
+	// @category and the @scope, regardless of when they were discovered. Either the @query must not
+	// be empty or the @category must not be nil. Returns the number of torrents deleted.
+	DeleteTorrents(ctx context.Context, query string, category *Category, scope SearchScope) (uint, error)
+	// ApplyRetention deletes the torrents that the @policy does not retain, and returns the number
+	// of torrents deleted. The torrents are deleted in batches, same as by PurgeTorrents.
+	ApplyRetention(ctx context.Context, policy RetentionPolicy) (uint, error)
 }
 
 type OrderingCriteria uint8
@@ -52,7 +158,43 @@ const (
 	ByUpdatedOn
 )
 
-// TODO: search `swtich (orderBy)` and see if all cases are covered all the time
+func (o OrderingCriteria) String() string {
+	switch o {
+	case ByRelevance:
+		return "relevance"
+	case ByTotalSize:
+		return "total size"
+	case ByDiscoveredOn:
+		return "discovery time"
+	case ByNFiles:
+		return "number of files"
+	case ByNSeeders:
+		return "number of seeders"
+	case ByNLeechers:
+		return "number of leechers"
+	case ByUpdatedOn:
+		return "update time"
+	default:
+		return fmt.Sprintf("OrderingCriteria(%d)", uint8(o))
+	}
+}
+
+// SearchScope is what the query of QueryTorrents is matched against.
+type SearchScope uint8
+
+const (
+	SearchNames SearchScope = iota
+	SearchFiles
+	SearchNamesAndFiles
+)
+
+func (s SearchScope) names() bool {
+	return s == SearchNames || s == SearchNamesAndFiles
+}
+
+func (s SearchScope) files() bool {
+	return s == SearchFiles || s == SearchNamesAndFiles
+}
 
 type databaseEngine uint8
 
@@ -60,6 +202,7 @@ const (
 	Sqlite3 databaseEngine = iota + 1
 	Postgres
 	Cockroach
+	Bolt
 )
 
 type Statistics struct {
@@ -68,19 +211,277 @@ type Statistics struct {
 	TotalSize   map[string]uint64 `json:"totalSize"`
 }
 
+// Swarm holds the facts gathered about the peers of a torrent while fetching its metadata.
+type Swarm struct {
+	// NPeers is the number of peers known for the torrent when it was first seen, or zero if
+	// unknown.
+	NPeers uint `json:"nPeers"`
+	// Clients are the distinct client names (e.g. "uTorrent/3.5.5") advertised by the peers.
+	Clients []string `json:"clients"`
+}
+
+// RetentionPolicy is which torrents are retained in the database, see ApplyRetention. The zero
+// value retains all of them.
+type RetentionPolicy struct {
+	// MaxAgeWithoutPeers is how long the torrents that had no known peers are retained after their
+	// discovery, or zero for ever. Since neither seeders are counted nor torrents refreshed, the
+	// peers known when a torrent was discovered (see Swarm.NPeers) stand for them.
+	MaxAgeWithoutPeers time.Duration
+	// MaxTorrents is the number of the most recently discovered torrents retained, or zero for no
+	// limit.
+	MaxTorrents uint
+}
+
+// IsZero reports whether the policy retains all the torrents.
+func (p RetentionPolicy) IsZero() bool {
+	return p.MaxAgeWithoutPeers == 0 && p.MaxTorrents == 0
+}
+
+// Readme is the text of a file of a torrent describing it (such as a README or an NFO file), as
+// fetched from its swarm.
+type Readme struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// Curation is what the users recorded about a torrent: its tags (ordered by name), a free-text
+// note, and whether it is starred.
+type Curation struct {
+	Tags    []string `json:"tags"`
+	Note    string   `json:"note"`
+	Starred bool     `json:"starred"`
+}
+
+// IsZero reports whether nothing is recorded about the torrent.
+func (c *Curation) IsZero() bool {
+	return len(c.Tags) == 0 && c.Note == "" && !c.Starred
+}
+
+// Tag is a tag, and the number of torrents tagged so.
+type Tag struct {
+	Name      string `json:"name"`
+	NTorrents uint   `json:"nTorrents"`
+}
+
+// Role is what a user is allowed to do, each role being allowed what the roles before it are.
+type Role uint8
+
+const (
+	// Viewer can search and browse the torrents.
+	Viewer Role = iota
+	// Curator can also tag, annotate, and star the torrents.
+	Curator
+	// Admin can also manage the users.
+	Admin
+)
+
+var roleNames = [...]string{
+	Viewer:  "viewer",
+	Curator: "curator",
+	Admin:   "admin",
+}
+
+func (r Role) String() string {
+	if int(r) < len(roleNames) {
+		return roleNames[r]
+	}
+	return fmt.Sprintf("Role(%d)", r)
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	role, err := ParseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// ParseRole returns the Role of the given name, as returned by Role.String().
+func ParseRole(s string) (Role, error) {
+	for r, name := range roleNames {
+		if s == name {
+			return Role(r), nil
+		}
+	}
+	return Viewer, fmt.Errorf("unknown role: %s", s)
+}
+
+// User is a user of magneticow.
+type User struct {
+	Name string `json:"name"`
+	// PasswordHash is the bcrypt hash of the password of the user.
+	PasswordHash []byte `json:"-"`
+	Role         Role   `json:"role"`
+}
+
+// userNameRegexp matches the valid user names: they start with a lowercase ASCII letter, and consist
+// of lowercase ASCII letters and digits, possibly with non-consecutive underscores in-between.
+var userNameRegexp = regexp.MustCompile(`^[a-z](?:_?[a-z0-9])*$`)
+
+// maxUserNameLength is the maximum length of the user names, in bytes.
+const maxUserNameLength = 32
+
+// ValidateUserName returns an error (meant for the users) if the name is not a valid user name.
+func ValidateUserName(name string) error {
+	if len(name) > maxUserNameLength {
+		return fmt.Errorf("user names must be at most %d characters long", maxUserNameLength)
+	}
+	if !userNameRegexp.MatchString(name) {
+		return fmt.Errorf("user names must start with a lowercase letter, and consist of lowercase letters, digits, and non-consecutive underscores only")
+	}
+	return nil
+}
+
+// credentialsRegexp matches the lines of the credentials files that magneticow used to read before
+// it had users of its own: `<USERNAME>:<BCRYPT HASH>`.
+var credentialsRegexp = regexp.MustCompile(`^([a-z](?:_?[a-z0-9])*):(\$2[aby]?\$\d{1,2}\$[./A-Za-z0-9]{53})$`)
+
+// ReadCredentials reads the users of a credentials file, giving them the role.
+func ReadCredentials(reader io.Reader, role Role) ([]User, error) {
+	var users []User
+	scanner := bufio.NewScanner(reader)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		match := credentialsRegexp.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			return nil, fmt.Errorf("on line %d: format should be: <USERNAME>:<BCRYPT HASH>, instead got: %s", lineno, scanner.Text())
+		}
+		users = append(users, User{Name: match[1], PasswordHash: []byte(match[2]), Role: role})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("Error while reading the credentials " + err.Error())
+	}
+	return users, nil
+}
+
+// Token is a secret that authenticates a user, either a session of the web interface or an API
+// token. Only the hash of the secret is stored, and the ID identifies the token publicly.
+type Token struct {
+	ID   string `json:"id"`
+	Hash []byte `json:"-"`
+	User string `json:"user"`
+	// Name is a description of the token given by its user, such as the script that it is for.
+	Name    string `json:"name"`
+	Session bool   `json:"session"`
+	// CreatedOn and ExpiresOn are Unix times, ExpiresOn being zero if the token never expires.
+	CreatedOn int64 `json:"createdOn"`
+	ExpiresOn int64 `json:"expiresOn"`
+}
+
+// Expired reports whether the token has expired by @now (a Unix time).
+func (t *Token) Expired(now int64) bool {
+	return t.ExpiresOn != 0 && t.ExpiresOn <= now
+}
+
 type File struct {
 	Size int64  `json:"size"`
 	Path string `json:"path"`
 }
 
+// Torrent is a torrent to be added to the database, see AddNewTorrents.
+type Torrent struct {
+	InfoHash []byte
+	Name     string
+	Files    []File
+	Category Category
+	// DiscoveredOn is the Unix time when the torrent was discovered, or zero for now (it is set
+	// when importing torrents discovered elsewhere).
+	DiscoveredOn int64
+	// Swarm is that of the torrent when it was discovered, or zero if unknown, see RecordSwarm.
+	Swarm Swarm
+}
+
+func (t *Torrent) totalSize() uint64 {
+	var totalSize uint64 = 0
+	for _, file := range t.Files {
+		totalSize += uint64(file.Size)
+	}
+	return totalSize
+}
+
+// Category is the kind of content that a torrent consists of, as assigned by a classifier.
+type Category uint8
+
+const (
+	Uncategorised Category = iota
+	Video
+	Audio
+	Software
+	Ebook
+	Archive
+	Images
+)
+
+var categoryNames = [...]string{
+	Uncategorised: "uncategorised",
+	Video:         "video",
+	Audio:         "audio",
+	Software:      "software",
+	Ebook:         "ebook",
+	Archive:       "archive",
+	Images:        "images",
+}
+
+func (c Category) String() string {
+	if int(c) < len(categoryNames) {
+		return categoryNames[c]
+	}
+	return fmt.Sprintf("Category(%d)", c)
+}
+
+func (c Category) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Category) UnmarshalText(text []byte) error {
+	category, err := ParseCategory(string(text))
+	if err != nil {
+		return err
+	}
+	*c = category
+	return nil
+}
+
+// ParseCategory returns the Category of the given name, as returned by Category.String().
+func ParseCategory(s string) (Category, error) {
+	for c, name := range categoryNames {
+		if s == name {
+			return Category(c), nil
+		}
+	}
+	return Uncategorised, fmt.Errorf("unknown category: %s", s)
+}
+
 type TorrentMetadata struct {
-	ID           uint64  `json:"id"`
-	InfoHash     []byte  `json:"infoHash"` // marshalled differently
-	Name         string  `json:"name"`
-	Size         uint64  `json:"size"`
-	DiscoveredOn int64   `json:"discoveredOn"`
-	NFiles       uint    `json:"nFiles"`
-	Relevance    float64 `json:"relevance"`
+	ID           uint64   `json:"id"`
+	InfoHash     []byte   `json:"infoHash"` // marshalled differently
+	Name         string   `json:"name"`
+	Size         uint64   `json:"size"`
+	DiscoveredOn int64    `json:"discoveredOn"`
+	NFiles       uint     `json:"nFiles"`
+	Relevance    float64  `json:"relevance"`
+	Category     Category `json:"category,omitempty"`
+	// MatchedFiles are the paths of the files that matched the query, if file paths were searched.
+	MatchedFiles []string `json:"matchedFiles,omitempty"`
+}
+
+// OrderedValue returns the value of the torrent that QueryTorrents orders by, which is to be passed
+// as its lastOrderedValue to get the next page.
+func (tm *TorrentMetadata) OrderedValue(orderBy OrderingCriteria) float64 {
+	switch orderBy {
+	case ByRelevance:
+		return tm.Relevance
+	case ByTotalSize:
+		return float64(tm.Size)
+	case ByNFiles:
+		return float64(tm.NFiles)
+	default:
+		return float64(tm.DiscoveredOn)
+	}
 }
 
 type SimpleTorrentSummary struct {
@@ -100,7 +501,32 @@ func (tm *TorrentMetadata) MarshalJSON() ([]byte, error) {
 	})
 }
 
-func MakeDatabase(rawURL string) (Database, error) {
+// MakeDatabase opens the database of the given URL, whose scheme selects the engine. The paths of
+// the files of the torrents are indexed for search if the `files_index` query parameter is true
+// (e.g. `sqlite3:///path/to/database.sqlite3?files_index=true`), which takes a while the first time
+// on an existing database and makes it grow considerably.
+//
+// The pools of connections to SQL databases are sized by the `max_open_conns` and `max_idle_conns`
+// query parameters, 3 connections by default (e.g. `postgres://host/magnetico?max_open_conns=10`).
+//
+// If the URL of a read-only replica of the database is given (that is, if replicaURL is not empty),
+// the reads of searching and browsing are served by the replica, see replicatedDatabase. Only SQL
+// databases can have replicas, of the same engine, which are not migrated.
+func MakeDatabase(rawURL string, replicaURL string) (Database, error) {
+	db, err := makeDatabase(rawURL)
+	if err != nil || replicaURL == "" {
+		return db, err
+	}
+
+	replicated, err := makeReplicatedDatabase(db, replicaURL)
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.New("replica " + err.Error())
+	}
+	return replicated, nil
+}
+
+func makeDatabase(rawURL string) (Database, error) {
 	url_, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, errors.New("url.Parse " + err.Error())
@@ -111,9 +537,15 @@ func MakeDatabase(rawURL string) (Database, error) {
 	case "sqlite", "sqlite3":
 		return makeSqlite3Database(url_)
 
-	case "postgres", "cockroach":
+	case "postgres":
 		return makePostgresDatabase(url_)
 
+	case "cockroach":
+		return makeCockroachDatabase(url_)
+
+	case "bolt", "bbolt":
+		return makeBoltDatabase(url_)
+
 	default:
 		return nil, fmt.Errorf("unknown URI scheme: `%s`", url_.Scheme)
 	}
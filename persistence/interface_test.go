@@ -2,6 +2,8 @@ package persistence
 
 import (
 	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -43,3 +45,66 @@ func TestNewStatistics(t *testing.T) {
 		t.Error("TotalSize map is not initialized")
 	}
 }
+
+func TestParseCategory(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []Category{Uncategorised, Video, Audio, Software, Ebook, Archive, Images} {
+		got, err := ParseCategory(c.String())
+		if err != nil {
+			t.Errorf("ParseCategory(%q) error = %v", c.String(), err)
+		}
+		if got != c {
+			t.Errorf("ParseCategory(%q) = %v, want %v", c.String(), got, c)
+		}
+	}
+
+	if _, err := ParseCategory("films"); err == nil {
+		t.Error("ParseCategory() of an unknown category did not err")
+	}
+
+	var c Category
+	if err := c.UnmarshalText([]byte("ebook")); err != nil || c != Ebook {
+		t.Errorf("Category.UnmarshalText() = %v, %v, want ebook", c, err)
+	}
+	if err := c.UnmarshalText([]byte("films")); err == nil {
+		t.Error("Category.UnmarshalText() of an unknown category did not err")
+	}
+}
+
+func TestTorrentMetadata_MarshalJSON_Category(t *testing.T) {
+	tm := &TorrentMetadata{
+		InfoHash: []byte{1, 2, 3, 4, 5, 6},
+		Category: Video,
+	}
+
+	expectedJSON := `{"infoHash":"010203040506","id":0,"name":"","size":0,"discoveredOn":0,"nFiles":0,"relevance":0,"category":"video"}`
+
+	jsonData, err := tm.MarshalJSON()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if string(jsonData) != expectedJSON {
+		t.Errorf("Unexpected JSON string. Expected: %s, Got: %s", expectedJSON, string(jsonData))
+	}
+}
+
+func TestReadCredentials(t *testing.T) {
+	const hash = "$2y$12$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+	users, err := ReadCredentials(strings.NewReader("ada:"+hash+"\nbob_2:"+hash+"\n"), Curator)
+	want := []User{
+		{Name: "ada", PasswordHash: []byte(hash), Role: Curator},
+		{Name: "bob_2", PasswordHash: []byte(hash), Role: Curator},
+	}
+	if err != nil || !reflect.DeepEqual(users, want) {
+		t.Errorf("ReadCredentials() = %v, %v, want %v", users, err, want)
+	}
+
+	for _, credentials := range []string{"Ada:" + hash, "ada:password", "ada" + hash, "\n"} {
+		if _, err = ReadCredentials(strings.NewReader(credentials), Viewer); err == nil {
+			t.Errorf("ReadCredentials(%q) error = nil, want an error", credentials)
+		}
+	}
+}
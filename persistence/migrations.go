@@ -0,0 +1,135 @@
+package persistence
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+)
+
+// migration upgrades the schema of a SQL database by one version. The migrations of each engine
+// are registered in order (see sqlite3Migrations, postgresMigrations, and cockroachMigrations), so
+// that the version of a schema is the number of migrations applied to it.
+//
+// Migrations are FROZEN once released: the schema is changed by appending migrations, never by
+// editing the released ones. Only the last migration of an engine may be marked NOT FROZEN, until
+// it is released.
+type migration struct {
+	// name describes the changes, and is logged as the migration is applied.
+	name string
+	// sql is executed within the transaction of the migrations, with no arguments.
+	sql string
+}
+
+// Migration is a migration of the schema of a database, as reported by Migrate.
+type Migration struct {
+	// Version is the version of the schema once the migration is applied.
+	Version int
+	Name    string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%d (%s)", m.Version, m.Name)
+}
+
+// schemaVersioner reads and records the version of the schema, which each engine keeps differently.
+type schemaVersioner struct {
+	get func(tx *sql.Tx) (int, error)
+	set func(tx *sql.Tx, version int) error
+}
+
+// Migrate opens the database of the given URL (see MakeDatabase) only to migrate its schema to the
+// latest version, which MakeDatabase does as well, and returns the migrations applied. If dryRun,
+// the migrations pending are returned without applying any of them, nor changing the database in
+// any way (SQLite databases are opened read-only).
+//
+// Bolt databases have no versioned schema, hence never any migrations.
+func Migrate(rawURL string, dryRun bool) ([]Migration, error) {
+	url_, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("url.Parse " + err.Error())
+	}
+
+	switch url_.Scheme {
+
+	case "sqlite", "sqlite3":
+		if dryRun {
+			// Opening the database would create it otherwise, and switch it to WAL journaling.
+			if _, err = os.Stat(url_.Path); errors.Is(err, os.ErrNotExist) {
+				pending := make([]Migration, len(sqlite3Migrations))
+				for i, m := range sqlite3Migrations {
+					pending[i] = Migration{Version: i + 1, Name: m.name}
+				}
+				return pending, nil
+			}
+			query := url_.Query()
+			query.Set("mode", "ro")
+			url_.RawQuery = query.Encode()
+		}
+		db, _, err := openSqlite3(url_)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		return db.setupDatabase(dryRun)
+
+	case "postgres":
+		db, _, err := openPostgres(url_)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		return db.setupDatabase(dryRun)
+
+	case "cockroach":
+		db, _, err := openCockroach(url_)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		return db.setupDatabase(dryRun)
+
+	case "bolt", "bbolt":
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("unknown URI scheme: `%s`", url_.Scheme)
+	}
+}
+
+// migrate applies the migrations that the schema has not gone through yet, in order and within the
+// transaction, and returns them. If dryRun, the migrations pending are returned without applying any
+// of them.
+//
+// Refuses to touch a schema of a version newer than the latest one registered, that is a schema
+// migrated by a newer version of magnetico, whose data this version might not preserve.
+func migrate(tx *sql.Tx, migrations []migration, versioner schemaVersioner, dryRun bool) ([]Migration, error) {
+	version, err := versioner.get(tx)
+	if err != nil {
+		return nil, errors.New("schema version " + err.Error())
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("the schema version %d is newer than the latest one known (%d), upgrade magnetico", version, len(migrations))
+	}
+
+	pending := make([]Migration, 0, len(migrations)-version)
+	for ; version < len(migrations); version++ {
+		m := migrations[version]
+		pending = append(pending, Migration{Version: version + 1, Name: m.name})
+		if dryRun {
+			continue
+		}
+
+		log.Printf("Updating database schema from %d to %d (%s)... (this might take a while)", version, version+1, m.name)
+		if _, err = tx.Exec(m.sql); err != nil {
+			return nil, fmt.Errorf("sql.Tx.Exec (v%d -> v%d) %s", version, version+1, err.Error())
+		}
+		if err = versioner.set(tx, version+1); err != nil {
+			return nil, fmt.Errorf("schema version (v%d) %s", version+1, err.Error())
+		}
+	}
+
+	return pending, nil
+}
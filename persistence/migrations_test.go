@@ -0,0 +1,119 @@
+package persistence
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	t.Parallel()
+
+	for engine, migrations := range map[string][]migration{"sqlite3": sqlite3Migrations, "postgres": postgresMigrations, "cockroach": cockroachMigrations} {
+		for i, m := range migrations {
+			if m.name == "" || m.sql == "" {
+				t.Errorf("%s migration to %d has no name or no SQL", engine, i+1)
+			}
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+
+	rawURL := "sqlite3://" + filepath.Join(t.TempDir(), "database.sqlite3")
+
+	// A dry run reports every migration of a new database, but applies none of them.
+	for i := 0; i < 2; i++ {
+		pending, err := Migrate(rawURL, true)
+		if err != nil {
+			t.Fatalf("Migrate() dry run error = %v", err)
+		}
+		if len(pending) != len(sqlite3Migrations) {
+			t.Fatalf("Migrate() dry run = %v, want %d migrations", pending, len(sqlite3Migrations))
+		}
+		for j, m := range pending {
+			if m.Version != j+1 || m.Name != sqlite3Migrations[j].name {
+				t.Errorf("Migrate() dry run [%d] = %v, want %d (%s)", j, m, j+1, sqlite3Migrations[j].name)
+			}
+		}
+	}
+
+	applied, err := Migrate(rawURL, false)
+	if err != nil || len(applied) != len(sqlite3Migrations) {
+		t.Fatalf("Migrate() = %v, %v, want %d migrations", applied, err, len(sqlite3Migrations))
+	}
+	if applied, err = Migrate(rawURL, false); err != nil || len(applied) != 0 {
+		t.Errorf("Migrate() again = %v, %v, want no migrations", applied, err)
+	}
+
+	if applied, err = Migrate("bolt://"+filepath.Join(t.TempDir(), "database.bolt"), false); err != nil || len(applied) != 0 {
+		t.Errorf("Migrate() of bolt = %v, %v, want no migrations", applied, err)
+	}
+}
+
+func TestMigrate_DryRunReadOnly(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "database.sqlite3")
+	if _, err := Migrate("sqlite3://"+path, true); err != nil {
+		t.Fatalf("Migrate() dry run error = %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Migrate() dry run created the database: %v", err)
+	}
+
+	// An existing database, as set up by a version of magnetico before any migration.
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Exec("CREATE TABLE torrents (id INTEGER PRIMARY KEY);"); err != nil {
+		t.Fatalf("sql.DB.Exec() error = %v", err)
+	}
+
+	pending, err := Migrate("sqlite3://"+path, true)
+	if err != nil || len(pending) != len(sqlite3Migrations) {
+		t.Fatalf("Migrate() dry run = %v, %v, want %d migrations", pending, err, len(sqlite3Migrations))
+	}
+	var journalMode string
+	if err = conn.QueryRow("PRAGMA journal_mode;").Scan(&journalMode); err != nil || journalMode != "delete" {
+		t.Errorf("journal mode after a dry run = %q, %v, want delete", journalMode, err)
+	}
+	var n int
+	if err = conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'files';").Scan(&n); err != nil || n != 0 {
+		t.Errorf("tables named files after a dry run = %d, %v, want none", n, err)
+	}
+}
+
+func TestMigrate_NewerSchema(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "database.sqlite3")
+	if _, err := Migrate("sqlite3://"+path, false); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	// As if migrated by a newer version of magnetico.
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	_, err = conn.Exec(fmt.Sprintf("PRAGMA user_version = %d;", len(sqlite3Migrations)+1))
+	conn.Close()
+	if err != nil {
+		t.Fatalf("sql.DB.Exec() error = %v", err)
+	}
+
+	if _, err = Migrate("sqlite3://"+path, true); err == nil {
+		t.Error("Migrate() dry run of a newer schema error = nil")
+	}
+	if db, err := MakeDatabase("sqlite3://"+path, ""); err == nil {
+		db.Close()
+		t.Error("MakeDatabase() of a newer schema error = nil")
+	}
+}
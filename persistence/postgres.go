@@ -2,11 +2,15 @@ package persistence
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
@@ -20,13 +24,56 @@ import (
 type postgresDatabase struct {
 	conn   *sql.DB
 	schema string
+	// trgm is whether the pg_trgm extension is installed, which enables fuzzy matching.
+	trgm bool
+	// wholeNames is whether the fuzzy matching compares the query to the whole names, with
+	// similarity() and %, rather than to their words, with word_similarity() and <% which
+	// CockroachDB lacks.
+	wholeNames bool
+	// filesIndex is whether the full-text index of the paths of the files exists, see
+	// setupFilesIndex.
+	filesIndex bool
+	// retryBatch runs the transactions of the batches of deletions, which CockroachDB retries (see
+	// cockroachDatabase.retry), or nil to run them once.
+	retryBatch batchRunner
 }
 
+// pathTSVector is the full-text search vector of the path of a file, where punctuation separates
+// words as in the `name_tsv` column of the `torrents` table. Queries must use the very same
+// expression for the index to be used.
+const pathTSVector = `to_tsvector('simple', regexp_replace(path, '[^[:alnum:]]+', ' ', 'g'))`
+
 func makePostgresDatabase(url_ *url.URL) (Database, error) {
+	db, filesIndex, err := openPostgres(url_)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.setupDatabase(false); err != nil {
+		_ = db.conn.Close()
+		return nil, fmt.Errorf("setupDatabase %w", err)
+	}
+
+	if err := db.setupFilesIndex(filesIndex); err != nil {
+		_ = db.conn.Close()
+		return nil, fmt.Errorf("setupFilesIndex %w", err)
+	}
+
+	return db, nil
+}
+
+// openPostgres connects to the database of the given URL, without setting it up, and returns
+// whether its files are to be indexed.
+func openPostgres(url_ *url.URL) (*postgresDatabase, bool, error) {
 	db := new(postgresDatabase)
 
-	if url_.Scheme == "cockroach" {
-		url_.Scheme = "postgres"
+	filesIndex, err := popFilesIndexOption(url_)
+	if err != nil {
+		return nil, false, err
+	}
+	maxOpen, maxIdle, err := popPoolOptions(url_)
+	if err != nil {
+		return nil, false, err
 	}
 
 	query := url_.Query()
@@ -40,37 +87,55 @@ func makePostgresDatabase(url_ *url.URL) (Database, error) {
 	query.Del("schema")
 	url_.RawQuery = query.Encode()
 
-	var err error
 	db.conn, err = sql.Open("pgx", url_.String())
 	if err != nil {
-		return nil, errors.New("sql.Open " + err.Error())
+		return nil, false, fmt.Errorf("sql.Open %w", err)
 	}
 
 	// > Open may just validate its arguments without creating a connection to the database. To
 	// > verify that the data source Name is valid, call Ping.
 	// https://golang.org/pkg/database/sql/#Open
 	if err = db.conn.Ping(); err != nil {
-		return nil, errors.New("sql.DB.Ping " + err.Error())
+		_ = db.conn.Close()
+		return nil, false, fmt.Errorf("sql.DB.Ping %w", err)
 	}
 
 	// https://github.com/mattn/go-sqlite3/issues/618
 	db.conn.SetConnMaxLifetime(0) // https://golang.org/pkg/database/sql/#DB.SetConnMaxLifetime
-	db.conn.SetMaxOpenConns(3)
-	db.conn.SetMaxIdleConns(3)
+	db.conn.SetMaxOpenConns(maxOpen)
+	db.conn.SetMaxIdleConns(maxIdle)
 
-	if err := db.setupDatabase(); err != nil {
-		return nil, errors.New("setupDatabase " + err.Error())
+	return db, filesIndex, nil
+}
+
+func (db *postgresDatabase) openReplica(url_ *url.URL) (Database, error) {
+	replica, _, err := openPostgres(url_)
+	if err != nil {
+		return nil, err
 	}
 
-	return db, nil
+	if err = checkReplicaSchema(replica.conn, postgresMigrations, postgresVersioner); err != nil {
+		_ = replica.conn.Close()
+		return nil, err
+	}
+	if err = replica.detectTrgm(); err != nil {
+		_ = replica.conn.Close()
+		return nil, err
+	}
+	if err = replica.setupFilesIndex(false); err != nil {
+		_ = replica.conn.Close()
+		return nil, fmt.Errorf("setupFilesIndex %w", err)
+	}
+
+	return replica, nil
 }
 
 func (db *postgresDatabase) Engine() databaseEngine {
 	return Postgres
 }
 
-func (db *postgresDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
-	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE info_hash = $1;", infoHash)
+func (db *postgresDatabase) DoesTorrentExist(ctx context.Context, infoHash []byte) (bool, error) {
+	rows, err := db.conn.QueryContext(ctx, "SELECT 1 FROM torrents WHERE info_hash = $1;", infoHash)
 	if err != nil {
 		return false, err
 	}
@@ -84,16 +149,22 @@ func (db *postgresDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return exists, nil
 }
 
-func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []File) error {
-	if !utf8.ValidString(name) {
-		log.Printf("Ignoring a torrent whose name is not UTF-8 compliant. infoHash: %s", infoHash)
+func (db *postgresDatabase) AddNewTorrent(ctx context.Context, infoHash []byte, name string, files []File, category Category) error {
+	return db.AddNewTorrents(ctx, []Torrent{{InfoHash: infoHash, Name: name, Files: files, Category: category}})
+}
+
+// AddNewTorrents inserts the torrents, and then their files, with a single statement each, whose
+// parameters are arrays unnested into rows: a round trip per batch rather than per row, same as COPY
+// but within a transaction of database/sql.
+func (db *postgresDatabase) AddNewTorrents(ctx context.Context, torrents []Torrent) error {
+	torrents = acceptableTorrents(torrents)
+	if len(torrents) == 0 {
 		return nil
 	}
-	name = strings.ReplaceAll(name, "\x00", "")
 
-	tx, err := db.conn.Begin()
+	tx, err := db.conn.BeginTx(ctx, nil)
 	if err != nil {
-		return errors.New("conn.Begin " + err.Error())
+		return fmt.Errorf("conn.BeginTx %w", err)
 	}
 	// If everything goes as planned and no error occurs, we will commit the transaction before
 	// returning from the function so the tx.Rollback() call will fail, trying to rollback a
@@ -101,54 +172,102 @@ func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []
 	// is nice.
 	defer db.rollback(tx)
 
-	var totalSize uint64 = 0
-	for _, file := range files {
-		totalSize += uint64(file.Size)
+	infoHashes := make([][]byte, len(torrents))
+	names := make([]string, len(torrents))
+	totalSizes := make([]int64, len(torrents))
+	discoveredOns := make([]int64, len(torrents))
+	categories := make([]int16, len(torrents))
+	nFiles := make([]int32, len(torrents))
+	nPeers := make([]int64, len(torrents))
+	for i, torrent := range torrents {
+		infoHashes[i] = torrent.InfoHash
+		names[i] = strings.ReplaceAll(torrent.Name, "\x00", "")
+		totalSizes[i] = int64(torrent.totalSize())
+		discoveredOns[i] = torrent.DiscoveredOn
+		categories[i] = int16(torrent.Category)
+		nFiles[i] = int32(len(torrent.Files))
+		nPeers[i] = int64(torrent.Swarm.NPeers)
 	}
 
-	// This is a workaround for a bug: the database will not accept total_size to be zero.
-	if totalSize == 0 {
-		return nil
-	}
-
-	if exist, err := db.DoesTorrentExist(infoHash); exist || err != nil {
-		return err
-	}
-
-	var lastInsertId int64
-
-	err = tx.QueryRow(`
+	// Torrents that exist already are skipped by ON CONFLICT, which (unlike checking beforehand)
+	// holds even against concurrent transactions; only the inserted ones are returned.
+	rows, err := tx.QueryContext(ctx, `
 		INSERT INTO torrents (
 			info_hash,
 			name,
 			total_size,
-			discovered_on
-		) VALUES ($1, $2, $3, $4)
-		RETURNING id;
-	`, infoHash, name, totalSize, time.Now().Unix()).Scan(&lastInsertId)
+			discovered_on,
+			category,
+			n_files,
+			n_initial_peers
+		)
+		SELECT info_hash, name, total_size, discovered_on, category, n_files, NULLIF(n_initial_peers, 0)
+		FROM unnest($1::BYTEA[], $2::TEXT[], $3::BIGINT[], $4::INTEGER[], $5::SMALLINT[], $6::INTEGER[], $7::BIGINT[])
+			AS t (info_hash, name, total_size, discovered_on, category, n_files, n_initial_peers)
+		ON CONFLICT (info_hash) DO NOTHING
+		RETURNING id, info_hash;
+	`, infoHashes, names, totalSizes, discoveredOns, categories, nFiles, nPeers)
 	if err != nil {
-		return errors.New("tx.QueryRow (INSERT INTO torrents) " + err.Error())
+		return fmt.Errorf("tx.QueryContext (INSERT INTO torrents) %w", err)
 	}
+	insertedIDs := make(map[string]int64, len(torrents))
+	for rows.Next() {
+		var id int64
+		var infoHash []byte
+		if err = rows.Scan(&id, &infoHash); err != nil {
+			db.closeRows(rows)
+			return fmt.Errorf("sql.Rows.Scan (INSERT INTO torrents) %w", err)
+		}
+		insertedIDs[string(infoHash)] = id
+	}
+	if err = rows.Err(); err != nil {
+		db.closeRows(rows)
+		return fmt.Errorf("sql.Rows.Err (INSERT INTO torrents) %w", err)
+	}
+	db.closeRows(rows)
 
-	for _, file := range files {
-		if !utf8.ValidString(file.Path) {
-			log.Printf("Ignoring a file whose path is not UTF-8 compliant. %s", file.Path)
-
-			// Returning nil so deferred tx.Rollback() will be called and transaction will be canceled.
-			return nil
+	var torrentIDs, sizes, clientTorrentIDs []int64
+	var paths, clients []string
+	for _, torrent := range torrents {
+		id, inserted := insertedIDs[string(torrent.InfoHash)]
+		if !inserted {
+			continue
 		}
+		for _, file := range torrent.Files {
+			torrentIDs = append(torrentIDs, id)
+			sizes = append(sizes, file.Size)
+			paths = append(paths, file.Path)
+		}
+		for _, client := range postgresClients(torrent.Swarm.Clients) {
+			clientTorrentIDs = append(clientTorrentIDs, id)
+			clients = append(clients, client)
+		}
+	}
 
-		_, err = tx.Exec("INSERT INTO files (torrent_id, size, path) VALUES ($1, $2, $3);",
-			lastInsertId, file.Size, file.Path,
-		)
+	if len(torrentIDs) != 0 {
+		// unnest() preserves the order of the arrays, hence the files get their IDs in order.
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO files (torrent_id, size, path)
+			SELECT * FROM unnest($1::INTEGER[], $2::BIGINT[], $3::TEXT[]);
+		`, torrentIDs, sizes, paths)
+		if err != nil {
+			return fmt.Errorf("tx.ExecContext (INSERT INTO files) %w", err)
+		}
+	}
+	if len(clientTorrentIDs) != 0 {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO peer_clients (torrent_id, client)
+			SELECT * FROM unnest($1::BIGINT[], $2::TEXT[])
+			ON CONFLICT (torrent_id, client) DO NOTHING;
+		`, clientTorrentIDs, clients)
 		if err != nil {
-			return errors.New("tx.Exec (INSERT INTO files) " + err.Error())
+			return fmt.Errorf("tx.ExecContext (INSERT INTO peer_clients) %w", err)
 		}
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return errors.New("tx.Commit " + err.Error())
+		return fmt.Errorf("tx.Commit %w", err)
 	}
 
 	return nil
@@ -158,8 +277,8 @@ func (db *postgresDatabase) Close() error {
 	return db.conn.Close()
 }
 
-func (db *postgresDatabase) GetNumberOfTorrents() (uint, error) {
-	rows, err := db.conn.Query("SELECT COUNT(*)::BIGINT AS exact_count FROM torrents;")
+func (db *postgresDatabase) GetNumberOfTorrents(ctx context.Context) (uint, error) {
+	rows, err := db.conn.QueryContext(ctx, "SELECT COUNT(*)::BIGINT AS exact_count FROM torrents;")
 	if err != nil {
 		return 0, err
 	}
@@ -184,6 +303,7 @@ func (db *postgresDatabase) GetNumberOfTorrents() (uint, error) {
 }
 
 func (db *postgresDatabase) QueryTorrents(
+	ctx context.Context,
 	query string,
 	epoch int64,
 	orderBy OrderingCriteria,
@@ -191,82 +311,35 @@ func (db *postgresDatabase) QueryTorrents(
 	limit uint,
 	lastOrderedValue *float64,
 	lastID *uint64,
+	category *Category,
+	scope SearchScope,
 ) ([]TorrentMetadata, error) {
-	var (
-		safeLastID           uint64  = 0
-		safeLastOrderedValue float64 = 0
-		querySkeleton                = `
-		SELECT
-			id,
-			info_hash,
-			name,
-			total_size,
-			discovered_on,
-			(SELECT COUNT(*) FROM files WHERE torrents.id = files.torrent_id) AS n_files,
-			0
-		FROM torrents
-		WHERE
-			name LIKE CONCAT('%',$1::text,'%') AND
-			discovered_on <= $2 AND
-			{{.OrderOn}} {{GTEorLTE .Ascending}} $3 AND
-			id {{GTEorLTE .Ascending}} $4
-		ORDER BY {{.OrderOn}} {{AscOrDesc .Ascending}}, id {{AscOrDesc .Ascending}}
-		LIMIT $5;
-	`
-	)
-
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkOrdering(q, orderBy); err != nil {
+		return nil, err
+	}
 	if (lastOrderedValue == nil) != (lastID == nil) {
 		return nil, fmt.Errorf("lastOrderedValue and lastID should be supplied together, if supplied")
 	}
-	firstPage := lastID == nil
-	if !firstPage {
-		safeLastID = *lastID
-		safeLastOrderedValue = *lastOrderedValue
-	}
-
-	sqlQuery := db.executeTemplate(
-		querySkeleton,
-		struct {
-			OrderOn   string
-			Ascending bool
-		}{
-			OrderOn:   db.orderOn(orderBy),
-			Ascending: ascending,
-		}, template.FuncMap{
-			"GTEorLTE": func(ascending bool) string {
-				if ascending {
-					return ">"
-				} else {
-					return "<"
-				}
-			},
-			"AscOrDesc": func(ascending bool) string {
-				if ascending {
-					return "ASC"
-				} else {
-					return "DESC"
-				}
-			},
-		},
-	)
+	if (q.HasTerms() || len(q.Excluded) != 0) && scope.files() && !db.filesIndex {
+		return nil, &SearchError{Reason: "file paths cannot be searched since they are not indexed"}
+	}
 
-	rows, err := db.conn.Query(
-		sqlQuery,
-		query,
-		epoch,
-		safeLastOrderedValue,
-		safeLastID,
-		limit,
-	)
+	sqlQuery, queryArgs := db.buildQueryTorrents(q, epoch, orderBy, ascending, limit, lastOrderedValue, lastID, category, scope)
 
+	rows, err := db.conn.QueryContext(ctx, sqlQuery, queryArgs...)
 	if err != nil {
-		return nil, errors.New("query error " + err.Error())
+		return nil, fmt.Errorf("query error %w", err)
 	}
 	defer db.closeRows(rows)
 
 	torrents := make([]TorrentMetadata, 0)
 	for rows.Next() {
 		var torrent TorrentMetadata
+		var matchedFiles sql.NullString
 		err = rows.Scan(
 			&torrent.ID,
 			&torrent.InfoHash,
@@ -275,24 +348,289 @@ func (db *postgresDatabase) QueryTorrents(
 			&torrent.DiscoveredOn,
 			&torrent.NFiles,
 			&torrent.Relevance,
+			&matchedFiles,
+			&torrent.Category,
 		)
 		if err != nil {
 			return nil, err
 		}
+		if torrent.MatchedFiles, err = unmarshalMatchedFiles(matchedFiles); err != nil {
+			return nil, err
+		}
 		torrents = append(torrents, torrent)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
 	return torrents, nil
 }
 
-func (db *postgresDatabase) GetTorrent(infoHash []byte) (*TorrentMetadata, error) {
-	rows, err := db.conn.Query(`
+// buildQueryTorrents prepares the SQL query of QueryTorrents, WITH PLACEHOLDERS FOR USER INPUT, and
+// its arguments. Placeholders are numbered in the order they are needed, since PostgreSQL refuses
+// the parameters that are not referenced by the query.
+//
+// Relevance is the opposite of the full-text rank of the name (plus its trigram similarity to the
+// query, if pg_trgm is installed or on CockroachDB, and the best rank of its matched file paths, if
+// searched) so that, like bm25 on SQLite, the most relevant torrents come first in the ascending
+// order.
+func (db *postgresDatabase) buildQueryTorrents(
+	q *Query,
+	epoch int64,
+	orderBy OrderingCriteria,
+	ascending bool,
+	limit uint,
+	lastOrderedValue *float64,
+	lastID *uint64,
+	category *Category,
+	scope SearchScope,
+) (string, []interface{}) {
+	var queryArgs []interface{}
+	placeholder := func(arg interface{}) string {
+		queryArgs = append(queryArgs, arg)
+		return "$" + strconv.Itoa(len(queryArgs))
+	}
+	// tsQuery returns the tsquery matching all (&&) or any (||) of the terms, as phrases.
+	tsQuery := func(terms []string, operator string) string {
+		phrases := make([]string, len(terms))
+		for i, term := range terms {
+			// Punctuation separates words in torrent names, see the name_tsv column.
+			phrases[i] = "phraseto_tsquery('simple', regexp_replace(" + placeholder(term) + "::TEXT, '[^[:alnum:]]+', ' ', 'g'))"
+		}
+		return "(" + strings.Join(phrases, " "+operator+" ") + ")"
+	}
+
+	data := struct {
+		DoJoin       bool
+		SearchNames  bool
+		SearchFiles  bool
+		Trgm         bool
+		WholeNames   bool
+		PathTSVector string
+		OrderOn      string
+		Ascending    bool
+
+		TSQuery          string
+		Text             string
+		LikePattern      string
+		Filters          []string
+		LastOrderedValue string
+		LastID           string
+		Limit            string
+	}{
+		DoJoin:       q.HasTerms(),
+		SearchNames:  scope.names(),
+		SearchFiles:  scope.files(),
+		Trgm:         db.trgm,
+		WholeNames:   db.wholeNames,
+		PathTSVector: pathTSVector,
+		OrderOn:      db.orderOn(orderBy),
+		Ascending:    ascending,
+	}
+	if data.DoJoin {
+		data.TSQuery = tsQuery(q.Terms, "&&")
+		if data.SearchNames {
+			// For the fuzzy matching of the names.
+			text := strings.Join(q.Terms, " ")
+			data.Text = placeholder(text)
+			data.LikePattern = placeholder("%" + escapeLike(text) + "%")
+		}
+	}
+	data.Filters = append(data.Filters, "discovered_on <= "+placeholder(epoch))
+	if category != nil {
+		data.Filters = append(data.Filters, "category = "+placeholder(int16(*category))+"::SMALLINT")
+	}
+	data.Filters = append(data.Filters, db.filters(q, scope, placeholder, tsQuery)...)
+	if lastID != nil {
+		data.LastOrderedValue = placeholder(*lastOrderedValue)
+		data.LastID = placeholder(*lastID)
+	}
+	data.Limit = placeholder(limit)
+
+	sqlQuery := db.executeTemplate(`
+	{{ if and .DoJoin .SearchFiles }}
+		WITH file_matches AS (
+			SELECT
+				torrent_id,
+				MAX(ts_rank({{.PathTSVector}}, tsq)::FLOAT8) AS rank,
+				array_to_json(array_agg(path)) AS paths
+			FROM files
+			, {{.TSQuery}} AS tsq
+			WHERE {{.PathTSVector}} @@ tsq
+			GROUP BY torrent_id
+		)
+	{{ end }}
+		SELECT
+			id,
+			info_hash,
+			name,
+			total_size,
+			discovered_on,
+			n_files,
+			relevance,
+			matched_files,
+			category
+		FROM (
+			SELECT
+				id,
+				info_hash,
+				name,
+				total_size,
+				discovered_on,
+				n_files,
+	{{ if .DoJoin }}
+				-(
+		{{ if .SearchNames }}
+					ts_rank(name_tsv, tsq)::FLOAT8
+			{{ if and .Trgm .WholeNames }}
+					+ similarity({{.Text}}::TEXT, name)::FLOAT8
+			{{ else if .Trgm }}
+					+ word_similarity({{.Text}}::TEXT, name)::FLOAT8
+			{{ end }}
+		{{ end }}
+		{{ if and .SearchNames .SearchFiles }}
+					+
+		{{ end }}
+		{{ if .SearchFiles }}
+					COALESCE(file_matches.rank, 0)
+		{{ end }}
+				) AS relevance,
+		{{ if .SearchFiles }}
+				file_matches.paths::TEXT AS matched_files,
+		{{ else }}
+				NULL::TEXT AS matched_files,
+		{{ end }}
+	{{ else }}
+				0::FLOAT8 AS relevance,
+				NULL::TEXT AS matched_files,
+	{{ end }}
+				category
+			FROM torrents
+	{{ if and .DoJoin .SearchFiles }}
+			LEFT JOIN file_matches ON file_matches.torrent_id = torrents.id
+	{{ end }}
+	{{ if and .DoJoin .SearchNames }}
+			CROSS JOIN {{.TSQuery}} AS tsq
+	{{ end }}
+			WHERE
+	{{ if .DoJoin }}
+				(
+		{{ if .SearchNames }}
+					name_tsv @@ tsq OR
+			{{ if and .Trgm .WholeNames }}
+					{{.Text}}::TEXT % name OR
+			{{ else if .Trgm }}
+					{{.Text}}::TEXT <% name OR
+			{{ end }}
+					name ILIKE {{.LikePattern}}::TEXT
+		{{ end }}
+		{{ if and .SearchNames .SearchFiles }}
+					OR
+		{{ end }}
+		{{ if .SearchFiles }}
+					file_matches.torrent_id IS NOT NULL
+		{{ end }}
+				) AND
+	{{ end }}
+				{{ range $i, $filter := .Filters }}{{ if $i }} AND {{ end }}{{ $filter }}{{ end }}
+		) AS t
+	{{ if .LastID }}
+		WHERE ({{.OrderOn}}, id) {{GTEorLTE .Ascending}} ({{.LastOrderedValue}}, {{.LastID}})
+	{{ end }}
+		ORDER BY {{.OrderOn}} {{AscOrDesc .Ascending}}, id {{AscOrDesc .Ascending}}
+		LIMIT {{.Limit}};
+	`, data, template.FuncMap{
+		"GTEorLTE": func(ascending bool) string {
+			if ascending {
+				return ">"
+			} else {
+				return "<"
+			}
+		},
+		"AscOrDesc": func(ascending bool) string {
+			if ascending {
+				return "ASC"
+			} else {
+				return "DESC"
+			}
+		},
+	})
+
+	return sqlQuery, queryArgs
+}
+
+// filters returns the conditions on the `torrents` table of the query other than its terms, WITH
+// PLACEHOLDERS FOR USER INPUT.
+func (db *postgresDatabase) filters(
+	q *Query,
+	scope SearchScope,
+	placeholder func(interface{}) string,
+	tsQuery func([]string, string) string,
+) []string {
+	var filters []string
+
+	if len(q.Excluded) != 0 {
+		excluded := tsQuery(q.Excluded, "||")
+		if scope.names() {
+			filters = append(filters, "NOT (name_tsv @@ "+excluded+")")
+		}
+		if scope.files() {
+			filters = append(filters, "NOT EXISTS (SELECT 1 FROM files WHERE files.torrent_id = torrents.id AND "+pathTSVector+" @@ "+excluded+")")
+		}
+	}
+
+	for _, c := range q.Size {
+		filters = append(filters, "total_size "+c.Operator+" "+placeholder(int64(c.Value)))
+	}
+	for _, c := range q.NFiles {
+		filters = append(filters, "n_files "+c.Operator+" "+placeholder(int64(c.Value)))
+	}
+
+	if len(q.Extensions) != 0 {
+		// Extensions consist of letters and digits only, hence there is nothing to escape.
+		conditions := make([]string, len(q.Extensions))
+		for i, ext := range q.Extensions {
+			conditions[i] = "files.path ILIKE " + placeholder("%."+ext)
+		}
+		filters = append(filters, "EXISTS (SELECT 1 FROM files WHERE files.torrent_id = torrents.id AND ("+strings.Join(conditions, " OR ")+"))")
+	}
+
+	if q.After != nil {
+		filters = append(filters, "discovered_on >= "+placeholder(q.After.Unix()))
+	}
+	if q.Before != nil {
+		filters = append(filters, "discovered_on < "+placeholder(q.Before.Unix()))
+	}
+
+	for _, tag := range q.Tags {
+		filters = append(filters, `EXISTS (
+			SELECT 1
+			FROM torrent_tags
+			INNER JOIN tags ON tags.id = torrent_tags.tag_id
+			WHERE torrent_tags.torrent_id = torrents.id AND tags.name = `+placeholder(tag)+`::TEXT
+		)`)
+	}
+	if q.Starred {
+		filters = append(filters, "starred")
+	}
+
+	return filters
+}
+
+// escapeLike escapes the wildcards of the LIKE patterns in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (db *postgresDatabase) GetTorrent(ctx context.Context, infoHash []byte) (*TorrentMetadata, error) {
+	rows, err := db.conn.QueryContext(ctx, `
 		SELECT
 			t.info_hash,
 			t.name,
 			t.total_size,
 			t.discovered_on,
-			(SELECT COUNT(*) FROM files f WHERE f.torrent_id = t.id) AS n_files
+			t.n_files,
+			t.category
 		FROM torrents t
 		WHERE t.info_hash = $1;`,
 		infoHash,
@@ -307,15 +645,15 @@ func (db *postgresDatabase) GetTorrent(infoHash []byte) (*TorrentMetadata, error
 	}
 
 	var tm TorrentMetadata
-	if err = rows.Scan(&tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles); err != nil {
+	if err = rows.Scan(&tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles, &tm.Category); err != nil {
 		return nil, err
 	}
 
 	return &tm, nil
 }
 
-func (db *postgresDatabase) GetFiles(infoHash []byte) ([]File, error) {
-	rows, err := db.conn.Query(`
+func (db *postgresDatabase) GetFiles(ctx context.Context, infoHash []byte) ([]File, error) {
+	rows, err := db.conn.QueryContext(ctx, `
 		SELECT
        		f.size,
        		f.path 
@@ -324,7 +662,9 @@ func (db *postgresDatabase) GetFiles(infoHash []byte) ([]File, error) {
 			torrents t
 		WHERE
 			f.torrent_id = t.id AND
-			t.info_hash = $1;`,
+			t.info_hash = $1
+		ORDER BY
+			f.id;`,
 		infoHash,
 	)
 	defer db.closeRows(rows)
@@ -340,51 +680,65 @@ func (db *postgresDatabase) GetFiles(infoHash []byte) ([]File, error) {
 		}
 		files = append(files, file)
 	}
+	// Otherwise the files read so far would be returned as all of them, if the context is done
+	// in the meantime.
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
 	return files, nil
 }
 
-func (db *postgresDatabase) GetStatistics(from string, n uint) (*Statistics, error) {
-	fromTime, gran, err := ParseISO8601(from)
+func (db *postgresDatabase) GetFilesOfTorrents(ctx context.Context, infoHashes [][]byte) (map[string][]File, error) {
+	files := make(map[string][]File, len(infoHashes))
+	err := forEachChunk(infoHashes, func(args []interface{}) error {
+		rows, err := db.conn.QueryContext(ctx, `
+			SELECT
+				t.info_hash,
+				f.size,
+				f.path
+			FROM files f
+			INNER JOIN torrents t ON t.id = f.torrent_id
+			WHERE t.info_hash IN (`+numberedPlaceholders(len(args))+`)
+			ORDER BY f.id;`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		defer db.closeRows(rows)
+
+		for rows.Next() {
+			var infoHash []byte
+			var file File
+			if err = rows.Scan(&infoHash, &file.Size, &file.Path); err != nil {
+				return err
+			}
+			files[string(infoHash)] = append(files[string(infoHash)], file)
+		}
+		return rows.Err()
+	})
 	if err != nil {
-		return nil, errors.New("parsing ISO8601 error " + err.Error())
+		return nil, err
 	}
 
-	var toTime time.Time
-	var timef string
+	return files, nil
+}
 
-	switch gran {
-	case Year:
-		toTime = fromTime.AddDate(int(n), 0, 0)
-		timef = "2006"
-	case Month:
-		toTime = fromTime.AddDate(0, int(n), 0)
-		timef = "2006-01"
-	case Week:
-		toTime = fromTime.AddDate(0, 0, int(n)*7)
-		timef = "2006-01-02"
-	case Day:
-		toTime = fromTime.AddDate(0, 0, int(n))
-		timef = "2006-01-02"
-	case Hour:
-		toTime = fromTime.Add(time.Duration(n) * time.Hour)
-		timef = "2006-01-02 15:04"
+func (db *postgresDatabase) GetStatistics(ctx context.Context, from string, n uint) (*Statistics, error) {
+	fromTime, gran, err := ParseISO8601(from)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ISO8601 error %w", err)
 	}
-
-	rows, err := db.conn.Query(`
-		SELECT
-			discovered_on AS dT,
-			sum(files.size) AS tS,
-			count(DISTINCT torrents.id) AS nD,
-			count(DISTINCT files.id) AS nF
-		FROM
-			torrents,
-			files
-		WHERE
-			torrents.id = files.torrent_id AND
-			discovered_on >= $1 AND
-			discovered_on <= $2
-		GROUP BY dt;`,
+	toTime := statisticsEnd(*fromTime, gran, n)
+
+	// Statistics are served from the hourly aggregates (kept up to date by triggers), which are
+	// summed up into the periods of the granularity. As the periods end on the last second of an
+	// hour, the hours within them start after the beginning and not after the end.
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT hour, n_discovered, n_files, total_size
+		FROM statistics_hourly
+		WHERE hour > $1 AND hour <= $2 AND n_discovered > 0;`,
 		fromTime.Unix(),
 		toTime.Unix(),
 	)
@@ -393,47 +747,630 @@ func (db *postgresDatabase) GetStatistics(from string, n uint) (*Statistics, err
 	}
 	defer db.closeRows(rows)
 
-	stats := NewStatistics()
+	return scanStatistics(rows, gran)
+}
+
+func (db *postgresDatabase) RecordSwarm(ctx context.Context, infoHash []byte, swarm Swarm) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("conn.BeginTx %w", err)
+	}
+	defer db.rollback(tx)
+
+	var torrentID int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM torrents WHERE info_hash = $1;", infoHash).Scan(&torrentID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("tx.QueryRowContext (SELECT id FROM torrents) %w", err)
+	}
 
+	if swarm.NPeers > 0 {
+		_, err = tx.ExecContext(ctx, "UPDATE torrents SET n_initial_peers = $1 WHERE id = $2 AND n_initial_peers IS NULL;",
+			swarm.NPeers, torrentID,
+		)
+		if err != nil {
+			return fmt.Errorf("tx.ExecContext (UPDATE torrents) %w", err)
+		}
+	}
+
+	for _, client := range postgresClients(swarm.Clients) {
+		_, err = tx.ExecContext(ctx, "INSERT INTO peer_clients (torrent_id, client) VALUES ($1, $2) ON CONFLICT (torrent_id, client) DO NOTHING;",
+			torrentID, client,
+		)
+		if err != nil {
+			return fmt.Errorf("tx.ExecContext (INSERT INTO peer_clients) %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return nil
+}
+
+// postgresClients returns the client names that PostgreSQL can store: those that are not valid UTF-8
+// are left out, and NUL characters are removed.
+func postgresClients(clients []string) []string {
+	valid := make([]string, 0, len(clients))
+	for _, client := range clients {
+		if !utf8.ValidString(client) {
+			log.Printf("Ignoring a client name that is not UTF-8 compliant. %q", client)
+			continue
+		}
+		valid = append(valid, strings.ReplaceAll(client, "\x00", ""))
+	}
+	return valid
+}
+
+func (db *postgresDatabase) GetSwarm(ctx context.Context, infoHash []byte) (*Swarm, error) {
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT
+			COALESCE(t.n_initial_peers, 0),
+			c.client
+		FROM torrents t
+		LEFT JOIN peer_clients c ON c.torrent_id = t.id
+		WHERE t.info_hash = $1
+		ORDER BY c.client;`,
+		infoHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer db.closeRows(rows)
+
+	var swarm *Swarm
 	for rows.Next() {
-		var dT string
-		var tS, nD, nF uint64
-		if err := rows.Scan(&dT, &tS, &nD, &nF); err != nil {
-			if err := rows.Close(); err != nil {
-				panic(err.Error())
-			}
+		var nPeers int64
+		var client sql.NullString
+		if err = rows.Scan(&nPeers, &client); err != nil {
 			return nil, err
 		}
+		if swarm == nil {
+			swarm = &Swarm{NPeers: uint(nPeers), Clients: []string{}}
+		}
+		if client.Valid {
+			swarm.Clients = append(swarm.Clients, client.String)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
-		epoch, _ := strconv.ParseInt(dT, 10, 64)
-		dT = time.Unix(epoch, 0).Format(timef)
+	return swarm, nil
+}
 
-		stats.NDiscovered[dT] = nD
-		stats.TotalSize[dT] = tS
-		stats.NFiles[dT] = nF
+func (db *postgresDatabase) GetSwarms(ctx context.Context, infoHashes [][]byte) (map[string]Swarm, error) {
+	swarms := make(map[string]Swarm, len(infoHashes))
+	err := forEachChunk(infoHashes, func(args []interface{}) error {
+		rows, err := db.conn.QueryContext(ctx, `
+			SELECT
+				t.info_hash,
+				COALESCE(t.n_initial_peers, 0),
+				c.client
+			FROM torrents t
+			LEFT JOIN peer_clients c ON c.torrent_id = t.id
+			WHERE t.info_hash IN (`+numberedPlaceholders(len(args))+`)
+			ORDER BY c.client;`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		defer db.closeRows(rows)
+
+		for rows.Next() {
+			var infoHash []byte
+			var nPeers int64
+			var client sql.NullString
+			if err = rows.Scan(&infoHash, &nPeers, &client); err != nil {
+				return err
+			}
+			swarm, exists := swarms[string(infoHash)]
+			if !exists {
+				swarm = Swarm{NPeers: uint(nPeers), Clients: []string{}}
+			}
+			if client.Valid {
+				swarm.Clients = append(swarm.Clients, client.String)
+			}
+			swarms[string(infoHash)] = swarm
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return stats, nil
+	return swarms, nil
 }
 
-func (db *postgresDatabase) setupDatabase() error {
-	tx, err := db.conn.Begin()
+func (db *postgresDatabase) SetReadme(ctx context.Context, infoHash []byte, readme Readme) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
 	if err != nil {
-		return errors.New("sql.DB.Begin " + err.Error())
+		return fmt.Errorf("conn.BeginTx %w", err)
 	}
 	defer db.rollback(tx)
 
-	rows, err := db.conn.Query("SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm';")
+	var fileID int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT files.id
+		FROM files
+		INNER JOIN torrents ON torrents.id = files.torrent_id
+		WHERE torrents.info_hash = $1 AND files.path = $2
+		ORDER BY files.id
+		LIMIT 1;`,
+		infoHash, readme.Path,
+	).Scan(&fileID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("tx.QueryRowContext (SELECT files.id) %w", err)
+	}
+
+	// There can be only one readme per torrent (see readme_index), hence the previous one is
+	// unmarked first.
+	_, err = tx.ExecContext(ctx, `
+		UPDATE files SET is_readme = NULL, content = NULL
+		WHERE torrent_id = (SELECT torrent_id FROM files WHERE id = $1) AND is_readme = TRUE;`,
+		fileID,
+	)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext (UPDATE files SET is_readme = NULL) %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE files SET is_readme = TRUE, content = $1 WHERE id = $2;",
+		strings.ReplaceAll(readme.Content, "\x00", ""), fileID,
+	)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext (UPDATE files SET is_readme) %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) GetReadme(ctx context.Context, infoHash []byte) (*Readme, error) {
+	readme := new(Readme)
+	err := db.conn.QueryRowContext(ctx, `
+		SELECT files.path, files.content
+		FROM files
+		INNER JOIN torrents ON torrents.id = files.torrent_id
+		WHERE torrents.info_hash = $1 AND files.is_readme = TRUE;`,
+		infoHash,
+	).Scan(&readme.Path, &readme.Content)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return readme, nil
+}
+
+func (db *postgresDatabase) AddTag(ctx context.Context, infoHash []byte, tag string) error {
+	tag, err := NormaliseTag(tag)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("conn.BeginTx %w", err)
+	}
+	defer db.rollback(tx)
+
+	var torrentID int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM torrents WHERE info_hash = $1;", infoHash).Scan(&torrentID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("tx.QueryRowContext (SELECT id FROM torrents) %w", err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "INSERT INTO tags (name) VALUES ($1) ON CONFLICT (name) DO NOTHING;", tag); err != nil {
+		return fmt.Errorf("tx.ExecContext (INSERT INTO tags) %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO torrent_tags (torrent_id, tag_id)
+		SELECT $1::BIGINT, id FROM tags WHERE name = $2
+		ON CONFLICT (torrent_id, tag_id) DO NOTHING;`,
+		torrentID, tag,
+	)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext (INSERT INTO torrent_tags) %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) RemoveTag(ctx context.Context, infoHash []byte, tag string) error {
+	tag, err := NormaliseTag(tag)
 	if err != nil {
 		return err
 	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("conn.BeginTx %w", err)
+	}
+	defer db.rollback(tx)
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM torrent_tags
+		WHERE torrent_id = (SELECT id FROM torrents WHERE info_hash = $1)
+			AND tag_id = (SELECT id FROM tags WHERE name = $2);`,
+		infoHash, tag,
+	)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext (DELETE FROM torrent_tags) %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM tags
+		WHERE name = $1 AND NOT EXISTS (SELECT 1 FROM torrent_tags WHERE torrent_tags.tag_id = tags.id);`,
+		tag,
+	)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext (DELETE FROM tags) %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit %w", err)
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) SetNote(ctx context.Context, infoHash []byte, note string) error {
+	// PostgreSQL rejects NUL characters in text, same as in the names of the torrents.
+	note = strings.ReplaceAll(note, "\x00", "")
+	_, err := db.conn.ExecContext(ctx, "UPDATE torrents SET note = NULLIF($1, '') WHERE info_hash = $2;", note, infoHash)
+	if err != nil {
+		return fmt.Errorf("conn.ExecContext (UPDATE torrents SET note) %w", err)
+	}
+	return nil
+}
+
+func (db *postgresDatabase) SetStarred(ctx context.Context, infoHash []byte, starred bool) error {
+	_, err := db.conn.ExecContext(ctx, "UPDATE torrents SET starred = $1 WHERE info_hash = $2;", starred, infoHash)
+	if err != nil {
+		return fmt.Errorf("conn.ExecContext (UPDATE torrents SET starred) %w", err)
+	}
+	return nil
+}
+
+func (db *postgresDatabase) GetCuration(ctx context.Context, infoHash []byte) (*Curation, error) {
+	curation := &Curation{Tags: []string{}}
+	var torrentID int64
+	var note sql.NullString
+	err := db.conn.QueryRowContext(ctx,
+		"SELECT id, note, starred FROM torrents WHERE info_hash = $1;",
+		infoHash,
+	).Scan(&torrentID, &note, &curation.Starred)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	curation.Note = note.String
+
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT tags.name
+		FROM torrent_tags
+		INNER JOIN tags ON tags.id = torrent_tags.tag_id
+		WHERE torrent_tags.torrent_id = $1
+		ORDER BY tags.name;`,
+		torrentID,
+	)
+	if err != nil {
+		return nil, err
+	}
 	defer db.closeRows(rows)
 
-	trgmInstalled := rows.Next()
-	if rows.Err() != nil {
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		curation.Tags = append(curation.Tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return curation, nil
+}
+
+func (db *postgresDatabase) GetTags(ctx context.Context) ([]Tag, error) {
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT tags.name, count(*)::BIGINT
+		FROM tags
+		INNER JOIN torrent_tags ON torrent_tags.tag_id = tags.id
+		GROUP BY tags.id, tags.name
+		ORDER BY tags.name;`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer db.closeRows(rows)
+
+	tags := make([]Tag, 0)
+	for rows.Next() {
+		var tag Tag
+		if err = rows.Scan(&tag.Name, &tag.NTorrents); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+func (db *postgresDatabase) SetUser(ctx context.Context, user User) error {
+	if err := ValidateUserName(user.Name); err != nil {
 		return err
 	}
-	if !trgmInstalled {
+
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO users (name, password_hash, role) VALUES ($1, $2, $3::SMALLINT)
+		ON CONFLICT (name) DO UPDATE SET password_hash = excluded.password_hash, role = excluded.role;`,
+		user.Name, user.PasswordHash, int16(user.Role),
+	)
+	if err != nil {
+		return fmt.Errorf("conn.ExecContext (INSERT INTO users) %w", err)
+	}
+	return nil
+}
+
+func (db *postgresDatabase) GetUser(ctx context.Context, name string) (*User, error) {
+	user := new(User)
+	err := db.conn.QueryRowContext(ctx,
+		"SELECT name, password_hash, role FROM users WHERE name = $1;",
+		name,
+	).Scan(&user.Name, &user.PasswordHash, &user.Role)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (db *postgresDatabase) GetUsers(ctx context.Context) ([]User, error) {
+	rows, err := db.conn.QueryContext(ctx, "SELECT name, password_hash, role FROM users ORDER BY name;")
+	if err != nil {
+		return nil, err
+	}
+	defer db.closeRows(rows)
+
+	users := make([]User, 0)
+	for rows.Next() {
+		var user User
+		if err = rows.Scan(&user.Name, &user.PasswordHash, &user.Role); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (db *postgresDatabase) DeleteUser(ctx context.Context, name string) (bool, error) {
+	result, err := db.conn.ExecContext(ctx, "DELETE FROM users WHERE name = $1;", name)
+	if err != nil {
+		return false, fmt.Errorf("conn.ExecContext (DELETE FROM users) %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("sql.Result.RowsAffected %w", err)
+	}
+	return n != 0, nil
+}
+
+func (db *postgresDatabase) AddToken(ctx context.Context, token Token) error {
+	// PostgreSQL rejects NUL characters in text, same as in the notes of the torrents.
+	token.Name = strings.ReplaceAll(token.Name, "\x00", "")
+	result, err := db.conn.ExecContext(ctx, `
+		INSERT INTO tokens (id, hash, user_id, name, session, created_on, expires_on)
+		SELECT $1::TEXT, $2::BYTEA, id, $3::TEXT, $4::BOOLEAN, $5::BIGINT, $6::BIGINT FROM users WHERE name = $7;`,
+		token.ID, token.Hash, token.Name, token.Session, token.CreatedOn, token.ExpiresOn, token.User,
+	)
+	if err != nil {
+		return fmt.Errorf("conn.ExecContext (INSERT INTO tokens) %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("sql.Result.RowsAffected %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("unknown user: %s", token.User)
+	}
+	return nil
+}
+
+func (db *postgresDatabase) GetToken(ctx context.Context, id string) (*Token, error) {
+	token := new(Token)
+	err := db.conn.QueryRowContext(ctx, `
+		SELECT tokens.id, tokens.hash, users.name, tokens.name, tokens.session, tokens.created_on, tokens.expires_on
+		FROM tokens
+		INNER JOIN users ON users.id = tokens.user_id
+		WHERE tokens.id = $1;`,
+		id,
+	).Scan(&token.ID, &token.Hash, &token.User, &token.Name, &token.Session, &token.CreatedOn, &token.ExpiresOn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (db *postgresDatabase) GetTokens(ctx context.Context, user string) ([]Token, error) {
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT tokens.id, tokens.hash, users.name, tokens.name, tokens.session, tokens.created_on, tokens.expires_on
+		FROM tokens
+		INNER JOIN users ON users.id = tokens.user_id
+		WHERE users.name = $1
+		ORDER BY tokens.created_on, tokens.id;`,
+		user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer db.closeRows(rows)
+
+	tokens := make([]Token, 0)
+	for rows.Next() {
+		var token Token
+		if err = rows.Scan(&token.ID, &token.Hash, &token.User, &token.Name, &token.Session, &token.CreatedOn, &token.ExpiresOn); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (db *postgresDatabase) DeleteToken(ctx context.Context, id string) (bool, error) {
+	result, err := db.conn.ExecContext(ctx, "DELETE FROM tokens WHERE id = $1;", id)
+	if err != nil {
+		return false, fmt.Errorf("conn.ExecContext (DELETE FROM tokens) %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("sql.Result.RowsAffected %w", err)
+	}
+	return n != 0, nil
+}
+
+func (db *postgresDatabase) DeleteExpiredTokens(ctx context.Context, now int64) (uint, error) {
+	result, err := db.conn.ExecContext(ctx, "DELETE FROM tokens WHERE expires_on != 0 AND expires_on <= $1;", now)
+	if err != nil {
+		return 0, fmt.Errorf("conn.ExecContext (DELETE FROM tokens) %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("sql.Result.RowsAffected %w", err)
+	}
+	return uint(n), nil
+}
+
+func (db *postgresDatabase) PurgeTorrents(ctx context.Context, infoHashes [][]byte, pattern *regexp.Regexp) (uint, error) {
+	args := make([]interface{}, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		args[i] = infoHash
+	}
+	nDeleted, err := deleteInBatches(ctx, db.conn, db.retryBatch, "DELETE FROM torrents WHERE info_hash = $1;", args)
+	if err != nil || pattern == nil {
+		return nDeleted, err
+	}
+
+	ids, err := matchingTorrentIDs(
+		ctx,
+		db.conn,
+		pattern,
+		"SELECT id, id, name FROM torrents WHERE id > $1 ORDER BY id LIMIT $2;",
+		"SELECT id, torrent_id, path FROM files WHERE id > $1 AND torrent_id IS NOT NULL ORDER BY id LIMIT $2;",
+	)
+	if err != nil {
+		return nDeleted, fmt.Errorf("matchingTorrentIDs %w", err)
+	}
+	args = make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	n, err := deleteInBatches(ctx, db.conn, db.retryBatch, "DELETE FROM torrents WHERE id = $1;", args)
+	return nDeleted + n, err
+}
+
+func (db *postgresDatabase) DeleteTorrent(ctx context.Context, infoHash []byte) (bool, error) {
+	n, err := db.PurgeTorrents(ctx, [][]byte{infoHash}, nil)
+	return n != 0, err
+}
+
+func (db *postgresDatabase) DeleteTorrents(ctx context.Context, query string, category *Category, scope SearchScope) (uint, error) {
+	infoHashes, err := queriedInfoHashes(ctx, db, query, category, scope)
+	if err != nil {
+		return 0, err
+	}
+	return db.PurgeTorrents(ctx, infoHashes, nil)
+}
+
+func (db *postgresDatabase) ApplyRetention(ctx context.Context, policy RetentionPolicy) (uint, error) {
+	var nDeleted uint
+
+	if policy.MaxAgeWithoutPeers != 0 {
+		cutoff := time.Now().Add(-policy.MaxAgeWithoutPeers).Unix()
+		n, err := deleteRepeatedly(ctx, db.conn, db.retryBatch, `
+			DELETE FROM torrents WHERE id IN (
+				SELECT id FROM torrents WHERE discovered_on < $1 AND COALESCE(n_initial_peers, 0) = 0 LIMIT $2
+			);`,
+			cutoff,
+		)
+		nDeleted += n
+		if err != nil {
+			return nDeleted, err
+		}
+	}
+
+	if policy.MaxTorrents != 0 {
+		// The most recently discovered torrent not retained is looked up once, rather than counting
+		// the torrents retained on every batch.
+		var discoveredOn, id int64
+		err := db.conn.QueryRowContext(ctx,
+			"SELECT discovered_on, id FROM torrents ORDER BY discovered_on DESC, id DESC LIMIT 1 OFFSET $1;",
+			policy.MaxTorrents,
+		).Scan(&discoveredOn, &id)
+		if err == sql.ErrNoRows {
+			return nDeleted, nil
+		} else if err != nil {
+			return nDeleted, fmt.Errorf("conn.QueryRowContext (SELECT FROM torrents OFFSET) %w", err)
+		}
+
+		n, err := deleteRepeatedly(ctx, db.conn, db.retryBatch, `
+			DELETE FROM torrents WHERE id IN (
+				SELECT id FROM torrents WHERE discovered_on < $1 OR (discovered_on = $2 AND id <= $3) LIMIT $4
+			);`,
+			discoveredOn, discoveredOn, id,
+		)
+		nDeleted += n
+		if err != nil {
+			return nDeleted, err
+		}
+	}
+
+	return nDeleted, nil
+}
+
+// setupDatabase creates the tables of the very first schema if they do not exist, and migrates the
+// schema to the latest version, see migrate.
+func (db *postgresDatabase) setupDatabase(dryRun bool) ([]Migration, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("sql.DB.Begin %w", err)
+	}
+	defer db.rollback(tx)
+
+	if err = db.detectTrgm(); err != nil {
+		return nil, err
+	}
+	if !db.trgm {
 		log.Println("pg_trgm extension is not enabled. You need to execute 'CREATE EXTENSION pg_trgm' on this database")
 	}
 
@@ -482,45 +1419,319 @@ func (db *postgresDatabase) setupDatabase() error {
 		INSERT INTO migrations (schema_version) VALUES (0) ON CONFLICT DO NOTHING;
 	`)
 	if err != nil {
-		return errors.New("sql.Tx.Exec (v0) " + err.Error())
+		return nil, fmt.Errorf("sql.Tx.Exec (v0) %w", err)
 	}
 
-	// Get current schema version
-	rows, err = tx.Query("SELECT MAX(schema_version) FROM migrations;")
+	migrations, err := migrate(tx, postgresMigrations, postgresVersioner, dryRun)
 	if err != nil {
-		return errors.New("sql.Tx.Query (SELECT MAX(version) FROM migrations) " + err.Error())
+		return nil, err
 	}
-	defer db.closeRows(rows)
-
-	var schemaVersion int
-	if !rows.Next() {
-		return fmt.Errorf("sql.Rows.Next (SELECT MAX(version) FROM migrations): Query did not return any rows")
+	if dryRun {
+		return migrations, nil
 	}
-	if err = rows.Scan(&schemaVersion); err != nil {
-		return errors.New("sql.Rows.Scan (MAX(version)) " + err.Error())
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("sql.Tx.Commit %w", err)
 	}
-	// If next line is removed we're getting error on sql.Tx.Commit: unexpected command tag SELECT
-	// https://stackoverflow.com/questions/36295883/golang-postgres-commit-unknown-command-error/36866993#36866993
-	db.closeRows(rows)
 
-	// Uncomment for future migrations:
-	//switch schemaVersion {
-	//case 0: // FROZEN.
-	//	log.Println("Updating (fake) database schema from 0 to 1...")
-	//	_, err = tx.Exec(`INSERT INTO migrations (schema_version) VALUES (1);`)
-	//	if err != nil {
-	//		return errors.Wrap(err, "sql.Tx.Exec (v0 -> v1)")
-	//	}
-	//	//fallthrough
-	//}
+	return migrations, nil
+}
 
-	if err = tx.Commit(); err != nil {
-		return errors.New("sql.Tx.Commit " + err.Error())
+// postgresVersioner keeps the version of the schema in the `migrations` table, a row per version.
+var postgresVersioner = schemaVersioner{
+	get: func(tx *sql.Tx) (int, error) {
+		var version int
+		err := tx.QueryRow("SELECT MAX(schema_version) FROM migrations;").Scan(&version)
+		return version, err
+	},
+	set: func(tx *sql.Tx, version int) error {
+		_, err := tx.Exec("INSERT INTO migrations (schema_version) VALUES ($1);", version)
+		return err
+	},
+}
+
+// postgresMigrations are the migrations of the schema of PostgreSQL databases, see migration.
+var postgresMigrations = []migration{
+	// 0 -> 1: FROZEN.
+	// Changes:
+	//   * Added `n_initial_peers` column to the `torrents` table, which is the number of peers
+	//     known for the torrent when it was first seen (NULL if unknown).
+	//   * Created `peer_clients` table, that holds the distinct client names observed in the
+	//     swarm of each torrent.
+	{
+		name: "initial peers and peer clients",
+		sql: `
+		ALTER TABLE torrents ADD COLUMN n_initial_peers INTEGER CHECK (n_initial_peers IS NULL OR n_initial_peers >= 0) DEFAULT NULL;
+
+		CREATE TABLE peer_clients (
+			torrent_id  INTEGER NOT NULL REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			client      TEXT NOT NULL,
+			UNIQUE (torrent_id, client)
+		);
+	`,
+	},
+
+	// 1 -> 2: FROZEN.
+	// Changes:
+	//   * Added `category` column to the `torrents` table, and an index on it. Existing
+	//     torrents are left uncategorised (0).
+	{
+		name: "categories",
+		sql: `
+		ALTER TABLE torrents ADD COLUMN category SMALLINT NOT NULL CHECK (category >= 0) DEFAULT 0;
+		CREATE INDEX idx_torrents_category ON torrents (category);
+	`,
+	},
+
+	// 2 -> 3: FROZEN.
+	// Changes:
+	//   * Added `name_tsv` generated column to the `torrents` table, the full-text search
+	//     vector of the name where punctuation separates words (as in `Some.Torrent-Name`),
+	//     and a GIN index on it for ranking by relevance.
+	{
+		name: "full-text search vector of names",
+		sql: `
+		ALTER TABLE torrents ADD COLUMN name_tsv TSVECTOR
+			GENERATED ALWAYS AS (to_tsvector('simple', regexp_replace(name, '[^[:alnum:]]+', ' ', 'g'))) STORED;
+		CREATE INDEX idx_torrents_name_tsv ON torrents USING GIN (name_tsv);
+	`,
+	},
+
+	// 3 -> 4: FROZEN.
+	// Changes:
+	//   * Created `statistics_hourly` table, that holds the number of torrents discovered in
+	//     each hour (starting on `hour`, in Unix time), their number of files, and their total
+	//     size; populated from the existing torrents.
+	//   * Created triggers that keep `statistics_hourly` up to date as torrents and files are
+	//     added and deleted. Files are counted as they are added to a torrent, whereas they
+	//     are discounted before the torrent is deleted, when they still exist (they are deleted
+	//     only by ON DELETE CASCADE).
+	{
+		name: "hourly statistics",
+		sql: `
+		CREATE TABLE statistics_hourly (
+			hour          BIGINT PRIMARY KEY,
+			n_discovered  BIGINT NOT NULL DEFAULT 0,
+			n_files       BIGINT NOT NULL DEFAULT 0,
+			total_size    BIGINT NOT NULL DEFAULT 0
+		);
+
+		INSERT INTO statistics_hourly (hour, n_discovered, n_files, total_size)
+			SELECT
+				t.discovered_on - t.discovered_on % 3600,
+				count(DISTINCT t.id),
+				count(f.id),
+				COALESCE(sum(f.size), 0)
+			FROM torrents t
+			LEFT JOIN files f ON f.torrent_id = t.id
+			GROUP BY 1;
+
+		CREATE FUNCTION statistics_hourly_torrents_ai() RETURNS TRIGGER AS $$
+		BEGIN
+			INSERT INTO statistics_hourly (hour, n_discovered, total_size)
+				VALUES (NEW.discovered_on - NEW.discovered_on % 3600, 1, NEW.total_size)
+				ON CONFLICT (hour) DO UPDATE SET
+					n_discovered = statistics_hourly.n_discovered + 1,
+					total_size = statistics_hourly.total_size + EXCLUDED.total_size;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER statistics_hourly_torrents_ai AFTER INSERT ON torrents
+			FOR EACH ROW EXECUTE FUNCTION statistics_hourly_torrents_ai();
+
+		CREATE FUNCTION statistics_hourly_torrents_bd() RETURNS TRIGGER AS $$
+		BEGIN
+			UPDATE statistics_hourly SET
+				n_discovered = n_discovered - 1,
+				n_files = n_files - (SELECT count(*) FROM files WHERE torrent_id = OLD.id),
+				total_size = total_size - OLD.total_size
+			WHERE hour = OLD.discovered_on - OLD.discovered_on % 3600;
+			RETURN OLD;
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER statistics_hourly_torrents_bd BEFORE DELETE ON torrents
+			FOR EACH ROW EXECUTE FUNCTION statistics_hourly_torrents_bd();
+
+		CREATE FUNCTION statistics_hourly_files_ai() RETURNS TRIGGER AS $$
+		BEGIN
+			UPDATE statistics_hourly SET n_files = n_files + 1
+			WHERE hour = (SELECT discovered_on - discovered_on % 3600 FROM torrents WHERE id = NEW.torrent_id);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER statistics_hourly_files_ai AFTER INSERT ON files
+			FOR EACH ROW EXECUTE FUNCTION statistics_hourly_files_ai();
+	`,
+	},
+
+	// 4 -> 5: FROZEN.
+	// Changes:
+	//   * Added `n_files` column to the `torrents` table, the number of files of the torrent
+	//     (set on insert, since files are never added to existing torrents), and an index on
+	//     it; back-filled for the existing torrents.
+	//   * The triggers of `statistics_hourly` count the files by `n_files`, so that inserting
+	//     files does not fire a trigger for every single one of them anymore.
+	{
+		name: "number of files",
+		sql: `
+		ALTER TABLE torrents ADD COLUMN n_files INTEGER NOT NULL CHECK (n_files >= 0) DEFAULT 0;
+		UPDATE torrents t SET n_files = f.n_files
+			FROM (SELECT torrent_id, count(*) AS n_files FROM files GROUP BY torrent_id) f
+			WHERE f.torrent_id = t.id;
+		CREATE INDEX idx_torrents_n_files ON torrents (n_files);
+
+		DROP TRIGGER statistics_hourly_files_ai ON files;
+		DROP FUNCTION statistics_hourly_files_ai();
+		DROP TRIGGER statistics_hourly_torrents_bd ON torrents;
+		DROP FUNCTION statistics_hourly_torrents_bd();
+
+		CREATE OR REPLACE FUNCTION statistics_hourly_torrents_ai() RETURNS TRIGGER AS $$
+		BEGIN
+			INSERT INTO statistics_hourly (hour, n_discovered, n_files, total_size)
+				VALUES (NEW.discovered_on - NEW.discovered_on % 3600, 1, NEW.n_files, NEW.total_size)
+				ON CONFLICT (hour) DO UPDATE SET
+					n_discovered = statistics_hourly.n_discovered + 1,
+					n_files = statistics_hourly.n_files + EXCLUDED.n_files,
+					total_size = statistics_hourly.total_size + EXCLUDED.total_size;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		CREATE FUNCTION statistics_hourly_torrents_ad() RETURNS TRIGGER AS $$
+		BEGIN
+			UPDATE statistics_hourly SET
+				n_discovered = n_discovered - 1,
+				n_files = n_files - OLD.n_files,
+				total_size = total_size - OLD.total_size
+			WHERE hour = OLD.discovered_on - OLD.discovered_on % 3600;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER statistics_hourly_torrents_ad AFTER DELETE ON torrents
+			FOR EACH ROW EXECUTE FUNCTION statistics_hourly_torrents_ad();
+	`,
+	},
+
+	// 5 -> 6: FROZEN.
+	// Changes:
+	//   * Added `is_readme` and `content` columns to the `files` table, and the constraints &
+	//     the indices they entail, as in SQLite: the content of at most one file of each
+	//     torrent (its readme) is stored.
+	{
+		name: "readmes",
+		sql: `
+		ALTER TABLE files ADD COLUMN is_readme BOOLEAN CHECK (is_readme IS NULL OR is_readme) DEFAULT NULL;
+		ALTER TABLE files ADD COLUMN content   TEXT    CHECK ((content IS NULL AND is_readme IS NULL) OR (content IS NOT NULL AND is_readme)) DEFAULT NULL;
+		CREATE UNIQUE INDEX readme_index ON files (torrent_id, is_readme);
+	`,
+	},
+	// 6 -> 7: FROZEN.
+	// Changes:
+	//   * Created the `tags` table, and the `torrent_tags` table that tags the torrents.
+	//   * Added `note` and `starred` columns to the `torrents` table, and a (partial) index of
+	//     the starred torrents.
+	{
+		name: "tags, notes, and stars",
+		sql: `
+		CREATE TABLE tags (
+			id    SERIAL PRIMARY KEY,
+			name  TEXT NOT NULL UNIQUE
+		);
+
+		CREATE TABLE torrent_tags (
+			torrent_id  INTEGER NOT NULL REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			tag_id      INTEGER NOT NULL REFERENCES tags ON DELETE CASCADE ON UPDATE RESTRICT,
+			PRIMARY KEY (torrent_id, tag_id)
+		);
+		CREATE INDEX idx_torrent_tags_tag_id ON torrent_tags (tag_id);
+
+		ALTER TABLE torrents ADD COLUMN note TEXT DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN starred BOOLEAN NOT NULL DEFAULT FALSE;
+		CREATE INDEX idx_torrents_starred ON torrents (id) WHERE starred;
+	`,
+	},
+	// 7 -> 8: NOT FROZEN! (subject to change or complete removal)
+	// Changes:
+	//   * Created the `users` table, the users of magneticow and their roles.
+	//   * Created the `tokens` table, the sessions and the API tokens of the users (of which only
+	//     the hashes are stored).
+	{
+		name: "users and tokens",
+		sql: `
+		CREATE TABLE users (
+			id             SERIAL PRIMARY KEY,
+			name           TEXT NOT NULL UNIQUE,
+			password_hash  BYTEA NOT NULL,
+			role           SMALLINT NOT NULL CHECK (role >= 0)
+		);
+
+		CREATE TABLE tokens (
+			id          TEXT PRIMARY KEY,
+			hash        BYTEA NOT NULL,
+			user_id     INTEGER NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE RESTRICT,
+			name        TEXT NOT NULL,
+			session     BOOLEAN NOT NULL,
+			created_on  BIGINT NOT NULL CHECK (created_on >= 0),
+			expires_on  BIGINT NOT NULL CHECK (expires_on >= 0)
+		);
+		CREATE INDEX idx_tokens_user_id ON tokens (user_id);
+		CREATE INDEX idx_tokens_expires_on ON tokens (expires_on) WHERE expires_on != 0;
+	`,
+	},
+}
+
+// setupFilesIndex creates the full-text index of the paths of the files if asked so and if it does
+// not exist yet. It is not part of the schema migrations since it is optional; once created, it is
+// kept up to date even if it is not asked for anymore.
+func (db *postgresDatabase) setupFilesIndex(create bool) error {
+	err := db.conn.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM pg_indexes WHERE schemaname = $1 AND indexname = 'idx_files_path_tsv');",
+		db.schema,
+	).Scan(&db.filesIndex)
+	if err != nil {
+		return fmt.Errorf("sql.DB.QueryRow (pg_indexes) %w", err)
+	}
+	if db.filesIndex || !create {
+		return nil
+	}
+
+	log.Println("Indexing the paths of the files... (this might take a while)")
+	_, err = db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_files_path_tsv ON files USING GIN (" + pathTSVector + ");")
+	if err != nil {
+		return fmt.Errorf("sql.DB.Exec (CREATE INDEX idx_files_path_tsv) %w", err)
 	}
 
+	db.filesIndex = true
+	return nil
+}
+
+// detectTrgm sets trgm, as to whether the pg_trgm extension is installed.
+func (db *postgresDatabase) detectTrgm() error {
+	err := db.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm');").Scan(&db.trgm)
+	if err != nil {
+		return fmt.Errorf("sql.DB.QueryRow (pg_extension) %w", err)
+	}
 	return nil
 }
 
+// unmarshalMatchedFiles decodes the JSON array of the paths of the matched files, as aggregated by
+// QueryTorrents. Returns nil if no files matched.
+func unmarshalMatchedFiles(matchedFiles sql.NullString) ([]string, error) {
+	if !matchedFiles.Valid {
+		return nil, nil
+	}
+
+	var paths []string
+	if err := json.Unmarshal([]byte(matchedFiles.String), &paths); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal (matched files) %w", err)
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
 func (db *postgresDatabase) closeRows(rows *sql.Rows) {
 	if err := rows.Close(); err != nil {
 		log.Printf("could not close row %v", err)
@@ -534,10 +1745,19 @@ func (db *postgresDatabase) rollback(tx *sql.Tx) {
 	}
 }
 
+// numberedPlaceholders returns the placeholders of n arguments, "$1, $2, ..., $n".
+func numberedPlaceholders(n int) string {
+	placeholders := make([]string, n)
+	for i := range placeholders {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+	}
+	return strings.Join(placeholders, ", ")
+}
+
 func (db *postgresDatabase) orderOn(orderBy OrderingCriteria) string {
 	switch orderBy {
 	case ByRelevance:
-		return "discovered_on"
+		return "relevance"
 
 	case ByTotalSize:
 		return "total_size"
@@ -1,10 +1,62 @@
 package persistence
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"text/template"
 )
 
+// openPostgresDatabase opens the database of MAGNETICO_TEST_POSTGRES_URL (which must be a server
+// started for the tests, such as a throwaway container) in a schema of its own for each test, which
+// is dropped at its end.
+func openPostgresDatabase(t *testing.T, filesIndex bool) Database {
+	t.Helper()
+
+	url_, err := url.Parse(os.Getenv("MAGNETICO_TEST_POSTGRES_URL"))
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+	suffix := make([]byte, 8)
+	if _, err = rand.Read(suffix); err != nil {
+		t.Fatalf("rand.Read() error = %v", err)
+	}
+	schema := "test_" + hex.EncodeToString(suffix)
+
+	query := url_.Query()
+	query.Set("schema", schema)
+	if filesIndex {
+		query.Set("files_index", "true")
+	}
+	url_.RawQuery = query.Encode()
+
+	db, err := makePostgresDatabase(url_)
+	if err != nil {
+		t.Fatalf("makePostgresDatabase() error = %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.(*postgresDatabase).conn.Exec("DROP SCHEMA " + schema + " CASCADE;"); err != nil {
+			t.Errorf("could not drop the schema %s: %v", schema, err)
+		}
+		db.Close()
+	})
+
+	return db
+}
+
+func TestPostgresDatabase_Conformance(t *testing.T) {
+	if os.Getenv("MAGNETICO_TEST_POSTGRES_URL") == "" {
+		t.Skip("MAGNETICO_TEST_POSTGRES_URL is not set")
+	}
+	t.Parallel()
+
+	testConformance(t, openPostgresDatabase)
+}
+
 func TestPostgresDatabase_ExecuteTemplate(t *testing.T) {
 	db := &postgresDatabase{}
 
@@ -30,7 +82,7 @@ func TestPostgresDatabase_OrderOn(t *testing.T) {
 		orderBy  OrderingCriteria
 		expected string
 	}{
-		{ByRelevance, "discovered_on"},
+		{ByRelevance, "relevance"},
 		{ByTotalSize, "total_size"},
 		{ByDiscoveredOn, "discovered_on"},
 		{ByNFiles, "n_files"},
@@ -43,3 +95,81 @@ func TestPostgresDatabase_OrderOn(t *testing.T) {
 		}
 	}
 }
+
+func TestPostgresDatabase_BuildQueryTorrents(t *testing.T) {
+	db := &postgresDatabase{trgm: true}
+
+	q, _ := ParseQuery("ubuntu")
+	sqlQuery, args := db.buildQueryTorrents(q, 1000, ByRelevance, true, 20, nil, nil, nil, SearchNames)
+	expectedArgs := []interface{}{"ubuntu", "ubuntu", "%ubuntu%", int64(1000), uint(20)}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Expected args to be %v, but got %v", expectedArgs, args)
+	}
+	for _, fragment := range []string{"name_tsv @@ tsq", "$2::TEXT <% name", "name ILIKE $3::TEXT", "discovered_on <= $4", "LIMIT $5", "ORDER BY relevance ASC"} {
+		if !strings.Contains(sqlQuery, fragment) {
+			t.Errorf("Expected the query to contain %q, but got %s", fragment, sqlQuery)
+		}
+	}
+	if strings.Contains(sqlQuery, "(relevance, id)") {
+		t.Error("The first page must not be constrained by the keyset")
+	}
+
+	category := Video
+	lastOrderedValue, lastID := 1.5, uint64(7)
+	db.trgm = false
+	q, _ = ParseQuery("")
+	sqlQuery, args = db.buildQueryTorrents(q, 1000, ByTotalSize, false, 20, &lastOrderedValue, &lastID, &category, SearchNamesAndFiles)
+	expectedArgs = []interface{}{int64(1000), int16(Video), 1.5, uint64(7), uint(20)}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Expected args to be %v, but got %v", expectedArgs, args)
+	}
+	for _, fragment := range []string{"0::FLOAT8 AS relevance", "category = $2::SMALLINT", "(total_size, id) < ($3, $4)", "LIMIT $5"} {
+		if !strings.Contains(sqlQuery, fragment) {
+			t.Errorf("Expected the query to contain %q, but got %s", fragment, sqlQuery)
+		}
+	}
+	if strings.Contains(sqlQuery, "tsq") || strings.Contains(sqlQuery, "<%") || strings.Contains(sqlQuery, "file_matches") {
+		t.Error("The query must not search when no query is supplied")
+	}
+
+	q, _ = ParseQuery("ubuntu")
+	sqlQuery, args = db.buildQueryTorrents(q, 1000, ByRelevance, true, 20, nil, nil, nil, SearchFiles)
+	expectedArgs = []interface{}{"ubuntu", int64(1000), uint(20)}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Expected args to be %v, but got %v", expectedArgs, args)
+	}
+	for _, fragment := range []string{"WITH file_matches AS", pathTSVector + " @@ tsq", "file_matches.torrent_id IS NOT NULL", "file_matches.paths::TEXT AS matched_files"} {
+		if !strings.Contains(sqlQuery, fragment) {
+			t.Errorf("Expected the query to contain %q, but got %s", fragment, sqlQuery)
+		}
+	}
+	if strings.Contains(sqlQuery, "name_tsv @@ tsq") {
+		t.Error("The names must not be searched when only the files are")
+	}
+
+	q, _ = ParseQuery(`"50%_off" -cam size:>=1KiB files:<3 ext:mkv after:2024-01-01`)
+	sqlQuery, args = db.buildQueryTorrents(q, 1000, ByDiscoveredOn, true, 20, nil, nil, nil, SearchNames)
+	expectedArgs = []interface{}{
+		"50%_off", "50%_off", `%50\%\_off%`, int64(1000), "cam", int64(1024), int64(3), "%.mkv", int64(1704067200), uint(20),
+	}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Expected args to be %v, but got %v", expectedArgs, args)
+	}
+	for _, fragment := range []string{"NOT (name_tsv @@ (phraseto_tsquery('simple', regexp_replace($5::TEXT", "total_size >= $6", "n_files < $7", "files.path ILIKE $8", "discovered_on >= $9"} {
+		if !strings.Contains(sqlQuery, fragment) {
+			t.Errorf("Expected the query to contain %q, but got %s", fragment, sqlQuery)
+		}
+	}
+
+	q, _ = ParseQuery("tag:Linux is:starred")
+	sqlQuery, args = db.buildQueryTorrents(q, 1000, ByDiscoveredOn, true, 20, nil, nil, nil, SearchNames)
+	expectedArgs = []interface{}{int64(1000), "linux", uint(20)}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Expected args to be %v, but got %v", expectedArgs, args)
+	}
+	for _, fragment := range []string{"torrent_tags.torrent_id = torrents.id AND tags.name = $2::TEXT", "starred"} {
+		if !strings.Contains(sqlQuery, fragment) {
+			t.Errorf("Expected the query to contain %q, but got %s", fragment, sqlQuery)
+		}
+	}
+}
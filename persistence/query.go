@@ -0,0 +1,284 @@
+package persistence
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Query is a parsed search query, see ParseQuery.
+type Query struct {
+	// Terms are the words and phrases that the torrents must all match.
+	Terms []string
+	// Excluded are the words and phrases that the torrents must not match.
+	Excluded []string
+	// Size are the comparisons that the total size of the torrents must all satisfy, in bytes.
+	Size []Comparison
+	// NFiles are the comparisons that the number of files of the torrents must all satisfy.
+	NFiles []Comparison
+	// Extensions are the (lowercase) file extensions, without the leading dot, of which the
+	// torrents must have at least one file.
+	Extensions []string
+	// After, if not nil, is the time on or after which the torrents must have been discovered.
+	After *time.Time
+	// Before, if not nil, is the time before which the torrents must have been discovered.
+	Before *time.Time
+	// Tags are the tags that the torrents must all be tagged with, see NormaliseTag.
+	Tags []string
+	// Starred is whether the torrents must be starred.
+	Starred bool
+}
+
+// Comparison is a comparison against a value, such as `>= 1024`.
+type Comparison struct {
+	// Operator is one of `<`, `<=`, `=`, `>=`, and `>`.
+	Operator string
+	Value    uint64
+}
+
+// QueryError is returned by ParseQuery for malformed queries. Its message is meant for the users.
+type QueryError struct {
+	Token  string
+	Reason string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("malformed search query at `%s`: %s", e.Token, e.Reason)
+}
+
+// SearchError is returned by QueryTorrents for the searches that the database cannot run, such as
+// an ordering of the torrents that it does not record. Its message is meant for the users.
+type SearchError struct {
+	Reason string
+}
+
+func (e *SearchError) Error() string {
+	return e.Reason
+}
+
+var sizeUnits = map[string]uint64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ParseQuery parses the search query syntax, which is portable across all the backends:
+//
+//	word            torrents matching the word
+//	"some phrase"   torrents matching the words in that order
+//	-word           torrents not matching the word (or -"some phrase")
+//	size:>1GiB      torrents of the given total size (units are B, KB, MB, GB, TB, and KiB, MiB,
+//	                GiB, TiB; operators are <, <=, =, >=, and >, the default being =)
+//	files:>10       torrents of the given number of files (same operators as size:)
+//	ext:mkv         torrents with at least one file of any of the given extensions
+//	after:2024-01-01, before:2024-02-01
+//	                torrents discovered on or after, or before, the given day (UTC)
+//	tag:name        torrents tagged with the given tag
+//	is:starred      torrents that are starred
+//
+// Words and phrases are matched as per the full-text index of the backend; those that consist of
+// punctuation only are ignored since they cannot match anything. Unknown prefixes such as `re:` are
+// taken as part of the words, as they might well be.
+func ParseQuery(s string) (*Query, error) {
+	q := new(Query)
+
+	for rest := strings.TrimSpace(s); rest != ""; rest = strings.TrimLeftFunc(rest, unicode.IsSpace) {
+		var token string
+		exclude := strings.HasPrefix(rest, "-")
+		if exclude {
+			rest = rest[1:]
+		}
+
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				return nil, &QueryError{Token: rest, Reason: "unterminated phrase"}
+			}
+			token, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end == -1 {
+				end = len(rest)
+			}
+			token, rest = rest[:end], rest[end:]
+
+			if !exclude {
+				isFilter, err := q.parseFilter(token)
+				if err != nil {
+					return nil, err
+				} else if isFilter {
+					continue
+				}
+			}
+		}
+
+		if strings.IndexFunc(token, isAlphanumeric) == -1 {
+			continue
+		}
+		if exclude {
+			q.Excluded = append(q.Excluded, token)
+		} else {
+			q.Terms = append(q.Terms, token)
+		}
+	}
+
+	return q, nil
+}
+
+// HasTerms reports whether the query has any words or phrases that the torrents must match, without
+// which the torrents cannot be ordered by relevance.
+func (q *Query) HasTerms() bool {
+	return len(q.Terms) != 0
+}
+
+// parseFilter parses the token if it is a filter (e.g. `size:>1GiB`), and returns false otherwise.
+func (q *Query) parseFilter(token string) (bool, error) {
+	key, value, found := strings.Cut(token, ":")
+	if !found {
+		return false, nil
+	}
+
+	var err error
+	switch strings.ToLower(key) {
+	case "size":
+		var c Comparison
+		if c, err = parseComparison(value, ParseSize); err == nil {
+			q.Size = append(q.Size, c)
+		}
+
+	case "files":
+		var c Comparison
+		if c, err = parseComparison(value, parseCount); err == nil {
+			q.NFiles = append(q.NFiles, c)
+		}
+
+	case "ext":
+		ext := strings.ToLower(strings.TrimPrefix(value, "."))
+		if ext == "" || strings.IndexFunc(ext, func(r rune) bool { return !isAlphanumeric(r) }) != -1 {
+			err = fmt.Errorf("extensions must consist of letters and digits only")
+		} else {
+			q.Extensions = append(q.Extensions, ext)
+		}
+
+	case "after":
+		var t time.Time
+		if t, err = parseDate(value); err == nil {
+			q.After = &t
+		}
+
+	case "before":
+		var t time.Time
+		if t, err = parseDate(value); err == nil {
+			q.Before = &t
+		}
+
+	case "tag":
+		var tag string
+		if tag, err = NormaliseTag(value); err == nil {
+			q.Tags = append(q.Tags, tag)
+		}
+
+	case "is":
+		if strings.ToLower(value) == "starred" {
+			q.Starred = true
+		} else {
+			err = fmt.Errorf("only is:starred is supported")
+		}
+
+	default:
+		return false, nil
+	}
+
+	if err != nil {
+		return false, &QueryError{Token: token, Reason: err.Error()}
+	}
+	return true, nil
+}
+
+func parseComparison(s string, parseValue func(string) (uint64, error)) (Comparison, error) {
+	c := Comparison{Operator: "="}
+	// Two-character operators must be tried first.
+	for _, operator := range []string{"<=", ">=", "<", ">", "="} {
+		if value, found := strings.CutPrefix(s, operator); found {
+			c.Operator, s = operator, value
+			break
+		}
+	}
+
+	var err error
+	c.Value, err = parseValue(s)
+	return c, err
+}
+
+// ParseSize parses a size of the search query syntax, a (decimal) number followed by a unit (e.g.
+// 1.5GiB), into bytes. Its error is meant for the users.
+func ParseSize(s string) (uint64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+	if i == -1 {
+		i = len(s)
+	}
+
+	unit, known := sizeUnits[strings.ToLower(s[i:])]
+	if !known {
+		return 0, fmt.Errorf("unknown size unit `%s`", s[i:])
+	}
+	number, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("sizes must be a (decimal) number followed by a unit, such as 1.5GiB")
+	}
+	if number*float64(unit) >= math.MaxInt64 {
+		return 0, fmt.Errorf("size is too large")
+	}
+
+	return uint64(number * float64(unit)), nil
+}
+
+func parseCount(s string) (uint64, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("the number of files must be a non-negative integer")
+	}
+	return n, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("dates must be in the YYYY-MM-DD format")
+	}
+	return t, nil
+}
+
+// maxTagLength is the maximum length of the tags, in characters.
+const maxTagLength = 64
+
+// NormaliseTag returns the tag in lowercase, or an error (meant for the users) if it is not valid:
+// tags consist of up to 64 letters, digits, dashes, and underscores.
+func NormaliseTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "", fmt.Errorf("tags must not be empty")
+	}
+	if utf8.RuneCountInString(tag) > maxTagLength {
+		return "", fmt.Errorf("tags must be at most %d characters long", maxTagLength)
+	}
+	if strings.IndexFunc(tag, func(r rune) bool { return !isAlphanumeric(r) && r != '-' && r != '_' }) != -1 {
+		return "", fmt.Errorf("tags must consist of letters, digits, dashes, and underscores only")
+	}
+	return tag, nil
+}
+
+func isAlphanumeric(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
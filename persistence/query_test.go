@@ -0,0 +1,67 @@
+package persistence
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	t.Parallel()
+
+	after := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query string
+		want  *Query
+	}{
+		{"", &Query{}},
+		{"  ubuntu   server ", &Query{Terms: []string{"ubuntu", "server"}}},
+		{`"ubuntu server" -desktop -"live cd"`, &Query{
+			Terms:    []string{"ubuntu server"},
+			Excluded: []string{"desktop", "live cd"},
+		}},
+		{"Artist - Album", &Query{Terms: []string{"Artist", "Album"}}},
+		{`foo"bar re:zero`, &Query{Terms: []string{`foo"bar`, "re:zero"}}},
+		{"size:>1.5GiB size:<=2GB files:10", &Query{
+			Size:   []Comparison{{">", 1610612736}, {"<=", 2000000000}},
+			NFiles: []Comparison{{"=", 10}},
+		}},
+		{"ext:MKV ext:.mp4 after:2024-01-01", &Query{Extensions: []string{"mkv", "mp4"}, After: &after}},
+		{"tag:Linux tag:to_seed is:Starred iso", &Query{Terms: []string{"iso"}, Tags: []string{"linux", "to_seed"}, Starred: true}},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) error = %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseQuery_Malformed(t *testing.T) {
+	t.Parallel()
+
+	for _, query := range []string{
+		`"ubuntu server`,
+		"size:>1XB",
+		"size:big",
+		"files:-1",
+		"ext:m*v",
+		"ext:",
+		"after:yesterday",
+		"before:2024-13-01",
+		"tag:",
+		"tag:foo/bar",
+		"is:seeded",
+	} {
+		_, err := ParseQuery(query)
+		var queryError *QueryError
+		if !errors.As(err, &queryError) {
+			t.Errorf("ParseQuery(%q) error = %v, want a QueryError", query, err)
+		}
+	}
+}
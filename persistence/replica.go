@@ -0,0 +1,118 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// replicatedDatabase routes the reads of searching and browsing (QueryTorrents, GetTorrent,
+// GetFiles, GetFilesOfTorrents, and GetStatistics) to a read-only replica of the database, and
+// everything else to the primary, so that heavy search traffic does not compete with the ingestion
+// of torrents. The reads that writes depend on, such as DoesTorrentExist, are not routed as the
+// replica lags behind.
+type replicatedDatabase struct {
+	Database
+	replica Database
+}
+
+// replicable is implemented by the engines whose databases can have read-only replicas.
+type replicable interface {
+	// openReplica connects to the database of the given URL, which must be a replica of this one
+	// hence migrated to the latest schema, without setting it up.
+	openReplica(url_ *url.URL) (Database, error)
+}
+
+// schemeEngines are the engines selected by the schemes of the URLs, see MakeDatabase.
+var schemeEngines = map[string]databaseEngine{
+	"sqlite":    Sqlite3,
+	"sqlite3":   Sqlite3,
+	"postgres":  Postgres,
+	"cockroach": Cockroach,
+	"bolt":      Bolt,
+	"bbolt":     Bolt,
+}
+
+// makeReplicatedDatabase opens the replica of the given URL of the primary database.
+func makeReplicatedDatabase(primary Database, rawURL string) (Database, error) {
+	url_, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("url.Parse " + err.Error())
+	}
+	if engine, ok := schemeEngines[url_.Scheme]; !ok {
+		return nil, fmt.Errorf("unknown URI scheme: `%s`", url_.Scheme)
+	} else if engine != primary.Engine() {
+		return nil, fmt.Errorf("the replica must be of the engine of the database, not `%s`", url_.Scheme)
+	}
+
+	r, ok := primary.(replicable)
+	if !ok {
+		return nil, fmt.Errorf("`%s` databases cannot have replicas", url_.Scheme)
+	}
+	replica, err := r.openReplica(url_)
+	if err != nil {
+		return nil, err
+	}
+
+	return &replicatedDatabase{Database: primary, replica: replica}, nil
+}
+
+func (db *replicatedDatabase) Close() error {
+	replicaErr := db.replica.Close()
+	if err := db.Database.Close(); err != nil {
+		return err
+	}
+	return replicaErr
+}
+
+func (db *replicatedDatabase) QueryTorrents(
+	ctx context.Context,
+	query string,
+	epoch int64,
+	orderBy OrderingCriteria,
+	ascending bool,
+	limit uint,
+	lastOrderedValue *float64,
+	lastID *uint64,
+	category *Category,
+	scope SearchScope,
+) ([]TorrentMetadata, error) {
+	return db.replica.QueryTorrents(ctx, query, epoch, orderBy, ascending, limit, lastOrderedValue, lastID, category, scope)
+}
+
+func (db *replicatedDatabase) GetTorrent(ctx context.Context, infoHash []byte) (*TorrentMetadata, error) {
+	return db.replica.GetTorrent(ctx, infoHash)
+}
+
+func (db *replicatedDatabase) GetFiles(ctx context.Context, infoHash []byte) ([]File, error) {
+	return db.replica.GetFiles(ctx, infoHash)
+}
+
+func (db *replicatedDatabase) GetFilesOfTorrents(ctx context.Context, infoHashes [][]byte) (map[string][]File, error) {
+	return db.replica.GetFilesOfTorrents(ctx, infoHashes)
+}
+
+func (db *replicatedDatabase) GetStatistics(ctx context.Context, from string, n uint) (*Statistics, error) {
+	return db.replica.GetStatistics(ctx, from, n)
+}
+
+// checkReplicaSchema returns an error unless the schema of the replica is of the latest version, as
+// the queries are of the latest schema whereas replicas cannot be migrated.
+func checkReplicaSchema(replica *sql.DB, migrations []migration, versioner schemaVersioner) error {
+	tx, err := replica.Begin()
+	if err != nil {
+		return errors.New("sql.DB.Begin " + err.Error())
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	version, err := versioner.get(tx)
+	if err != nil {
+		return errors.New("schema version " + err.Error())
+	}
+	if version != len(migrations) {
+		return fmt.Errorf("the schema version %d of the replica is not the latest one (%d), migrate the database first", version, len(migrations))
+	}
+	return nil
+}
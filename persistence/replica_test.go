@@ -0,0 +1,131 @@
+package persistence
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMakeDatabase_Replica(t *testing.T) {
+	ctx := context.Background()
+	t.Parallel()
+
+	dir := t.TempDir()
+	primaryPath, replicaPath := filepath.Join(dir, "primary.sqlite3"), filepath.Join(dir, "replica.sqlite3")
+
+	primary, err := makeSqlite3Database(&url.URL{Scheme: "sqlite3", Path: primaryPath})
+	if err != nil {
+		t.Fatalf("makeSqlite3Database() error = %v", err)
+	}
+	if err = primary.AddNewTorrent(ctx, []byte("replicated"), "replicated", []File{{Size: 1, Path: "a"}}, Uncategorised); err != nil {
+		t.Fatalf("sqlite3Database.AddNewTorrent() error = %v", err)
+	}
+	primary.Close()
+
+	// The replica is a copy of the primary, which then goes ahead of it.
+	copyFile(t, primaryPath, replicaPath)
+	db, err := MakeDatabase("sqlite3://"+primaryPath, "sqlite3://"+replicaPath)
+	if err != nil {
+		t.Fatalf("MakeDatabase() error = %v", err)
+	}
+	defer db.Close()
+	if err = db.AddNewTorrent(ctx, []byte("not replicated"), "not replicated", []File{{Size: 1, Path: "b"}}, Uncategorised); err != nil {
+		t.Fatalf("AddNewTorrent() error = %v", err)
+	}
+
+	// Writes, and the reads they depend on, go to the primary.
+	if exists, err := db.DoesTorrentExist(ctx, []byte("not replicated")); err != nil || !exists {
+		t.Errorf("DoesTorrentExist() = %v, %v, want true", exists, err)
+	}
+	// Searching and browsing go to the replica.
+	if tm, err := db.GetTorrent(ctx, []byte("not replicated")); err != nil || tm != nil {
+		t.Errorf("GetTorrent() of a torrent not replicated = %v, %v, want nil", tm, err)
+	}
+	if tm, err := db.GetTorrent(ctx, []byte("replicated")); err != nil || tm == nil {
+		t.Errorf("GetTorrent() of a replicated torrent = %v, %v, want the torrent", tm, err)
+	}
+	got, err := db.QueryTorrents(ctx, "", time.Now().Unix(), ByDiscoveredOn, true, 10, nil, nil, nil, SearchNames)
+	if err != nil || len(got) != 1 || got[0].Name != "replicated" {
+		t.Errorf("QueryTorrents() = %v, %v, want the replicated torrent only", got, err)
+	}
+}
+
+func TestMakeDatabase_InvalidReplica(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	rawURL := "sqlite3://" + filepath.Join(dir, "primary.sqlite3")
+
+	for _, replicaURL := range []string{
+		// Not migrated.
+		"sqlite3://" + filepath.Join(dir, "empty.sqlite3"),
+		// Of another engine.
+		"bolt://" + filepath.Join(dir, "replica.bolt"),
+		"unknown://replica",
+	} {
+		if db, err := MakeDatabase(rawURL, replicaURL); err == nil {
+			db.Close()
+			t.Errorf("MakeDatabase() with the replica %s error = nil", replicaURL)
+		}
+	}
+
+	boltURL := "bolt://" + filepath.Join(dir, "primary.bolt")
+	if db, err := MakeDatabase(boltURL, boltURL); err == nil {
+		db.Close()
+		t.Error("MakeDatabase() of bolt with a replica error = nil")
+	}
+}
+
+func Test_popPoolOptions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		rawQuery         string
+		maxOpen, maxIdle int
+		wantErr          bool
+	}{
+		{"", 3, 3, false},
+		{"max_open_conns=10&sslmode=disable", 10, 10, false},
+		{"max_open_conns=10&max_idle_conns=2", 10, 2, false},
+		{"max_idle_conns=5", 3, 3, false},
+		{"max_idle_conns=0", 3, 0, false},
+		{"max_open_conns=0", 0, 0, true},
+		{"max_open_conns=many", 0, 0, true},
+	}
+	for _, tt := range tests {
+		url_ := &url.URL{Scheme: "postgres", Host: "localhost", RawQuery: tt.rawQuery}
+		maxOpen, maxIdle, err := popPoolOptions(url_)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("popPoolOptions(%q) error = %v, wantErr %v", tt.rawQuery, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (maxOpen != tt.maxOpen || maxIdle != tt.maxIdle) {
+			t.Errorf("popPoolOptions(%q) = %d, %d, want %d, %d", tt.rawQuery, maxOpen, maxIdle, tt.maxOpen, tt.maxIdle)
+		}
+		if err == nil && (url_.Query().Has("max_open_conns") || url_.Query().Has("max_idle_conns")) {
+			t.Errorf("popPoolOptions(%q) left the options in the URL %s", tt.rawQuery, url_)
+		}
+	}
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatalf("os.Open() error = %v", err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatalf("os.Create() error = %v", err)
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, in); err != nil {
+		t.Fatalf("io.Copy() error = %v", err)
+	}
+}
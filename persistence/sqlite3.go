@@ -2,11 +2,13 @@ package persistence
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
 	"net/url"
+	"regexp"
 	"strings"
 	"text/template"
 	"time"
@@ -19,27 +21,68 @@ import (
 
 type sqlite3Database struct {
 	conn *sql.DB
+	// filesIndex is whether the `files_idx` FTS5 virtual table exists, see setupFilesIndex.
+	filesIndex bool
 }
 
 func makeSqlite3Database(url_ *url.URL) (Database, error) {
+	db, filesIndex, err := openSqlite3(url_)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.setupDatabase(false); err != nil {
+		_ = db.conn.Close()
+		return nil, errors.New("setupDatabase " + err.Error())
+	}
+
+	if err := db.setupFilesIndex(filesIndex); err != nil {
+		_ = db.conn.Close()
+		return nil, errors.New("setupFilesIndex " + err.Error())
+	}
+
+	return db, nil
+}
+
+// openSqlite3 connects to the database of the given URL, without setting it up, and returns whether
+// its files are to be indexed.
+func openSqlite3(url_ *url.URL) (*sqlite3Database, bool, error) {
 	db := new(sqlite3Database)
 
-	var err error
+	filesIndex, err := popFilesIndexOption(url_)
+	if err != nil {
+		return nil, false, err
+	}
+	maxOpen, maxIdle, err := popPoolOptions(url_)
+	if err != nil {
+		return nil, false, err
+	}
+	if maxOpen < 2 {
+		return nil, false, fmt.Errorf("max_open_conns must be at least 2 on SQLite, not %d", maxOpen)
+	}
+
 	// To handle spaces in the file path, we ensure that URI path handling is triggered in the
 	// sqlite3 driver, and that escaping is applied to the URL on this side. See issue #240.
 	url_.Scheme = "file"
 	// To ensure that // isn't injected into the URI. The query is still handled.
 	url_.Opaque = url_.Path
+	// PRAGMA foreign_keys (see setupDatabase) applies only to the connection it is executed on,
+	// whereas the driver executes it for every new connection of the pool if asked so. Without it
+	// ON DELETE CASCADE would be left to chance.
+	query := url_.Query()
+	query.Set("_foreign_keys", "1")
+	url_.RawQuery = query.Encode()
 	db.conn, err = sql.Open("sqlite3", url_.String())
 	if err != nil {
-		return nil, errors.New("sql.Open " + err.Error())
+		return nil, false, errors.New("sql.Open " + err.Error())
 	}
 
 	// > Open may just validate its arguments without creating a connection to the database. To
 	// > verify that the data source Name is valid, call Ping.
 	// https://golang.org/pkg/database/sql/#Open
 	if err = db.conn.Ping(); err != nil {
-		return nil, errors.New("sql.DB.Ping " + err.Error())
+		_ = db.conn.Close()
+		return nil, false, errors.New("sql.DB.Ping " + err.Error())
 	}
 
 	// > After some time we receive "unable to open database file" error while trying to execute a transaction using
@@ -57,25 +100,39 @@ func makeSqlite3Database(url_ *url.URL) (Database, error) {
 	// https://github.com/mattn/go-sqlite3/issues/618
 	//
 	// Our solution is to set the connection max lifetime to infinity (reuse connection forever), and max open
-	// connections to 3 (1 causes deadlocks, unlimited is too lax!). Max idle conns are set to 3 to persist connections
-	// (instead of opening the database again and again).
+	// connections to 3 by default (1 causes deadlocks, unlimited is too lax!). Max idle conns are set to as many to
+	// persist connections (instead of opening the database again and again). See popPoolOptions.
 	db.conn.SetConnMaxLifetime(0) // https://golang.org/pkg/database/sql/#DB.SetConnMaxLifetime
-	db.conn.SetMaxOpenConns(3)
-	db.conn.SetMaxIdleConns(3)
+	db.conn.SetMaxOpenConns(maxOpen)
+	db.conn.SetMaxIdleConns(maxIdle)
 
-	if err := db.setupDatabase(); err != nil {
-		return nil, errors.New("setupDatabase " + err.Error())
+	return db, filesIndex, nil
+}
+
+func (db *sqlite3Database) openReplica(url_ *url.URL) (Database, error) {
+	replica, _, err := openSqlite3(url_)
+	if err != nil {
+		return nil, err
 	}
 
-	return db, nil
+	if err = checkReplicaSchema(replica.conn, sqlite3Migrations, sqlite3Versioner); err != nil {
+		_ = replica.conn.Close()
+		return nil, err
+	}
+	if err = replica.setupFilesIndex(false); err != nil {
+		_ = replica.conn.Close()
+		return nil, errors.New("setupFilesIndex " + err.Error())
+	}
+
+	return replica, nil
 }
 
 func (db *sqlite3Database) Engine() databaseEngine {
 	return Sqlite3
 }
 
-func (db *sqlite3Database) DoesTorrentExist(infoHash []byte) (bool, error) {
-	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE info_hash = ?;", infoHash)
+func (db *sqlite3Database) DoesTorrentExist(ctx context.Context, infoHash []byte) (bool, error) {
+	rows, err := db.conn.QueryContext(ctx, "SELECT 1 FROM torrents WHERE info_hash = ?;", infoHash)
 	if err != nil {
 		return false, err
 	}
@@ -91,10 +148,23 @@ func (db *sqlite3Database) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return exists, nil
 }
 
-func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []File) error {
-	tx, err := db.conn.Begin()
+func (db *sqlite3Database) AddNewTorrent(ctx context.Context, infoHash []byte, name string, files []File, category Category) error {
+	return db.AddNewTorrents(ctx, []Torrent{{InfoHash: infoHash, Name: name, Files: files, Category: category}})
+}
+
+// sqlite3MaxFileRows is the number of files inserted per statement, as SQLite (before 3.32.0)
+// limits the number of variables of a statement to 999.
+const sqlite3MaxFileRows = 999 / 3
+
+func (db *sqlite3Database) AddNewTorrents(ctx context.Context, torrents []Torrent) error {
+	torrents = acceptableTorrents(torrents)
+	if len(torrents) == 0 {
+		return nil
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
 	if err != nil {
-		return errors.New("conn.Begin " + err.Error())
+		return errors.New("conn.BeginTx " + err.Error())
 	}
 	// If everything goes as planned and no error occurs, we will commit the transaction before
 	// returning from the function so the tx.Rollback() call will fail, trying to rollback a
@@ -102,18 +172,9 @@ func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []F
 	// is nice.
 	defer db.rollback(tx)
 
-	var totalSize uint64 = 0
-	for _, file := range files {
-		totalSize += uint64(file.Size)
-	}
-
-	// This is a workaround for a bug: the database will not accept total_size to be zero.
-	if totalSize == 0 {
-		return nil
-	}
-
 	// Although we check whether the torrent exists in the database before asking MetadataSink to
-	// fetch its metadata, the torrent can also exists in the Sink before that:
+	// fetch its metadata, the torrent can also exists in the Sink (or in the write buffer) before
+	// that:
 	//
 	// If the torrent is complete (i.e. its metadata) and if its waiting in the channel to be
 	// received, a race condition arises when we query the database and seeing that it doesn't
@@ -145,48 +206,88 @@ func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []F
 	//     INSERT OR REPLACE INTO is definitely much closer to what you may want, but deleting
 	//     pre-existing rows means that you might cause users loose data (such as seeder and leecher
 	//     information, readme, and so on) at the expense of /your/ own laziness...
-	if exist, err := db.DoesTorrentExist(infoHash); exist || err != nil {
-		return err
+	//
+	// Hence the existence of each torrent is checked within the transaction, before inserting it.
+	existsStmt, err := tx.PrepareContext(ctx, "SELECT 1 FROM torrents WHERE info_hash = ?;")
+	if err != nil {
+		return errors.New("tx.PrepareContext (SELECT 1 FROM torrents) " + err.Error())
 	}
+	defer existsStmt.Close()
 
-	res, err := tx.Exec(`
+	insertStmt, err := tx.PrepareContext(ctx, `
 		INSERT INTO torrents (
 			info_hash,
 			name,
 			total_size,
-			discovered_on
-		) VALUES (?, ?, ?, ?);
-	`, infoHash, name, totalSize, time.Now().Unix())
+			discovered_on,
+			category,
+			n_files,
+			n_initial_peers
+		) VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, 0));
+	`)
 	if err != nil {
-		return errors.New("tx.Exec (INSERT OR REPLACE INTO torrents) " + err.Error())
+		return errors.New("tx.PrepareContext (INSERT INTO torrents) " + err.Error())
 	}
+	defer insertStmt.Close()
+
+	var fileArgs, clientArgs []interface{}
+	for _, torrent := range torrents {
+		var one int
+		if err = existsStmt.QueryRowContext(ctx, torrent.InfoHash).Scan(&one); err == nil {
+			continue
+		} else if err != sql.ErrNoRows {
+			return errors.New("sql.Stmt.QueryRowContext (SELECT 1 FROM torrents) " + err.Error())
+		}
 
-	var lastInsertId int64
-	if lastInsertId, err = res.LastInsertId(); err != nil {
-		return errors.New("sql.Result.LastInsertId " + err.Error())
-	}
+		res, err := insertStmt.ExecContext(ctx, torrent.InfoHash, torrent.Name, torrent.totalSize(), torrent.DiscoveredOn, torrent.Category, len(torrent.Files), torrent.Swarm.NPeers)
+		if err != nil {
+			return errors.New("sql.Stmt.ExecContext (INSERT INTO torrents) " + err.Error())
+		}
 
-	// > last_insert_rowid()
-	// >   The last_insert_rowid() function returns the ROWID of the last row insert from the
-	// >   database connection which invoked the function. If no successful INSERTs into rowid
-	// >   tables have ever occurred on the database connection, then last_insert_rowid() returns
-	// >   zero.
-	// https://www.sqlite.org/lang_corefunc.html#last_insert_rowid
-	// https://www.sqlite.org/c3ref/last_insert_rowid.html
-	//
-	// Now, last_insert_rowid() should never return zero (or any negative values really) as we
-	// insert into torrents and handle any errors accordingly right afterwards.
-	if lastInsertId <= 0 {
-		log.Panicf("last_insert_rowid() <= 0 (this should have never happened!). lastInsertId: %d", lastInsertId)
+		var lastInsertId int64
+		if lastInsertId, err = res.LastInsertId(); err != nil {
+			return errors.New("sql.Result.LastInsertId " + err.Error())
+		}
+
+		// > last_insert_rowid()
+		// >   The last_insert_rowid() function returns the ROWID of the last row insert from the
+		// >   database connection which invoked the function. If no successful INSERTs into rowid
+		// >   tables have ever occurred on the database connection, then last_insert_rowid()
+		// >   returns zero.
+		// https://www.sqlite.org/lang_corefunc.html#last_insert_rowid
+		// https://www.sqlite.org/c3ref/last_insert_rowid.html
+		//
+		// Now, last_insert_rowid() should never return zero (or any negative values really) as we
+		// insert into torrents and handle any errors accordingly right afterwards.
+		if lastInsertId <= 0 {
+			log.Panicf("last_insert_rowid() <= 0 (this should have never happened!). lastInsertId: %d", lastInsertId)
+		}
+
+		for _, file := range torrent.Files {
+			fileArgs = append(fileArgs, lastInsertId, file.Size, file.Path)
+		}
+		for _, client := range torrent.Swarm.Clients {
+			clientArgs = append(clientArgs, lastInsertId, client)
+		}
 	}
 
-	for _, file := range files {
-		_, err = tx.Exec("INSERT INTO files (torrent_id, size, path) VALUES (?, ?, ?);",
-			lastInsertId, file.Size, file.Path,
-		)
+	// The files of all the torrents are inserted with as few (multi-row) statements as possible.
+	for len(fileArgs) != 0 {
+		n := min(len(fileArgs)/3, sqlite3MaxFileRows)
+		values := strings.TrimSuffix(strings.Repeat("(?, ?, ?), ", n), ", ")
+		if _, err = tx.ExecContext(ctx, "INSERT INTO files (torrent_id, size, path) VALUES "+values+";", fileArgs[:n*3]...); err != nil {
+			return errors.New("tx.ExecContext (INSERT INTO files) " + err.Error())
+		}
+		fileArgs = fileArgs[n*3:]
+	}
+	for len(clientArgs) != 0 {
+		n := min(len(clientArgs)/2, sqlite3MaxFileRows)
+		values := strings.TrimSuffix(strings.Repeat("(?, ?), ", n), ", ")
+		_, err = tx.ExecContext(ctx, "INSERT INTO peer_clients (torrent_id, client) VALUES "+values+" ON CONFLICT (torrent_id, client) DO NOTHING;", clientArgs[:n*2]...)
 		if err != nil {
-			return errors.New("tx.Exec (INSERT INTO files) " + err.Error())
+			return errors.New("tx.ExecContext (INSERT INTO peer_clients) " + err.Error())
 		}
+		clientArgs = clientArgs[n*2:]
 	}
 
 	err = tx.Commit()
@@ -201,10 +302,10 @@ func (db *sqlite3Database) Close() error {
 	return db.conn.Close()
 }
 
-func (db *sqlite3Database) GetNumberOfTorrents() (uint, error) {
+func (db *sqlite3Database) GetNumberOfTorrents(ctx context.Context) (uint, error) {
 	// COUNT(1) is much more inefficient since it scans the whole table, so use MAX(ROWID).
 	// Keep in mind that the value returned by GetNumberOfTorrents() might be an approximation.
-	rows, err := db.conn.Query("SELECT MAX(ROWID) FROM torrents;")
+	rows, err := db.conn.QueryContext(ctx, "SELECT MAX(ROWID) FROM torrents;")
 	if err != nil {
 		return 0, err
 	}
@@ -228,6 +329,7 @@ func (db *sqlite3Database) GetNumberOfTorrents() (uint, error) {
 }
 
 func (db *sqlite3Database) QueryTorrents(
+	ctx context.Context,
 	query string,
 	epoch int64,
 	orderBy OrderingCriteria,
@@ -235,16 +337,28 @@ func (db *sqlite3Database) QueryTorrents(
 	limit uint,
 	lastOrderedValue *float64,
 	lastID *uint64,
+	category *Category,
+	scope SearchScope,
 ) ([]TorrentMetadata, error) {
-	if query == "" && orderBy == ByRelevance {
-		return nil, fmt.Errorf("torrents cannot be ordered by relevance when the query is empty")
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkOrdering(q, orderBy); err != nil {
+		return nil, err
 	}
 	if (lastOrderedValue == nil) != (lastID == nil) {
 		return nil, fmt.Errorf("lastOrderedValue and lastID should be supplied together, if supplied")
 	}
+	if (q.HasTerms() || len(q.Excluded) != 0) && scope.files() && !db.filesIndex {
+		return nil, &SearchError{Reason: "file paths cannot be searched since they are not indexed"}
+	}
 
-	doJoin := query != ""
+	doJoin := q.HasTerms()
 	firstPage := lastID == nil
+	filterCategory := category != nil
+	match := fts5Match(q.Terms, " ")
+	filters, filterArgs := sqlite3Filters(q, scope)
 
 	// executeTemplate is used to prepare the SQL query, WITH PLACEHOLDERS FOR USER INPUT.
 	sqlQuery := executeTemplate(`
@@ -253,37 +367,81 @@ func (db *sqlite3Database) QueryTorrents(
 			 , name
 			 , total_size
 			 , discovered_on
-			 , (SELECT COUNT(*) FROM files WHERE torrents.id = files.torrent_id) AS n_files
+			 , n_files
 	{{ if .DoJoin }}
 			 , idx.rank
 	{{ else }}
 			 , 0
 	{{ end }}
+			 , category
 		FROM torrents
 	{{ if .DoJoin }}
+		-- Auxiliary functions such as bm25() cannot be used in aggregates, hence the LIMIT -1 of
+		-- the full-text queries which prevents them from being flattened into the GROUP BY query.
+		-- https://sqlite.org/optoverview.html#flattening
 		INNER JOIN (
-			SELECT rowid AS id
-				 , bm25(torrents_idx) AS rank
-			FROM torrents_idx
-			WHERE torrents_idx MATCH ?
+			SELECT id
+				 , MIN(rank) AS rank
+			FROM (
+		{{ if .SearchNames }}
+				SELECT *
+				FROM (
+					SELECT rowid AS id
+						 , bm25(torrents_idx) AS rank
+					FROM torrents_idx
+					WHERE torrents_idx MATCH ?
+					LIMIT -1
+				)
+		{{ end }}
+		{{ if and .SearchNames .SearchFiles }}
+				UNION ALL
+		{{ end }}
+		{{ if .SearchFiles }}
+				SELECT files.torrent_id AS id
+					 , matches.rank
+				FROM (
+					SELECT rowid
+						 , bm25(files_idx) AS rank
+					FROM files_idx
+					WHERE files_idx MATCH ?
+					LIMIT -1
+				) AS matches
+				INNER JOIN files ON files.id = matches.rowid
+		{{ end }}
+			)
+			GROUP BY id
 		) AS idx USING(id)
 	{{ end }}
 		WHERE     modified_on <= ?
+	{{ if .FilterCategory }}
+			  AND category = ?
+	{{ end }}
+	{{ range .Filters }}
+			  AND {{.}}
+	{{ end }}
 	{{ if not .FirstPage }}
 			  AND ( {{.OrderOn}}, id ) {{GTEorLTE .Ascending}} (?, ?) -- https://www.sqlite.org/rowvalue.html#row_value_comparisons
 	{{ end }}
 		ORDER BY {{.OrderOn}} {{AscOrDesc .Ascending}}, id {{AscOrDesc .Ascending}}
 		LIMIT ?;	
 	`, struct {
-		DoJoin    bool
-		FirstPage bool
-		OrderOn   string
-		Ascending bool
+		DoJoin         bool
+		SearchNames    bool
+		SearchFiles    bool
+		FirstPage      bool
+		FilterCategory bool
+		Filters        []string
+		OrderOn        string
+		Ascending      bool
 	}{
-		DoJoin:    doJoin,
-		FirstPage: firstPage,
-		OrderOn:   orderOn(orderBy),
-		Ascending: ascending,
+		DoJoin:         doJoin,
+		SearchNames:    scope.names(),
+		SearchFiles:    scope.files(),
+		FirstPage:      firstPage,
+		FilterCategory: filterCategory,
+		Filters:        filters,
+		OrderOn:        orderOn(orderBy),
+		Ascending:      ascending,
 	}, template.FuncMap{
 		"GTEorLTE": func(ascending bool) string {
 			if ascending {
@@ -303,21 +461,28 @@ func (db *sqlite3Database) QueryTorrents(
 
 	// Prepare query
 	queryArgs := make([]interface{}, 0)
-	if doJoin {
-		queryArgs = append(queryArgs, query)
+	if doJoin && scope.names() {
+		queryArgs = append(queryArgs, match)
+	}
+	if doJoin && scope.files() {
+		queryArgs = append(queryArgs, match)
 	}
 	queryArgs = append(queryArgs, epoch)
+	if filterCategory {
+		queryArgs = append(queryArgs, *category)
+	}
+	queryArgs = append(queryArgs, filterArgs...)
 	if !firstPage {
 		queryArgs = append(queryArgs, lastOrderedValue)
 		queryArgs = append(queryArgs, lastID)
 	}
 	queryArgs = append(queryArgs, limit)
 
-	rows, err := db.conn.Query(sqlQuery, queryArgs...)
-	defer closeRows(rows)
+	rows, err := db.conn.QueryContext(ctx, sqlQuery, queryArgs...)
 	if err != nil {
 		return nil, errors.New("query error " + err.Error())
 	}
+	defer closeRows(rows)
 
 	torrents := make([]TorrentMetadata, 0)
 	for rows.Next() {
@@ -330,16 +495,144 @@ func (db *sqlite3Database) QueryTorrents(
 			&torrent.DiscoveredOn,
 			&torrent.NFiles,
 			&torrent.Relevance,
+			&torrent.Category,
 		)
 		if err != nil {
 			return nil, err
 		}
 		torrents = append(torrents, torrent)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	closeRows(rows)
+
+	if doJoin && scope.files() && len(torrents) != 0 {
+		if err = db.fillMatchedFiles(ctx, match, torrents); err != nil {
+			return nil, errors.New("fillMatchedFiles " + err.Error())
+		}
+	}
 
 	return torrents, nil
 }
 
+// fillMatchedFiles sets the MatchedFiles of the torrents, which is done separately from the query
+// since the JSON1 extension (to aggregate the paths) might not be available.
+func (db *sqlite3Database) fillMatchedFiles(ctx context.Context, match string, torrents []TorrentMetadata) error {
+	queryArgs := make([]interface{}, 0, len(torrents)+1)
+	queryArgs = append(queryArgs, match)
+	byID := make(map[uint64]*TorrentMetadata, len(torrents))
+	for i := range torrents {
+		queryArgs = append(queryArgs, torrents[i].ID)
+		byID[torrents[i].ID] = &torrents[i]
+	}
+
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT files.torrent_id
+			 , files.path
+		FROM files_idx
+		INNER JOIN files ON files.id = files_idx.rowid
+		WHERE files_idx MATCH ?
+		  AND files.torrent_id IN (?`+strings.Repeat(", ?", len(torrents)-1)+`)
+		ORDER BY files.path;`,
+		queryArgs...,
+	)
+	if err != nil {
+		return err
+	}
+	defer closeRows(rows)
+
+	for rows.Next() {
+		var id uint64
+		var path string
+		if err = rows.Scan(&id, &path); err != nil {
+			return err
+		}
+		if torrent, exists := byID[id]; exists {
+			torrent.MatchedFiles = append(torrent.MatchedFiles, path)
+		}
+	}
+
+	return rows.Err()
+}
+
+// fts5Match returns the FTS5 query that matches the terms (as phrases, so that no character of
+// theirs can be taken as an operator), joined by the given operator (a space for AND).
+func fts5Match(terms []string, operator string) string {
+	phrases := make([]string, len(terms))
+	for i, term := range terms {
+		phrases[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	return strings.Join(phrases, operator)
+}
+
+// sqlite3Filters returns the conditions on the `torrents` table of the query other than its terms,
+// WITH PLACEHOLDERS FOR USER INPUT, and their arguments in order.
+func sqlite3Filters(q *Query, scope SearchScope) ([]string, []interface{}) {
+	var filters []string
+	var args []interface{}
+
+	if len(q.Excluded) != 0 {
+		excluded := fts5Match(q.Excluded, " OR ")
+		if scope.names() {
+			filters = append(filters, "id NOT IN (SELECT rowid FROM torrents_idx WHERE torrents_idx MATCH ?)")
+			args = append(args, excluded)
+		}
+		if scope.files() {
+			filters = append(filters, `id NOT IN (
+				SELECT files.torrent_id
+				FROM files_idx
+				INNER JOIN files ON files.id = files_idx.rowid
+				WHERE files_idx MATCH ? AND files.torrent_id IS NOT NULL
+			)`)
+			args = append(args, excluded)
+		}
+	}
+
+	for _, c := range q.Size {
+		filters = append(filters, "total_size "+c.Operator+" ?")
+		args = append(args, c.Value)
+	}
+	for _, c := range q.NFiles {
+		filters = append(filters, "n_files "+c.Operator+" ?")
+		args = append(args, c.Value)
+	}
+
+	if len(q.Extensions) != 0 {
+		// Extensions consist of letters and digits only, hence there is nothing to escape.
+		conditions := make([]string, len(q.Extensions))
+		for i, ext := range q.Extensions {
+			conditions[i] = "path LIKE ?"
+			args = append(args, "%."+ext)
+		}
+		filters = append(filters, "EXISTS (SELECT 1 FROM files WHERE files.torrent_id = torrents.id AND ("+strings.Join(conditions, " OR ")+"))")
+	}
+
+	if q.After != nil {
+		filters = append(filters, "discovered_on >= ?")
+		args = append(args, q.After.Unix())
+	}
+	if q.Before != nil {
+		filters = append(filters, "discovered_on < ?")
+		args = append(args, q.Before.Unix())
+	}
+
+	for _, tag := range q.Tags {
+		filters = append(filters, `EXISTS (
+			SELECT 1
+			FROM torrent_tags
+			INNER JOIN tags ON tags.id = torrent_tags.tag_id
+			WHERE torrent_tags.torrent_id = torrents.id AND tags.name = ?
+		)`)
+		args = append(args, tag)
+	}
+	if q.Starred {
+		filters = append(filters, "starred = 1")
+	}
+
+	return filters, args
+}
+
 func orderOn(orderBy OrderingCriteria) string {
 	switch orderBy {
 	case ByRelevance:
@@ -359,14 +652,15 @@ func orderOn(orderBy OrderingCriteria) string {
 	}
 }
 
-func (db *sqlite3Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error) {
-	rows, err := db.conn.Query(`
+func (db *sqlite3Database) GetTorrent(ctx context.Context, infoHash []byte) (*TorrentMetadata, error) {
+	rows, err := db.conn.QueryContext(ctx, `
 		SELECT
 			info_hash,
 			name,
 			total_size,
 			discovered_on,
-			(SELECT COUNT(*) FROM files WHERE torrent_id = torrents.id) AS n_files
+			n_files,
+			category
 		FROM torrents
 		WHERE info_hash = ?`,
 		infoHash,
@@ -381,16 +675,16 @@ func (db *sqlite3Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error)
 	}
 
 	var tm TorrentMetadata
-	if err = rows.Scan(&tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles); err != nil {
+	if err = rows.Scan(&tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles, &tm.Category); err != nil {
 		return nil, err
 	}
 
 	return &tm, nil
 }
 
-func (db *sqlite3Database) GetFiles(infoHash []byte) ([]File, error) {
-	rows, err := db.conn.Query(
-		"SELECT size, path FROM files, torrents WHERE files.torrent_id = torrents.id AND torrents.info_hash = ?;",
+func (db *sqlite3Database) GetFiles(ctx context.Context, infoHash []byte) ([]File, error) {
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT size, path FROM files, torrents WHERE files.torrent_id = torrents.id AND torrents.info_hash = ? ORDER BY files.id;",
 		infoHash)
 	defer closeRows(rows)
 	if err != nil {
@@ -405,75 +699,664 @@ func (db *sqlite3Database) GetFiles(infoHash []byte) ([]File, error) {
 		}
 		files = append(files, file)
 	}
+	// Otherwise the files read so far would be returned as all of them, if the context is done
+	// in the meantime.
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (db *sqlite3Database) GetFilesOfTorrents(ctx context.Context, infoHashes [][]byte) (map[string][]File, error) {
+	files := make(map[string][]File, len(infoHashes))
+	err := forEachChunk(infoHashes, func(args []interface{}) error {
+		rows, err := db.conn.QueryContext(ctx, `
+			SELECT torrents.info_hash, files.size, files.path
+			FROM files
+			INNER JOIN torrents ON torrents.id = files.torrent_id
+			WHERE torrents.info_hash IN (?`+strings.Repeat(", ?", len(args)-1)+`)
+			ORDER BY files.id;`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		defer closeRows(rows)
+
+		for rows.Next() {
+			var infoHash []byte
+			var file File
+			if err = rows.Scan(&infoHash, &file.Size, &file.Path); err != nil {
+				return err
+			}
+			files[string(infoHash)] = append(files[string(infoHash)], file)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	return files, nil
 }
 
-func (db *sqlite3Database) GetStatistics(from string, n uint) (*Statistics, error) {
+func (db *sqlite3Database) GetStatistics(ctx context.Context, from string, n uint) (*Statistics, error) {
 	fromTime, gran, err := ParseISO8601(from)
 	if err != nil {
 		return nil, errors.New("parsing ISO8601 error " + err.Error())
 	}
-
-	var toTime time.Time
-	var timef string // time format: https://www.sqlite.org/lang_datefunc.html
-
-	switch gran {
-	case Year:
-		toTime = fromTime.AddDate(int(n), 0, 0)
-		timef = "%Y"
-	case Month:
-		toTime = fromTime.AddDate(0, int(n), 0)
-		timef = "%Y-%m"
-	case Week:
-		toTime = fromTime.AddDate(0, 0, int(n)*7)
-		timef = "%Y-%W"
-	case Day:
-		toTime = fromTime.AddDate(0, 0, int(n))
-		timef = "%Y-%m-%d"
-	case Hour:
-		toTime = fromTime.Add(time.Duration(n) * time.Hour)
-		timef = "%Y-%m-%dT%H"
-	}
-
-	// TODO: make it faster!
-	rows, err := db.conn.Query(fmt.Sprintf(`
-			SELECT strftime('%s', discovered_on, 'unixepoch') AS dT
-                 , sum(files.size) AS tS
-                 , count(DISTINCT torrents.id) AS nD              
-                 , count(DISTINCT files.id) AS nF
-			FROM torrents, files
- 			WHERE     torrents.id = files.torrent_id
-                  AND discovered_on >= ?
-                  AND discovered_on <= ?
-			GROUP BY dt;`,
-		timef),
+	toTime := statisticsEnd(*fromTime, gran, n)
+
+	// Statistics are served from the hourly aggregates (kept up to date by triggers), which are
+	// summed up into the periods of the granularity. As the periods end on the last second of an
+	// hour, the hours within them start after the beginning and not after the end.
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT hour, n_discovered, n_files, total_size
+		FROM statistics_hourly
+		WHERE hour > ? AND hour <= ? AND n_discovered > 0;`,
 		fromTime.Unix(), toTime.Unix())
-	defer closeRows(rows)
 	if err != nil {
 		return nil, err
 	}
+	defer closeRows(rows)
+
+	return scanStatistics(rows, gran)
+}
+
+func (db *sqlite3Database) RecordSwarm(ctx context.Context, infoHash []byte, swarm Swarm) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.New("conn.BeginTx " + err.Error())
+	}
+	defer db.rollback(tx)
+
+	var torrentID int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM torrents WHERE info_hash = ?;", infoHash).Scan(&torrentID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return errors.New("tx.QueryRowContext (SELECT id FROM torrents) " + err.Error())
+	}
+
+	if swarm.NPeers > 0 {
+		_, err = tx.ExecContext(ctx, "UPDATE torrents SET n_initial_peers = ? WHERE id = ? AND n_initial_peers IS NULL;",
+			swarm.NPeers, torrentID,
+		)
+		if err != nil {
+			return errors.New("tx.ExecContext (UPDATE torrents) " + err.Error())
+		}
+	}
 
-	stats := NewStatistics()
+	for _, client := range swarm.Clients {
+		// Only the uniqueness of (torrent_id, client) is meant to be ignored here, unlike INSERT
+		// OR IGNORE INTO (see AddNewTorrent).
+		_, err = tx.ExecContext(ctx, "INSERT INTO peer_clients (torrent_id, client) VALUES (?, ?) ON CONFLICT (torrent_id, client) DO NOTHING;",
+			torrentID, client,
+		)
+		if err != nil {
+			return errors.New("tx.ExecContext (INSERT INTO peer_clients) " + err.Error())
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.New("tx.Commit " + err.Error())
+	}
 
+	return nil
+}
+
+func (db *sqlite3Database) GetSwarm(ctx context.Context, infoHash []byte) (*Swarm, error) {
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT
+			IFNULL(torrents.n_initial_peers, 0),
+			peer_clients.client
+		FROM torrents
+		LEFT JOIN peer_clients ON peer_clients.torrent_id = torrents.id
+		WHERE torrents.info_hash = ?
+		ORDER BY peer_clients.client;`,
+		infoHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	var swarm *Swarm
 	for rows.Next() {
-		var dT string
-		var tS, nD, nF uint64
-		if err := rows.Scan(&dT, &tS, &nD, &nF); err != nil {
-			if err := rows.Close(); err != nil {
-				panic(err.Error())
+		var nPeers uint
+		var client sql.NullString
+		if err = rows.Scan(&nPeers, &client); err != nil {
+			return nil, err
+		}
+		if swarm == nil {
+			swarm = &Swarm{NPeers: nPeers, Clients: []string{}}
+		}
+		if client.Valid {
+			swarm.Clients = append(swarm.Clients, client.String)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return swarm, nil
+}
+
+func (db *sqlite3Database) GetSwarms(ctx context.Context, infoHashes [][]byte) (map[string]Swarm, error) {
+	swarms := make(map[string]Swarm, len(infoHashes))
+	err := forEachChunk(infoHashes, func(args []interface{}) error {
+		rows, err := db.conn.QueryContext(ctx, `
+			SELECT
+				torrents.info_hash,
+				IFNULL(torrents.n_initial_peers, 0),
+				peer_clients.client
+			FROM torrents
+			LEFT JOIN peer_clients ON peer_clients.torrent_id = torrents.id
+			WHERE torrents.info_hash IN (?`+strings.Repeat(", ?", len(args)-1)+`)
+			ORDER BY peer_clients.client;`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		defer closeRows(rows)
+
+		for rows.Next() {
+			var infoHash []byte
+			var nPeers uint
+			var client sql.NullString
+			if err = rows.Scan(&infoHash, &nPeers, &client); err != nil {
+				return err
 			}
+			swarm, exists := swarms[string(infoHash)]
+			if !exists {
+				swarm = Swarm{NPeers: nPeers, Clients: []string{}}
+			}
+			if client.Valid {
+				swarm.Clients = append(swarm.Clients, client.String)
+			}
+			swarms[string(infoHash)] = swarm
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return swarms, nil
+}
+
+func (db *sqlite3Database) SetReadme(ctx context.Context, infoHash []byte, readme Readme) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.New("conn.BeginTx " + err.Error())
+	}
+	defer db.rollback(tx)
+
+	var fileID int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT files.id
+		FROM files
+		INNER JOIN torrents ON torrents.id = files.torrent_id
+		WHERE torrents.info_hash = ? AND files.path = ?
+		ORDER BY files.id
+		LIMIT 1;`,
+		infoHash, readme.Path,
+	).Scan(&fileID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return errors.New("tx.QueryRowContext (SELECT files.id) " + err.Error())
+	}
+
+	// There can be only one readme per torrent (see readme_index), hence the previous one is
+	// unmarked first.
+	_, err = tx.ExecContext(ctx, `
+		UPDATE files SET is_readme = NULL, content = NULL
+		WHERE torrent_id = (SELECT torrent_id FROM files WHERE id = ?) AND is_readme = 1;`,
+		fileID,
+	)
+	if err != nil {
+		return errors.New("tx.ExecContext (UPDATE files SET is_readme = NULL) " + err.Error())
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE files SET is_readme = 1, content = ? WHERE id = ?;", readme.Content, fileID)
+	if err != nil {
+		return errors.New("tx.ExecContext (UPDATE files SET is_readme) " + err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.New("tx.Commit " + err.Error())
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) GetReadme(ctx context.Context, infoHash []byte) (*Readme, error) {
+	readme := new(Readme)
+	err := db.conn.QueryRowContext(ctx, `
+		SELECT files.path, files.content
+		FROM files
+		INNER JOIN torrents ON torrents.id = files.torrent_id
+		WHERE torrents.info_hash = ? AND files.is_readme = 1;`,
+		infoHash,
+	).Scan(&readme.Path, &readme.Content)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return readme, nil
+}
+
+func (db *sqlite3Database) AddTag(ctx context.Context, infoHash []byte, tag string) error {
+	tag, err := NormaliseTag(tag)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.New("conn.BeginTx " + err.Error())
+	}
+	defer db.rollback(tx)
+
+	var torrentID int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM torrents WHERE info_hash = ?;", infoHash).Scan(&torrentID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return errors.New("tx.QueryRowContext (SELECT id FROM torrents) " + err.Error())
+	}
+
+	if _, err = tx.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?) ON CONFLICT (name) DO NOTHING;", tag); err != nil {
+		return errors.New("tx.ExecContext (INSERT INTO tags) " + err.Error())
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO torrent_tags (torrent_id, tag_id)
+		SELECT ?, id FROM tags WHERE name = ?
+		ON CONFLICT (torrent_id, tag_id) DO NOTHING;`,
+		torrentID, tag,
+	)
+	if err != nil {
+		return errors.New("tx.ExecContext (INSERT INTO torrent_tags) " + err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.New("tx.Commit " + err.Error())
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) RemoveTag(ctx context.Context, infoHash []byte, tag string) error {
+	tag, err := NormaliseTag(tag)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.New("conn.BeginTx " + err.Error())
+	}
+	defer db.rollback(tx)
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM torrent_tags
+		WHERE torrent_id = (SELECT id FROM torrents WHERE info_hash = ?)
+			AND tag_id = (SELECT id FROM tags WHERE name = ?);`,
+		infoHash, tag,
+	)
+	if err != nil {
+		return errors.New("tx.ExecContext (DELETE FROM torrent_tags) " + err.Error())
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM tags
+		WHERE name = ? AND NOT EXISTS (SELECT 1 FROM torrent_tags WHERE torrent_tags.tag_id = tags.id);`,
+		tag,
+	)
+	if err != nil {
+		return errors.New("tx.ExecContext (DELETE FROM tags) " + err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.New("tx.Commit " + err.Error())
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) SetNote(ctx context.Context, infoHash []byte, note string) error {
+	_, err := db.conn.ExecContext(ctx, "UPDATE torrents SET note = NULLIF(?, '') WHERE info_hash = ?;", note, infoHash)
+	if err != nil {
+		return errors.New("conn.ExecContext (UPDATE torrents SET note) " + err.Error())
+	}
+	return nil
+}
+
+func (db *sqlite3Database) SetStarred(ctx context.Context, infoHash []byte, starred bool) error {
+	_, err := db.conn.ExecContext(ctx, "UPDATE torrents SET starred = ? WHERE info_hash = ?;", starred, infoHash)
+	if err != nil {
+		return errors.New("conn.ExecContext (UPDATE torrents SET starred) " + err.Error())
+	}
+	return nil
+}
+
+func (db *sqlite3Database) GetCuration(ctx context.Context, infoHash []byte) (*Curation, error) {
+	curation := &Curation{Tags: []string{}}
+	var torrentID int64
+	var note sql.NullString
+	err := db.conn.QueryRowContext(ctx,
+		"SELECT id, note, starred FROM torrents WHERE info_hash = ?;",
+		infoHash,
+	).Scan(&torrentID, &note, &curation.Starred)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	curation.Note = note.String
+
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT tags.name
+		FROM torrent_tags
+		INNER JOIN tags ON tags.id = torrent_tags.tag_id
+		WHERE torrent_tags.torrent_id = ?
+		ORDER BY tags.name;`,
+		torrentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		curation.Tags = append(curation.Tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return curation, nil
+}
+
+func (db *sqlite3Database) GetTags(ctx context.Context) ([]Tag, error) {
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT tags.name, count(*)
+		FROM tags
+		INNER JOIN torrent_tags ON torrent_tags.tag_id = tags.id
+		GROUP BY tags.id
+		ORDER BY tags.name;`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	tags := make([]Tag, 0)
+	for rows.Next() {
+		var tag Tag
+		if err = rows.Scan(&tag.Name, &tag.NTorrents); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+func (db *sqlite3Database) SetUser(ctx context.Context, user User) error {
+	if err := ValidateUserName(user.Name); err != nil {
+		return err
+	}
+
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO users (name, password_hash, role) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET password_hash = excluded.password_hash, role = excluded.role;`,
+		user.Name, user.PasswordHash, user.Role,
+	)
+	if err != nil {
+		return errors.New("conn.ExecContext (INSERT INTO users) " + err.Error())
+	}
+	return nil
+}
+
+func (db *sqlite3Database) GetUser(ctx context.Context, name string) (*User, error) {
+	user := new(User)
+	err := db.conn.QueryRowContext(ctx,
+		"SELECT name, password_hash, role FROM users WHERE name = ?;",
+		name,
+	).Scan(&user.Name, &user.PasswordHash, &user.Role)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (db *sqlite3Database) GetUsers(ctx context.Context) ([]User, error) {
+	rows, err := db.conn.QueryContext(ctx, "SELECT name, password_hash, role FROM users ORDER BY name;")
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	users := make([]User, 0)
+	for rows.Next() {
+		var user User
+		if err = rows.Scan(&user.Name, &user.PasswordHash, &user.Role); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (db *sqlite3Database) DeleteUser(ctx context.Context, name string) (bool, error) {
+	result, err := db.conn.ExecContext(ctx, "DELETE FROM users WHERE name = ?;", name)
+	if err != nil {
+		return false, errors.New("conn.ExecContext (DELETE FROM users) " + err.Error())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.New("sql.Result.RowsAffected " + err.Error())
+	}
+	return n != 0, nil
+}
+
+func (db *sqlite3Database) AddToken(ctx context.Context, token Token) error {
+	result, err := db.conn.ExecContext(ctx, `
+		INSERT INTO tokens (id, hash, user_id, name, session, created_on, expires_on)
+		SELECT ?, ?, id, ?, ?, ?, ? FROM users WHERE name = ?;`,
+		token.ID, token.Hash, token.Name, token.Session, token.CreatedOn, token.ExpiresOn, token.User,
+	)
+	if err != nil {
+		return errors.New("conn.ExecContext (INSERT INTO tokens) " + err.Error())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.New("sql.Result.RowsAffected " + err.Error())
+	} else if n == 0 {
+		return fmt.Errorf("unknown user: %s", token.User)
+	}
+	return nil
+}
+
+func (db *sqlite3Database) GetToken(ctx context.Context, id string) (*Token, error) {
+	token := new(Token)
+	err := db.conn.QueryRowContext(ctx, `
+		SELECT tokens.id, tokens.hash, users.name, tokens.name, tokens.session, tokens.created_on, tokens.expires_on
+		FROM tokens
+		INNER JOIN users ON users.id = tokens.user_id
+		WHERE tokens.id = ?;`,
+		id,
+	).Scan(&token.ID, &token.Hash, &token.User, &token.Name, &token.Session, &token.CreatedOn, &token.ExpiresOn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (db *sqlite3Database) GetTokens(ctx context.Context, user string) ([]Token, error) {
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT tokens.id, tokens.hash, users.name, tokens.name, tokens.session, tokens.created_on, tokens.expires_on
+		FROM tokens
+		INNER JOIN users ON users.id = tokens.user_id
+		WHERE users.name = ?
+		ORDER BY tokens.created_on, tokens.id;`,
+		user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+
+	tokens := make([]Token, 0)
+	for rows.Next() {
+		var token Token
+		if err = rows.Scan(&token.ID, &token.Hash, &token.User, &token.Name, &token.Session, &token.CreatedOn, &token.ExpiresOn); err != nil {
 			return nil, err
 		}
-		stats.NDiscovered[dT] = nD
-		stats.TotalSize[dT] = tS
-		stats.NFiles[dT] = nF
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (db *sqlite3Database) DeleteToken(ctx context.Context, id string) (bool, error) {
+	result, err := db.conn.ExecContext(ctx, "DELETE FROM tokens WHERE id = ?;", id)
+	if err != nil {
+		return false, errors.New("conn.ExecContext (DELETE FROM tokens) " + err.Error())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.New("sql.Result.RowsAffected " + err.Error())
+	}
+	return n != 0, nil
+}
+
+func (db *sqlite3Database) DeleteExpiredTokens(ctx context.Context, now int64) (uint, error) {
+	result, err := db.conn.ExecContext(ctx, "DELETE FROM tokens WHERE expires_on != 0 AND expires_on <= ?;", now)
+	if err != nil {
+		return 0, errors.New("conn.ExecContext (DELETE FROM tokens) " + err.Error())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.New("sql.Result.RowsAffected " + err.Error())
+	}
+	return uint(n), nil
+}
+
+func (db *sqlite3Database) PurgeTorrents(ctx context.Context, infoHashes [][]byte, pattern *regexp.Regexp) (uint, error) {
+	args := make([]interface{}, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		args[i] = infoHash
+	}
+	nDeleted, err := deleteInBatches(ctx, db.conn, nil, "DELETE FROM torrents WHERE info_hash = ?;", args)
+	if err != nil || pattern == nil {
+		return nDeleted, err
+	}
+
+	ids, err := matchingTorrentIDs(
+		ctx,
+		db.conn,
+		pattern,
+		"SELECT id, id, name FROM torrents WHERE id > ? ORDER BY id LIMIT ?;",
+		"SELECT id, torrent_id, path FROM files WHERE id > ? AND torrent_id IS NOT NULL ORDER BY id LIMIT ?;",
+	)
+	if err != nil {
+		return nDeleted, errors.New("matchingTorrentIDs " + err.Error())
+	}
+	args = make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	n, err := deleteInBatches(ctx, db.conn, nil, "DELETE FROM torrents WHERE id = ?;", args)
+	return nDeleted + n, err
+}
+
+func (db *sqlite3Database) DeleteTorrent(ctx context.Context, infoHash []byte) (bool, error) {
+	n, err := db.PurgeTorrents(ctx, [][]byte{infoHash}, nil)
+	return n != 0, err
+}
+
+func (db *sqlite3Database) DeleteTorrents(ctx context.Context, query string, category *Category, scope SearchScope) (uint, error) {
+	infoHashes, err := queriedInfoHashes(ctx, db, query, category, scope)
+	if err != nil {
+		return 0, err
+	}
+	return db.PurgeTorrents(ctx, infoHashes, nil)
+}
+
+func (db *sqlite3Database) ApplyRetention(ctx context.Context, policy RetentionPolicy) (uint, error) {
+	var nDeleted uint
+
+	if policy.MaxAgeWithoutPeers != 0 {
+		cutoff := time.Now().Add(-policy.MaxAgeWithoutPeers).Unix()
+		n, err := deleteRepeatedly(ctx, db.conn, nil, `
+			DELETE FROM torrents WHERE id IN (
+				SELECT id FROM torrents WHERE discovered_on < ? AND IFNULL(n_initial_peers, 0) = 0 LIMIT ?
+			);`,
+			cutoff,
+		)
+		nDeleted += n
+		if err != nil {
+			return nDeleted, err
+		}
+	}
+
+	if policy.MaxTorrents != 0 {
+		// The most recently discovered torrent not retained is looked up once, rather than counting
+		// the torrents retained on every batch.
+		var discoveredOn, id int64
+		err := db.conn.QueryRowContext(ctx,
+			"SELECT discovered_on, id FROM torrents ORDER BY discovered_on DESC, id DESC LIMIT 1 OFFSET ?;",
+			policy.MaxTorrents,
+		).Scan(&discoveredOn, &id)
+		if err == sql.ErrNoRows {
+			return nDeleted, nil
+		} else if err != nil {
+			return nDeleted, errors.New("conn.QueryRowContext (SELECT FROM torrents OFFSET) " + err.Error())
+		}
+
+		n, err := deleteRepeatedly(ctx, db.conn, nil, `
+			DELETE FROM torrents WHERE id IN (
+				SELECT id FROM torrents WHERE discovered_on < ? OR (discovered_on = ? AND id <= ?) LIMIT ?
+			);`,
+			discoveredOn, discoveredOn, id,
+		)
+		nDeleted += n
+		if err != nil {
+			return nDeleted, err
+		}
 	}
 
-	return stats, nil
+	return nDeleted, nil
 }
 
-func (db *sqlite3Database) setupDatabase() error {
+// setupDatabase creates the tables of the very first schema if they do not exist, and migrates the
+// schema to the latest version, see migrate.
+func (db *sqlite3Database) setupDatabase(dryRun bool) ([]Migration, error) {
 	// Enable Write-Ahead Logging for SQLite as "WAL provides more concurrency as readers do not
 	// block writers and a writer does not block readers. Reading and writing can proceed
 	// concurrently."
@@ -489,19 +1372,23 @@ func (db *sqlite3Database) setupDatabase() error {
 	//
 	// Enable foreign key constraints in SQLite which are crucial to prevent programmer errors on
 	// our side.
-	_, err := db.conn.Exec(`
-		PRAGMA journal_mode=WAL;
-		PRAGMA temp_store=2;
-		PRAGMA foreign_keys=ON;
-		PRAGMA encoding='UTF-8';
-	`)
-	if err != nil {
-		return errors.New("sql.DB.Exec (PRAGMAs) " + err.Error())
+	//
+	// None of which is done on a dry run, as the database is read-only then.
+	if !dryRun {
+		_, err := db.conn.Exec(`
+			PRAGMA journal_mode=WAL;
+			PRAGMA temp_store=2;
+			PRAGMA foreign_keys=ON;
+			PRAGMA encoding='UTF-8';
+		`)
+		if err != nil {
+			return nil, errors.New("sql.DB.Exec (PRAGMAs) " + err.Error())
+		}
 	}
 
 	tx, err := db.conn.Begin()
 	if err != nil {
-		return errors.New("sql.DB.Begin " + err.Error())
+		return nil, errors.New("sql.DB.Begin " + err.Error())
 	}
 	// If everything goes as planned and no error occurs, we will commit the transaction before
 	// returning from the function so the tx.Rollback() call will fail, trying to rollback a
@@ -509,10 +1396,13 @@ func (db *sqlite3Database) setupDatabase() error {
 	// is nice.
 	defer db.rollback(tx)
 
-	// Initial Setup for `user_version` 0:
+	// Initial Setup for `user_version` 0, which a dry run has no need of:
 	// FROZEN.
 	// TODO: "torrent_id" column of the "files" table can be NULL, how can we fix this in a new
 	//       version schema?
+	if dryRun {
+		return migrate(tx, sqlite3Migrations, sqlite3Versioner, true)
+	}
 	_, err = tx.Exec(`
 		CREATE TABLE IF NOT EXISTS torrents (
 			id             INTEGER PRIMARY KEY,
@@ -529,147 +1419,359 @@ func (db *sqlite3Database) setupDatabase() error {
 		);
 	`)
 	if err != nil {
-		return errors.New("sql.Tx.Exec (v0) " + err.Error())
+		return nil, errors.New("sql.Tx.Exec (v0) " + err.Error())
 	}
 
-	// Get the user_version:
-	rows, err := tx.Query("PRAGMA user_version;")
+	migrations, err := migrate(tx, sqlite3Migrations, sqlite3Versioner, false)
 	if err != nil {
-		return errors.New("sql.Tx.Query (user_version) " + err.Error())
+		return nil, err
 	}
-	defer rows.Close()
-	var userVersion int
-	if !rows.Next() {
-		return fmt.Errorf("sql.Rows.Next (user_version): PRAGMA user_version did not return any rows")
-	}
-	if err = rows.Scan(&userVersion); err != nil {
-		return errors.New("sql.Rows.Scan (user_version) " + err.Error())
-	}
-
-	switch userVersion {
-	case 0: // FROZEN.
-		// Upgrade from user_version 0 to 1
-		// Changes:
-		//   * `info_hash_index` is recreated as UNIQUE.
-		log.Println("Updating database schema from 0 to 1... (this might take a while)")
-		_, err = tx.Exec(`
-			DROP INDEX IF EXISTS info_hash_index;
-			CREATE UNIQUE INDEX info_hash_index ON torrents	(info_hash);
-			PRAGMA user_version = 1;
-		`)
-		if err != nil {
-			return errors.New("sql.Tx.Exec (v0 -> v1) " + err.Error())
-		}
-		fallthrough
-
-	case 1: // FROZEN.
-		// Upgrade from user_version 1 to 2
-		// Changes:
-		//   * Added `n_seeders`, `n_leechers`, and `updated_on` columns to the `torrents` table, and
-		//     the constraints they entail.
-		//   * Added `is_readme` and `content` columns to the `files` table, and the constraints & the
-		//     the indices they entail.
-		//     * Added unique index `readme_index`  on `files` table.
-		log.Println("Updating database schema from 1 to 2... (this might take a while)")
-		// We introduce two new columns in `files`: content BLOB, and is_readme INTEGER which we
-		// treat as a bool (NULL for false, and 1 for true; see the CHECK statement).
-		// The reason for the change is that as we introduce the new "readme" feature which
-		// downloads a readme file as a torrent descriptor, we needed to store it somewhere in the
-		// database with the following conditions:
-		//
-		//   1. There can be one and only one readme (content) for a given torrent; hence the
-		//      UNIQUE INDEX on (torrent_id, is_description) (remember that SQLite treats each NULL
-		//      value as distinct [UNIQUE], see https://sqlite.org/nulls.html).
-		//   2. We would like to keep the readme (content) associated with the file it came from;
-		//      hence we modify the files table instead of the torrents table.
-		//
-		// Regarding the implementation details, following constraints arise:
-		//
-		//   1. The column is_readme is either NULL or 1, and if it is 1, then column content cannot
-		//      be NULL (but might be an empty BLOB). Vice versa, if column content of a row is,
-		//      NULL then column is_readme must be NULL.
-		//
-		//      This is to prevent unused content fields filling up the database, and to catch
-		//      programmers' errors.
-		_, err = tx.Exec(`
-			ALTER TABLE torrents ADD COLUMN updated_on INTEGER CHECK (updated_on > 0) DEFAULT NULL;
-			ALTER TABLE torrents ADD COLUMN n_seeders  INTEGER CHECK ((updated_on IS NOT NULL AND n_seeders >= 0) OR (updated_on IS NULL AND n_seeders IS NULL)) DEFAULT NULL;
-			ALTER TABLE torrents ADD COLUMN n_leechers INTEGER CHECK ((updated_on IS NOT NULL AND n_leechers >= 0) OR (updated_on IS NULL AND n_leechers IS NULL)) DEFAULT NULL;
-
-			ALTER TABLE files ADD COLUMN is_readme INTEGER CHECK (is_readme IS NULL OR is_readme=1) DEFAULT NULL;
-			ALTER TABLE files ADD COLUMN content   TEXT    CHECK ((content IS NULL AND is_readme IS NULL) OR (content IS NOT NULL AND is_readme=1)) DEFAULT NULL;
-			CREATE UNIQUE INDEX readme_index ON files (torrent_id, is_readme);
-
-			PRAGMA user_version = 2;
-		`)
-		if err != nil {
-			return errors.New("sql.Tx.Exec (v1 -> v2) " + err.Error())
-		}
-		fallthrough
 
-	case 2: // NOT FROZEN! (subject to change or complete removal)
-		// Upgrade from user_version 2 to 3
-		// Changes:
-		//   * Created `torrents_idx` FTS5 virtual table.
-		//
-		//     See:
-		//     * https://sqlite.org/fts5.html
-		//     * https://sqlite.org/fts3.html
-		//
-		//   * Added `modified_on` column to the `torrents` table.
-		log.Println("Updating database schema from 2 to 3... (this might take a while)")
-		_, err = tx.Exec(`
-			CREATE VIRTUAL TABLE torrents_idx USING fts5(name, content='torrents', content_rowid='id', tokenize="porter unicode61 separators ' !""#$%&''()*+,-./:;<=>?@[\]^_` + "`" + `{|}~'");
-			
-			-- Populate the index
-			INSERT INTO torrents_idx(rowid, name) SELECT id, name FROM torrents;
-
-			-- Triggers to keep the FTS index up to date.
-			CREATE TRIGGER torrents_idx_ai_t AFTER INSERT ON torrents BEGIN
-			  INSERT INTO torrents_idx(rowid, name) VALUES (new.id, new.name);
-			END;
-			CREATE TRIGGER torrents_idx_ad_t AFTER DELETE ON torrents BEGIN
-			  INSERT INTO torrents_idx(torrents_idx, rowid, name) VALUES('delete', old.id, old.name);
-			END;
-			CREATE TRIGGER torrents_idx_au_t AFTER UPDATE ON torrents BEGIN
-			  INSERT INTO torrents_idx(torrents_idx, rowid, name) VALUES('delete', old.id, old.name);
-			  INSERT INTO torrents_idx(rowid, name) VALUES (new.id, new.name);
-			END;
+	if err = tx.Commit(); err != nil {
+		return nil, errors.New("sql.Tx.Commit " + err.Error())
+	}
+
+	return migrations, nil
+}
+
+// sqlite3Versioner keeps the version of the schema in the `user_version` of the database.
+var sqlite3Versioner = schemaVersioner{
+	get: func(tx *sql.Tx) (int, error) {
+		var version int
+		err := tx.QueryRow("PRAGMA user_version;").Scan(&version)
+		return version, err
+	},
+	set: func(tx *sql.Tx, version int) error {
+		// PRAGMAs take no arguments, hence the formatting.
+		_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", version))
+		return err
+	},
+}
+
+// sqlite3Migrations are the migrations of the schema of SQLite databases, see migration.
+var sqlite3Migrations = []migration{
+	// 0 -> 1: FROZEN.
+	// Changes:
+	//   * `info_hash_index` is recreated as UNIQUE.
+	{
+		name: "unique index of info hashes",
+		sql: `
+		DROP INDEX IF EXISTS info_hash_index;
+		CREATE UNIQUE INDEX info_hash_index ON torrents	(info_hash);
+	`,
+	},
+
+	// 1 -> 2: FROZEN.
+	// Changes:
+	//   * Added `n_seeders`, `n_leechers`, and `updated_on` columns to the `torrents` table, and
+	//     the constraints they entail.
+	//   * Added `is_readme` and `content` columns to the `files` table, and the constraints & the
+	//     the indices they entail.
+	//     * Added unique index `readme_index`  on `files` table.
+	{
+		name: "seeders, leechers, and readmes",
+		sql: `
+		ALTER TABLE torrents ADD COLUMN updated_on INTEGER CHECK (updated_on > 0) DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN n_seeders  INTEGER CHECK ((updated_on IS NOT NULL AND n_seeders >= 0) OR (updated_on IS NULL AND n_seeders IS NULL)) DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN n_leechers INTEGER CHECK ((updated_on IS NOT NULL AND n_leechers >= 0) OR (updated_on IS NULL AND n_leechers IS NULL)) DEFAULT NULL;
+
+		ALTER TABLE files ADD COLUMN is_readme INTEGER CHECK (is_readme IS NULL OR is_readme=1) DEFAULT NULL;
+		ALTER TABLE files ADD COLUMN content   TEXT    CHECK ((content IS NULL AND is_readme IS NULL) OR (content IS NOT NULL AND is_readme=1)) DEFAULT NULL;
+		CREATE UNIQUE INDEX readme_index ON files (torrent_id, is_readme);
+	`,
+	},
+
+	// 2 -> 3: FROZEN.
+	// Changes:
+	//   * Created `torrents_idx` FTS5 virtual table.
+	//
+	//     See:
+	//     * https://sqlite.org/fts5.html
+	//     * https://sqlite.org/fts3.html
+	//
+	//   * Added `modified_on` column to the `torrents` table.
+	{
+		name: "full-text index of names, and modification times",
+		sql: `
+		CREATE VIRTUAL TABLE torrents_idx USING fts5(name, content='torrents', content_rowid='id', tokenize="porter unicode61 separators ' !""#$%&''()*+,-./:;<=>?@[\]^_` + "`" + `{|}~'");
+		
+		-- Populate the index
+		INSERT INTO torrents_idx(rowid, name) SELECT id, name FROM torrents;
+
+		-- Triggers to keep the FTS index up to date.
+		CREATE TRIGGER torrents_idx_ai_t AFTER INSERT ON torrents BEGIN
+		  INSERT INTO torrents_idx(rowid, name) VALUES (new.id, new.name);
+		END;
+		CREATE TRIGGER torrents_idx_ad_t AFTER DELETE ON torrents BEGIN
+		  INSERT INTO torrents_idx(torrents_idx, rowid, name) VALUES('delete', old.id, old.name);
+		END;
+		CREATE TRIGGER torrents_idx_au_t AFTER UPDATE ON torrents BEGIN
+		  INSERT INTO torrents_idx(torrents_idx, rowid, name) VALUES('delete', old.id, old.name);
+		  INSERT INTO torrents_idx(rowid, name) VALUES (new.id, new.name);
+		END;
 
             -- Add column 'modified_on'
-			-- BEWARE: code needs to be updated before January 1, 3000 (32503680000)!
-			ALTER TABLE torrents ADD COLUMN modified_on INTEGER NOT NULL
-				CHECK (modified_on >= discovered_on AND (updated_on IS NOT NULL OR modified_on >= updated_on))
-				DEFAULT 32503680000
-			;
-
-			-- If 'modified_on' is not explicitly supplied, then it shall be set, by default, to
-			-- 'discovered_on' right after the row is inserted to 'torrents'.
+		-- BEWARE: code needs to be updated before January 1, 3000 (32503680000)!
+		ALTER TABLE torrents ADD COLUMN modified_on INTEGER NOT NULL
+			CHECK (modified_on >= discovered_on AND (updated_on IS NOT NULL OR modified_on >= updated_on))
+			DEFAULT 32503680000
+		;
+
+		-- If 'modified_on' is not explicitly supplied, then it shall be set, by default, to
+		-- 'discovered_on' right after the row is inserted to 'torrents'.
             --
-			-- {WHEN expr} does NOT work for some reason (trigger doesn't get triggered), so we use
+		-- {WHEN expr} does NOT work for some reason (trigger doesn't get triggered), so we use
             --   AND NEW."modified_on" = 32503680000
             -- instead in the WHERE clause.
-			CREATE TRIGGER "torrents_modified_on_default_t" AFTER INSERT ON "torrents" BEGIN
+		CREATE TRIGGER "torrents_modified_on_default_t" AFTER INSERT ON "torrents" BEGIN
 	          UPDATE "torrents" SET "modified_on" = NEW."discovered_on" WHERE "id" = NEW."id" AND NEW."modified_on" = 32503680000;
             END;
 
-			-- Set 'modified_on' value of all rows to 'discovered_on' or 'updated_on', whichever is
+		-- Set 'modified_on' value of all rows to 'discovered_on' or 'updated_on', whichever is
             -- greater; beware that 'updated_on' can be NULL too.			
-			UPDATE torrents SET modified_on = (SELECT MAX(discovered_on, IFNULL(updated_on, 0)));
+		UPDATE torrents SET modified_on = (SELECT MAX(discovered_on, IFNULL(updated_on, 0)));
+
+		CREATE INDEX modified_on_index ON torrents (modified_on);
+	`,
+	},
+
+	// 3 -> 4: FROZEN.
+	// Changes:
+	//   * Added `n_initial_peers` column to the `torrents` table, which is the number of peers
+	//     known for the torrent when it was first seen (NULL if unknown).
+	//   * Created `peer_clients` table, that holds the distinct client names observed in the
+	//     swarm of each torrent.
+	{
+		name: "initial peers and peer clients",
+		sql: `
+		ALTER TABLE torrents ADD COLUMN n_initial_peers INTEGER CHECK (n_initial_peers IS NULL OR n_initial_peers >= 0) DEFAULT NULL;
+
+		CREATE TABLE peer_clients (
+			torrent_id  INTEGER NOT NULL REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			client      TEXT NOT NULL,
+			UNIQUE (torrent_id, client)
+		);
+	`,
+	},
+
+	// 4 -> 5: FROZEN.
+	// Changes:
+	//   * Added `category` column to the `torrents` table, and an index on it. Existing
+	//     torrents are left uncategorised (0).
+	{
+		name: "categories",
+		sql: `
+		ALTER TABLE torrents ADD COLUMN category INTEGER NOT NULL CHECK (category >= 0) DEFAULT 0;
+		CREATE INDEX category_index ON torrents (category);
+	`,
+	},
+
+	// 5 -> 6: FROZEN.
+	// Changes:
+	//   * Added an index on the `discovered_on` column of the `torrents` table, for the
+	//     retention policies to find the oldest (and the newest) torrents quickly.
+	{
+		name: "index of discovery times",
+		sql: `
+		CREATE INDEX discovered_on_index ON torrents (discovered_on);
+	`,
+	},
+
+	// 6 -> 7: FROZEN.
+	// Changes:
+	//   * Created `statistics_hourly` table, that holds the number of torrents discovered in
+	//     each hour (starting on `hour`, in Unix time), their number of files, and their total
+	//     size; populated from the existing torrents.
+	//   * Created triggers that keep `statistics_hourly` up to date as torrents and files are
+	//     added and deleted. Files are counted as they are added to a torrent, whereas they
+	//     are discounted before the torrent is deleted, when they still exist (they are deleted
+	//     only by ON DELETE CASCADE).
+	{
+		name: "hourly statistics",
+		sql: `
+		CREATE TABLE statistics_hourly (
+			hour          INTEGER PRIMARY KEY,
+			n_discovered  INTEGER NOT NULL DEFAULT 0,
+			n_files       INTEGER NOT NULL DEFAULT 0,
+			total_size    INTEGER NOT NULL DEFAULT 0
+		);
 
-			CREATE INDEX modified_on_index ON torrents (modified_on);
+		INSERT INTO statistics_hourly (hour, n_discovered, n_files, total_size)
+			SELECT
+				torrents.discovered_on - torrents.discovered_on % 3600,
+				count(DISTINCT torrents.id),
+				count(files.id),
+				IFNULL(sum(files.size), 0)
+			FROM torrents
+			LEFT JOIN files ON files.torrent_id = torrents.id
+			GROUP BY 1;
+
+		CREATE TRIGGER statistics_hourly_torrents_ai AFTER INSERT ON torrents BEGIN
+			INSERT INTO statistics_hourly (hour, n_discovered, total_size)
+				VALUES (new.discovered_on - new.discovered_on % 3600, 1, new.total_size)
+				ON CONFLICT (hour) DO UPDATE SET
+					n_discovered = n_discovered + 1,
+					total_size = total_size + excluded.total_size;
+		END;
+		CREATE TRIGGER statistics_hourly_torrents_bd BEFORE DELETE ON torrents BEGIN
+			UPDATE statistics_hourly SET
+				n_discovered = n_discovered - 1,
+				n_files = n_files - (SELECT count(*) FROM files WHERE torrent_id = old.id),
+				total_size = total_size - old.total_size
+			WHERE hour = old.discovered_on - old.discovered_on % 3600;
+		END;
+		CREATE TRIGGER statistics_hourly_files_ai AFTER INSERT ON files BEGIN
+			UPDATE statistics_hourly SET n_files = n_files + 1
+			WHERE hour = (SELECT discovered_on - discovered_on % 3600 FROM torrents WHERE id = new.torrent_id);
+		END;
+	`,
+	},
+
+	// 7 -> 8: FROZEN.
+	// Changes:
+	//   * Added `n_files` column to the `torrents` table, the number of files of the torrent
+	//     (set on insert, since files are never added to existing torrents), and an index on
+	//     it; back-filled for the existing torrents.
+	//   * The triggers of `statistics_hourly` count the files by `n_files`, so that inserting
+	//     files does not fire a trigger for every single one of them anymore.
+	//   * `torrents_idx_au_t` is recreated to fire only on updates of the name, so that
+	//     neither the back-filling nor recording swarms re-indexes the torrents needlessly.
+	{
+		name: "number of files",
+		sql: `
+		DROP TRIGGER torrents_idx_au_t;
+		CREATE TRIGGER torrents_idx_au_t AFTER UPDATE OF name ON torrents BEGIN
+		  INSERT INTO torrents_idx(torrents_idx, rowid, name) VALUES('delete', old.id, old.name);
+		  INSERT INTO torrents_idx(rowid, name) VALUES (new.id, new.name);
+		END;
+
+		ALTER TABLE torrents ADD COLUMN n_files INTEGER NOT NULL CHECK (n_files >= 0) DEFAULT 0;
+		UPDATE torrents SET n_files = (SELECT count(*) FROM files WHERE files.torrent_id = torrents.id);
+		CREATE INDEX n_files_index ON torrents (n_files);
+
+		DROP TRIGGER statistics_hourly_files_ai;
+		DROP TRIGGER statistics_hourly_torrents_ai;
+		DROP TRIGGER statistics_hourly_torrents_bd;
+		CREATE TRIGGER statistics_hourly_torrents_ai AFTER INSERT ON torrents BEGIN
+			INSERT INTO statistics_hourly (hour, n_discovered, n_files, total_size)
+				VALUES (new.discovered_on - new.discovered_on % 3600, 1, new.n_files, new.total_size)
+				ON CONFLICT (hour) DO UPDATE SET
+					n_discovered = n_discovered + 1,
+					n_files = n_files + excluded.n_files,
+					total_size = total_size + excluded.total_size;
+		END;
+		CREATE TRIGGER statistics_hourly_torrents_ad AFTER DELETE ON torrents BEGIN
+			UPDATE statistics_hourly SET
+				n_discovered = n_discovered - 1,
+				n_files = n_files - old.n_files,
+				total_size = total_size - old.total_size
+			WHERE hour = old.discovered_on - old.discovered_on % 3600;
+		END;
+	`,
+	},
+	// 8 -> 9: FROZEN.
+	// Changes:
+	//   * Created the `tags` table, and the `torrent_tags` table that tags the torrents.
+	//   * Added `note` and `starred` columns to the `torrents` table, and a (partial) index of
+	//     the starred torrents.
+	{
+		name: "tags, notes, and stars",
+		sql: `
+		CREATE TABLE tags (
+			id    INTEGER PRIMARY KEY,
+			name  TEXT NOT NULL UNIQUE
+		);
 
-			PRAGMA user_version = 3;
-		`)
-		if err != nil {
-			return errors.New("sql.Tx.Exec (v2 -> v3) " + err.Error())
-		}
+		CREATE TABLE torrent_tags (
+			torrent_id  INTEGER NOT NULL REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			tag_id      INTEGER NOT NULL REFERENCES tags ON DELETE CASCADE ON UPDATE RESTRICT,
+			PRIMARY KEY (torrent_id, tag_id)
+		);
+		CREATE INDEX torrent_tags_tag_id_index ON torrent_tags (tag_id);
+
+		ALTER TABLE torrents ADD COLUMN note TEXT DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN starred INTEGER NOT NULL CHECK (starred IN (0, 1)) DEFAULT 0;
+		CREATE INDEX starred_index ON torrents (id) WHERE starred = 1;
+	`,
+	},
+	// 9 -> 10: NOT FROZEN! (subject to change or complete removal)
+	// Changes:
+	//   * Created the `users` table, the users of magneticow and their roles.
+	//   * Created the `tokens` table, the sessions and the API tokens of the users (of which only
+	//     the hashes are stored).
+	{
+		name: "users and tokens",
+		sql: `
+		CREATE TABLE users (
+			id             INTEGER PRIMARY KEY,
+			name           TEXT NOT NULL UNIQUE,
+			password_hash  BLOB NOT NULL,
+			role           INTEGER NOT NULL CHECK (role >= 0)
+		);
+
+		CREATE TABLE tokens (
+			id          TEXT PRIMARY KEY,
+			hash        BLOB NOT NULL,
+			user_id     INTEGER NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE RESTRICT,
+			name        TEXT NOT NULL,
+			session     INTEGER NOT NULL CHECK (session IN (0, 1)),
+			created_on  INTEGER NOT NULL CHECK (created_on >= 0),
+			expires_on  INTEGER NOT NULL CHECK (expires_on >= 0)
+		);
+		CREATE INDEX tokens_user_id_index ON tokens (user_id);
+		CREATE INDEX tokens_expires_on_index ON tokens (expires_on) WHERE expires_on != 0;
+	`,
+	},
+}
+
+// setupFilesIndex creates the `files_idx` FTS5 virtual table (the full-text index of the paths of
+// the files) if asked so and if it does not exist yet. It is not part of the schema migrations since
+// it is optional; once created, it is kept up to date even if it is not asked for anymore.
+func (db *sqlite3Database) setupFilesIndex(create bool) error {
+	err := db.conn.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'files_idx');",
+	).Scan(&db.filesIndex)
+	if err != nil {
+		return errors.New("sql.DB.QueryRow (sqlite_master) " + err.Error())
+	}
+	if db.filesIndex || !create {
+		return nil
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return errors.New("sql.DB.Begin " + err.Error())
+	}
+	defer db.rollback(tx)
+
+	log.Println("Indexing the paths of the files... (this might take a while)")
+	_, err = tx.Exec(`
+		CREATE VIRTUAL TABLE files_idx USING fts5(path, content='files', content_rowid='id', tokenize="porter unicode61 separators ' !""#$%&''()*+,-./:;<=>?@[\]^_` + "`" + `{|}~'");
+
+		-- Populate the index
+		INSERT INTO files_idx(rowid, path) SELECT id, path FROM files;
+
+		-- Triggers to keep the FTS index up to date.
+		CREATE TRIGGER files_idx_ai_t AFTER INSERT ON files BEGIN
+		  INSERT INTO files_idx(rowid, path) VALUES (new.id, new.path);
+		END;
+		CREATE TRIGGER files_idx_ad_t AFTER DELETE ON files BEGIN
+		  INSERT INTO files_idx(files_idx, rowid, path) VALUES('delete', old.id, old.path);
+		END;
+		CREATE TRIGGER files_idx_au_t AFTER UPDATE ON files BEGIN
+		  INSERT INTO files_idx(files_idx, rowid, path) VALUES('delete', old.id, old.path);
+		  INSERT INTO files_idx(rowid, path) VALUES (new.id, new.path);
+		END;
+	`)
+	if err != nil {
+		return errors.New("sql.Tx.Exec (files_idx) " + err.Error())
 	}
 
 	if err = tx.Commit(); err != nil {
 		return errors.New("sql.Tx.Commit " + err.Error())
 	}
 
+	db.filesIndex = true
 	return nil
 }
 
@@ -1,339 +1,148 @@
 package persistence
 
 import (
+	"context"
+	"database/sql"
 	"net/url"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var db, _ = makeSqlite3Database(&url.URL{
-	Scheme:   "sqlite3",
-	Path:     ":memory:",
-	RawQuery: "cache=shared",
-})
+// openSqlite3Database opens a database of its own for each test, as the tests run in parallel.
+func openSqlite3Database(t *testing.T, filesIndex bool) Database {
+	t.Helper()
 
-func Test_sqlite3Database_DoesTorrentExist(t *testing.T) {
-	t.Parallel()
-
-	tests := []struct {
-		name     string
-		infoHash []byte
-		want     bool
-		wantErr  bool
-	}{
-		{
-			name:     "Test Empty",
-			infoHash: []byte{},
-			want:     false,
-			wantErr:  false,
-		},
-		{
-			name:     "Test Zeroes",
-			infoHash: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-			want:     false,
-			wantErr:  false,
-		},
+	url_ := &url.URL{Scheme: "sqlite3", Path: filepath.Join(t.TempDir(), "database.sqlite3")}
+	if filesIndex {
+		url_.RawQuery = "files_index=true"
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := db.DoesTorrentExist(tt.infoHash)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("sqlite3Database.DoesTorrentExist() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if got != tt.want {
-				t.Errorf("sqlite3Database.DoesTorrentExist() = %v, want %v", got, tt.want)
-			}
-		})
+	db, err := makeSqlite3Database(url_)
+	if err != nil {
+		t.Fatalf("makeSqlite3Database() error = %v", err)
 	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
 }
 
-func Test_sqlite3Database_GetNumberOfTorrents(t *testing.T) {
+func Test_sqlite3Database_Conformance(t *testing.T) {
 	t.Parallel()
 
-	db, _ := makeSqlite3Database(&url.URL{
-		Scheme:   "sqlite3",
-		Path:     ":memory:",
-		RawQuery: "cache=shared",
-	})
-
-	got, err := db.GetNumberOfTorrents()
-	if err != nil {
-		t.Errorf("sqlite3Database.GetNumberOfTorrents() error = %v", err)
-		return
-	}
-	if got != 0 {
-		t.Errorf("sqlite3Database.GetNumberOfTorrents() = %v, want 0", got)
-	}
+	testConformance(t, openSqlite3Database)
 }
 
-func Test_sqlite3Database_AddNewTorrent(t *testing.T) {
+func Test_sqlite3Database_PurgeTorrents(t *testing.T) {
+	ctx := context.Background()
 	t.Parallel()
 
-	tests := []struct {
-		name     string
-		infoHash []byte
-		files    []File
-		wantErr  bool
-	}{
-		{
-			name:     "Test Nil",
-			infoHash: []byte{},
-			files:    nil,
-			wantErr:  false,
-		},
-		{
-			name:     "Test Empty",
-			infoHash: []byte{},
-			files:    []File{},
-			wantErr:  false,
-		},
-		{
-			name:     "Test Zeroes",
-			infoHash: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-			files:    []File{{Size: 0, Path: "test"}},
-			wantErr:  false,
-		},
-		{
-			name:     "Test NonZeroes",
-			infoHash: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-			files:    []File{{Size: 1, Path: "test"}},
-			wantErr:  false,
-		},
+	db := openSqlite3Database(t, false)
+
+	if err := db.AddNewTorrent(ctx, []byte("purged"), "purged", []File{{Size: 1, Path: "a"}, {Size: 1, Path: "b"}}, Uncategorised); err != nil {
+		t.Fatalf("sqlite3Database.AddNewTorrent() error = %v", err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := db.AddNewTorrent(tt.infoHash, tt.name, tt.files); (err != nil) != tt.wantErr {
-				t.Errorf("sqlite3Database.AddNewTorrent() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
+	if err := db.AddNewTorrent(ctx, []byte("kept"), "kept", []File{{Size: 1, Path: "c"}}, Uncategorised); err != nil {
+		t.Fatalf("sqlite3Database.AddNewTorrent() error = %v", err)
+	}
+	if _, err := db.PurgeTorrents(ctx, [][]byte{[]byte("purged")}, nil); err != nil {
+		t.Fatalf("sqlite3Database.PurgeTorrents() error = %v", err)
+	}
+
+	// The files of the purged torrents must not be left behind.
+	var nFiles int
+	if err := db.(*sqlite3Database).conn.QueryRow("SELECT COUNT(*) FROM files;").Scan(&nFiles); err != nil || nFiles != 1 {
+		t.Errorf("%d files left after purging (err %v), want 1", nFiles, err)
 	}
 }
 
-func Test_sqlite3Database_QueryTorrents(t *testing.T) {
+func Test_sqlite3Database_QueryTorrents_Files(t *testing.T) {
+	ctx := context.Background()
 	t.Parallel()
 
-	tests := []struct {
-		name             string
-		query            string
-		epoch            int64
-		orderBy          OrderingCriteria
-		ascending        bool
-		limit            uint
-		lastOrderedValue *float64
-		lastID           *uint64
-		want             []TorrentMetadata
-		wantErr          bool
-	}{
-		{
-			name:             "Test Relevance",
-			query:            "",
-			epoch:            0,
-			orderBy:          ByRelevance,
-			ascending:        false,
-			limit:            10,
-			lastOrderedValue: nil,
-			lastID:           nil,
-			want:             nil,
-			wantErr:          true,
-		},
-		{
-			name:             "Test DiscoveredOn",
-			query:            "",
-			epoch:            0,
-			orderBy:          ByDiscoveredOn,
-			ascending:        true,
-			limit:            10,
-			lastOrderedValue: nil,
-			lastID:           nil,
-			want:             []TorrentMetadata{},
-			wantErr:          false,
-		},
-		{
-			name:             "Test NFiles",
-			query:            "",
-			epoch:            0,
-			orderBy:          ByNFiles,
-			ascending:        false,
-			limit:            10,
-			lastOrderedValue: nil,
-			lastID:           nil,
-			want:             []TorrentMetadata{},
-			wantErr:          false,
-		},
-		{
-			name:             "Test NFiles",
-			query:            "",
-			epoch:            0,
-			orderBy:          ByTotalSize,
-			ascending:        true,
-			limit:            10,
-			lastOrderedValue: nil,
-			lastID:           nil,
-			want:             []TorrentMetadata{},
-			wantErr:          false,
-		},
+	// An in-memory database would not survive being reopened.
+	path := filepath.Join(t.TempDir(), "database.sqlite3")
+
+	db, err := makeSqlite3Database(&url.URL{Scheme: "sqlite3", Path: path})
+	if err != nil {
+		t.Fatalf("makeSqlite3Database() error = %v", err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := db.QueryTorrents(tt.query, tt.epoch, tt.orderBy, tt.ascending, tt.limit, tt.lastOrderedValue, tt.lastID)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("sqlite3Database.QueryTorrents() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("sqlite3Database.QueryTorrents() = %v, want %v", got, tt.want)
-			}
-		})
+	if err = db.AddNewTorrent(ctx, []byte("before"), "xyz-123", []File{{Size: 1, Path: "ubuntu-22.04.iso"}}, Uncategorised); err != nil {
+		t.Fatalf("sqlite3Database.AddNewTorrent() error = %v", err)
 	}
-}
+	db.Close()
 
-func Test_sqlite3Database_GetTorrent(t *testing.T) {
-	t.Parallel()
+	// Reopening with the index populates it with the existing files.
+	db, err = makeSqlite3Database(&url.URL{Scheme: "sqlite3", Path: path, RawQuery: "files_index=true"})
+	if err != nil {
+		t.Fatalf("makeSqlite3Database() error = %v", err)
+	}
+	defer db.Close()
 
-	tests := []struct {
-		name     string
-		infoHash []byte
-		want     *TorrentMetadata
-		wantErr  bool
-	}{
-		{
-			name:     "Test Empty",
-			infoHash: []byte{},
-			wantErr:  false,
-		},
-		{
-			name:     "Test Zeroes",
-			infoHash: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-			wantErr:  false,
-		},
+	got, err := db.QueryTorrents(ctx, "ubuntu", time.Now().Unix(), ByRelevance, true, 10, nil, nil, nil, SearchFiles)
+	if err != nil {
+		t.Fatalf("sqlite3Database.QueryTorrents() error = %v", err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			_, err := db.GetTorrent(tt.infoHash)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("sqlite3Database.GetTorrent() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-		})
+	if len(got) != 1 || !reflect.DeepEqual(got[0].MatchedFiles, []string{"ubuntu-22.04.iso"}) {
+		t.Errorf("sqlite3Database.QueryTorrents() = %v, want the torrent added before the index", got)
 	}
 }
 
-func Test_sqlite3Database_GetFiles(t *testing.T) {
+func Test_sqlite3Database_Migration(t *testing.T) {
+	ctx := context.Background()
 	t.Parallel()
 
-	tests := []struct {
-		name     string
-		infoHash []byte
-		want     []File
-		wantErr  bool
-	}{
-		{
-			name:     "Test Empty",
-			infoHash: []byte{},
-			want:     nil,
-			wantErr:  false,
-		},
-		{
-			name:     "Test Zeroes",
-			infoHash: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-			want:     nil,
-			wantErr:  false,
-		},
+	path := filepath.Join(t.TempDir(), "database.sqlite3")
+	discoveredOn := time.Now().Unix()
+
+	// A database of the very first schema, with a torrent.
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := db.GetFiles(tt.infoHash)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("sqlite3Database.GetFiles() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("sqlite3Database.GetFiles() = %v, want %v", got, tt.want)
-			}
-		})
+	_, err = conn.Exec(`
+		CREATE TABLE torrents (
+			id             INTEGER PRIMARY KEY,
+			info_hash      BLOB NOT NULL UNIQUE,
+			name           TEXT NOT NULL,
+			total_size     INTEGER NOT NULL CHECK(total_size > 0),
+			discovered_on  INTEGER NOT NULL CHECK(discovered_on > 0)
+		);
+		CREATE TABLE files (
+			id          INTEGER PRIMARY KEY,
+			torrent_id  INTEGER REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			size        INTEGER NOT NULL,
+			path        TEXT NOT NULL
+		);
+		INSERT INTO torrents VALUES (1, CAST('before' AS BLOB), 'before', 3, ?);
+		INSERT INTO files VALUES (1, 1, 1, 'a'), (2, 1, 2, 'b');
+	`, discoveredOn)
+	conn.Close()
+	if err != nil {
+		t.Fatalf("sql.DB.Exec() error = %v", err)
 	}
-}
 
-func Test_sqlite3Database_GetStatistics(t *testing.T) {
-	t.Parallel()
+	// Opening migrates the database, back-filling what is derived from the existing torrents.
+	db, err := makeSqlite3Database(&url.URL{Scheme: "sqlite3", Path: path})
+	if err != nil {
+		t.Fatalf("makeSqlite3Database() error = %v", err)
+	}
+	defer db.Close()
 
-	tests := []struct {
-		name    string
-		from    string
-		n       uint
-		want    *Statistics
-		wantErr bool
-	}{
-		{
-			name: "Test Year",
-			from: "2018",
-			n:    0,
-			want: &Statistics{
-				NDiscovered: map[string]uint64{},
-				NFiles:      map[string]uint64{},
-				TotalSize:   map[string]uint64{},
-			},
-			wantErr: false,
-		},
-		{
-			name: "Test Month",
-			from: "2018-04",
-			n:    0,
-			want: &Statistics{
-				NDiscovered: map[string]uint64{},
-				NFiles:      map[string]uint64{},
-				TotalSize:   map[string]uint64{},
-			},
-			wantErr: false,
-		},
-		{
-			name: "Test Week",
-			from: "2018-W16",
-			n:    0,
-			want: &Statistics{
-				NDiscovered: map[string]uint64{},
-				NFiles:      map[string]uint64{},
-				TotalSize:   map[string]uint64{},
-			},
-			wantErr: false,
-		},
-		{
-			name: "Test Day",
-			from: "2018-04-20",
-			n:    0,
-			want: &Statistics{
-				NDiscovered: map[string]uint64{},
-				NFiles:      map[string]uint64{},
-				TotalSize:   map[string]uint64{},
-			},
-			wantErr: false,
-		},
-		{
-			name: "Test Hour",
-			from: "2018-04-20T15",
-			n:    1,
-			want: &Statistics{
-				NDiscovered: map[string]uint64{},
-				NFiles:      map[string]uint64{},
-				TotalSize:   map[string]uint64{},
-			},
-			wantErr: false,
-		},
+	if tm, err := db.GetTorrent(ctx, []byte("before")); err != nil || tm == nil || tm.NFiles != 2 {
+		t.Errorf("sqlite3Database.GetTorrent() after the migration = %+v, %v, want 2 files", tm, err)
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := db.GetStatistics(tt.from, tt.n)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("sqlite3Database.GetStatistics() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("sqlite3Database.GetStatistics() = %v, want %v", got, tt.want)
-			}
-		})
+	key := statisticsKey(Hour)(time.Unix(discoveredOn, 0))
+	want := &Statistics{
+		NDiscovered: map[string]uint64{key: 1},
+		NFiles:      map[string]uint64{key: 2},
+		TotalSize:   map[string]uint64{key: 3},
+	}
+	hour := time.Unix(discoveredOn, 0).UTC().Add(-time.Hour).Format("2006-01-02T15")
+	if got, err := db.GetStatistics(ctx, hour, 1); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("sqlite3Database.GetStatistics() after the migration = %v, %v, want %v", got, err, want)
 	}
 }
@@ -0,0 +1,425 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// deleteBatchSize is the number of torrents that PurgeTorrents and ApplyRetention delete per
+// transaction, so that the torrents being added meanwhile are not held up for long.
+const deleteBatchSize = 100
+
+// scanPageSize is the number of rows that matchingTorrentIDs reads at once.
+const scanPageSize = 1000
+
+// matchingTorrentIDs returns the IDs of the torrents whose names or file paths match the pattern, in
+// ascending order.
+//
+// Matching is done here rather than by the database, so that patterns have the same (regexp
+// package) semantics regardless of the backend. The tables are read a page at a time rather than in
+// a transaction lasting for the whole walk: @torrentsQuery and @filesQuery select the ID, the ID of
+// the torrent, and the name or the path of (at most their second argument) rows whose IDs are
+// greater than their first argument, in ascending order of their IDs.
+func matchingTorrentIDs(ctx context.Context, conn *sql.DB, pattern *regexp.Regexp, torrentsQuery string, filesQuery string) ([]int64, error) {
+	matches := make(map[int64]struct{})
+
+	// scanPage matches the rows of the page after lastID, and returns the ID of its last row and
+	// the number of its rows.
+	scanPage := func(query string, lastID int64) (int64, int, error) {
+		rows, err := conn.QueryContext(ctx, query, lastID, scanPageSize)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer rows.Close()
+
+		var n int
+		for ; rows.Next(); n++ {
+			var torrentID int64
+			var s string
+			if err = rows.Scan(&lastID, &torrentID, &s); err != nil {
+				return 0, 0, err
+			}
+			if pattern.MatchString(s) {
+				matches[torrentID] = struct{}{}
+			}
+		}
+		return lastID, n, rows.Err()
+	}
+
+	scan := func(query string) error {
+		lastID := int64(math.MinInt64)
+		for {
+			var n int
+			var err error
+			if lastID, n, err = scanPage(query, lastID); err != nil {
+				return err
+			} else if n < scanPageSize {
+				return nil
+			}
+		}
+	}
+
+	if err := scan(torrentsQuery); err != nil {
+		return nil, fmt.Errorf("scan (torrents) %w", err)
+	}
+	if err := scan(filesQuery); err != nil {
+		return nil, fmt.Errorf("scan (files) %w", err)
+	}
+
+	ids := make([]int64, 0, len(matches))
+	for id := range matches {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+// batchRunner runs fn, which executes the transaction of a batch of deletions, such as
+// cockroachDatabase.retry does to retry it; nil runs it once.
+type batchRunner func(ctx context.Context, fn func() error) error
+
+func (run batchRunner) do(ctx context.Context, fn func() error) error {
+	if run == nil {
+		return fn()
+	}
+	return run(ctx, fn)
+}
+
+// deleteInBatches executes the @query, which deletes the torrent of its single argument, with each
+// of the @args, in transactions of up to deleteBatchSize of them that are committed one after the
+// other, each of them run by @run. Returns the number of torrents deleted, including those of the
+// batches committed before an error.
+func deleteInBatches(ctx context.Context, conn *sql.DB, run batchRunner, query string, args []interface{}) (uint, error) {
+	var nDeleted uint
+	for start := 0; start < len(args); start += deleteBatchSize {
+		var n uint
+		err := run.do(ctx, func() error {
+			var err error
+			n, err = deleteBatch(ctx, conn, query, args[start:min(start+deleteBatchSize, len(args))])
+			return err
+		})
+		if err != nil {
+			return nDeleted, err
+		}
+		nDeleted += n
+	}
+	return nDeleted, nil
+}
+
+func deleteBatch(ctx context.Context, conn *sql.DB, query string, args []interface{}) (uint, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("conn.BeginTx %w", err)
+	}
+
+	var nDeleted int64
+	for _, arg := range args {
+		// Files (and everything else referencing the torrent) are deleted by ON DELETE CASCADE.
+		res, err := tx.ExecContext(ctx, query, arg)
+		if err == nil {
+			var n int64
+			n, err = res.RowsAffected()
+			nDeleted += n
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("tx.ExecContext (DELETE FROM torrents) %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("tx.Commit %w", err)
+	}
+	return uint(nDeleted), nil
+}
+
+// deleteRepeatedly executes the @query, which deletes up to deleteBatchSize torrents (its last
+// argument) matching the @args, until it deletes fewer of them, each time in a transaction of its
+// own run by @run. Returns the number of torrents deleted, including those committed before an
+// error.
+func deleteRepeatedly(ctx context.Context, conn *sql.DB, run batchRunner, query string, args ...interface{}) (uint, error) {
+	args = append(args, deleteBatchSize)
+	var nDeleted uint
+	for {
+		var n int64
+		err := run.do(ctx, func() error {
+			// Files (and everything else referencing the torrents) are deleted by ON DELETE CASCADE.
+			res, err := conn.ExecContext(ctx, query, args...)
+			if err != nil {
+				return fmt.Errorf("conn.ExecContext (DELETE FROM torrents) %w", err)
+			}
+			if n, err = res.RowsAffected(); err != nil {
+				return fmt.Errorf("sql.Result.RowsAffected %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nDeleted, err
+		}
+		nDeleted += uint(n)
+		if n < deleteBatchSize {
+			return nDeleted, nil
+		}
+	}
+}
+
+// maxQueriedInfoHashes is the number of info hashes that GetFilesOfTorrents and GetSwarms query at
+// once, well within the limits of the engines on the number of the parameters of a statement.
+const maxQueriedInfoHashes = 1000
+
+// forEachChunk calls fn with the successive chunks of up to maxQueriedInfoHashes of the info hashes,
+// as the arguments of a query, until it fails.
+func forEachChunk(infoHashes [][]byte, fn func(args []interface{}) error) error {
+	for start := 0; start < len(infoHashes); start += maxQueriedInfoHashes {
+		chunk := infoHashes[start:min(start+maxQueriedInfoHashes, len(infoHashes))]
+		args := make([]interface{}, len(chunk))
+		for i, infoHash := range chunk {
+			args[i] = infoHash
+		}
+		if err := fn(args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queriedInfoHashes returns the info hashes of all the torrents that QueryTorrents returns for the
+// query, the category and the scope, regardless of when they were discovered.
+//
+// Querying through the Database rather than deleting in SQL directly is what lets DeleteTorrents
+// match exactly what is searched, whatever the backend.
+func queriedInfoHashes(ctx context.Context, db Database, query string, category *Category, scope SearchScope) ([][]byte, error) {
+	if strings.TrimSpace(query) == "" && category == nil {
+		return nil, fmt.Errorf("either a query or a category is required, not to delete all the torrents")
+	}
+
+	const pageSize = 1000
+	var infoHashes [][]byte
+	var lastOrderedValue *float64
+	var lastID *uint64
+	for {
+		torrents, err := db.QueryTorrents(ctx, query, math.MaxInt64, ByDiscoveredOn, true, pageSize, lastOrderedValue, lastID, category, scope)
+		if err != nil {
+			return nil, fmt.Errorf("QueryTorrents %w", err)
+		}
+		for _, torrent := range torrents {
+			infoHashes = append(infoHashes, torrent.InfoHash)
+		}
+		if len(torrents) < pageSize {
+			return infoHashes, nil
+		}
+
+		last := torrents[len(torrents)-1]
+		value := float64(last.DiscoveredOn)
+		lastOrderedValue, lastID = &value, &last.ID
+	}
+}
+
+// maxCountedTorrents is the number of torrents up to which EstimateNumberOfTorrents counts those
+// that the queries match.
+const maxCountedTorrents = 500
+
+// EstimateNumberOfTorrents returns an estimate of the number of torrents that QueryTorrents returns
+// for the query, the category and the scope (discovered before the epoch), and whether it is exact:
+// if neither a query nor a category is given, it is the number of all the torrents (as returned by
+// GetNumberOfTorrents, hence not exact); otherwise the torrents are counted, up to 500 of them.
+func EstimateNumberOfTorrents(ctx context.Context, db Database, query string, epoch int64, category *Category, scope SearchScope) (uint, bool, error) {
+	if strings.TrimSpace(query) == "" && category == nil {
+		n, err := db.GetNumberOfTorrents(ctx)
+		if err != nil {
+			return 0, false, fmt.Errorf("GetNumberOfTorrents %w", err)
+		}
+		return n, false, nil
+	}
+
+	torrents, err := db.QueryTorrents(ctx, query, epoch, ByDiscoveredOn, true, maxCountedTorrents+1, nil, nil, category, scope)
+	if err != nil {
+		return 0, false, fmt.Errorf("QueryTorrents %w", err)
+	}
+	if len(torrents) > maxCountedTorrents {
+		return maxCountedTorrents, false, nil
+	}
+	return uint(len(torrents)), true, nil
+}
+
+// popFilesIndexOption removes the `files_index` parameter from the query of the URL (so that it is
+// not passed on to the driver), and returns whether it is true.
+func popFilesIndexOption(url_ *url.URL) (bool, error) {
+	query := url_.Query()
+	value := query.Get("files_index")
+	if value == "" {
+		return false, nil
+	}
+	query.Del("files_index")
+	url_.RawQuery = query.Encode()
+
+	filesIndex, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("files_index %w", err)
+	}
+	return filesIndex, nil
+}
+
+// defaultMaxConns is the default size of the pools of connections to SQL databases, see
+// popPoolOptions.
+const defaultMaxConns = 3
+
+// popPoolOptions removes the `max_open_conns` and `max_idle_conns` parameters from the query of the
+// URL (so that they are not passed on to the driver), and returns their values: the maximum number of
+// open connections to the database, and of those kept idle, which is the former by default.
+func popPoolOptions(url_ *url.URL) (int, int, error) {
+	query := url_.Query()
+	maxOpen, maxIdle := defaultMaxConns, -1
+	for name, value := range map[string]*int{"max_open_conns": &maxOpen, "max_idle_conns": &maxIdle} {
+		if !query.Has(name) {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			return 0, 0, errors.New(name + " " + err.Error())
+		} else if n < 0 || (n == 0 && name == "max_open_conns") {
+			return 0, 0, fmt.Errorf("%s must be positive, not %d", name, n)
+		}
+		*value = n
+		query.Del(name)
+	}
+	url_.RawQuery = query.Encode()
+
+	if maxIdle == -1 || maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	return maxOpen, maxIdle, nil
+}
+
+// checkOrdering returns a SearchError if the torrents matching the query cannot be ordered by orderBy,
+// which is the same for all the backends: relevance requires search terms, and the number of seeders
+// and leechers and the time of the last update are not recorded at all.
+func checkOrdering(q *Query, orderBy OrderingCriteria) error {
+	switch orderBy {
+	case ByRelevance:
+		if !q.HasTerms() {
+			return &SearchError{Reason: "torrents cannot be ordered by relevance when the query has no search terms"}
+		}
+		return nil
+
+	case ByTotalSize, ByDiscoveredOn, ByNFiles:
+		return nil
+
+	default:
+		return &SearchError{Reason: fmt.Sprintf("torrents cannot be ordered by %s since it is not recorded", orderBy)}
+	}
+}
+
+// statisticsKey returns the function that formats the (UTC) times into the keys of Statistics for
+// the given granularity, as done by the strftime function of SQLite with %Y, %Y-%m, %Y-%W,
+// %Y-%m-%d, and %Y-%m-%dT%H respectively.
+func statisticsKey(gran Granularity) func(t time.Time) string {
+	switch gran {
+	case Year:
+		return func(t time.Time) string { return t.UTC().Format("2006") }
+	case Month:
+		return func(t time.Time) string { return t.UTC().Format("2006-01") }
+	case Week:
+		// %W is the week of the year, where the first Monday is the first day of week 01.
+		return func(t time.Time) string {
+			t = t.UTC()
+			return fmt.Sprintf("%d-%02d", t.Year(), (t.YearDay()+6-(int(t.Weekday())+6)%7)/7)
+		}
+	case Day:
+		return func(t time.Time) string { return t.UTC().Format("2006-01-02") }
+	default:
+		return func(t time.Time) string { return t.UTC().Format("2006-01-02T15") }
+	}
+}
+
+// statisticsEnd returns the end of the n periods of the granularity after from.
+func statisticsEnd(from time.Time, gran Granularity, n uint) time.Time {
+	switch gran {
+	case Year:
+		return from.AddDate(int(n), 0, 0)
+	case Month:
+		return from.AddDate(0, int(n), 0)
+	case Week:
+		return from.AddDate(0, 0, int(n)*7)
+	case Day:
+		return from.AddDate(0, 0, int(n))
+	default:
+		return from.Add(time.Duration(n) * time.Hour)
+	}
+}
+
+// scanStatistics sums up the rows of hourly aggregates (the Unix time of the start of the hour, the
+// number of torrents discovered, of their files, and their total size) into the Statistics of the
+// granularity.
+func scanStatistics(rows *sql.Rows, gran Granularity) (*Statistics, error) {
+	format := statisticsKey(gran)
+	stats := NewStatistics()
+
+	for rows.Next() {
+		var hour int64
+		var nD, nF, tS uint64
+		if err := rows.Scan(&hour, &nD, &nF, &tS); err != nil {
+			return nil, err
+		}
+
+		dT := format(time.Unix(hour, 0))
+		stats.NDiscovered[dT] += nD
+		stats.NFiles[dT] += nF
+		stats.TotalSize[dT] += tS
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// acceptableTorrents returns the torrents that can be stored, in the same order: those whose total
+// size is not zero (which the databases do not accept) and whose name and file paths are valid
+// UTF-8, without the duplicates within the batch. Torrents discovered on zero are discovered now.
+func acceptableTorrents(torrents []Torrent) []Torrent {
+	now := time.Now().Unix()
+	acceptable := make([]Torrent, 0, len(torrents))
+	seen := make(map[string]struct{}, len(torrents))
+
+	for _, torrent := range torrents {
+		if _, duplicate := seen[string(torrent.InfoHash)]; duplicate || torrent.totalSize() == 0 {
+			continue
+		}
+		if !utf8.ValidString(torrent.Name) {
+			log.Printf("Ignoring a torrent whose name is not UTF-8 compliant. infoHash: %s", torrent.InfoHash)
+			continue
+		}
+		valid := true
+		for _, file := range torrent.Files {
+			if !utf8.ValidString(file.Path) {
+				log.Printf("Ignoring a file whose path is not UTF-8 compliant. %s", file.Path)
+				valid = false
+				break
+			}
+		}
+		if !valid {
+			continue
+		}
+
+		seen[string(torrent.InfoHash)] = struct{}{}
+		if torrent.DiscoveredOn == 0 {
+			torrent.DiscoveredOn = now
+		}
+		acceptable = append(acceptable, torrent)
+	}
+
+	return acceptable
+}